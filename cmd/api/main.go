@@ -1,14 +1,22 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
-	"strconv"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/safar/go-sql-store/internal/api"
 	"github.com/safar/go-sql-store/internal/config"
 	"github.com/safar/go-sql-store/internal/database"
+	"github.com/safar/go-sql-store/internal/logging"
 	"github.com/safar/go-sql-store/internal/store"
 	"github.com/shopspring/decimal"
 )
@@ -16,255 +24,122 @@ import (
 func main() {
 	cfg, err := config.Load()
 	if err != nil {
-		log.Fatalf("Load config: %v", err)
+		fmt.Fprintf(os.Stderr, "Load config: %v\n", err)
+		os.Exit(1)
 	}
 
-	db, err := database.NewConnection(&cfg.Database)
+	logger, err := logging.New(cfg.Log)
 	if err != nil {
-		log.Fatalf("Connect to database: %v", err)
+		fmt.Fprintf(os.Stderr, "Configure logging: %v\n", err)
+		os.Exit(1)
 	}
-	defer func() {
-		if err := db.Close(); err != nil {
-			log.Printf("Failed to close database: %v", err)
-		}
-	}()
-
-	log.Printf("Connected to database successfully")
+	slog.SetDefault(logger)
 
-	mux := http.NewServeMux()
-
-	mux.HandleFunc("/users", handleUsers(db))
-	mux.HandleFunc("/users/", handleUserByID(db))
-	mux.HandleFunc("/products", handleProducts(db))
-	mux.HandleFunc("/products/", handleProductByID(db))
-	mux.HandleFunc("/orders", handleOrders(db))
-	mux.HandleFunc("/orders/", handleOrderByID(db))
-
-	server := &http.Server{
-		Addr:         ":" + cfg.Server.Port,
-		Handler:      mux,
-		ReadTimeout:  cfg.Server.ReadTimeout,
-		WriteTimeout: cfg.Server.WriteTimeout,
+	orderNumbers, err := store.NewOrderNumberGenerator(cfg.Orders.NumberStrategy, cfg.Orders.NumberPrefix)
+	if err != nil {
+		fatal(logger, "Configure order numbers", err)
 	}
+	store.DefaultOrderNumberGenerator = orderNumbers
 
-	log.Printf("Server starting on port %s", cfg.Server.Port)
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("Server error: %v", err)
+	maxTotal, err := decimal.NewFromString(cfg.Orders.MaxTotal)
+	if err != nil {
+		fatal(logger, "Invalid ORDER_MAX_TOTAL", err)
 	}
-}
-
-func handleUsers(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-
-		switch r.Method {
-		case http.MethodPost:
-			var req struct {
-				Email string `json:"email"`
-				Name  string `json:"name"`
-			}
-			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-				respondError(w, http.StatusBadRequest, "Invalid request body")
-				return
-			}
-
-			user, err := store.CreateUser(ctx, db, req.Email, req.Name)
-			if err != nil {
-				respondError(w, http.StatusInternalServerError, err.Error())
-				return
-			}
-
-			respondJSON(w, http.StatusCreated, user)
-
-		case http.MethodGet:
-			page, _ := strconv.Atoi(r.URL.Query().Get("page"))
-			if page < 1 {
-				page = 1
-			}
-			pageSize, _ := strconv.Atoi(r.URL.Query().Get("page_size"))
-			if pageSize < 1 || pageSize > 100 {
-				pageSize = 20
-			}
-
-			result, err := store.ListUsers(ctx, db, page, pageSize)
-			if err != nil {
-				respondError(w, http.StatusInternalServerError, err.Error())
-				return
-			}
-
-			respondJSON(w, http.StatusOK, result)
-
-		default:
-			respondError(w, http.StatusMethodNotAllowed, "Method not allowed")
-		}
+	if err := store.SetOrderLimits(maxTotal, cfg.Orders.MaxItemQuantity); err != nil {
+		fatal(logger, "Invalid ORDER_MAX_TOTAL or ORDER_MAX_ITEM_QUANTITY", err)
 	}
-}
-
-func handleUserByID(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-
-		idStr := r.URL.Path[len("/users/"):]
-		id, err := strconv.ParseInt(idStr, 10, 64)
-		if err != nil {
-			respondError(w, http.StatusBadRequest, "Invalid user ID")
-			return
-		}
-
-		user, err := store.GetUser(ctx, db, id)
-		if err != nil {
-			respondError(w, http.StatusNotFound, err.Error())
-			return
-		}
 
-		respondJSON(w, http.StatusOK, user)
+	isolation, err := database.ParseIsolationLevel(cfg.Database.DefaultIsolation)
+	if err != nil {
+		fatal(logger, "Invalid DATABASE_DEFAULT_ISOLATION", err)
 	}
-}
-
-func handleProducts(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-
-		switch r.Method {
-		case http.MethodPost:
-			var req struct {
-				SKU         string  `json:"sku"`
-				Name        string  `json:"name"`
-				Description string  `json:"description"`
-				Price       float64 `json:"price"`
-				Stock       int     `json:"stock"`
-			}
-			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-				respondError(w, http.StatusBadRequest, "Invalid request body")
-				return
-			}
+	database.SetDefaultIsolationLevel(isolation)
 
-			price := decimal.NewFromFloat(req.Price)
-			product, err := store.CreateProduct(ctx, db, req.SKU, req.Name, req.Description, price, req.Stock)
-			if err != nil {
-				respondError(w, http.StatusInternalServerError, err.Error())
-				return
-			}
-
-			respondJSON(w, http.StatusCreated, product)
-
-		case http.MethodGet:
-			page, _ := strconv.Atoi(r.URL.Query().Get("page"))
-			if page < 1 {
-				page = 1
-			}
-			pageSize, _ := strconv.Atoi(r.URL.Query().Get("page_size"))
-			if pageSize < 1 || pageSize > 100 {
-				pageSize = 20
-			}
-
-			result, err := store.ListProducts(ctx, db, page, pageSize)
-			if err != nil {
-				respondError(w, http.StatusInternalServerError, err.Error())
-				return
-			}
-
-			respondJSON(w, http.StatusOK, result)
-
-		default:
-			respondError(w, http.StatusMethodNotAllowed, "Method not allowed")
-		}
+	db, err := database.NewConnection(&cfg.Database)
+	if err != nil {
+		fatal(logger, "Connect to database", err)
 	}
-}
+	defer func() {
+		if err := db.Close(); err != nil {
+			logger.Error("Failed to close database", "error", err)
+		}
+	}()
 
-func handleProductByID(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
+	logger.Info("Connected to database successfully")
 
-		idStr := r.URL.Path[len("/products/"):]
-		id, err := strconv.ParseInt(idStr, 10, 64)
+	if cfg.Database.WarmupConns > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := database.Warmup(ctx, db, cfg.Database.WarmupConns)
+		cancel()
 		if err != nil {
-			respondError(w, http.StatusBadRequest, "Invalid product ID")
-			return
+			logger.Warn("Connection pool warmup failed", "error", err)
+		} else {
+			logger.Info("Warmed up database connections", "count", cfg.Database.WarmupConns)
 		}
+	}
 
-		product, err := store.GetProduct(ctx, db, id)
+	if cfg.Database.PoolAlertThreshold > 0 {
+		err := database.StartPoolMonitor(context.Background(), db, cfg.Database.PoolMonitorInterval, cfg.Database.PoolAlertThreshold, func(stats sql.DBStats) {
+			logger.Warn("Database connections in use reached alert threshold",
+				"in_use", stats.InUse,
+				"threshold", cfg.Database.PoolAlertThreshold,
+				"max_open", stats.MaxOpenConnections,
+				"wait_count", stats.WaitCount)
+		})
 		if err != nil {
-			respondError(w, http.StatusNotFound, err.Error())
-			return
+			fatal(logger, "Invalid DATABASE_POOL_MONITOR_INTERVAL", err)
 		}
-
-		respondJSON(w, http.StatusOK, product)
 	}
-}
 
-func handleOrders(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-		switch r.Method {
-		case http.MethodPost:
-			var req struct {
-				UserID int64 `json:"user_id"`
-				Items  []struct {
-					ProductID int64 `json:"product_id"`
-					Quantity  int   `json:"quantity"`
-				} `json:"items"`
-			}
-			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-				respondError(w, http.StatusBadRequest, "Invalid request body")
-				return
-			}
-
-			var items []store.OrderItemRequest
-			for _, item := range req.Items {
-				items = append(items, store.OrderItemRequest{
-					ProductID: item.ProductID,
-					Quantity:  item.Quantity,
-				})
-			}
-
-			order, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
-				UserID: req.UserID,
-				Items:  items,
-			})
-			if err != nil {
-				respondError(w, http.StatusInternalServerError, err.Error())
-				return
-			}
-
-			respondJSON(w, http.StatusCreated, order)
-
-		default:
-			respondError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	if cfg.Server.GRPCPort != "" {
+		listener, err := net.Listen("tcp", ":"+cfg.Server.GRPCPort)
+		if err != nil {
+			fatal(logger, "Listen for gRPC", err)
 		}
+		grpcServer := api.NewGRPCServer(db, &cfg.Server)
+		defer grpcServer.GracefulStop()
+		go func() {
+			logger.Info("gRPC server starting", "port", cfg.Server.GRPCPort)
+			if err := grpcServer.Serve(listener); err != nil {
+				fatal(logger, "gRPC server error", err)
+			}
+		}()
 	}
-}
-
-func handleOrderByID(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
 
-		idStr := r.URL.Path[len("/orders/"):]
-		id, err := strconv.ParseInt(idStr, 10, 64)
-		if err != nil {
-			respondError(w, http.StatusBadRequest, "Invalid order ID")
-			return
-		}
+	server := &http.Server{
+		Addr:         ":" + cfg.Server.Port,
+		Handler:      api.NewRouter(db, &cfg.Server),
+		ReadTimeout:  cfg.Server.ReadTimeout,
+		WriteTimeout: cfg.Server.WriteTimeout,
+		ErrorLog:     slog.NewLogLogger(logger.Handler(), slog.LevelError),
+	}
 
-		order, err := store.GetOrder(ctx, db, id)
-		if err != nil {
-			respondError(w, http.StatusNotFound, err.Error())
-			return
+	// On SIGINT or SIGTERM, finish in-flight HTTP requests before the
+	// deferred gRPC stop and database close run.
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.WriteTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Error("Failed to shut down server", "error", err)
 		}
+	}()
 
-		respondJSON(w, http.StatusOK, order)
-	}
-}
-
-func respondJSON(w http.ResponseWriter, status int, data interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	if err := json.NewEncoder(w).Encode(data); err != nil {
-		log.Printf("Error encoding JSON response: %v", err)
+	logger.Info("Server starting", "port", cfg.Server.Port)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		fatal(logger, "Server error", err)
 	}
+	<-shutdownDone
+	logger.Info("Server stopped")
 }
 
-func respondError(w http.ResponseWriter, status int, message string) {
-	respondJSON(w, status, map[string]string{"error": message})
+// fatal logs err and exits. Deferred calls don't run, as with log.Fatal.
+func fatal(logger *slog.Logger, msg string, err error) {
+	logger.Error(msg, "error", err)
+	os.Exit(1)
 }
@@ -0,0 +1,29 @@
+package api
+
+import (
+	"net/http"
+)
+
+// admission caps in-flight requests at n. Requests over the cap get 503 with
+// Retry-After instead of queueing for a pool connection until they time out.
+// A limit of zero or less disables the cap.
+func admission(n int, next http.Handler) http.Handler {
+	if n <= 0 {
+		return next
+	}
+
+	slots := make(chan struct{}, n)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+		default:
+			w.Header().Set("Retry-After", "1")
+			respondError(w, http.StatusServiceUnavailable, "Server is at capacity, retry later")
+			return
+		}
+		defer func() { <-slots }()
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// notModified sets a weak ETag and Last-Modified for a resource last written
+// at updatedAt and reports whether the request's validators show the client
+// already has it, in which case it has written 304 Not Modified. The ETag
+// includes updated_at because stock changes from orders don't bump a
+// product's version. If-None-Match takes precedence over If-Modified-Since,
+// which can only compare whole seconds.
+func notModified(w http.ResponseWriter, r *http.Request, version int, updatedAt time.Time) bool {
+	etag := fmt.Sprintf(`W/"%d-%d"`, version, updatedAt.UnixMicro())
+	lastModified := updatedAt.UTC().Truncate(time.Second)
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if !etagMatches(match, etag) {
+			return false
+		}
+	} else if since := r.Header.Get("If-Modified-Since"); since != "" {
+		t, err := http.ParseTime(since)
+		if err != nil || lastModified.After(t) {
+			return false
+		}
+	} else {
+		return false
+	}
+
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, using the
+// weak comparison that If-None-Match calls for.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/safar/go-sql-store/internal/models"
+)
+
+// productFields is the allow-list for ?fields= on product responses, keyed by
+// JSON name.
+var productFields = map[string]bool{
+	"id":                true,
+	"sku":               true,
+	"name":              true,
+	"description":       true,
+	"price":             true,
+	"stock_quantity":    true,
+	"reserved_quantity": true,
+	"currency":          true,
+	"stocked_quantity":  true,
+	"created_at":        true,
+	"updated_at":        true,
+	"version":           true,
+}
+
+// parseFields splits a comma-separated fields parameter and checks every name
+// against allowed. An empty parameter returns nil, meaning all fields.
+func parseFields(param string, allowed map[string]bool) ([]string, error) {
+	if param == "" {
+		return nil, nil
+	}
+
+	var fields []string
+	for _, field := range strings.Split(param, ",") {
+		field = strings.TrimSpace(field)
+		if !allowed[field] {
+			return nil, fmt.Errorf("unknown field %q", field)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// projectProduct returns the product's JSON object reduced to fields. Fields
+// the product omits, such as an empty description, stay absent.
+func projectProduct(product models.Product, fields []string) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(product)
+	if err != nil {
+		return nil, err
+	}
+
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+
+	projected := make(map[string]json.RawMessage, len(fields))
+	for _, field := range fields {
+		if value, ok := all[field]; ok {
+			projected[field] = value
+		}
+	}
+	return projected, nil
+}
+
+func projectProducts(products []models.Product, fields []string) ([]map[string]json.RawMessage, error) {
+	projected := make([]map[string]json.RawMessage, 0, len(products))
+	for _, product := range products {
+		p, err := projectProduct(product, fields)
+		if err != nil {
+			return nil, err
+		}
+		projected = append(projected, p)
+	}
+	return projected, nil
+}
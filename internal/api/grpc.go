@@ -0,0 +1,294 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/safar/go-sql-store/internal/config"
+	"github.com/safar/go-sql-store/internal/database"
+	"github.com/safar/go-sql-store/internal/models"
+	"github.com/safar/go-sql-store/internal/store"
+	storev1 "github.com/safar/go-sql-store/proto/store/v1"
+	"github.com/shopspring/decimal"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// NewGRPCServer returns a gRPC server with StoreService registered, backed
+// by the same store functions and field validation as the REST routes.
+// CreateOrder is rate limited per user like POST /orders, with its own
+// buckets.
+func NewGRPCServer(db *sql.DB, cfg *config.ServerConfig) *grpc.Server {
+	server := grpc.NewServer()
+	storev1.RegisterStoreServiceServer(server, &storeService{
+		db:           db,
+		orderLimiter: newUserRateLimiter(cfg.OrderRatePerUser, cfg.OrderBurstPerUser),
+	})
+	return server
+}
+
+type storeService struct {
+	storev1.UnimplementedStoreServiceServer
+
+	db           *sql.DB
+	orderLimiter *userRateLimiter
+}
+
+func (s *storeService) CreateUser(ctx context.Context, req *storev1.CreateUserRequest) (*storev1.User, error) {
+	if err := validateMessage(createUserFields, map[string]interface{}{
+		"email": req.GetEmail(),
+		"name":  req.GetName(),
+	}); err != nil {
+		return nil, grpcError(err)
+	}
+
+	user, err := store.CreateUser(ctx, s.db, req.GetEmail(), req.GetName())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return userMessage(user), nil
+}
+
+func (s *storeService) GetUser(ctx context.Context, req *storev1.GetUserRequest) (*storev1.User, error) {
+	if err := validateMessage(idParamFields, map[string]interface{}{"id": req.GetId()}); err != nil {
+		return nil, grpcError(err)
+	}
+
+	user, err := store.GetUser(ctx, s.db, req.GetId())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return userMessage(user), nil
+}
+
+func (s *storeService) CreateProduct(ctx context.Context, req *storev1.CreateProductRequest) (*storev1.Product, error) {
+	if err := validateMessage(createProductFields, map[string]interface{}{
+		"sku":         req.GetSku(),
+		"name":        req.GetName(),
+		"description": req.GetDescription(),
+		"price":       json.Number(req.GetPrice()),
+		"stock":       req.GetStock(),
+		"currency":    req.GetCurrency(),
+	}); err != nil {
+		return nil, grpcError(err)
+	}
+
+	price, err := decimal.NewFromString(req.GetPrice())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "price: must be a number")
+	}
+
+	product, err := store.CreateProduct(ctx, s.db, req.GetSku(), req.GetName(), req.GetDescription(), price, int(req.GetStock()), req.GetCurrency())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return productMessage(product), nil
+}
+
+func (s *storeService) GetProduct(ctx context.Context, req *storev1.GetProductRequest) (*storev1.Product, error) {
+	if err := validateMessage(idParamFields, map[string]interface{}{"id": req.GetId()}); err != nil {
+		return nil, grpcError(err)
+	}
+
+	product, err := store.GetProduct(ctx, s.db, req.GetId())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return productMessage(product), nil
+}
+
+func (s *storeService) CreateOrder(ctx context.Context, req *storev1.CreateOrderRequest) (*storev1.Order, error) {
+	items := make([]interface{}, 0, len(req.GetItems()))
+	for _, item := range req.GetItems() {
+		items = append(items, map[string]interface{}{
+			"product_id": item.GetProductId(),
+			"quantity":   item.GetQuantity(),
+		})
+	}
+	if err := validateMessage(createOrderFields, map[string]interface{}{
+		"user_id": req.GetUserId(),
+		"items":   items,
+	}); err != nil {
+		return nil, grpcError(err)
+	}
+
+	if ok, retryAfter := s.orderLimiter.allow(req.GetUserId()); !ok {
+		return nil, status.Errorf(codes.ResourceExhausted,
+			"Too many orders for this user, retry in %s", retryAfter.Round(time.Second))
+	}
+
+	orderItems := make([]store.OrderItemRequest, 0, len(req.GetItems()))
+	for _, item := range req.GetItems() {
+		orderItems = append(orderItems, store.OrderItemRequest{ProductID: item.GetProductId(), Quantity: int(item.GetQuantity())})
+	}
+
+	order, err := store.CreateOrder(ctx, s.db, store.CreateOrderRequest{UserID: req.GetUserId(), Items: orderItems})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return orderMessage(order), nil
+}
+
+func (s *storeService) GetOrder(ctx context.Context, req *storev1.GetOrderRequest) (*storev1.Order, error) {
+	if err := validateMessage(idParamFields, map[string]interface{}{"id": req.GetId()}); err != nil {
+		return nil, grpcError(err)
+	}
+
+	order, err := store.GetOrder(ctx, s.db, req.GetId())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return orderMessage(order), nil
+}
+
+var idParamFields = []field{
+	{Name: "id", Type: typeInteger, Required: true, Min: minOf(1)},
+}
+
+// validateMessage checks a request's fields against the REST body schema.
+// Proto3 can't tell an unset field from its zero value, so zero values are
+// left out of object and treated like a missing JSON member.
+func validateMessage(fields []field, object map[string]interface{}) error {
+	normalizeMessageObject(object)
+
+	var errs store.ValidationErrors
+	validateObject(object, fields, "", &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// normalizeMessageObject drops the zero values from object and turns its
+// integers into json.Number, as decodeValid's decoder produces them.
+func normalizeMessageObject(object map[string]interface{}) {
+	for name, value := range object {
+		switch v := value.(type) {
+		case string:
+			if v == "" {
+				delete(object, name)
+			}
+		case json.Number:
+			if v == "" {
+				delete(object, name)
+			}
+		case int32:
+			object[name] = json.Number(strconv.FormatInt(int64(v), 10))
+			if v == 0 {
+				delete(object, name)
+			}
+		case int64:
+			object[name] = json.Number(strconv.FormatInt(v, 10))
+			if v == 0 {
+				delete(object, name)
+			}
+		case []interface{}:
+			if len(v) == 0 {
+				delete(object, name)
+			}
+			for _, element := range v {
+				if elementObject, ok := element.(map[string]interface{}); ok {
+					normalizeMessageObject(elementObject)
+				}
+			}
+		}
+	}
+}
+
+// grpcError maps store errors to gRPC statuses, with the same grouping
+// respondStoreError uses for HTTP.
+func grpcError(err error) error {
+	var validationErrs store.ValidationErrors
+	if errors.As(err, &validationErrs) {
+		return status.Error(codes.InvalidArgument, validationErrs.Error())
+	}
+
+	switch {
+	case errors.Is(err, database.ErrUserNotFound),
+		errors.Is(err, database.ErrProductNotFound),
+		errors.Is(err, database.ErrOrderNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, database.ErrDuplicateSKU):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, database.ErrOptimisticLockFailed):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, database.ErrInsufficientStock),
+		errors.Is(err, database.ErrInvalidStatusTransition):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, database.ErrUnsupportedCurrency),
+		errors.Is(err, database.ErrMixedCurrency),
+		errors.Is(err, database.ErrOrderTotalTooLarge),
+		errors.Is(err, database.ErrNumericOutOfRange):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+
+	return status.Error(codes.Internal, err.Error())
+}
+
+func userMessage(user *models.User) *storev1.User {
+	return &storev1.User{
+		Id:        user.ID,
+		Email:     user.Email,
+		Name:      user.Name,
+		CreatedAt: timestamppb.New(user.CreatedAt),
+		UpdatedAt: timestamppb.New(user.UpdatedAt),
+		Version:   int32(user.Version),
+	}
+}
+
+func productMessage(product *models.Product) *storev1.Product {
+	return &storev1.Product{
+		Id:               product.ID,
+		Sku:              product.SKU,
+		Name:             product.Name,
+		Description:      product.Description,
+		Price:            product.Price.String(),
+		StockQuantity:    int32(product.StockQuantity),
+		ReservedQuantity: int32(product.ReservedQuantity),
+		Currency:         product.Currency,
+		CreatedAt:        timestamppb.New(product.CreatedAt),
+		UpdatedAt:        timestamppb.New(product.UpdatedAt),
+		Version:          int32(product.Version),
+	}
+}
+
+func orderMessage(order *models.Order) *storev1.Order {
+	message := &storev1.Order{
+		Id:          order.ID,
+		UserId:      order.UserID,
+		OrderNumber: order.OrderNumber,
+		Status:      order.Status,
+		TotalAmount: order.TotalAmount.String(),
+		Currency:    order.Currency,
+		CreatedAt:   timestamppb.New(order.CreatedAt),
+		UpdatedAt:   timestamppb.New(order.UpdatedAt),
+		Version:     int32(order.Version),
+	}
+	if order.TrackingNumber != nil {
+		message.TrackingNumber = *order.TrackingNumber
+	}
+	if order.ShippedAt != nil {
+		message.ShippedAt = timestamppb.New(*order.ShippedAt)
+	}
+	for _, item := range order.Items {
+		message.Items = append(message.Items, &storev1.OrderItem{
+			Id:          item.ID,
+			ProductId:   item.ProductID,
+			ProductName: item.ProductName,
+			Quantity:    int32(item.Quantity),
+			UnitPrice:   item.UnitPrice.String(),
+			Subtotal:    item.Subtotal.String(),
+		})
+	}
+	return message
+}
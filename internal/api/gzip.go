@@ -0,0 +1,115 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gzipMinSize is the smallest body worth compressing; below it the gzip
+// header and footer outweigh the savings.
+const gzipMinSize = 1024
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+	gz     *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+// Write buffers the body until it reaches gzipMinSize, then switches to
+// streaming it through a gzip.Writer.
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+
+	w.buf.Write(b)
+	if w.buf.Len() < gzipMinSize || w.Header().Get("Content-Encoding") != "" {
+		return len(b), nil
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(w.status)
+
+	w.gz = gzip.NewWriter(w.ResponseWriter)
+	if _, err := w.gz.Write(w.buf.Bytes()); err != nil {
+		return 0, err
+	}
+	w.buf.Reset()
+
+	return len(b), nil
+}
+
+// Flush sends what has been compressed so far. A body still under
+// gzipMinSize stays buffered.
+func (w *gzipResponseWriter) Flush() {
+	if w.gz == nil {
+		return
+	}
+	if err := w.gz.Flush(); err != nil {
+		return
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// finish flushes whatever the handler wrote: the gzip trailer if the body was
+// large enough to compress, otherwise the buffered body as is.
+func (w *gzipResponseWriter) finish() error {
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+	_, err := w.ResponseWriter.Write(w.buf.Bytes())
+	return err
+}
+
+// gzipResponses compresses response bodies of at least gzipMinSize bytes for
+// clients that accept gzip.
+func gzipResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(gw, r)
+
+		if err := gw.finish(); err != nil {
+			log.Printf("Error writing compressed response: %v", err)
+		}
+	})
+}
+
+// acceptsGzip reports whether an Accept-Encoding header lists gzip with a
+// non-zero quality.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		quality, err := strconv.ParseFloat(q, 64)
+		return err == nil && quality > 0
+	}
+	return false
+}
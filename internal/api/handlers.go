@@ -0,0 +1,992 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/safar/go-sql-store/internal/config"
+	"github.com/safar/go-sql-store/internal/database"
+	"github.com/safar/go-sql-store/internal/models"
+	"github.com/safar/go-sql-store/internal/store"
+	"github.com/safar/go-sql-store/migrations"
+	"github.com/shopspring/decimal"
+)
+
+func NewRouter(db *sql.DB, cfg *config.ServerConfig) http.Handler {
+	mux := http.NewServeMux()
+	orderLimiter := newUserRateLimiter(cfg.OrderRatePerUser, cfg.OrderBurstPerUser)
+
+	mux.HandleFunc("/users", handleUsers(db))
+	mux.HandleFunc("/users/", handleUserByID(db))
+	mux.HandleFunc("/users/top-spenders", handleTopSpenders(db))
+	mux.HandleFunc("/users/{id}/order-count", handleUserOrderCount(db))
+	mux.HandleFunc("/products", handleProducts(db))
+	mux.HandleFunc("/products/", handleProductByID(db))
+	mux.HandleFunc("/products/low-stock", handleLowStockProducts(db))
+	mux.HandleFunc("/products/stream", handleProductStream(db))
+	mux.HandleFunc("/products/stock-check", handleStockCheck(db))
+	mux.HandleFunc("/products/batch", handlePatchProducts(db))
+	mux.HandleFunc("/products/{id}/order-items", handleProductOrderItems(db))
+	mux.HandleFunc("/products/{id}/sales", handleProductSales(db))
+	mux.HandleFunc("/orders", handleOrders(db, orderLimiter))
+	mux.HandleFunc("/orders/", handleOrderByID(db))
+	mux.HandleFunc("/orders/statuses", handleOrderStatuses(db))
+	mux.HandleFunc("/orders/{id}/ship", handleShipOrder(db))
+	mux.HandleFunc("/orders/{id}/reprice", handleRepriceOrder(db))
+	mux.HandleFunc("/orders/{id}/metadata", handleOrderMetadata(db))
+	mux.HandleFunc("/orders/{id}/timeline", handleOrderTimeline(db))
+	mux.HandleFunc("/healthz/migrations", handleMigrationHealth(db, migrations.FS))
+
+	if cfg.DebugEndpoints {
+		mux.HandleFunc("/debug/explain", handleExplain(db))
+	}
+
+	return gzipResponses(admission(cfg.MaxConcurrentRequests,
+		idempotency(db, cfg.IdempotencyTTL, retryBudget(cfg.RetryBudget, mux))))
+}
+
+func handleUsers(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		switch r.Method {
+		case http.MethodPost:
+			var req struct {
+				Email string `json:"email"`
+				Name  string `json:"name"`
+			}
+			if !decodeValid(w, r, createUserFields, &req) {
+				return
+			}
+
+			user, err := store.CreateUser(ctx, db, req.Email, req.Name)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			respondJSON(w, http.StatusCreated, user)
+
+		case http.MethodGet:
+			page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+			if page < 1 {
+				page = 1
+			}
+			pageSize, _ := strconv.Atoi(r.URL.Query().Get("page_size"))
+			if pageSize < 1 || pageSize > 100 {
+				pageSize = 20
+			}
+
+			pageOpts := store.PageOptions{IncludeTotal: r.URL.Query().Get("include_total") != "false"}
+
+			result, err := store.ListUsers(ctx, db, page, pageSize, pageOpts)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			respondJSON(w, http.StatusOK, result)
+
+		default:
+			respondError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	}
+}
+
+func handleUserByID(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		idStr := r.URL.Path[len("/users/"):]
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid user ID")
+			return
+		}
+
+		if r.URL.Query().Get("include") == "orders" {
+			limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+			if limit < 1 || limit > 100 {
+				limit = 10
+			}
+
+			user, err := store.GetUserWithRecentOrders(ctx, db, id, limit)
+			if err != nil {
+				if err == database.ErrUserNotFound {
+					respondError(w, http.StatusNotFound, err.Error())
+					return
+				}
+				respondError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			respondJSON(w, http.StatusOK, user)
+			return
+		}
+
+		user, err := store.GetUser(ctx, db, id)
+		if err != nil {
+			respondError(w, http.StatusNotFound, err.Error())
+			return
+		}
+
+		if notModified(w, r, user.Version, user.UpdatedAt) {
+			return
+		}
+
+		respondJSON(w, http.StatusOK, user)
+	}
+}
+
+func handleUserOrderCount(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid user ID")
+			return
+		}
+
+		count, err := store.CountUserOrders(r.Context(), db, id)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondJSON(w, http.StatusOK, struct {
+			UserID     int64 `json:"user_id"`
+			OrderCount int64 `json:"order_count"`
+		}{id, count})
+	}
+}
+
+func handleTopSpenders(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		if limit < 1 || limit > 100 {
+			limit = 10
+		}
+
+		spenders, err := store.ListTopSpenders(r.Context(), db, r.URL.Query().Get("currency"), limit)
+		if err != nil {
+			switch err {
+			case database.ErrUnsupportedCurrency:
+				respondError(w, http.StatusBadRequest, err.Error())
+			default:
+				respondError(w, http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+
+		respondJSON(w, http.StatusOK, spenders)
+	}
+}
+
+func handleProducts(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		switch r.Method {
+		case http.MethodPost:
+			var req struct {
+				SKU         string  `json:"sku"`
+				Name        string  `json:"name"`
+				Description string  `json:"description"`
+				Price       float64 `json:"price"`
+				Stock       int     `json:"stock"`
+				Currency    string  `json:"currency"`
+			}
+			if !decodeValid(w, r, createProductFields, &req) {
+				return
+			}
+
+			price := decimal.NewFromFloat(req.Price)
+			product, err := store.CreateProduct(ctx, db, req.SKU, req.Name, req.Description, price, req.Stock, req.Currency)
+			if err != nil {
+				switch err {
+				case database.ErrUnsupportedCurrency:
+					respondError(w, http.StatusBadRequest, err.Error())
+				case database.ErrDuplicateSKU:
+					respondError(w, http.StatusConflict, err.Error())
+				case database.ErrNumericOutOfRange:
+					respondError(w, http.StatusUnprocessableEntity, err.Error())
+				default:
+					respondError(w, http.StatusInternalServerError, err.Error())
+				}
+				return
+			}
+
+			respondJSON(w, http.StatusCreated, product)
+
+		case http.MethodGet:
+			if r.URL.Query().Has("ids") {
+				handleProductsByIDs(w, r, db)
+				return
+			}
+
+			page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+			if page < 1 {
+				page = 1
+			}
+			pageSize, _ := strconv.Atoi(r.URL.Query().Get("page_size"))
+			if pageSize < 1 || pageSize > 100 {
+				pageSize = 20
+			}
+
+			filter := store.ProductFilter{
+				InStockOnly: r.URL.Query().Get("in_stock") == "true",
+			}
+			if from := r.URL.Query().Get("created_from"); from != "" {
+				createdFrom, err := time.Parse(time.RFC3339, from)
+				if err != nil {
+					respondError(w, http.StatusBadRequest, "Invalid created_from, expected RFC3339")
+					return
+				}
+				filter.CreatedFrom = createdFrom
+			}
+			if to := r.URL.Query().Get("created_to"); to != "" {
+				createdTo, err := time.Parse(time.RFC3339, to)
+				if err != nil {
+					respondError(w, http.StatusBadRequest, "Invalid created_to, expected RFC3339")
+					return
+				}
+				filter.CreatedTo = createdTo
+			}
+
+			fields, err := parseFields(r.URL.Query().Get("fields"), productFields)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+
+			pageOpts := store.PageOptions{IncludeTotal: r.URL.Query().Get("include_total") != "false"}
+
+			var result *store.OffsetPage
+			if r.URL.Query().Get("consistent") == "true" {
+				result, err = store.ListProductsConsistent(ctx, db, page, pageSize, filter, pageOpts)
+			} else {
+				result, err = store.ListProducts(ctx, db, page, pageSize, filter, pageOpts)
+			}
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			if fields != nil {
+				products, _ := result.Items.([]models.Product)
+				result.Items, err = projectProducts(products, fields)
+				if err != nil {
+					respondError(w, http.StatusInternalServerError, err.Error())
+					return
+				}
+			}
+
+			respondJSON(w, http.StatusOK, result)
+
+		default:
+			respondError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	}
+}
+
+// maxProductIDs caps the ids of a GET /products?ids= request.
+const maxProductIDs = 100
+
+// handleProductsByIDs serves GET /products?ids=1,2,3: the products in the
+// order requested, skipping IDs with no product and repeated IDs.
+func handleProductsByIDs(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var ids []int64
+	seen := make(map[int64]bool)
+	for _, raw := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+		if err != nil || id < 1 {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("Invalid product ID %q", raw))
+			return
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > maxProductIDs {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("At most %d product IDs are allowed", maxProductIDs))
+		return
+	}
+
+	fields, err := parseFields(r.URL.Query().Get("fields"), productFields)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	found, err := store.GetProductsByIDs(r.Context(), db, ids)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	products := []models.Product{}
+	for _, id := range ids {
+		if product, ok := found[id]; ok {
+			products = append(products, product)
+		}
+	}
+
+	if fields != nil {
+		projected, err := projectProducts(products, fields)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondJSON(w, http.StatusOK, projected)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, products)
+}
+
+func handleLowStockProducts(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		threshold, _ := strconv.Atoi(r.URL.Query().Get("threshold"))
+		if threshold < 1 {
+			threshold = 10
+		}
+
+		products, err := store.ListLowStockProducts(r.Context(), db, threshold)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondJSON(w, http.StatusOK, products)
+	}
+}
+
+// handleStockCheck serves POST /products/stock-check: the stock_quantity of
+// each product in product_ids, keyed by ID. Unknown IDs are left out.
+func handleStockCheck(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			respondError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		var req struct {
+			ProductIDs []int64 `json:"product_ids"`
+		}
+		if !decodeValid(w, r, stockCheckFields, &req) {
+			return
+		}
+
+		var errs store.ValidationErrors
+		if len(req.ProductIDs) > maxProductIDs {
+			errs = append(errs, store.FieldError{Field: "product_ids", Message: fmt.Sprintf("must have at most %d elements", maxProductIDs)})
+		}
+		for i, id := range req.ProductIDs {
+			if id < 1 {
+				errs = append(errs, store.FieldError{Field: fmt.Sprintf("product_ids[%d]", i), Message: "must be a positive integer"})
+			}
+		}
+		if len(errs) > 0 {
+			respondValidationErrors(w, errs)
+			return
+		}
+
+		levels, err := store.GetStockLevels(r.Context(), db, req.ProductIDs)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondJSON(w, http.StatusOK, levels)
+	}
+}
+
+func handleProductOrderItems(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid product ID")
+			return
+		}
+
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		if limit < 1 || limit > 100 {
+			limit = 20
+		}
+
+		cursor := r.URL.Query().Get("cursor")
+		if _, err := store.DecodeCursor(cursor); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid cursor")
+			return
+		}
+
+		page, err := store.ListOrderItemsByProduct(r.Context(), db, id, cursor, limit)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondJSON(w, http.StatusOK, page)
+	}
+}
+
+func handleProductSales(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid product ID")
+			return
+		}
+
+		sales, err := store.GetProductSales(r.Context(), db, id)
+		if err != nil {
+			if err == database.ErrProductNotFound {
+				respondError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			respondError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondJSON(w, http.StatusOK, sales)
+	}
+}
+
+func handleProductByID(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		idStr := r.URL.Path[len("/products/"):]
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid product ID")
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			fields, err := parseFields(r.URL.Query().Get("fields"), productFields)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+
+			product, err := store.GetProduct(ctx, db, id)
+			if err != nil {
+				respondError(w, http.StatusNotFound, err.Error())
+				return
+			}
+
+			if notModified(w, r, product.Version, product.UpdatedAt) {
+				return
+			}
+
+			if fields != nil {
+				projected, err := projectProduct(*product, fields)
+				if err != nil {
+					respondError(w, http.StatusInternalServerError, err.Error())
+					return
+				}
+				respondJSON(w, http.StatusOK, projected)
+				return
+			}
+
+			respondJSON(w, http.StatusOK, product)
+
+		case http.MethodPatch:
+			var req struct {
+				Name          *string          `json:"name"`
+				Description   *string          `json:"description"`
+				Price         *decimal.Decimal `json:"price"`
+				StockQuantity *int             `json:"stock_quantity"`
+				Version       int              `json:"version"`
+			}
+			if !decodeValid(w, r, patchProductFields, &req) {
+				return
+			}
+
+			patch := store.ProductPatch{
+				Name:          req.Name,
+				Description:   req.Description,
+				Price:         req.Price,
+				StockQuantity: req.StockQuantity,
+			}
+			if patch.IsEmpty() {
+				respondError(w, http.StatusBadRequest, "No fields to update")
+				return
+			}
+
+			product, err := store.PatchProduct(ctx, db, id, patch, req.Version)
+			if err != nil {
+				var validationErrs store.ValidationErrors
+				if errors.As(err, &validationErrs) {
+					respondValidationErrors(w, validationErrs)
+					return
+				}
+
+				switch err {
+				case database.ErrProductNotFound:
+					respondError(w, http.StatusNotFound, err.Error())
+				case database.ErrOptimisticLockFailed:
+					respondError(w, http.StatusConflict, err.Error())
+				default:
+					respondError(w, http.StatusInternalServerError, err.Error())
+				}
+				return
+			}
+
+			respondJSON(w, http.StatusOK, product)
+
+		default:
+			respondError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	}
+}
+
+// handlePatchProducts serves PATCH /products/batch: it applies every patch in
+// one transaction, so if any product is missing or has moved past its version
+// none of them change.
+func handlePatchProducts(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch {
+			respondError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		var req struct {
+			Products []struct {
+				ID            int64            `json:"id"`
+				Name          *string          `json:"name"`
+				Description   *string          `json:"description"`
+				Price         *decimal.Decimal `json:"price"`
+				StockQuantity *int             `json:"stock_quantity"`
+				Version       int              `json:"version"`
+			} `json:"products"`
+		}
+		if !decodeValid(w, r, patchProductsFields, &req) {
+			return
+		}
+
+		var errs store.ValidationErrors
+		if len(req.Products) > maxProductIDs {
+			errs = append(errs, store.FieldError{Field: "products", Message: fmt.Sprintf("must have at most %d elements", maxProductIDs)})
+		}
+		patches := make([]store.ProductPatch, len(req.Products))
+		for i, p := range req.Products {
+			patches[i] = store.ProductPatch{
+				Name:          p.Name,
+				Description:   p.Description,
+				Price:         p.Price,
+				StockQuantity: p.StockQuantity,
+			}
+			if patches[i].IsEmpty() {
+				errs = append(errs, store.FieldError{Field: fmt.Sprintf("products[%d]", i), Message: "has no fields to update"})
+			}
+		}
+		if len(errs) > 0 {
+			respondValidationErrors(w, errs)
+			return
+		}
+
+		products := make([]*models.Product, len(req.Products))
+		committed := withTx(w, r, db, func(q store.Querier) error {
+			for i, p := range req.Products {
+				product, err := store.PatchProduct(r.Context(), q, p.ID, patches[i], p.Version)
+				if err != nil {
+					return err
+				}
+				products[i] = product
+			}
+			return nil
+		})
+		if !committed {
+			return
+		}
+
+		respondJSON(w, http.StatusOK, products)
+	}
+}
+
+func handleOrders(db *sql.DB, limiter *userRateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		switch r.Method {
+		case http.MethodPost:
+			var req struct {
+				UserID int64 `json:"user_id"`
+				Items  []struct {
+					ProductID int64 `json:"product_id"`
+					Quantity  int   `json:"quantity"`
+				} `json:"items"`
+			}
+			if !decodeValid(w, r, createOrderFields, &req) {
+				return
+			}
+
+			if ok, retryAfter := limiter.allow(req.UserID); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				respondError(w, http.StatusTooManyRequests, "Too many orders for this user, retry later")
+				return
+			}
+
+			var items []store.OrderItemRequest
+			for _, item := range req.Items {
+				items = append(items, store.OrderItemRequest{
+					ProductID: item.ProductID,
+					Quantity:  item.Quantity,
+				})
+			}
+
+			dryRun := r.URL.Query().Get("dry_run") == "true"
+			order, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+				UserID: req.UserID,
+				Items:  items,
+				DryRun: dryRun,
+			})
+			if err != nil {
+				respondStoreError(w, err)
+				return
+			}
+
+			if dryRun {
+				respondJSON(w, http.StatusOK, order)
+				return
+			}
+			respondJSON(w, http.StatusCreated, order)
+
+		case http.MethodGet:
+			query := r.URL.Query()
+
+			limit, _ := strconv.Atoi(query.Get("limit"))
+			if limit < 1 || limit > 100 {
+				limit = 20
+			}
+
+			cursor := query.Get("cursor")
+			if _, err := store.DecodeCursor(cursor); err != nil {
+				respondError(w, http.StatusBadRequest, "Invalid cursor")
+				return
+			}
+
+			var filter store.OrderFilter
+			if statuses := query.Get("status"); statuses != "" {
+				filter.Statuses = strings.Split(statuses, ",")
+			}
+			if userIDs := query.Get("user_ids"); userIDs != "" {
+				for _, raw := range strings.Split(userIDs, ",") {
+					id, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+					if err != nil || id < 1 {
+						respondError(w, http.StatusBadRequest, fmt.Sprintf("Invalid user ID %q", raw))
+						return
+					}
+					filter.UserIDs = append(filter.UserIDs, id)
+				}
+				if len(filter.UserIDs) > store.MaxFilterUserIDs {
+					respondError(w, http.StatusBadRequest, fmt.Sprintf("At most %d user IDs are allowed", store.MaxFilterUserIDs))
+					return
+				}
+			}
+			var err error
+			if filter.MinTotal, err = parseDecimalParam(r, "min_total"); err != nil {
+				respondError(w, http.StatusBadRequest, fmt.Sprintf("Invalid min_total: %v", err))
+				return
+			}
+			if filter.MaxTotal, err = parseDecimalParam(r, "max_total"); err != nil {
+				respondError(w, http.StatusBadRequest, fmt.Sprintf("Invalid max_total: %v", err))
+				return
+			}
+
+			page, err := store.ListOrders(ctx, db, filter, cursor, limit)
+			if err != nil {
+				if err == database.ErrInvalidOrderStatus {
+					respondError(w, http.StatusBadRequest, err.Error())
+					return
+				}
+				respondError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			respondJSON(w, http.StatusOK, page)
+
+		default:
+			respondError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	}
+}
+
+func handleOrderByID(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		idStr := r.URL.Path[len("/orders/"):]
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid order ID")
+			return
+		}
+
+		order, err := store.GetOrder(ctx, db, id)
+		if err != nil {
+			respondError(w, http.StatusNotFound, err.Error())
+			return
+		}
+
+		respondJSON(w, http.StatusOK, order)
+	}
+}
+
+func handleOrderStatuses(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		statuses, err := store.ListDistinctOrderStatuses(r.Context(), db)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondJSON(w, http.StatusOK, statuses)
+	}
+}
+
+func handleOrderTimeline(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid order ID")
+			return
+		}
+
+		timeline, err := store.GetOrderTimeline(r.Context(), db, id)
+		if err != nil {
+			switch err {
+			case database.ErrOrderNotFound:
+				respondError(w, http.StatusNotFound, err.Error())
+			default:
+				respondError(w, http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+
+		respondJSON(w, http.StatusOK, timeline)
+	}
+}
+
+func handleShipOrder(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			respondError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid order ID")
+			return
+		}
+
+		var req struct {
+			TrackingNumber string `json:"tracking_number"`
+			Version        int    `json:"version"`
+		}
+		if !decodeValid(w, r, shipOrderFields, &req) {
+			return
+		}
+
+		order, err := store.ShipOrder(r.Context(), db, id, req.TrackingNumber, req.Version)
+		if err != nil {
+			var validationErrs store.ValidationErrors
+			if errors.As(err, &validationErrs) {
+				respondValidationErrors(w, validationErrs)
+				return
+			}
+
+			switch err {
+			case database.ErrOrderNotFound:
+				respondError(w, http.StatusNotFound, err.Error())
+			case database.ErrOptimisticLockFailed, database.ErrInvalidStatusTransition:
+				respondError(w, http.StatusConflict, err.Error())
+			default:
+				respondError(w, http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+
+		respondJSON(w, http.StatusOK, order)
+	}
+}
+
+func handleRepriceOrder(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			respondError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid order ID")
+			return
+		}
+
+		var req struct {
+			Version int `json:"version"`
+		}
+		if !decodeValid(w, r, repriceOrderFields, &req) {
+			return
+		}
+
+		order, err := store.RepriceOrder(r.Context(), db, id, req.Version)
+		if err != nil {
+			switch err {
+			case database.ErrOrderNotFound:
+				respondError(w, http.StatusNotFound, err.Error())
+			case database.ErrOptimisticLockFailed, database.ErrOrderNotPending:
+				respondError(w, http.StatusConflict, err.Error())
+			case database.ErrMixedCurrency, database.ErrOrderTotalTooLarge:
+				respondError(w, http.StatusBadRequest, err.Error())
+			case database.ErrNumericOutOfRange:
+				respondError(w, http.StatusUnprocessableEntity, err.Error())
+			default:
+				respondError(w, http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+
+		respondJSON(w, http.StatusOK, order)
+	}
+}
+
+func handleOrderMetadata(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch {
+			respondError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid order ID")
+			return
+		}
+
+		var req struct {
+			Metadata json.RawMessage `json:"metadata"`
+			Version  int             `json:"version"`
+		}
+		if !decodeValid(w, r, orderMetadataFields, &req) {
+			return
+		}
+
+		order, err := store.UpdateOrderMetadata(r.Context(), db, id, req.Metadata, req.Version)
+		if err != nil {
+			var validationErrs store.ValidationErrors
+			if errors.As(err, &validationErrs) {
+				respondValidationErrors(w, validationErrs)
+				return
+			}
+
+			switch err {
+			case database.ErrOrderNotFound:
+				respondError(w, http.StatusNotFound, err.Error())
+			case database.ErrOptimisticLockFailed:
+				respondError(w, http.StatusConflict, err.Error())
+			default:
+				respondError(w, http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+
+		respondJSON(w, http.StatusOK, order)
+	}
+}
+
+// handleExplain returns the EXPLAIN ANALYZE plan of one of the store's
+// predefined queries, named by ?q=, as plain text.
+func handleExplain(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		plan, err := store.ExplainQuery(r.Context(), db, r.URL.Query().Get("q"))
+		if err != nil {
+			if err == database.ErrUnknownQuery {
+				respondError(w, http.StatusBadRequest,
+					"Unknown query, expected one of: "+strings.Join(store.ExplainQueryNames(), ", "))
+				return
+			}
+			respondError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if _, err := io.WriteString(w, plan+"\n"); err != nil {
+			log.Printf("Error writing plan: %v", err)
+		}
+	}
+}
+
+func respondJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Printf("Error encoding JSON response: %v", err)
+	}
+}
+
+func respondError(w http.ResponseWriter, status int, message string) {
+	respondJSON(w, status, map[string]string{"error": message})
+}
+
+// respondValidationErrors reports every invalid field at once with 422.
+func respondValidationErrors(w http.ResponseWriter, errs store.ValidationErrors) {
+	respondJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+		"error":  "Validation failed",
+		"fields": errs,
+	})
+}
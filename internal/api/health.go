@@ -0,0 +1,39 @@
+package api
+
+import (
+	"database/sql"
+	"io/fs"
+	"net/http"
+
+	"github.com/safar/go-sql-store/internal/database"
+)
+
+type migrationHealth struct {
+	Status string `json:"status"`
+	*database.MigrationStatus
+}
+
+// handleMigrationHealth serves GET /healthz/migrations: the applied schema
+// version against the migrations in fsys. It answers 503 while any are
+// pending, so a load balancer can keep traffic away from an instance whose
+// schema is behind the code, and when the database can't be read.
+func handleMigrationHealth(db *sql.DB, fsys fs.FS) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		status, err := database.GetMigrationStatus(r.Context(), db, fsys)
+		if err != nil {
+			respondError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+
+		if !status.UpToDate() {
+			respondJSON(w, http.StatusServiceUnavailable, migrationHealth{Status: "pending", MigrationStatus: status})
+			return
+		}
+		respondJSON(w, http.StatusOK, migrationHealth{Status: "ok", MigrationStatus: status})
+	}
+}
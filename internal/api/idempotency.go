@@ -0,0 +1,143 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/safar/go-sql-store/internal/database"
+	"github.com/safar/go-sql-store/internal/store"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyLease is how long an in-progress request holds its key. It must
+// outlast the slowest request, or a retry could run the request twice; past
+// it, a key left behind by a crashed request can be claimed again.
+const idempotencyLease = time.Minute
+
+// maxIdempotentBodySize bounds the request body read to hash it for its key.
+const maxIdempotentBodySize = 1 << 20
+
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// idempotency replays the stored response for POST requests repeating an
+// Idempotency-Key within ttl. Duplicates arriving while the first request is
+// still running get 409, and a key reused for a request with a different
+// path, query or body gets 422. Server errors are not stored so clients can
+// retry.
+func idempotency(db *sql.DB, ttl time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if r.Method != http.MethodPost || key == "" || ttl <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		path := r.URL.Path
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBodySize))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				respondError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+				return
+			}
+			respondError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		record, claim, err := store.ClaimIdempotencyKey(ctx, db, r.Method, path, key,
+			requestHash(r, body), ttl, idempotencyLease)
+		if err == database.ErrIdempotencyKeyReused {
+			respondError(w, http.StatusUnprocessableEntity, "Idempotency key was already used for a different request")
+			return
+		}
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if claim == nil {
+			if !record.Completed {
+				respondError(w, http.StatusConflict, "A request with this idempotency key is already in progress")
+				return
+			}
+
+			w.Header().Set("Content-Type", record.ContentType)
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(record.StatusCode)
+			if _, err := w.Write(record.Body); err != nil {
+				log.Printf("Error writing replayed response: %v", err)
+			}
+			return
+		}
+
+		rec := &recordingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		completed := false
+		defer func() {
+			if completed {
+				return
+			}
+			err := store.ReleaseIdempotencyKey(context.WithoutCancel(ctx), db, claim)
+			if err != nil && !errors.Is(err, database.ErrIdempotencyClaimLost) {
+				log.Printf("Error releasing idempotency key: %v", err)
+			}
+		}()
+
+		next.ServeHTTP(rec, r)
+
+		if rec.status >= http.StatusInternalServerError {
+			return
+		}
+
+		err = store.CompleteIdempotencyKey(context.WithoutCancel(ctx), db, claim,
+			rec.status, rec.Header().Get("Content-Type"), rec.body.Bytes())
+		if errors.Is(err, database.ErrIdempotencyClaimLost) {
+			// The lease ran out and a retry holds the key now; it is not
+			// ours to release.
+			log.Printf("Idempotency key %q outlived its lease; response not stored", key)
+			completed = true
+			return
+		}
+		if err != nil {
+			log.Printf("Error storing idempotent response: %v", err)
+			return
+		}
+		completed = true
+	})
+}
+
+// requestHash identifies a request for its idempotency key by method, path,
+// query and body.
+func requestHash(r *http.Request, body []byte) []byte {
+	h := sha256.New()
+	for _, part := range []string{r.Method, r.URL.Path, r.URL.RawQuery} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	h.Write(body)
+	return h.Sum(nil)
+}
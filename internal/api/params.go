@@ -0,0 +1,26 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+// parseDecimalParam parses the query parameter name as a decimal, so amounts
+// such as 19.99 are compared exactly rather than as floats. It returns nil if
+// the parameter is absent or empty. Callers report the error with 400,
+// naming the parameter.
+func parseDecimalParam(r *http.Request, name string) (*decimal.Decimal, error) {
+	raw := strings.TrimSpace(r.URL.Query().Get(name))
+	if raw == "" {
+		return nil, nil
+	}
+
+	d, err := decimal.NewFromString(raw)
+	if err != nil {
+		return nil, fmt.Errorf("expected a decimal number, got %q", raw)
+	}
+	return &d, nil
+}
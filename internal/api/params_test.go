@@ -0,0 +1,60 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseDecimalParam(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    string
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "integer", query: "max_price=100", want: "100"},
+		{name: "fraction", query: "max_price=19.99", want: "19.99"},
+		{name: "negative", query: "max_price=-0.5", want: "-0.5"},
+		{name: "exponent", query: "max_price=1.5e2", want: "150"},
+		{name: "surrounding spaces", query: "max_price=%2019.99%20", want: "19.99"},
+		{name: "absent", query: "", wantNil: true},
+		{name: "empty", query: "max_price=", wantNil: true},
+		{name: "word", query: "max_price=lots", wantErr: true},
+		{name: "two points", query: "max_price=1.2.3", wantErr: true},
+		{name: "comma", query: "max_price=1,50", wantErr: true},
+		{name: "NaN", query: "max_price=NaN", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/products?"+tt.query, nil)
+
+			got, err := parseDecimalParam(r, "max_price")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantNil {
+				if got != nil {
+					t.Errorf("expected nil, got %s", got)
+				}
+				return
+			}
+			if got == nil || got.String() != tt.want {
+				t.Errorf("expected %s, got %v", tt.want, got)
+			}
+		})
+	}
+
+	r := httptest.NewRequest("GET", "/orders?min_total=lots", nil)
+	_, err := parseDecimalParam(r, "min_total")
+	if want := `expected a decimal number, got "lots"`; err == nil || err.Error() != want {
+		t.Errorf("expected error %q, got %v", want, err)
+	}
+}
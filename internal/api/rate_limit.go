@@ -0,0 +1,93 @@
+package api
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// maxTrackedUsers bounds the buckets a userRateLimiter keeps. Past it, the
+// least recently used bucket is dropped to make room, so a user idle that
+// long starts again with a full bucket.
+const maxTrackedUsers = 10000
+
+// userRateLimiter is a token bucket per user: a user may make burst requests
+// at once, then rate more per second.
+type userRateLimiter struct {
+	rate     float64
+	burst    float64
+	maxUsers int
+
+	mu      sync.Mutex
+	buckets map[int64]*list.Element
+	// recent orders the buckets from most to least recently used.
+	recent *list.List
+}
+
+type tokenBucket struct {
+	userID  int64
+	tokens  float64
+	updated time.Time
+}
+
+// newUserRateLimiter returns nil, which allows everything, when rate is zero
+// or less.
+func newUserRateLimiter(rate float64, burst int) *userRateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &userRateLimiter{
+		rate:     rate,
+		burst:    float64(burst),
+		maxUsers: maxTrackedUsers,
+		buckets:  make(map[int64]*list.Element),
+		recent:   list.New(),
+	}
+}
+
+// allow takes a token from userID's bucket. When the bucket is empty it
+// reports false and how long until the next token.
+func (l *userRateLimiter) allow(userID int64) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	var bucket *tokenBucket
+	if element, ok := l.buckets[userID]; ok {
+		l.recent.MoveToFront(element)
+		bucket = element.Value.(*tokenBucket)
+	} else {
+		if len(l.buckets) >= l.maxUsers {
+			oldest := l.recent.Back()
+			l.recent.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*tokenBucket).userID)
+		}
+		bucket = &tokenBucket{userID: userID, tokens: l.burst, updated: now}
+		l.buckets[userID] = l.recent.PushFront(bucket)
+	}
+
+	l.refill(bucket, now)
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+
+	bucket.tokens--
+	return true, 0
+}
+
+func (l *userRateLimiter) refill(bucket *tokenBucket, now time.Time) {
+	elapsed := now.Sub(bucket.updated).Seconds()
+	if elapsed > 0 {
+		bucket.tokens = min(l.burst, bucket.tokens+elapsed*l.rate)
+		bucket.updated = now
+	}
+}
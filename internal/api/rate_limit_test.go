@@ -0,0 +1,33 @@
+package api
+
+import "testing"
+
+func TestUserRateLimiterEvictsLeastRecentlyUsed(t *testing.T) {
+	limiter := newUserRateLimiter(0.001, 1)
+	limiter.maxUsers = 3
+
+	for userID := int64(1); userID <= 3; userID++ {
+		if ok, _ := limiter.allow(userID); !ok {
+			t.Fatalf("Expected the first request of user %d to be allowed", userID)
+		}
+	}
+
+	// User 1 is used again, so user 2 is now the least recently used.
+	if ok, _ := limiter.allow(1); ok {
+		t.Fatal("Expected user 1 to be limited")
+	}
+
+	for userID := int64(4); userID <= 100; userID++ {
+		limiter.allow(userID)
+		if len(limiter.buckets) > limiter.maxUsers || limiter.recent.Len() != len(limiter.buckets) {
+			t.Fatalf("Expected at most %d buckets, got %d (list %d)", limiter.maxUsers, len(limiter.buckets), limiter.recent.Len())
+		}
+	}
+
+	if _, ok := limiter.buckets[2]; ok {
+		t.Error("Expected user 2's bucket to be evicted")
+	}
+	if ok, _ := limiter.allow(99); ok {
+		t.Error("Expected recently seen user 99 to still be limited")
+	}
+}
@@ -0,0 +1,19 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/safar/go-sql-store/internal/database"
+)
+
+// retryBudget gives every request a shared budget of n transaction retries.
+// A budget of zero or less leaves retries bounded only per call.
+func retryBudget(n int, next http.Handler) http.Handler {
+	if n <= 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(database.WithRetryBudget(r.Context(), n)))
+	})
+}
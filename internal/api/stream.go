@@ -0,0 +1,121 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/safar/go-sql-store/internal/models"
+	"github.com/safar/go-sql-store/internal/store"
+)
+
+// streamFlushEvery is how many array elements jsonArrayWriter writes between
+// flushes.
+const streamFlushEvery = 100
+
+// jsonArrayWriter writes a JSON array to a response one element at a time,
+// flushing every streamFlushEvery elements, so memory use doesn't grow with
+// the number of elements.
+type jsonArrayWriter struct {
+	w       http.ResponseWriter
+	flusher *http.ResponseController
+	count   int
+}
+
+func newJSONArrayWriter(w http.ResponseWriter) *jsonArrayWriter {
+	return &jsonArrayWriter{w: w, flusher: http.NewResponseController(w)}
+}
+
+// Write encodes v as the next element. The status line is sent with the
+// first element, so an error before it can still be reported normally.
+func (a *jsonArrayWriter) Write(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	separator := ","
+	if a.count == 0 {
+		a.w.Header().Set("Content-Type", "application/json")
+		a.w.WriteHeader(http.StatusOK)
+		separator = "["
+	}
+	if _, err := a.w.Write([]byte(separator)); err != nil {
+		return err
+	}
+	if _, err := a.w.Write(data); err != nil {
+		return err
+	}
+
+	a.count++
+	if a.count%streamFlushEvery == 0 {
+		if err := a.flusher.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close ends the array, writing [] if there were no elements.
+func (a *jsonArrayWriter) Close() error {
+	if a.count == 0 {
+		respondJSON(a.w, http.StatusOK, []interface{}{})
+		return nil
+	}
+	_, err := a.w.Write([]byte("]\n"))
+	return err
+}
+
+// handleProductStream serves GET /products/stream: every product, in ID
+// order, as one JSON array streamed while the rows are read. It takes the
+// same in_stock, created_from and created_to filters as GET /products. An
+// error after the first product has been sent can only cut the response
+// short, which leaves the array unterminated.
+func handleProductStream(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		filter := store.ProductFilter{
+			InStockOnly: r.URL.Query().Get("in_stock") == "true",
+		}
+		if from := r.URL.Query().Get("created_from"); from != "" {
+			createdFrom, err := time.Parse(time.RFC3339, from)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, "Invalid created_from, expected RFC3339")
+				return
+			}
+			filter.CreatedFrom = createdFrom
+		}
+		if to := r.URL.Query().Get("created_to"); to != "" {
+			createdTo, err := time.Parse(time.RFC3339, to)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, "Invalid created_to, expected RFC3339")
+				return
+			}
+			filter.CreatedTo = createdTo
+		}
+
+		array := newJSONArrayWriter(w)
+		err := store.StreamProducts(r.Context(), db, filter, func(product *models.Product) error {
+			return array.Write(product)
+		})
+		if err != nil {
+			if array.count == 0 {
+				respondError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			log.Printf("Error streaming products: %v", err)
+			return
+		}
+
+		if err := array.Close(); err != nil {
+			log.Printf("Error streaming products: %v", err)
+		}
+	}
+}
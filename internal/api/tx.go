@@ -0,0 +1,56 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/safar/go-sql-store/internal/database"
+	"github.com/safar/go-sql-store/internal/store"
+)
+
+// withTx runs fn in one transaction for handlers that make several writes,
+// passing it the transaction as a store.Querier. If fn or the commit fails,
+// everything is rolled back and the error is written to w with
+// respondStoreError. It reports whether the transaction committed, in which
+// case the caller writes the response.
+func withTx(w http.ResponseWriter, r *http.Request, db *sql.DB, fn func(q store.Querier) error) bool {
+	err := database.WithTransaction(r.Context(), db, database.DefaultTxOptions(), func(tx *sql.Tx) error {
+		return fn(tx)
+	})
+	if err != nil {
+		respondStoreError(w, err)
+		return false
+	}
+	return true
+}
+
+// respondStoreError maps an error from the store to a response, with the
+// statuses the single-write handlers use.
+func respondStoreError(w http.ResponseWriter, err error) {
+	var validationErrs store.ValidationErrors
+	if errors.As(err, &validationErrs) {
+		respondValidationErrors(w, validationErrs)
+		return
+	}
+
+	switch {
+	case errors.Is(err, database.ErrUserNotFound),
+		errors.Is(err, database.ErrProductNotFound),
+		errors.Is(err, database.ErrOrderNotFound):
+		respondError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, database.ErrDuplicateSKU),
+		errors.Is(err, database.ErrOptimisticLockFailed),
+		errors.Is(err, database.ErrInsufficientStock),
+		errors.Is(err, database.ErrInvalidStatusTransition):
+		respondError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, database.ErrUnsupportedCurrency),
+		errors.Is(err, database.ErrMixedCurrency),
+		errors.Is(err, database.ErrOrderTotalTooLarge):
+		respondError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, database.ErrNumericOutOfRange):
+		respondError(w, http.StatusUnprocessableEntity, err.Error())
+	default:
+		respondError(w, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,237 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/safar/go-sql-store/internal/store"
+	"github.com/shopspring/decimal"
+)
+
+type fieldType int
+
+const (
+	typeString fieldType = iota
+	typeInteger
+	typeNumber
+	// typeDecimal accepts a JSON number or a numeric string, matching how
+	// decimal.Decimal unmarshals.
+	typeDecimal
+	typeArray
+	typeObject
+)
+
+// field declares one member of a JSON request body. Min bounds numbers and,
+// for strings and arrays, the length. Elements describes the objects in an
+// array field.
+type field struct {
+	Name     string
+	Type     fieldType
+	Required bool
+	Min      *float64
+	Elements []field
+}
+
+func minOf(v float64) *float64 {
+	return &v
+}
+
+var (
+	createUserFields = []field{
+		{Name: "email", Type: typeString, Required: true, Min: minOf(1)},
+		{Name: "name", Type: typeString, Required: true, Min: minOf(1)},
+	}
+
+	createProductFields = []field{
+		{Name: "sku", Type: typeString, Required: true, Min: minOf(1)},
+		{Name: "name", Type: typeString, Required: true, Min: minOf(1)},
+		{Name: "description", Type: typeString},
+		{Name: "price", Type: typeNumber, Required: true, Min: minOf(0)},
+		{Name: "stock", Type: typeInteger, Min: minOf(0)},
+		{Name: "currency", Type: typeString},
+	}
+
+	patchProductFields = []field{
+		{Name: "name", Type: typeString, Min: minOf(1)},
+		{Name: "description", Type: typeString},
+		{Name: "price", Type: typeDecimal, Min: minOf(0)},
+		{Name: "stock_quantity", Type: typeInteger, Min: minOf(0)},
+		{Name: "version", Type: typeInteger, Required: true, Min: minOf(1)},
+	}
+
+	patchProductsFields = []field{
+		{Name: "products", Type: typeArray, Required: true, Min: minOf(1), Elements: append([]field{
+			{Name: "id", Type: typeInteger, Required: true, Min: minOf(1)},
+		}, patchProductFields...)},
+	}
+
+	createOrderFields = []field{
+		{Name: "user_id", Type: typeInteger, Required: true, Min: minOf(1)},
+		{Name: "items", Type: typeArray, Required: true, Min: minOf(1), Elements: []field{
+			{Name: "product_id", Type: typeInteger, Required: true, Min: minOf(1)},
+			{Name: "quantity", Type: typeInteger, Required: true, Min: minOf(1)},
+		}},
+	}
+
+	shipOrderFields = []field{
+		{Name: "tracking_number", Type: typeString, Required: true, Min: minOf(1)},
+		{Name: "version", Type: typeInteger, Required: true, Min: minOf(1)},
+	}
+
+	stockCheckFields = []field{
+		{Name: "product_ids", Type: typeArray, Required: true, Min: minOf(1)},
+	}
+
+	repriceOrderFields = []field{
+		{Name: "version", Type: typeInteger, Required: true, Min: minOf(1)},
+	}
+
+	orderMetadataFields = []field{
+		{Name: "metadata", Type: typeObject, Required: true},
+		{Name: "version", Type: typeInteger, Required: true, Min: minOf(1)},
+	}
+)
+
+// decodeValid reads a JSON object body, checks it against fields and decodes
+// it into dst. On failure it writes the response itself: 400 for malformed
+// JSON, 422 listing every violation. It reports whether the handler should
+// continue.
+func decodeValid(w http.ResponseWriter, r *http.Request, fields []field, dst interface{}) bool {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return false
+	}
+
+	var object map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&object); err != nil || object == nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return false
+	}
+
+	var errs store.ValidationErrors
+	validateObject(object, fields, "", &errs)
+	if len(errs) > 0 {
+		respondValidationErrors(w, errs)
+		return false
+	}
+
+	if err := json.Unmarshal(body, dst); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return false
+	}
+	return true
+}
+
+func validateObject(object map[string]interface{}, fields []field, prefix string, errs *store.ValidationErrors) {
+	for _, f := range fields {
+		path := prefix + f.Name
+
+		value, ok := object[f.Name]
+		if !ok || value == nil {
+			if f.Required {
+				*errs = append(*errs, store.FieldError{Field: path, Message: "is required"})
+			}
+			continue
+		}
+
+		if message := f.check(value); message != "" {
+			*errs = append(*errs, store.FieldError{Field: path, Message: message})
+			continue
+		}
+
+		if f.Type != typeArray || f.Elements == nil {
+			continue
+		}
+		for i, element := range value.([]interface{}) {
+			elementPath := fmt.Sprintf("%s[%d]", path, i)
+			elementObject, ok := element.(map[string]interface{})
+			if !ok {
+				*errs = append(*errs, store.FieldError{Field: elementPath, Message: "must be an object"})
+				continue
+			}
+			validateObject(elementObject, f.Elements, elementPath+".", errs)
+		}
+	}
+}
+
+// check returns a message describing why value doesn't satisfy f, or "".
+func (f field) check(value interface{}) string {
+	switch f.Type {
+	case typeString:
+		s, ok := value.(string)
+		if !ok {
+			return "must be a string"
+		}
+		if f.Min != nil && float64(len(s)) < *f.Min {
+			if *f.Min == 1 {
+				return "must not be empty"
+			}
+			return fmt.Sprintf("must be at least %g characters", *f.Min)
+		}
+
+	case typeInteger:
+		n, ok := value.(json.Number)
+		if !ok {
+			return "must be an integer"
+		}
+		// Checked on the raw number so that 2.5 is rejected here instead of
+		// being left to how json decodes it into an int.
+		i, err := strconv.ParseInt(n.String(), 10, 64)
+		if err != nil {
+			if d, err := decimal.NewFromString(n.String()); err == nil && !d.IsInteger() {
+				return "must be a whole number"
+			}
+			return "must be an integer"
+		}
+		if f.Min != nil && float64(i) < *f.Min {
+			if *f.Min == 1 {
+				return "must be a positive integer"
+			}
+			return fmt.Sprintf("must be at least %g", *f.Min)
+		}
+
+	case typeNumber, typeDecimal:
+		var raw string
+		switch v := value.(type) {
+		case json.Number:
+			raw = v.String()
+		case string:
+			if f.Type != typeDecimal {
+				return "must be a number"
+			}
+			raw = v
+		default:
+			return "must be a number"
+		}
+		d, err := decimal.NewFromString(raw)
+		if err != nil {
+			return "must be a number"
+		}
+		if f.Min != nil && d.LessThan(decimal.NewFromFloat(*f.Min)) {
+			return fmt.Sprintf("must be at least %g", *f.Min)
+		}
+
+	case typeArray:
+		a, ok := value.([]interface{})
+		if !ok {
+			return "must be an array"
+		}
+		if f.Min != nil && float64(len(a)) < *f.Min {
+			return fmt.Sprintf("must have at least %g elements", *f.Min)
+		}
+
+	case typeObject:
+		if _, ok := value.(map[string]interface{}); !ok {
+			return "must be an object"
+		}
+	}
+
+	return ""
+}
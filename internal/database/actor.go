@@ -0,0 +1,18 @@
+package database
+
+import "context"
+
+type actorKey struct{}
+
+// WithActor returns a context carrying the ID of the user on whose behalf
+// writes are made. Transactions begun with it record the actor on the
+// audit_log rows their writes produce.
+func WithActor(ctx context.Context, userID int64) context.Context {
+	return context.WithValue(ctx, actorKey{}, userID)
+}
+
+// ActorFromContext returns the actor set by WithActor, if any.
+func ActorFromContext(ctx context.Context) (int64, bool) {
+	userID, ok := ctx.Value(actorKey{}).(int64)
+	return userID, ok
+}
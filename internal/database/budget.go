@@ -0,0 +1,44 @@
+package database
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+type retryBudgetKey struct{}
+
+type retryBudget struct {
+	remaining atomic.Int64
+}
+
+// WithRetryBudget returns a context that allows at most n retries in total
+// across every WithRetry call made with it, so a request that runs several
+// transactions cannot multiply its retry work by MaxRetries each time.
+func WithRetryBudget(ctx context.Context, n int) context.Context {
+	budget := &retryBudget{}
+	budget.remaining.Store(int64(n))
+	return context.WithValue(ctx, retryBudgetKey{}, budget)
+}
+
+// RetryBudgetRemaining reports the retries left in ctx's budget, and false if
+// ctx carries no budget.
+func RetryBudgetRemaining(ctx context.Context) (int, bool) {
+	budget, ok := ctx.Value(retryBudgetKey{}).(*retryBudget)
+	if !ok {
+		return 0, false
+	}
+	if remaining := budget.remaining.Load(); remaining > 0 {
+		return int(remaining), true
+	}
+	return 0, true
+}
+
+// takeRetry consumes one retry from ctx's budget. It reports false once the
+// budget is used up; a context without a budget always allows the retry.
+func takeRetry(ctx context.Context) bool {
+	budget, ok := ctx.Value(retryBudgetKey{}).(*retryBudget)
+	if !ok {
+		return true
+	}
+	return budget.remaining.Add(-1) >= 0
+}
@@ -4,6 +4,9 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
 	"time"
 
 	_ "github.com/lib/pq"
@@ -11,14 +14,33 @@ import (
 )
 
 func NewConnection(cfg *config.DatabaseConfig) (*sql.DB, error) {
-	db, err := sql.Open("postgres", cfg.URL)
+	var hooks []QueryHook
+	if cfg.SlowQueryThreshold > 0 {
+		hooks = append(hooks, SlowQueryLogger(cfg.SlowQueryThreshold, slog.Default()))
+	}
+
+	lifetime, err := jitteredLifetime(cfg.ConnMaxLifetime, cfg.ConnMaxLifetimeJitter, rand.Int64N)
+	if err != nil {
+		return nil, err
+	}
+
+	dsn, err := WithSchema(cfg.URL, cfg.Schema)
+	if err != nil {
+		return nil, err
+	}
+	dsn, err = WithUTC(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := open(dsn, hooks)
 	if err != nil {
 		return nil, fmt.Errorf("open database: %w", err)
 	}
 
 	db.SetMaxOpenConns(cfg.MaxOpenConns)
 	db.SetMaxIdleConns(cfg.MaxIdleConns)
-	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	db.SetConnMaxLifetime(lifetime)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -29,3 +51,76 @@ func NewConnection(cfg *config.DatabaseConfig) (*sql.DB, error) {
 
 	return db, nil
 }
+
+// jitteredLifetime returns lifetime shortened by a random amount in
+// [0, jitter], using randN to pick a number in [0, n). A zero lifetime means
+// connections are never closed for age, so it isn't jittered.
+func jitteredLifetime(lifetime, jitter time.Duration, randN func(n int64) int64) (time.Duration, error) {
+	if lifetime <= 0 || jitter <= 0 {
+		return lifetime, nil
+	}
+	if jitter >= lifetime {
+		return 0, fmt.Errorf("conn max lifetime jitter %s must be less than the lifetime %s", jitter, lifetime)
+	}
+	return lifetime - time.Duration(randN(int64(jitter)+1)), nil
+}
+
+func open(dsn string, hooks []QueryHook) (*sql.DB, error) {
+	if len(hooks) == 0 {
+		return sql.Open("postgres", dsn)
+	}
+
+	connector, err := NewConnector(dsn, hooks...)
+	if err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(connector), nil
+}
+
+// Warmup opens and pings n connections concurrently so the pool has idle
+// connections ready before the first requests arrive. The number kept idle
+// is still bounded by MaxIdleConns. Every connection is held until all have
+// been pinged, so n is capped at MaxOpenConns; more would wait for a
+// connection that is never released.
+func Warmup(ctx context.Context, db *sql.DB, n int) error {
+	if limit := db.Stats().MaxOpenConnections; limit > 0 && n > limit {
+		n = limit
+	}
+
+	conns := make([]*sql.Conn, n)
+	errs := make([]error, n)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			conn, err := db.Conn(ctx)
+			if err != nil {
+				errs[i] = fmt.Errorf("open connection: %w", err)
+				return
+			}
+			conns[i] = conn
+
+			if err := conn.PingContext(ctx); err != nil {
+				errs[i] = fmt.Errorf("ping connection: %w", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, conn := range conns {
+		if conn != nil {
+			_ = conn.Close()
+		}
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return fmt.Errorf("warmup: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+package database
+
+import (
+	"math/rand/v2"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestJitteredLifetime(t *testing.T) {
+	lifetime := 5 * time.Minute
+	jitter := time.Minute
+
+	for i := 0; i < 1000; i++ {
+		got, err := jitteredLifetime(lifetime, jitter, rand.Int64N)
+		if err != nil {
+			t.Fatalf("jitteredLifetime: %v", err)
+		}
+		if got < lifetime-jitter || got > lifetime {
+			t.Fatalf("lifetime %s outside [%s, %s]", got, lifetime-jitter, lifetime)
+		}
+	}
+
+	lowest, _ := jitteredLifetime(lifetime, jitter, func(n int64) int64 { return n - 1 })
+	highest, _ := jitteredLifetime(lifetime, jitter, func(n int64) int64 { return 0 })
+	if lowest != lifetime-jitter || highest != lifetime {
+		t.Errorf("expected band [%s, %s], got [%s, %s]", lifetime-jitter, lifetime, lowest, highest)
+	}
+
+	if got, err := jitteredLifetime(lifetime, 0, rand.Int64N); err != nil || got != lifetime {
+		t.Errorf("expected no jitter to keep %s, got %s, %v", lifetime, got, err)
+	}
+	if got, err := jitteredLifetime(0, jitter, rand.Int64N); err != nil || got != 0 {
+		t.Errorf("expected an unlimited lifetime to stay 0, got %s, %v", got, err)
+	}
+	if _, err := jitteredLifetime(lifetime, lifetime, rand.Int64N); err == nil {
+		t.Error("expected an error for jitter not less than the lifetime")
+	}
+}
+
+func TestMigrationVersions(t *testing.T) {
+	fsys := fstest.MapFS{
+		"010_add_stocked_quantity.up.sql":   {},
+		"010_add_stocked_quantity.down.sql": {},
+		"002_create_products.up.sql":        {},
+		"002_create_products.down.sql":      {},
+		"embed.go":                          {},
+	}
+
+	versions, err := MigrationVersions(fsys)
+	if err != nil {
+		t.Fatalf("MigrationVersions: %v", err)
+	}
+	if len(versions) != 2 || versions[0] != 2 || versions[1] != 10 {
+		t.Errorf("expected [2 10], got %v", versions)
+	}
+
+	fsys["latest.up.sql"] = &fstest.MapFile{}
+	if _, err := MigrationVersions(fsys); err == nil {
+		t.Error("expected an error for a migration without a version")
+	}
+}
+
+func TestTimeoutSetting(t *testing.T) {
+	tests := []struct {
+		timeout time.Duration
+		want    string
+	}{
+		{time.Microsecond, "1ms"},
+		{time.Millisecond, "1ms"},
+		{1500 * time.Microsecond, "2ms"},
+		{2 * time.Second, "2000ms"},
+	}
+
+	for _, tt := range tests {
+		if got := TimeoutSetting(tt.timeout); got != tt.want {
+			t.Errorf("TimeoutSetting(%s) = %s, want %s", tt.timeout, got, tt.want)
+		}
+	}
+}
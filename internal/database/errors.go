@@ -16,11 +16,37 @@ const (
 	ErrorClassSerialization
 )
 
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorClassTransient:
+		return "transient"
+	case ErrorClassDeadlock:
+		return "deadlock"
+	case ErrorClassSerialization:
+		return "serialization"
+	default:
+		return "permanent"
+	}
+}
+
+// ErrorClassObserver, when set, is called with the class of every non-nil
+// error passed to ClassifyError, e.g. to count errors per class. It is off by
+// default; set it once at startup.
+var ErrorClassObserver func(ErrorClass)
+
 func ClassifyError(err error) ErrorClass {
 	if err == nil {
 		return ErrorClassPermanent
 	}
 
+	class := classifyError(err)
+	if observer := ErrorClassObserver; observer != nil {
+		observer(class)
+	}
+	return class
+}
+
+func classifyError(err error) ErrorClass {
 	var pqErr *pq.Error
 	if errors.As(err, &pqErr) {
 		switch pqErr.Code {
@@ -30,7 +56,7 @@ func ClassifyError(err error) ErrorClass {
 			return ErrorClassDeadlock
 		case "55P03":
 			return ErrorClassTransient
-		case "23505", "23503", "23502", "23514":
+		case "23505", "23503", "23502", "23514", "22003":
 			return ErrorClassPermanent
 		}
 	}
@@ -49,11 +75,49 @@ func IsRetryable(err error) bool {
 		class == ErrorClassSerialization
 }
 
+// IsNumericOutOfRange reports whether err is Postgres' numeric_value_out_of_range
+// (22003), raised when a value exceeds a column's numeric precision.
+func IsNumericOutOfRange(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "22003"
+}
+
+// IsCheckViolation reports whether err is Postgres' check_violation (23514)
+// of the named constraint.
+func IsCheckViolation(err error, constraint string) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23514" && pqErr.Constraint == constraint
+}
+
+// IsUniqueViolation reports whether err is Postgres' unique_violation
+// (23505).
+func IsUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
 var (
-	ErrUserNotFound        = errors.New("user not found")
-	ErrProductNotFound     = errors.New("product not found")
-	ErrOrderNotFound       = errors.New("order not found")
-	ErrInsufficientStock   = errors.New("insufficient stock")
-	ErrOptimisticLockFailed = errors.New("optimistic lock failed")
-	ErrLockTimeout         = errors.New("lock timeout")
+	ErrUserNotFound            = errors.New("user not found")
+	ErrProductNotFound         = errors.New("product not found")
+	ErrOrderNotFound           = errors.New("order not found")
+	ErrInsufficientStock       = errors.New("insufficient stock")
+	ErrOptimisticLockFailed    = errors.New("optimistic lock failed")
+	ErrLockTimeout             = errors.New("lock timeout")
+	ErrOrderNumberConflict     = errors.New("order number conflict")
+	ErrUnsupportedCurrency     = errors.New("unsupported currency")
+	ErrMixedCurrency           = errors.New("order items have different currencies")
+	ErrInvalidStatusTransition = errors.New("invalid order status transition")
+	ErrReservationNotFound     = errors.New("reservation not found")
+	ErrReservationExpired      = errors.New("reservation expired")
+	ErrInvalidOrderStatus      = errors.New("invalid order status")
+	ErrRetryBudgetExhausted    = errors.New("retry budget exhausted")
+	ErrInvalidQuantity         = errors.New("invalid item quantity")
+	ErrOrderTotalTooLarge      = errors.New("order total too large")
+	ErrUnknownQuery            = errors.New("unknown query")
+	ErrDuplicateSKU            = errors.New("duplicate sku")
+	ErrCartNotFound            = errors.New("cart not found")
+	ErrNumericOutOfRange       = errors.New("numeric value out of range")
+	ErrOrderNotPending         = errors.New("order is not pending")
+	ErrIdempotencyKeyReused    = errors.New("idempotency key reused for a different request")
+	ErrIdempotencyClaimLost    = errors.New("idempotency claim lost")
 )
@@ -0,0 +1,145 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// QueryEvent describes one statement sent to the database. For queries,
+// Duration covers the round trip until the first rows are available, not
+// the time the caller spends reading them.
+type QueryEvent struct {
+	Query    string
+	Args     []driver.NamedValue
+	Duration time.Duration
+	Err      error
+}
+
+// QueryHook is called after every statement run through a connector created
+// by NewConnector, including statements inside transactions. Hooks run on
+// the querying goroutine and must be fast.
+type QueryHook func(ctx context.Context, event QueryEvent)
+
+// NewConnector returns a lib/pq connector for dsn that reports every
+// statement to hooks. Use it with sql.OpenDB.
+func NewConnector(dsn string, hooks ...QueryHook) (driver.Connector, error) {
+	connector, err := pq.NewConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &hookedConnector{Connector: connector, hooks: hooks}, nil
+}
+
+type hookedConnector struct {
+	*pq.Connector
+	hooks []QueryHook
+}
+
+func (c *hookedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	inner, ok := conn.(pqConn)
+	if !ok {
+		_ = conn.Close()
+		return nil, fmt.Errorf("query hooks: unsupported connection type %T", conn)
+	}
+	return &hookedConn{pqConn: inner, hooks: c.hooks}, nil
+}
+
+func (c *hookedConnector) Driver() driver.Driver {
+	return c.Connector.Driver()
+}
+
+// pqConn is the set of driver interfaces implemented by lib/pq connections
+// that hookedConn forwards.
+type pqConn interface {
+	driver.Conn
+	driver.ConnBeginTx
+	driver.ConnPrepareContext
+	driver.ExecerContext
+	driver.QueryerContext
+	driver.Pinger
+	driver.SessionResetter
+	driver.Validator
+	driver.NamedValueChecker
+}
+
+type hookedConn struct {
+	pqConn
+	hooks []QueryHook
+}
+
+func (c *hookedConn) report(ctx context.Context, query string, args []driver.NamedValue, start time.Time, err error) {
+	event := QueryEvent{
+		Query:    query,
+		Args:     args,
+		Duration: time.Since(start),
+		Err:      err,
+	}
+	for _, hook := range c.hooks {
+		hook(ctx, event)
+	}
+}
+
+func (c *hookedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	result, err := c.pqConn.ExecContext(ctx, query, args)
+	c.report(ctx, query, args, start, err)
+	return result, err
+}
+
+func (c *hookedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := c.pqConn.QueryContext(ctx, query, args)
+	c.report(ctx, query, args, start, err)
+	return rows, err
+}
+
+func (c *hookedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := c.pqConn.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	inner, ok := stmt.(pqStmt)
+	if !ok {
+		_ = stmt.Close()
+		return nil, fmt.Errorf("query hooks: unsupported statement type %T", stmt)
+	}
+	return &hookedStmt{pqStmt: inner, conn: c, query: query}, nil
+}
+
+func (c *hookedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+type pqStmt interface {
+	driver.Stmt
+	driver.StmtExecContext
+	driver.StmtQueryContext
+}
+
+type hookedStmt struct {
+	pqStmt
+	conn  *hookedConn
+	query string
+}
+
+func (s *hookedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	result, err := s.pqStmt.ExecContext(ctx, args)
+	s.conn.report(ctx, s.query, args, start, err)
+	return result, err
+}
+
+func (s *hookedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := s.pqStmt.QueryContext(ctx, args)
+	s.conn.report(ctx, s.query, args, start, err)
+	return rows, err
+}
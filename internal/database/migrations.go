@@ -0,0 +1,158 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// schema_migrations (migration 026) lists the version of every applied
+// migration. Migration 026 backfills itself and the ones before it; later
+// versions are recorded by the runner with RecordMigration.
+
+// MigrationStatus compares the migrations applied to a database with a set
+// of migration files.
+type MigrationStatus struct {
+	// CurrentVersion is the highest applied version, 0 before migration 026.
+	CurrentVersion int `json:"current_version"`
+	LatestVersion  int `json:"latest_version"`
+	// Pending lists the versions in the set that haven't been applied,
+	// ascending.
+	Pending []int `json:"pending"`
+}
+
+// UpToDate reports whether every migration in the set has been applied.
+func (s *MigrationStatus) UpToDate() bool {
+	return len(s.Pending) == 0
+}
+
+// MigrationVersion returns the version of a migration file, the number its
+// name starts with, e.g. 26 for 026_create_schema_migrations.up.sql.
+func MigrationVersion(name string) (int, error) {
+	prefix, _, ok := strings.Cut(name, "_")
+	if !ok {
+		return 0, fmt.Errorf("migration %q has no version prefix", name)
+	}
+	version, err := strconv.Atoi(prefix)
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("migration %q has no version prefix", name)
+	}
+	return version, nil
+}
+
+// MigrationVersions returns the versions of the up migrations in fsys,
+// ascending.
+func MigrationVersions(fsys fs.FS) ([]int, error) {
+	names, err := fs.Glob(fsys, "*.up.sql")
+	if err != nil {
+		return nil, fmt.Errorf("list migrations: %w", err)
+	}
+
+	versions := make([]int, 0, len(names))
+	for _, name := range names {
+		version, err := MigrationVersion(name)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+
+	sort.Ints(versions)
+	return versions, nil
+}
+
+// AppliedMigrations returns the set of recorded versions, empty if
+// schema_migrations doesn't exist yet.
+func AppliedMigrations(ctx context.Context, db *sql.DB) (map[int]bool, error) {
+	applied := make(map[int]bool)
+
+	exists, err := migrationsTableExists(ctx, db)
+	if err != nil || !exists {
+		return applied, err
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("list applied migrations: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			return
+		}
+	}()
+
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, fmt.Errorf("scan migration version: %w", err)
+		}
+		applied[version] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return applied, nil
+}
+
+// GetMigrationStatus compares the migrations applied to db with those in
+// fsys.
+func GetMigrationStatus(ctx context.Context, db *sql.DB, fsys fs.FS) (*MigrationStatus, error) {
+	versions, err := MigrationVersions(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := AppliedMigrations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &MigrationStatus{Pending: []int{}}
+	for version := range applied {
+		status.CurrentVersion = max(status.CurrentVersion, version)
+	}
+	for _, version := range versions {
+		status.LatestVersion = max(status.LatestVersion, version)
+		if !applied[version] {
+			status.Pending = append(status.Pending, version)
+		}
+	}
+
+	return status, nil
+}
+
+// RecordMigration records version as applied after its up migration ran, or
+// removes it after its down migration ran. It does nothing while
+// schema_migrations doesn't exist.
+func RecordMigration(ctx context.Context, db *sql.DB, version int, up bool) error {
+	exists, err := migrationsTableExists(ctx, db)
+	if err != nil || !exists {
+		return err
+	}
+
+	if up {
+		_, err = db.ExecContext(ctx,
+			`INSERT INTO schema_migrations (version) VALUES ($1) ON CONFLICT DO NOTHING`, version)
+	} else {
+		_, err = db.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = $1`, version)
+	}
+	if err != nil {
+		return fmt.Errorf("record migration %d: %w", version, err)
+	}
+	return nil
+}
+
+func migrationsTableExists(ctx context.Context, db *sql.DB) (bool, error) {
+	var exists bool
+	err := db.QueryRowContext(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("check schema_migrations: %w", err)
+	}
+	return exists, nil
+}
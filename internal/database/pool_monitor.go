@@ -0,0 +1,46 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// StartPoolMonitor samples db.Stats() every interval in a background
+// goroutine until ctx is cancelled, and calls onExceed with the sample when
+// the number of connections in use reaches threshold. It fires once per
+// crossing: the monitor re-arms only after the count drops below threshold
+// again, so a pool that stays saturated doesn't repeat the alert every
+// interval. onExceed runs on the monitor goroutine and should not block. It
+// returns an error without starting the monitor if interval isn't positive.
+func StartPoolMonitor(ctx context.Context, db *sql.DB, interval time.Duration, threshold int, onExceed func(sql.DBStats)) error {
+	if interval <= 0 {
+		return fmt.Errorf("pool monitor interval must be positive, got %s", interval)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		exceeded := false
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			stats := db.Stats()
+			if stats.InUse < threshold {
+				exceeded = false
+				continue
+			}
+			if !exceeded {
+				exceeded = true
+				onExceed(stats)
+			}
+		}
+	}()
+	return nil
+}
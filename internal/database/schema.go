@@ -0,0 +1,49 @@
+package database
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var schemaName = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// WithSchema returns dsn with search_path set to schema, so every unqualified
+// table, sequence and function name the store and the migrations use
+// resolves inside that schema. Several apps can share one database this way
+// without their tables, indexes or triggers colliding. It accepts both URL
+// and key=value DSNs; an empty schema returns dsn unchanged.
+func WithSchema(dsn, schema string) (string, error) {
+	if schema == "" {
+		return dsn, nil
+	}
+	if !schemaName.MatchString(schema) {
+		return "", fmt.Errorf("invalid schema name %q: use lowercase letters, digits and underscores", schema)
+	}
+
+	return withParam(dsn, "search_path", schema)
+}
+
+// WithUTC returns dsn with the session TimeZone set to UTC. The timestamp
+// columns are timestamptz, so this only affects how they are returned:
+// always in UTC, which encodes in JSON with a Z suffix.
+func WithUTC(dsn string) (string, error) {
+	return withParam(dsn, "timezone", "UTC")
+}
+
+// withParam adds a run-time parameter to a URL or key=value DSN.
+func withParam(dsn, key, value string) (string, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "", fmt.Errorf("parse database url: %w", err)
+		}
+		query := u.Query()
+		query.Set(key, value)
+		u.RawQuery = query.Encode()
+		return u.String(), nil
+	}
+
+	return strings.TrimSpace(dsn) + " " + key + "=" + value, nil
+}
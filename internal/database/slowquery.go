@@ -0,0 +1,28 @@
+package database
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// SlowQueryLogger returns a QueryHook that logs statements taking at least
+// threshold at warn level. Arguments are left out of the log because they can
+// contain user data.
+func SlowQueryLogger(threshold time.Duration, logger *slog.Logger) QueryHook {
+	return func(ctx context.Context, event QueryEvent) {
+		if event.Duration < threshold {
+			return
+		}
+
+		attrs := []slog.Attr{
+			slog.Float64("duration_ms", float64(event.Duration.Microseconds())/1000),
+			slog.String("query", event.Query),
+		}
+		if event.Err != nil {
+			attrs = append(attrs, slog.String("error", event.Err.Error()))
+		}
+
+		logger.LogAttrs(ctx, slog.LevelWarn, "slow query", attrs...)
+	}
+}
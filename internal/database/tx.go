@@ -4,7 +4,10 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"log/slog"
 	"math/rand"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -12,26 +15,198 @@ type TxOptions struct {
 	IsolationLevel sql.IsolationLevel
 	ReadOnly       bool
 	MaxRetries     int
+
+	// Timeout bounds each transaction attempt when non-zero. The transaction
+	// is rolled back once it expires and the context error is returned. It is
+	// also applied as statement_timeout, since fn's statements run with the
+	// caller's context and would otherwise not be interrupted.
+	Timeout time.Duration
+
+	// OnRetry, when set, is called by WithRetry for every failed attempt it
+	// is about to retry, before the backoff.
+	OnRetry func(RetryEvent)
+
+	// RetryableClasses limits which error classes WithRetry retries; errors
+	// of any other class are returned at once. Empty means every class but
+	// ErrorClassPermanent, e.g. {ErrorClassSerialization} surfaces deadlocks
+	// for investigation instead of retrying them.
+	RetryableClasses []ErrorClass
+}
+
+// retries reports whether WithRetry should retry an error of class.
+func (o TxOptions) retries(class ErrorClass) bool {
+	if class == ErrorClassPermanent {
+		return false
+	}
+	if len(o.RetryableClasses) == 0 {
+		return true
+	}
+	for _, retryable := range o.RetryableClasses {
+		if class == retryable {
+			return true
+		}
+	}
+	return false
+}
+
+// RetryPhase tells whether an attempt failed while fn ran or at commit.
+type RetryPhase int
+
+const (
+	RetryPhaseFn RetryPhase = iota
+	// RetryPhaseCommit is typically a serialization failure that Postgres
+	// could only detect once the transaction tried to commit.
+	RetryPhaseCommit
+)
+
+func (p RetryPhase) String() string {
+	if p == RetryPhaseCommit {
+		return "commit"
+	}
+	return "fn"
+}
+
+// RetryEvent describes an attempt WithRetry is about to retry. Attempt
+// counts from 1.
+type RetryEvent struct {
+	Attempt int
+	Phase   RetryPhase
+	Class   ErrorClass
+	Err     error
+}
+
+// RetriesExhaustedError is returned by WithRetry when the last attempt it was
+// allowed failed with a retryable error. It unwraps to that error, so
+// errors.Is and errors.As still match it.
+type RetriesExhaustedError struct {
+	// Attempts counts every attempt made, the first one included.
+	Attempts int
+	Phase    RetryPhase
+	Class    ErrorClass
+	LastErr  error
+}
+
+func (e *RetriesExhaustedError) Error() string {
+	if e.Phase == RetryPhaseCommit {
+		return fmt.Sprintf("max retries (%d) exceeded on commit: %v", e.Attempts-1, e.LastErr)
+	}
+	return fmt.Sprintf("max retries (%d) exceeded: %v", e.Attempts-1, e.LastErr)
+}
+
+func (e *RetriesExhaustedError) Unwrap() error {
+	return e.LastErr
+}
+
+// LogValue makes slog record the error's fields as a group rather than only
+// its message.
+func (e *RetriesExhaustedError) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Int("attempts", e.Attempts),
+		slog.String("phase", e.Phase.String()),
+		slog.String("class", e.Class.String()),
+		slog.String("error", e.LastErr.Error()),
+	)
+}
+
+// defaultIsolationLevel is the isolation DefaultTxOptions uses. main sets it
+// once at startup from DATABASE_DEFAULT_ISOLATION.
+var defaultIsolationLevel = sql.LevelReadCommitted
+
+// SetDefaultIsolationLevel changes the isolation level DefaultTxOptions
+// returns. It isn't synchronized, so call it once before serving requests.
+func SetDefaultIsolationLevel(level sql.IsolationLevel) {
+	defaultIsolationLevel = level
+}
+
+var isolationLevels = map[string]sql.IsolationLevel{
+	"read uncommitted": sql.LevelReadUncommitted,
+	"read committed":   sql.LevelReadCommitted,
+	"repeatable read":  sql.LevelRepeatableRead,
+	"serializable":     sql.LevelSerializable,
+}
+
+// ParseIsolationLevel maps a level name such as "serializable" or
+// "repeatable_read" to its sql.IsolationLevel. Case is ignored and words may
+// be separated by spaces, underscores or hyphens.
+func ParseIsolationLevel(name string) (sql.IsolationLevel, error) {
+	normalized := strings.NewReplacer("_", " ", "-", " ").Replace(strings.ToLower(strings.TrimSpace(name)))
+	level, ok := isolationLevels[normalized]
+	if !ok {
+		return sql.LevelDefault, fmt.Errorf("unknown isolation level %q", name)
+	}
+	return level, nil
 }
 
 func DefaultTxOptions() TxOptions {
 	return TxOptions{
-		IsolationLevel: sql.LevelReadCommitted,
+		IsolationLevel: defaultIsolationLevel,
 		ReadOnly:       false,
 		MaxRetries:     3,
 	}
 }
 
-func WithTransaction(ctx context.Context, db *sql.DB, opts TxOptions, fn func(*sql.Tx) error) error {
-	tx, err := db.BeginTx(ctx, &sql.TxOptions{
+// TimeoutSetting formats d as a millisecond value for Postgres' timeout
+// settings, rounding up. A fraction of a millisecond becomes 1ms rather than
+// 0ms, which Postgres reads as no timeout at all.
+func TimeoutSetting(d time.Duration) string {
+	ms := (d + time.Millisecond - 1) / time.Millisecond
+	return fmt.Sprintf("%dms", max(ms, 1))
+}
+
+// beginTx starts a transaction, bounded by opts.Timeout if set. The returned
+// context is the one the transaction is bound to; cancel must always be called.
+func beginTx(ctx context.Context, db *sql.DB, opts TxOptions) (*sql.Tx, context.Context, context.CancelFunc, error) {
+	txCtx, cancel := ctx, context.CancelFunc(func() {})
+	if opts.Timeout > 0 {
+		txCtx, cancel = context.WithTimeout(ctx, opts.Timeout)
+	}
+
+	tx, err := db.BeginTx(txCtx, &sql.TxOptions{
 		Isolation: opts.IsolationLevel,
 		ReadOnly:  opts.ReadOnly,
 	})
 	if err != nil {
-		return fmt.Errorf("begin transaction: %w", err)
+		cancel()
+		return nil, nil, nil, fmt.Errorf("begin transaction: %w", err)
+	}
+
+	if opts.Timeout > 0 {
+		_, err := tx.ExecContext(txCtx, `SELECT set_config('statement_timeout', $1, true)`,
+			TimeoutSetting(opts.Timeout))
+		if err != nil {
+			_ = tx.Rollback()
+			cancel()
+			return nil, nil, nil, fmt.Errorf("set statement timeout: %w", err)
+		}
+	}
+
+	if actorID, ok := ActorFromContext(ctx); ok {
+		_, err := tx.ExecContext(txCtx, `SELECT set_config('app.actor_id', $1, true)`,
+			strconv.FormatInt(actorID, 10))
+		if err != nil {
+			_ = tx.Rollback()
+			cancel()
+			return nil, nil, nil, fmt.Errorf("set actor: %w", err)
+		}
+	}
+
+	return tx, txCtx, cancel, nil
+}
+
+func WithTransaction(ctx context.Context, db *sql.DB, opts TxOptions, fn func(*sql.Tx) error) error {
+	tx, txCtx, cancel, err := beginTx(ctx, db, opts)
+	if err != nil {
+		return err
 	}
+	defer cancel()
 
 	if err := fn(tx); err != nil {
+		if txCtx.Err() != nil {
+			// database/sql has already rolled back a transaction whose
+			// context is done.
+			_ = tx.Rollback()
+			return txCtx.Err()
+		}
 		if rbErr := tx.Rollback(); rbErr != nil {
 			return fmt.Errorf("rollback failed: %v (original error: %w)", rbErr, err)
 		}
@@ -39,6 +214,9 @@ func WithTransaction(ctx context.Context, db *sql.DB, opts TxOptions, fn func(*s
 	}
 
 	if err := tx.Commit(); err != nil {
+		if txCtx.Err() != nil {
+			return txCtx.Err()
+		}
 		return fmt.Errorf("commit transaction: %w", err)
 	}
 
@@ -56,30 +234,41 @@ func WithRetry(ctx context.Context, db *sql.DB, opts TxOptions, fn func(*sql.Tx)
 		default:
 		}
 
-		tx, err := db.BeginTx(ctx, &sql.TxOptions{
-			Isolation: opts.IsolationLevel,
-			ReadOnly:  opts.ReadOnly,
-		})
+		tx, txCtx, cancel, err := beginTx(ctx, db, opts)
 		if err != nil {
-			return fmt.Errorf("begin transaction: %w", err)
+			return err
 		}
 
 		err = fn(tx)
 		if err != nil {
-			if rbErr := tx.Rollback(); rbErr != nil {
+			rbErr := tx.Rollback()
+			txErr := txCtx.Err()
+			cancel()
+
+			if txErr != nil {
+				return txErr
+			}
+			if rbErr != nil {
 				return fmt.Errorf("rollback failed: %v (original error: %w)", rbErr, err)
 			}
 
 			errClass := ClassifyError(err)
-			if errClass == ErrorClassPermanent {
+			if !opts.retries(errClass) {
 				return err
 			}
 
 			if attempt == opts.MaxRetries {
-				return fmt.Errorf("max retries (%d) exceeded: %w", opts.MaxRetries, err)
+				return &RetriesExhaustedError{Attempts: attempt + 1, Phase: RetryPhaseFn, Class: errClass, LastErr: err}
+			}
+
+			if !takeRetry(ctx) {
+				return fmt.Errorf("%w: %w", ErrRetryBudgetExhausted, err)
 			}
 
 			lastErr = err
+			if opts.OnRetry != nil {
+				opts.OnRetry(RetryEvent{Attempt: attempt + 1, Phase: RetryPhaseFn, Class: errClass, Err: err})
+			}
 
 			jitter := time.Duration(rand.Int63n(int64(backoff / 4)))
 			sleepDuration := backoff + jitter
@@ -94,17 +283,32 @@ func WithRetry(ctx context.Context, db *sql.DB, opts TxOptions, fn func(*sql.Tx)
 			continue
 		}
 
-		if err := tx.Commit(); err != nil {
+		err = tx.Commit()
+		txErr := txCtx.Err()
+		cancel()
+
+		if err != nil {
+			if txErr != nil {
+				return txErr
+			}
+
 			errClass := ClassifyError(err)
-			if errClass == ErrorClassPermanent {
+			if !opts.retries(errClass) {
 				return fmt.Errorf("commit transaction: %w", err)
 			}
 
 			if attempt == opts.MaxRetries {
-				return fmt.Errorf("max retries (%d) exceeded on commit: %w", opts.MaxRetries, err)
+				return &RetriesExhaustedError{Attempts: attempt + 1, Phase: RetryPhaseCommit, Class: errClass, LastErr: err}
+			}
+
+			if !takeRetry(ctx) {
+				return fmt.Errorf("%w: %w", ErrRetryBudgetExhausted, err)
 			}
 
 			lastErr = err
+			if opts.OnRetry != nil {
+				opts.OnRetry(RetryEvent{Attempt: attempt + 1, Phase: RetryPhaseCommit, Class: errClass, Err: err})
+			}
 
 			jitter := time.Duration(rand.Int63n(int64(backoff / 4)))
 			sleepDuration := backoff + jitter
@@ -0,0 +1,47 @@
+// Package logging builds the application's slog logger from LOG_* settings.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/safar/go-sql-store/internal/config"
+)
+
+// New returns a logger writing to cfg.Output ("stdout" or "stderr") in
+// cfg.Format ("text" or "json"), dropping records below cfg.Level ("debug",
+// "info", "warn" or "error").
+func New(cfg config.LogConfig) (*slog.Logger, error) {
+	var w io.Writer
+	switch strings.ToLower(cfg.Output) {
+	case "", "stderr":
+		w = os.Stderr
+	case "stdout":
+		w = os.Stdout
+	default:
+		return nil, fmt.Errorf("unknown log output %q, expected stdout or stderr", cfg.Output)
+	}
+	return newLogger(cfg, w)
+}
+
+func newLogger(cfg config.LogConfig, w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if cfg.Level != "" {
+		if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+			return nil, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", cfg.Level)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	switch strings.ToLower(cfg.Format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q, expected text or json", cfg.Format)
+	}
+}
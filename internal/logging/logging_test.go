@@ -0,0 +1,66 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/safar/go-sql-store/internal/config"
+)
+
+func TestNewLoggerFormat(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(config.LogConfig{Level: "info", Format: "json"}, &buf)
+	if err != nil {
+		t.Fatalf("newLogger: %v", err)
+	}
+	logger.Info("server starting", "port", "8080")
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("expected a JSON record, got %q: %v", buf.String(), err)
+	}
+	if record["msg"] != "server starting" || record["port"] != "8080" {
+		t.Errorf("unexpected record %v", record)
+	}
+
+	buf.Reset()
+	logger, err = newLogger(config.LogConfig{Level: "info", Format: "text"}, &buf)
+	if err != nil {
+		t.Fatalf("newLogger: %v", err)
+	}
+	logger.Info("server starting", "port", "8080")
+
+	line := buf.String()
+	if !strings.Contains(line, `msg="server starting"`) || !strings.Contains(line, "port=8080") {
+		t.Errorf("expected a text record, got %q", line)
+	}
+	if json.Valid(buf.Bytes()) {
+		t.Errorf("expected text, got JSON %q", line)
+	}
+}
+
+func TestNewLoggerLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(config.LogConfig{Level: "WARN", Format: "text"}, &buf)
+	if err != nil {
+		t.Fatalf("newLogger: %v", err)
+	}
+
+	logger.Info("dropped")
+	logger.Warn("kept")
+	if out := buf.String(); strings.Contains(out, "dropped") || !strings.Contains(out, "kept") {
+		t.Errorf("expected only the warning, got %q", out)
+	}
+
+	if _, err := newLogger(config.LogConfig{Level: "verbose"}, &buf); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+	if _, err := newLogger(config.LogConfig{Format: "xml"}, &buf); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+	if _, err := New(config.LogConfig{Output: "syslog"}); err == nil {
+		t.Error("expected an error for an unknown output")
+	}
+}
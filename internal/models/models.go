@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/shopspring/decimal"
@@ -13,18 +14,27 @@ type User struct {
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 	Version   int       `json:"version"`
+	// DeletedAt is set once the user has been anonymized.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 type Product struct {
-	ID            int64           `json:"id"`
-	SKU           string          `json:"sku"`
-	Name          string          `json:"name"`
-	Description   string          `json:"description,omitempty"`
-	Price         decimal.Decimal `json:"price"`
-	StockQuantity int             `json:"stock_quantity"`
-	CreatedAt     time.Time       `json:"created_at"`
-	UpdatedAt     time.Time       `json:"updated_at"`
-	Version       int             `json:"version"`
+	ID               int64           `json:"id"`
+	SKU              string          `json:"sku"`
+	Name             string          `json:"name"`
+	Description      string          `json:"description,omitempty"`
+	Price            decimal.Decimal `json:"price"`
+	StockQuantity    int             `json:"stock_quantity"`
+	ReservedQuantity int             `json:"reserved_quantity"`
+	Currency         string          `json:"currency"`
+	StockedQuantity  int             `json:"stocked_quantity"`
+	CreatedAt        time.Time       `json:"created_at"`
+	UpdatedAt        time.Time       `json:"updated_at"`
+	Version          int             `json:"version"`
+}
+
+func (p *Product) AvailableQuantity() int {
+	return p.StockQuantity - p.ReservedQuantity
 }
 
 type Order struct {
@@ -33,10 +43,17 @@ type Order struct {
 	OrderNumber string          `json:"order_number"`
 	Status      string          `json:"status"`
 	TotalAmount decimal.Decimal `json:"total_amount"`
-	CreatedAt   time.Time       `json:"created_at"`
-	UpdatedAt   time.Time       `json:"updated_at"`
-	Version     int             `json:"version"`
-	Items       []OrderItem     `json:"items,omitempty"`
+	Currency    string          `json:"currency"`
+	// TrackingNumber and ShippedAt are set once the order ships.
+	TrackingNumber *string     `json:"tracking_number,omitempty"`
+	ShippedAt      *time.Time  `json:"shipped_at,omitempty"`
+	CreatedAt      time.Time   `json:"created_at"`
+	UpdatedAt      time.Time   `json:"updated_at"`
+	Version        int         `json:"version"`
+	Items          []OrderItem `json:"items,omitempty"`
+	// Metadata is a JSON object of free-form attributes such as a gift
+	// message or the channel the order came from.
+	Metadata json.RawMessage `json:"metadata,omitempty"`
 }
 
 type OrderItem struct {
@@ -47,8 +64,54 @@ type OrderItem struct {
 	UnitPrice decimal.Decimal `json:"unit_price"`
 	Subtotal  decimal.Decimal `json:"subtotal"`
 	CreatedAt time.Time       `json:"created_at"`
+	// ProductName is the product's name when the order was placed; like
+	// UnitPrice, it doesn't follow later changes to the product.
+	ProductName string `json:"product_name"`
+}
+
+type StockReservation struct {
+	ID         int64      `json:"id"`
+	ProductID  int64      `json:"product_id"`
+	Quantity   int        `json:"quantity"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ReleasedAt *time.Time `json:"released_at,omitempty"`
+	OrderID    *int64     `json:"order_id,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	ConsumedAt *time.Time `json:"consumed_at,omitempty"`
+	CartID     *int64     `json:"cart_id,omitempty"`
+}
+
+type PriceChange struct {
+	ID        int64           `json:"id"`
+	ProductID int64           `json:"product_id"`
+	OldPrice  decimal.Decimal `json:"old_price"`
+	NewPrice  decimal.Decimal `json:"new_price"`
+	ChangedAt time.Time       `json:"changed_at"`
+}
+
+type AuditEntry struct {
+	ID         int64           `json:"id"`
+	EntityType string          `json:"entity_type"`
+	EntityID   int64           `json:"entity_id"`
+	Action     string          `json:"action"`
+	OldData    json.RawMessage `json:"old_data,omitempty"`
+	NewData    json.RawMessage `json:"new_data,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+	// ActorID is the user the write was made on behalf of, if known.
+	ActorID *int64 `json:"actor_id,omitempty"`
 }
 
+const (
+	AuditEntityUser      = "user"
+	AuditEntityProduct   = "product"
+	AuditEntityOrder     = "order"
+	AuditEntityOrderItem = "order_item"
+
+	AuditActionCreate = "create"
+	AuditActionUpdate = "update"
+	AuditActionDelete = "delete"
+)
+
 const (
 	OrderStatusPending   = "pending"
 	OrderStatusConfirmed = "confirmed"
@@ -56,3 +119,58 @@ const (
 	OrderStatusDelivered = "delivered"
 	OrderStatusCancelled = "cancelled"
 )
+
+// OrderStatuses lists every status allowed by the orders.valid_status CHECK.
+var OrderStatuses = []string{
+	OrderStatusPending,
+	OrderStatusConfirmed,
+	OrderStatusShipped,
+	OrderStatusDelivered,
+	OrderStatusCancelled,
+}
+
+// orderStatusTransitions lists the statuses each status may move to.
+// Delivered and cancelled orders are final.
+var orderStatusTransitions = map[string][]string{
+	OrderStatusPending:   {OrderStatusConfirmed, OrderStatusCancelled},
+	OrderStatusConfirmed: {OrderStatusShipped, OrderStatusCancelled},
+	OrderStatusShipped:   {OrderStatusDelivered},
+}
+
+// IsValidOrderStatus reports whether s is one of OrderStatuses.
+func IsValidOrderStatus(s string) bool {
+	for _, status := range OrderStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func CanTransitionOrderStatus(from, to string) bool {
+	for _, next := range orderStatusTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultCurrency is used when a product is created without a currency.
+const DefaultCurrency = "USD"
+
+var supportedCurrencies = map[string]bool{
+	"USD": true,
+	"EUR": true,
+	"GBP": true,
+	"CAD": true,
+	"AUD": true,
+	"CHF": true,
+	"JPY": true,
+}
+
+// IsSupportedCurrency reports whether code is an ISO 4217 code the store
+// accepts.
+func IsSupportedCurrency(code string) bool {
+	return supportedCurrencies[code]
+}
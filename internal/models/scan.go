@@ -0,0 +1,161 @@
+package models
+
+import "database/sql"
+
+// Scanner is satisfied by both *sql.Row and *sql.Rows.
+type Scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Column lists follow the CREATE TABLE column order. Each Scan helper below
+// must read its columns in exactly this order.
+const (
+	UserColumns      = "id, email, name, created_at, updated_at, version, deleted_at"
+	ProductColumns   = "id, sku, name, description, price, stock_quantity, created_at, updated_at, version, reserved_quantity, currency, stocked_quantity"
+	OrderColumns     = "id, user_id, order_number, status, total_amount, created_at, updated_at, version, currency, tracking_number, shipped_at, metadata"
+	OrderItemColumns = "id, order_id, product_id, quantity, unit_price, subtotal, created_at, product_name"
+
+	StockReservationColumns = "id, product_id, quantity, created_at, released_at, order_id, expires_at, consumed_at, cart_id"
+	AuditEntryColumns       = "id, entity_type, entity_id, action, old_data, new_data, created_at, actor_id"
+	PriceChangeColumns      = "id, product_id, old_price, new_price, changed_at"
+)
+
+func ScanUser(row Scanner) (*User, error) {
+	user := &User{}
+	err := row.Scan(
+		&user.ID,
+		&user.Email,
+		&user.Name,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.Version,
+		&user.DeletedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// ScanProduct maps a NULL description to the empty string, which the JSON
+// encoding omits.
+func ScanProduct(row Scanner) (*Product, error) {
+	product := &Product{}
+	var description sql.NullString
+	err := row.Scan(
+		&product.ID,
+		&product.SKU,
+		&product.Name,
+		&description,
+		&product.Price,
+		&product.StockQuantity,
+		&product.CreatedAt,
+		&product.UpdatedAt,
+		&product.Version,
+		&product.ReservedQuantity,
+		&product.Currency,
+		&product.StockedQuantity,
+	)
+	if err != nil {
+		return nil, err
+	}
+	product.Description = description.String
+	return product, nil
+}
+
+func ScanOrder(row Scanner) (*Order, error) {
+	order := &Order{}
+	var metadata []byte
+	err := row.Scan(
+		&order.ID,
+		&order.UserID,
+		&order.OrderNumber,
+		&order.Status,
+		&order.TotalAmount,
+		&order.CreatedAt,
+		&order.UpdatedAt,
+		&order.Version,
+		&order.Currency,
+		&order.TrackingNumber,
+		&order.ShippedAt,
+		&metadata,
+	)
+	if err != nil {
+		return nil, err
+	}
+	order.Metadata = metadata
+	return order, nil
+}
+
+func ScanOrderItem(row Scanner) (*OrderItem, error) {
+	item := &OrderItem{}
+	err := row.Scan(
+		&item.ID,
+		&item.OrderID,
+		&item.ProductID,
+		&item.Quantity,
+		&item.UnitPrice,
+		&item.Subtotal,
+		&item.CreatedAt,
+		&item.ProductName,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func ScanStockReservation(row Scanner) (*StockReservation, error) {
+	reservation := &StockReservation{}
+	err := row.Scan(
+		&reservation.ID,
+		&reservation.ProductID,
+		&reservation.Quantity,
+		&reservation.CreatedAt,
+		&reservation.ReleasedAt,
+		&reservation.OrderID,
+		&reservation.ExpiresAt,
+		&reservation.ConsumedAt,
+		&reservation.CartID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return reservation, nil
+}
+
+func ScanAuditEntry(row Scanner) (*AuditEntry, error) {
+	entry := &AuditEntry{}
+	var oldData, newData []byte
+	err := row.Scan(
+		&entry.ID,
+		&entry.EntityType,
+		&entry.EntityID,
+		&entry.Action,
+		&oldData,
+		&newData,
+		&entry.CreatedAt,
+		&entry.ActorID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	entry.OldData = oldData
+	entry.NewData = newData
+	return entry, nil
+}
+
+func ScanPriceChange(row Scanner) (*PriceChange, error) {
+	change := &PriceChange{}
+	err := row.Scan(
+		&change.ID,
+		&change.ProductID,
+		&change.OldPrice,
+		&change.NewPrice,
+		&change.ChangedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return change, nil
+}
@@ -0,0 +1,77 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/safar/go-sql-store/internal/database"
+	"github.com/safar/go-sql-store/internal/models"
+)
+
+// Audit rows are written by the audit_row_change trigger (migration 008), so
+// every write to an audited table is recorded in the same transaction
+// regardless of which store function issued it. The trigger takes the actor
+// from the transaction's app.actor_id setting (migration 021).
+
+// WithActor returns a context that makes the store's writes record userID as
+// the actor on their audit rows. It is optional; without it actor_id is NULL.
+// Transactions the caller begins itself must use database.WithTransaction or
+// database.WithRetry with this context for the actor to be recorded.
+func WithActor(ctx context.Context, userID int64) context.Context {
+	return database.WithActor(ctx, userID)
+}
+
+// ActorFromContext returns the actor set by WithActor, if any.
+func ActorFromContext(ctx context.Context) (int64, bool) {
+	return database.ActorFromContext(ctx)
+}
+
+// writeAs runs a single-statement write. With an actor in ctx and db not
+// already a transaction, it wraps fn in one so that the audit trigger can see
+// the actor, which is set per transaction.
+func writeAs(ctx context.Context, db Querier, fn func(Querier) error) error {
+	sqlDB, ok := db.(*sql.DB)
+	if !ok {
+		return fn(db)
+	}
+	if _, ok := ActorFromContext(ctx); !ok {
+		return fn(db)
+	}
+	return database.WithTransaction(ctx, sqlDB, database.DefaultTxOptions(), func(tx *sql.Tx) error {
+		return fn(tx)
+	})
+}
+
+func ListAuditLog(ctx context.Context, db Querier, entityType string, entityID int64) ([]models.AuditEntry, error) {
+	query := `
+		SELECT ` + models.AuditEntryColumns + `
+		FROM audit_log
+		WHERE entity_type = $1 AND entity_id = $2
+		ORDER BY id`
+
+	rows, err := db.QueryContext(ctx, query, entityType, entityID)
+	if err != nil {
+		return nil, fmt.Errorf("list audit log: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			return
+		}
+	}()
+
+	var entries []models.AuditEntry
+	for rows.Next() {
+		entry, err := models.ScanAuditEntry(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan audit entry: %w", err)
+		}
+		entries = append(entries, *entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return entries, nil
+}
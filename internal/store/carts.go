@@ -0,0 +1,206 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/safar/go-sql-store/internal/database"
+	"github.com/safar/go-sql-store/internal/models"
+)
+
+// CartReservation is a group of stock reservations held together until the
+// cart is converted into an order, released, or expires.
+type CartReservation struct {
+	ID           int64                     `json:"id"`
+	CreatedAt    time.Time                 `json:"created_at"`
+	ExpiresAt    time.Time                 `json:"expires_at"`
+	Reservations []models.StockReservation `json:"reservations"`
+}
+
+// ReserveCart holds stock for every item for ttl in one transaction, so
+// either all items are reserved or none are. Products are locked in ID order.
+// Expired cart reservations are released by ReleaseExpiredReservations like
+// standalone ones.
+func ReserveCart(ctx context.Context, db *sql.DB, items []OrderItemRequest, ttl time.Duration) (*CartReservation, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("reservation ttl must be positive, got %s", ttl)
+	}
+
+	var errs ValidationErrors
+	validateOrderItems(items, &errs)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	var cart *CartReservation
+
+	err := database.WithRetry(ctx, db, database.DefaultTxOptions(), func(tx *sql.Tx) error {
+		cart = &CartReservation{}
+		err := tx.QueryRowContext(ctx,
+			`INSERT INTO carts (created_at, expires_at)
+			 VALUES (NOW(), NOW() + make_interval(secs => $1))
+			 RETURNING id, created_at, expires_at`,
+			ttl.Seconds()).Scan(&cart.ID, &cart.CreatedAt, &cart.ExpiresAt)
+		if err != nil {
+			return fmt.Errorf("create cart: %w", err)
+		}
+
+		for _, item := range lockOrder(items) {
+			reservation, err := holdStock(ctx, tx, item.ProductID, item.Quantity, ttl, cart.ID)
+			if err != nil {
+				return err
+			}
+			cart.Reservations = append(cart.Reservations, *reservation)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	invalidateProducts(requestProductIDs(CreateOrderRequest{Items: items})...)
+	return cart, nil
+}
+
+// ConvertCartToOrder places an order for userID with the cart's items and
+// closes the cart. The held units are handed over to the order in the same
+// serializable transaction, so they can't be taken by anyone else in between.
+// It fails with ErrReservationExpired if the cart has expired or was already
+// released or converted.
+func ConvertCartToOrder(ctx context.Context, db *sql.DB, cartID int64, userID int64) (*models.Order, error) {
+	var order *models.Order
+	var items []OrderItemRequest
+
+	err := database.WithRetry(ctx, db, database.TxOptions{
+		IsolationLevel: sql.LevelSerializable,
+		MaxRetries:     3,
+	}, func(tx *sql.Tx) error {
+		var err error
+		items, err = lockCart(ctx, tx, cartID, true)
+		if err != nil {
+			return err
+		}
+
+		// The order takes the units from stock itself, so the holds are
+		// released rather than consumed; the products stay locked.
+		if err := settleReservations(ctx, tx, "cart_id", cartID, false); err != nil {
+			return err
+		}
+
+		order, err = createOrder(ctx, tx, CreateOrderRequest{UserID: userID, Items: items})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx,
+			`UPDATE carts SET released_at = NOW(), order_id = $2 WHERE id = $1`,
+			cartID, order.ID)
+		if err != nil {
+			return fmt.Errorf("close cart: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	invalidateProducts(requestProductIDs(CreateOrderRequest{Items: items})...)
+
+	emitOrderEvent(OrderEvent{
+		OrderID:    order.ID,
+		NewStatus:  order.Status,
+		OccurredAt: order.CreatedAt,
+	})
+
+	return order, nil
+}
+
+// ReleaseCart returns the cart's held units to available stock and closes
+// the cart. It returns ErrReservationExpired if the cart was already released
+// or converted.
+func ReleaseCart(ctx context.Context, db *sql.DB, cartID int64) error {
+	var items []OrderItemRequest
+
+	err := database.WithRetry(ctx, db, database.DefaultTxOptions(), func(tx *sql.Tx) error {
+		var err error
+		items, err = lockCart(ctx, tx, cartID, false)
+		if err != nil {
+			return err
+		}
+
+		if err := settleReservations(ctx, tx, "cart_id", cartID, false); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE carts SET released_at = NOW() WHERE id = $1`, cartID)
+		if err != nil {
+			return fmt.Errorf("close cart: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	invalidateProducts(requestProductIDs(CreateOrderRequest{Items: items})...)
+	return nil
+}
+
+// lockCart locks an open cart and returns its items. With checkout set, it
+// also fails with ErrReservationExpired if the cart or any of its
+// reservations has expired.
+func lockCart(ctx context.Context, tx *sql.Tx, cartID int64, checkout bool) ([]OrderItemRequest, error) {
+	var released, expired bool
+	err := tx.QueryRowContext(ctx,
+		`SELECT released_at IS NOT NULL, expires_at <= NOW()
+		 FROM carts
+		 WHERE id = $1
+		 FOR UPDATE`,
+		cartID).Scan(&released, &expired)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, database.ErrCartNotFound
+		}
+		return nil, fmt.Errorf("lock cart: %w", err)
+	}
+
+	if released || (expired && checkout) {
+		return nil, database.ErrReservationExpired
+	}
+
+	rows, err := tx.QueryContext(ctx,
+		`SELECT product_id, quantity, released_at IS NULL
+		 FROM stock_reservations
+		 WHERE cart_id = $1
+		 ORDER BY product_id`,
+		cartID)
+	if err != nil {
+		return nil, fmt.Errorf("list cart reservations: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			return
+		}
+	}()
+
+	var items []OrderItemRequest
+	for rows.Next() {
+		var item OrderItemRequest
+		var open bool
+		if err := rows.Scan(&item.ProductID, &item.Quantity, &open); err != nil {
+			return nil, fmt.Errorf("scan cart reservation: %w", err)
+		}
+		if !open && checkout {
+			return nil, database.ErrReservationExpired
+		}
+		items = append(items, item)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return items, nil
+}
@@ -0,0 +1,77 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/safar/go-sql-store/internal/database"
+)
+
+// CursorIterate runs query through a server-side cursor and calls fn once per
+// row, with rows positioned on it; fn should only Scan. Rows are fetched
+// batchSize at a time, so only one batch is held in memory however large the
+// result, which suits exports of millions of rows.
+//
+// The cursor lives in a read-only transaction that stays open until the
+// iteration ends, which keeps its snapshot and holds back vacuum meanwhile.
+// The transaction is not retried, since fn may have had side effects. The
+// first error from fn stops the iteration and is returned.
+func CursorIterate(ctx context.Context, db *sql.DB, query string, args []interface{}, batchSize int, fn func(*sql.Rows) error) error {
+	if batchSize < 1 {
+		return fmt.Errorf("cursor batch size must be positive, got %d", batchSize)
+	}
+
+	opts := database.DefaultTxOptions()
+	opts.ReadOnly = true
+
+	return database.WithTransaction(ctx, db, opts, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DECLARE store_cursor NO SCROLL CURSOR FOR `+query, args...); err != nil {
+			return fmt.Errorf("declare cursor: %w", err)
+		}
+
+		fetch := fmt.Sprintf(`FETCH FORWARD %d FROM store_cursor`, batchSize)
+		for {
+			fetched, err := fetchBatch(ctx, tx, fetch, fn)
+			if err != nil {
+				return err
+			}
+			if fetched < batchSize {
+				break
+			}
+		}
+
+		if _, err := tx.ExecContext(ctx, `CLOSE store_cursor`); err != nil {
+			return fmt.Errorf("close cursor: %w", err)
+		}
+		return nil
+	})
+}
+
+// fetchBatch runs one FETCH, calls fn for each row and returns how many rows
+// it fetched.
+func fetchBatch(ctx context.Context, tx *sql.Tx, fetch string, fn func(*sql.Rows) error) (int, error) {
+	rows, err := tx.QueryContext(ctx, fetch)
+	if err != nil {
+		return 0, fmt.Errorf("fetch from cursor: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			return
+		}
+	}()
+
+	fetched := 0
+	for rows.Next() {
+		fetched++
+		if err := fn(rows); err != nil {
+			return fetched, err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fetched, fmt.Errorf("rows error: %w", err)
+	}
+
+	return fetched, nil
+}
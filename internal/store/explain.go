@@ -0,0 +1,110 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/safar/go-sql-store/internal/database"
+	"github.com/safar/go-sql-store/internal/models"
+)
+
+type explainQuery struct {
+	query string
+	args  func() []interface{}
+}
+
+// explainQueries are the only queries ExplainQuery runs. They mirror the
+// queries behind the list endpoints, with the arguments of a first page.
+var explainQueries = map[string]explainQuery{
+	"products": {
+		query: `SELECT ` + models.ProductColumns + `
+			FROM products
+			ORDER BY created_at DESC
+			LIMIT $1 OFFSET $2`,
+		args: func() []interface{} { return []interface{}{20, 0} },
+	},
+	"products-count": {
+		query: `SELECT COUNT(*) FROM products`,
+	},
+	"low-stock-products": {
+		query: `SELECT ` + models.ProductColumns + `
+			FROM products
+			WHERE stock_quantity < $1
+			ORDER BY stock_quantity, id`,
+		args: func() []interface{} { return []interface{}{10} },
+	},
+	"orders": {
+		query: `SELECT ` + models.OrderColumns + `
+			FROM orders
+			WHERE (created_at, id) < ($1, $2)
+			ORDER BY created_at DESC, id DESC
+			LIMIT $3`,
+		args: func() []interface{} { return []interface{}{time.Now(), int64(1<<63 - 1), 21} },
+	},
+	"orders-by-shipped-at": {
+		query: `SELECT ` + models.OrderColumns + `
+			FROM orders
+			ORDER BY shipped_at DESC NULLS LAST, id DESC
+			LIMIT $1`,
+		args: func() []interface{} { return []interface{}{21} },
+	},
+}
+
+// ExplainQueryNames lists the names ExplainQuery accepts, sorted.
+func ExplainQueryNames() []string {
+	names := make([]string, 0, len(explainQueries))
+	for name := range explainQueries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ExplainQuery runs EXPLAIN (ANALYZE, BUFFERS) on the named query and returns
+// the plan as text. ANALYZE executes the query, so it runs in a read-only
+// transaction. Unknown names fail with ErrUnknownQuery.
+func ExplainQuery(ctx context.Context, db *sql.DB, name string) (string, error) {
+	q, ok := explainQueries[name]
+	if !ok {
+		return "", database.ErrUnknownQuery
+	}
+
+	var args []interface{}
+	if q.args != nil {
+		args = q.args()
+	}
+
+	var lines []string
+	opts := database.TxOptions{IsolationLevel: sql.LevelReadCommitted, ReadOnly: true}
+	err := database.WithTransaction(ctx, db, opts, func(tx *sql.Tx) error {
+		lines = nil
+
+		rows, err := tx.QueryContext(ctx, `EXPLAIN (ANALYZE, BUFFERS) `+q.query, args...)
+		if err != nil {
+			return fmt.Errorf("explain %s: %w", name, err)
+		}
+		defer func() {
+			if err := rows.Close(); err != nil {
+				return
+			}
+		}()
+
+		for rows.Next() {
+			var line string
+			if err := rows.Scan(&line); err != nil {
+				return fmt.Errorf("scan plan: %w", err)
+			}
+			lines = append(lines, line)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
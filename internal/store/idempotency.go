@@ -0,0 +1,149 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/safar/go-sql-store/internal/database"
+)
+
+type IdempotencyRecord struct {
+	StatusCode  int
+	ContentType string
+	Body        []byte
+	Completed   bool
+	CreatedAt   time.Time
+}
+
+// IdempotencyClaim is one caller's hold on an idempotency key. Only its
+// holder can complete or release the key, so a request that outlives its
+// lease can't overwrite or delete the claim of the retry that took over.
+type IdempotencyClaim struct {
+	Method string
+	Path   string
+	Key    string
+
+	lockedUntil time.Time
+}
+
+// maxClaimAttempts bounds how often ClaimIdempotencyKey retries when the
+// stored key disappears between its insert and its read.
+const maxClaimAttempts = 3
+
+// ClaimIdempotencyKey reserves key for the caller. It returns a claim when
+// the caller should execute the request, otherwise the stored record, which
+// is incomplete while the original request is still running.
+//
+// requestHash identifies the request the key is used for; a key already
+// claimed with a different hash fails with ErrIdempotencyKeyReused. An
+// in-progress claim holds the key for lease, so a request that died without
+// completing or releasing it doesn't block the key for the whole ttl.
+func ClaimIdempotencyKey(ctx context.Context, db *sql.DB, method, path, key string, requestHash []byte, ttl, lease time.Duration) (*IdempotencyRecord, *IdempotencyClaim, error) {
+	for attempt := 0; attempt < maxClaimAttempts; attempt++ {
+		record, claim, err := claimIdempotencyKey(ctx, db, method, path, key, requestHash, ttl, lease)
+		if record != nil || claim != nil || err != nil {
+			return record, claim, err
+		}
+	}
+	return nil, nil, fmt.Errorf("claim idempotency key: key changed %d times while claiming", maxClaimAttempts)
+}
+
+// claimIdempotencyKey makes one claim attempt. It returns neither a record
+// nor a claim if the key was deleted before it could be read.
+func claimIdempotencyKey(ctx context.Context, db *sql.DB, method, path, key string, requestHash []byte, ttl, lease time.Duration) (*IdempotencyRecord, *IdempotencyClaim, error) {
+	_, err := db.ExecContext(ctx,
+		`DELETE FROM idempotency_keys
+		 WHERE method = $1 AND path = $2 AND idempotency_key = $3
+		   AND (created_at < NOW() - make_interval(secs => $4)
+		        OR (completed_at IS NULL AND locked_until < NOW()))`,
+		method, path, key, ttl.Seconds())
+	if err != nil {
+		return nil, nil, fmt.Errorf("expire idempotency key: %w", err)
+	}
+
+	claim := &IdempotencyClaim{Method: method, Path: path, Key: key}
+	err = db.QueryRowContext(ctx,
+		`INSERT INTO idempotency_keys (method, path, idempotency_key, request_hash, created_at, locked_until)
+		 VALUES ($1, $2, $3, $4, NOW(), NOW() + make_interval(secs => $5))
+		 ON CONFLICT DO NOTHING
+		 RETURNING locked_until`,
+		method, path, key, requestHash, lease.Seconds()).Scan(&claim.lockedUntil)
+	if err == nil {
+		return nil, claim, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, nil, fmt.Errorf("claim idempotency key: %w", err)
+	}
+
+	record := &IdempotencyRecord{}
+	var statusCode sql.NullInt64
+	var contentType sql.NullString
+	var storedHash []byte
+
+	err = db.QueryRowContext(ctx,
+		`SELECT status_code, content_type, response_body, created_at, request_hash
+		 FROM idempotency_keys
+		 WHERE method = $1 AND path = $2 AND idempotency_key = $3`,
+		method, path, key).Scan(&statusCode, &contentType, &record.Body, &record.CreatedAt, &storedHash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil, nil
+		}
+		return nil, nil, fmt.Errorf("get idempotency key: %w", err)
+	}
+
+	if storedHash != nil && !bytes.Equal(storedHash, requestHash) {
+		return nil, nil, database.ErrIdempotencyKeyReused
+	}
+
+	record.StatusCode = int(statusCode.Int64)
+	record.ContentType = contentType.String
+	record.Completed = statusCode.Valid
+
+	return record, nil, nil
+}
+
+// CompleteIdempotencyKey stores the response for claim. It fails with
+// ErrIdempotencyClaimLost if the claim's lease ran out and another request
+// took the key over.
+func CompleteIdempotencyKey(ctx context.Context, db *sql.DB, claim *IdempotencyClaim, statusCode int, contentType string, body []byte) error {
+	result, err := db.ExecContext(ctx,
+		`UPDATE idempotency_keys
+		 SET status_code = $5, content_type = $6, response_body = $7, completed_at = NOW()
+		 WHERE method = $1 AND path = $2 AND idempotency_key = $3
+		   AND locked_until = $4 AND completed_at IS NULL`,
+		claim.Method, claim.Path, claim.Key, claim.lockedUntil, statusCode, contentType, body)
+	if err != nil {
+		return fmt.Errorf("complete idempotency key: %w", err)
+	}
+	return checkClaimHeld(result)
+}
+
+// ReleaseIdempotencyKey gives up claim so the request can be retried. Like
+// CompleteIdempotencyKey, it leaves a key claimed by another request alone
+// and reports ErrIdempotencyClaimLost.
+func ReleaseIdempotencyKey(ctx context.Context, db *sql.DB, claim *IdempotencyClaim) error {
+	result, err := db.ExecContext(ctx,
+		`DELETE FROM idempotency_keys
+		 WHERE method = $1 AND path = $2 AND idempotency_key = $3
+		   AND locked_until = $4 AND completed_at IS NULL`,
+		claim.Method, claim.Path, claim.Key, claim.lockedUntil)
+	if err != nil {
+		return fmt.Errorf("release idempotency key: %w", err)
+	}
+	return checkClaimHeld(result)
+}
+
+func checkClaimHeld(result sql.Result) error {
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return database.ErrIdempotencyClaimLost
+	}
+	return nil
+}
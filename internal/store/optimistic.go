@@ -0,0 +1,40 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/safar/go-sql-store/internal/database"
+)
+
+// optimisticRetryBackoff is the pause before WithOptimisticRetry's first
+// retry; it doubles after each one.
+var optimisticRetryBackoff = 10 * time.Millisecond
+
+// WithOptimisticRetry runs fn up to maxAttempts times while it fails with
+// ErrOptimisticLockFailed. fn should be the whole read-modify-write, such as
+// GetProduct followed by UpdateStockOptimistic, so every attempt re-reads the
+// row and writes against its current version. Attempts are separated by a
+// short jittered backoff. Any other error, or the conflict from the last
+// attempt, is returned as is.
+func WithOptimisticRetry(ctx context.Context, maxAttempts int, fn func() error) error {
+	backoff := optimisticRetryBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if !errors.Is(err, database.ErrOptimisticLockFailed) || attempt >= maxAttempts {
+			return err
+		}
+
+		timer := time.NewTimer(backoff + rand.N(backoff/2+1))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,91 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/safar/go-sql-store/internal/database"
+)
+
+func TestWithOptimisticRetry(t *testing.T) {
+	defer func(backoff time.Duration) { optimisticRetryBackoff = backoff }(optimisticRetryBackoff)
+	optimisticRetryBackoff = time.Millisecond
+
+	otherErr := errors.New("boom")
+
+	tests := []struct {
+		name         string
+		maxAttempts  int
+		failures     []error
+		wantErr      error
+		wantAttempts int
+	}{
+		{
+			name:         "succeeds after two conflicts",
+			maxAttempts:  5,
+			failures:     []error{database.ErrOptimisticLockFailed, database.ErrOptimisticLockFailed},
+			wantAttempts: 3,
+		},
+		{
+			name:         "gives up after max attempts",
+			maxAttempts:  3,
+			failures:     []error{database.ErrOptimisticLockFailed, database.ErrOptimisticLockFailed, database.ErrOptimisticLockFailed, database.ErrOptimisticLockFailed},
+			wantErr:      database.ErrOptimisticLockFailed,
+			wantAttempts: 3,
+		},
+		{
+			name:         "other errors are not retried",
+			maxAttempts:  3,
+			failures:     []error{otherErr},
+			wantErr:      otherErr,
+			wantAttempts: 1,
+		},
+		{
+			name:         "zero max attempts still runs once",
+			maxAttempts:  0,
+			failures:     []error{database.ErrOptimisticLockFailed},
+			wantErr:      database.ErrOptimisticLockFailed,
+			wantAttempts: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			err := WithOptimisticRetry(context.Background(), tt.maxAttempts, func() error {
+				attempts++
+				if attempts <= len(tt.failures) {
+					return tt.failures[attempts-1]
+				}
+				return nil
+			})
+
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Errorf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("Expected %d attempts, got %d", tt.wantAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestWithOptimisticRetryStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	attempts := 0
+	err := WithOptimisticRetry(ctx, 5, func() error {
+		attempts++
+		cancel()
+		return database.ErrOptimisticLockFailed
+	})
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("Expected 1 attempt, got %d", attempts)
+	}
+}
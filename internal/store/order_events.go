@@ -0,0 +1,63 @@
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+type OrderEvent struct {
+	OrderID    int64     `json:"order_id"`
+	OldStatus  string    `json:"old_status,omitempty"`
+	NewStatus  string    `json:"new_status"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+// OrderEventHook is called after the transaction that created or changed an
+// order has committed. Hooks run synchronously on the caller's goroutine, so a
+// hook that does slow work (such as an HTTP webhook) should hand the event off
+// to its own queue.
+type OrderEventHook func(event OrderEvent)
+
+type registeredOrderEventHook struct {
+	id   int
+	hook OrderEventHook
+}
+
+var (
+	orderEventHooksMu sync.RWMutex
+	orderEventHooks   []registeredOrderEventHook
+	nextOrderEventID  int
+)
+
+// RegisterOrderEventHook adds hook and returns a function that removes it.
+// Hooks are called in registration order.
+func RegisterOrderEventHook(hook OrderEventHook) (unregister func()) {
+	orderEventHooksMu.Lock()
+	defer orderEventHooksMu.Unlock()
+
+	id := nextOrderEventID
+	nextOrderEventID++
+	orderEventHooks = append(orderEventHooks, registeredOrderEventHook{id: id, hook: hook})
+
+	return func() {
+		orderEventHooksMu.Lock()
+		defer orderEventHooksMu.Unlock()
+
+		for i, registered := range orderEventHooks {
+			if registered.id == id {
+				orderEventHooks = append(orderEventHooks[:i:i], orderEventHooks[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func emitOrderEvent(event OrderEvent) {
+	orderEventHooksMu.RLock()
+	hooks := orderEventHooks
+	orderEventHooksMu.RUnlock()
+
+	for _, registered := range hooks {
+		registered.hook(event)
+	}
+}
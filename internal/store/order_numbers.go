@@ -0,0 +1,65 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	OrderNumberStrategyTimestamp = "timestamp"
+	OrderNumberStrategySequence  = "sequence"
+	OrderNumberStrategyULID      = "ulid"
+)
+
+type OrderNumberGenerator interface {
+	NextOrderNumber(ctx context.Context, tx *sql.Tx) (string, error)
+}
+
+var DefaultOrderNumberGenerator OrderNumberGenerator = TimestampOrderNumberGenerator{Prefix: "ORD-"}
+
+func NewOrderNumberGenerator(strategy, prefix string) (OrderNumberGenerator, error) {
+	switch strategy {
+	case OrderNumberStrategyTimestamp:
+		return TimestampOrderNumberGenerator{Prefix: prefix}, nil
+	case OrderNumberStrategySequence:
+		return SequenceOrderNumberGenerator{Prefix: prefix}, nil
+	case OrderNumberStrategyULID:
+		return ULIDOrderNumberGenerator{Prefix: prefix}, nil
+	default:
+		return nil, fmt.Errorf("unknown order number strategy %q", strategy)
+	}
+}
+
+type TimestampOrderNumberGenerator struct {
+	Prefix string
+}
+
+func (g TimestampOrderNumberGenerator) NextOrderNumber(ctx context.Context, tx *sql.Tx) (string, error) {
+	return fmt.Sprintf("%s%d", g.Prefix, time.Now().UnixNano()), nil
+}
+
+// SequenceOrderNumberGenerator draws from order_number_seq, so numbers are
+// unique across all application instances sharing the database.
+type SequenceOrderNumberGenerator struct {
+	Prefix string
+}
+
+func (g SequenceOrderNumberGenerator) NextOrderNumber(ctx context.Context, tx *sql.Tx) (string, error) {
+	var next int64
+	if err := tx.QueryRowContext(ctx, `SELECT nextval('order_number_seq')`).Scan(&next); err != nil {
+		return "", fmt.Errorf("next order number: %w", err)
+	}
+	return fmt.Sprintf("%s%010d", g.Prefix, next), nil
+}
+
+type ULIDOrderNumberGenerator struct {
+	Prefix string
+}
+
+func (g ULIDOrderNumberGenerator) NextOrderNumber(ctx context.Context, tx *sql.Tx) (string, error) {
+	return g.Prefix + ulid.Make().String(), nil
+}
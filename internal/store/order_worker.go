@@ -0,0 +1,80 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/safar/go-sql-store/internal/database"
+	"github.com/safar/go-sql-store/internal/models"
+)
+
+// OrderHandler processes a claimed pending order inside the claiming
+// transaction. It must move the order out of pending, or the worker will
+// claim it again.
+type OrderHandler func(ctx context.Context, tx *sql.Tx, order *models.Order) error
+
+// maxSkippedOrders caps how many failed orders RunOrderWorker passes over.
+// Once it is reached the list is cleared, so the skipped orders are tried
+// again rather than the list growing for as long as the worker runs.
+const maxSkippedOrders = 1000
+
+// RunOrderWorker claims pending orders one at a time and passes each to
+// handler, retrying the claim and handler together on transient errors. When
+// the queue is empty it sleeps pollInterval. If handler still fails, the
+// order is rolled back to pending, onError (which may be nil) is called with
+// it, and the worker passes over it, so one bad order can't stop the queue.
+// Skipped orders are retried after maxSkippedOrders failures or a restart.
+// It returns nil once ctx is cancelled, or the first claim error that
+// WithRetry gives up on.
+func RunOrderWorker(ctx context.Context, db *sql.DB, handler OrderHandler, pollInterval time.Duration, onError func(order *models.Order, err error)) error {
+	var failed []int64
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		var claimed *models.Order
+		err := database.WithRetry(ctx, db, database.DefaultTxOptions(), func(tx *sql.Tx) error {
+			claimed = nil
+
+			order, err := claimNextPendingOrder(ctx, tx, failed)
+			if errors.Is(err, database.ErrOrderNotFound) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			claimed = order
+			return handler(ctx, tx, order)
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if claimed == nil {
+				return err
+			}
+			if onError != nil {
+				onError(claimed, err)
+			}
+			if len(failed) >= maxSkippedOrders {
+				failed = failed[:0]
+			}
+			failed = append(failed, claimed.ID)
+			continue
+		}
+
+		if claimed != nil {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(pollInterval):
+		}
+	}
+}
@@ -3,7 +3,11 @@ package store
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/safar/go-sql-store/internal/database"
@@ -12,8 +16,49 @@ import (
 )
 
 type CreateOrderRequest struct {
-	UserID int64
-	Items  []OrderItemRequest
+	UserID       int64
+	Items        []OrderItemRequest
+	OrderNumbers OrderNumberGenerator
+
+	// IsolationLevel overrides the default Serializable; see docs/patterns.md.
+	IsolationLevel sql.IsolationLevel
+
+	// ReserveOnly holds stock for the items instead of taking it. ConfirmOrder
+	// later converts the hold into a permanent decrement.
+	ReserveOnly bool
+
+	// LockMode selects how product rows are locked. The default, LockNoWait,
+	// fails immediately on a contended row; LockWait queues behind the holder,
+	// bounded by LockTimeout when it is positive, rounded up to whole
+	// milliseconds. A NOWAIT failure and an expired lock_timeout are both
+	// SQLSTATE 55P03 and are retried.
+	LockMode    LockMode
+	LockTimeout time.Duration
+
+	// DryRun runs every check and computes the prices and total as usual, then
+	// rolls the transaction back. CreateOrder returns the would-be order with
+	// its items but without IDs or an order number. Stock and reservations are
+	// left untouched, though a sequence-based order number is still consumed.
+	// CreateOrdersBatch rejects it.
+	DryRun bool
+}
+
+// errDryRun rolls back a dry-run CreateOrder transaction.
+var errDryRun = errors.New("dry run")
+
+type LockMode int
+
+const (
+	LockNoWait LockMode = iota
+	LockWait
+)
+
+// lockClause returns the row-locking clause for mode.
+func (m LockMode) lockClause() string {
+	if m == LockWait {
+		return "FOR UPDATE"
+	}
+	return "FOR UPDATE NOWAIT"
 }
 
 type OrderItemRequest struct {
@@ -21,148 +66,1012 @@ type OrderItemRequest struct {
 	Quantity  int
 }
 
-func generateOrderNumber() string {
-	return fmt.Sprintf("ORD-%d", time.Now().UnixNano())
+const maxOrderNumberAttempts = 5
+
+// orderTotalLimit is the largest value orders.total_amount, a
+// DECIMAL(10, 2), can hold.
+var orderTotalLimit = decimal.RequireFromString("99999999.99")
+
+var (
+	// MaxOrderTotal caps an order's total. Set it with SetOrderLimits, which
+	// keeps it within orderTotalLimit so oversized totals are rejected
+	// instead of failing on insert with a numeric overflow.
+	MaxOrderTotal = orderTotalLimit
+
+	// MaxItemQuantity caps the quantity of a single order item.
+	MaxItemQuantity = 10000
+)
+
+// SetOrderLimits sets MaxOrderTotal and MaxItemQuantity. maxTotal must be
+// positive and at most 99999999.99, and maxItemQuantity positive; otherwise
+// no order could be placed, or an oversized one would overflow the column.
+// Call it once at startup.
+func SetOrderLimits(maxTotal decimal.Decimal, maxItemQuantity int) error {
+	if !maxTotal.IsPositive() || maxTotal.GreaterThan(orderTotalLimit) {
+		return fmt.Errorf("max order total must be in (0, %s], got %s", orderTotalLimit, maxTotal)
+	}
+	if maxItemQuantity <= 0 {
+		return fmt.Errorf("max item quantity must be positive, got %d", maxItemQuantity)
+	}
+
+	MaxOrderTotal = maxTotal
+	MaxItemQuantity = maxItemQuantity
+	return nil
+}
+
+// lockOrder returns items sorted by product ID. Locking products in a single
+// global order keeps two orders over the same products from deadlocking.
+func lockOrder(items []OrderItemRequest) []OrderItemRequest {
+	sorted := make([]OrderItemRequest, len(items))
+	copy(sorted, items)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].ProductID < sorted[j].ProductID })
+	return sorted
+}
+
+// insertOrder regenerates the order number when it collides with an existing
+// one. ON CONFLICT keeps the collision from aborting the surrounding transaction.
+func insertOrder(ctx context.Context, tx *sql.Tx, orderNumbers OrderNumberGenerator, userID int64, totalAmount decimal.Decimal, currency string) (int64, error) {
+	for attempt := 0; attempt < maxOrderNumberAttempts; attempt++ {
+		orderNumber, err := orderNumbers.NextOrderNumber(ctx, tx)
+		if err != nil {
+			return 0, err
+		}
+
+		var orderID int64
+		err = tx.QueryRowContext(ctx,
+			`INSERT INTO orders (user_id, order_number, status, total_amount, currency, created_at, updated_at, version)
+			 VALUES ($1, $2, $3, $4, $5, NOW(), NOW(), 1)
+			 ON CONFLICT (order_number) DO NOTHING
+			 RETURNING id`,
+			userID, orderNumber, models.OrderStatusPending, totalAmount, currency).Scan(&orderID)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("create order: %w", err)
+		}
+
+		return orderID, nil
+	}
+
+	return 0, database.ErrOrderNumberConflict
 }
 
 func CreateOrder(ctx context.Context, db *sql.DB, req CreateOrderRequest) (*models.Order, error) {
+	if err := validateCreateOrder(req); err != nil {
+		return nil, err
+	}
+
 	var order *models.Order
 
+	isolation := req.IsolationLevel
+	if isolation == sql.LevelDefault {
+		isolation = sql.LevelSerializable
+	}
+
 	err := database.WithRetry(ctx, db, database.TxOptions{
-		IsolationLevel: sql.LevelSerializable,
+		IsolationLevel: isolation,
 		MaxRetries:     3,
 	}, func(tx *sql.Tx) error {
-		var exists bool
+		var err error
+		order, err = createOrder(ctx, tx, req)
+		if err != nil || !req.DryRun {
+			return err
+		}
+
+		order, err = GetOrder(ctx, tx, order.ID)
+		if err != nil {
+			return err
+		}
+		return errDryRun
+	})
+
+	if errors.Is(err, errDryRun) {
+		order.ID = 0
+		order.OrderNumber = ""
+		for i := range order.Items {
+			order.Items[i].ID = 0
+			order.Items[i].OrderID = 0
+		}
+		return order, nil
+	}
+	if database.IsNumericOutOfRange(err) {
+		return nil, database.ErrNumericOutOfRange
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	invalidateProducts(requestProductIDs(req)...)
+
+	emitOrderEvent(OrderEvent{
+		OrderID:    order.ID,
+		NewStatus:  order.Status,
+		OccurredAt: order.CreatedAt,
+	})
+
+	return order, nil
+}
+
+// createOrder does the work of CreateOrder inside tx.
+func createOrder(ctx context.Context, tx *sql.Tx, req CreateOrderRequest) (*models.Order, error) {
+	var exists bool
+	err := tx.QueryRowContext(ctx,
+		"SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)",
+		req.UserID).Scan(&exists)
+	if err != nil {
+		return nil, fmt.Errorf("check user exists: %w", err)
+	}
+	if !exists {
+		return nil, database.ErrUserNotFound
+	}
+
+	if req.LockMode == LockWait && req.LockTimeout > 0 {
+		_, err := tx.ExecContext(ctx, `SELECT set_config('lock_timeout', $1, true)`,
+			database.TimeoutSetting(req.LockTimeout))
+		if err != nil {
+			return nil, fmt.Errorf("set lock timeout: %w", err)
+		}
+	}
+
+	var totalAmount decimal.Decimal
+	var currency string
+	productPrices := make(map[int64]decimal.Decimal)
+	productNames := make(map[int64]string)
+
+	for _, item := range lockOrder(req.Items) {
+		var productID int64
+		var productName string
+		var price decimal.Decimal
+		var availableQuantity int
+		var productCurrency string
+
 		err := tx.QueryRowContext(ctx,
-			"SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)",
-			req.UserID).Scan(&exists)
+			`SELECT id, name, price, stock_quantity - reserved_quantity, currency
+			 FROM products
+			 WHERE id = $1
+			 `+req.LockMode.lockClause(),
+			item.ProductID).Scan(&productID, &productName, &price, &availableQuantity, &productCurrency)
 		if err != nil {
-			return fmt.Errorf("check user exists: %w", err)
+			if err == sql.ErrNoRows {
+				return nil, database.ErrProductNotFound
+			}
+			return nil, fmt.Errorf("lock product %d: %w", item.ProductID, err)
 		}
-		if !exists {
-			return database.ErrUserNotFound
+
+		if availableQuantity < item.Quantity {
+			return nil, database.ErrInsufficientStock
 		}
 
-		var totalAmount decimal.Decimal
-		productPrices := make(map[int64]decimal.Decimal)
+		if currency == "" {
+			currency = productCurrency
+		} else if productCurrency != currency {
+			return nil, database.ErrMixedCurrency
+		}
 
-		for _, item := range req.Items {
-			var productID int64
-			var price decimal.Decimal
-			var stockQuantity int
-
-			err := tx.QueryRowContext(ctx,
-				`SELECT id, price, stock_quantity
-				 FROM products
-				 WHERE id = $1
-				 FOR UPDATE NOWAIT`,
-				item.ProductID).Scan(&productID, &price, &stockQuantity)
+		productPrices[item.ProductID] = price
+		productNames[item.ProductID] = productName
+		totalAmount = totalAmount.Add(price.Mul(decimal.NewFromInt(int64(item.Quantity))))
+		if totalAmount.GreaterThan(MaxOrderTotal) {
+			return nil, database.ErrOrderTotalTooLarge
+		}
+	}
+
+	if currency == "" {
+		currency = models.DefaultCurrency
+	}
+
+	orderNumbers := req.OrderNumbers
+	if orderNumbers == nil {
+		orderNumbers = DefaultOrderNumberGenerator
+	}
+
+	orderID, err := insertOrder(ctx, tx, orderNumbers, req.UserID, totalAmount, currency)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := insertOrderItems(ctx, tx, orderID, req.Items, productPrices, productNames); err != nil {
+		return nil, err
+	}
+
+	if req.ReserveOnly {
+		err = holdOrderStock(ctx, tx, orderID, req.Items)
+	} else {
+		err = DecrementStockBatch(ctx, tx, req.Items)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := models.ScanOrder(tx.QueryRowContext(ctx,
+		`SELECT `+models.OrderColumns+`
+		 FROM orders WHERE id = $1`,
+		orderID))
+	if err != nil {
+		return nil, fmt.Errorf("fetch created order: %w", err)
+	}
+
+	return order, nil
+}
+
+// insertOrderItems inserts every item of an order in one statement, at the
+// prices and names read when the products were locked.
+func insertOrderItems(ctx context.Context, tx *sql.Tx, orderID int64, items []OrderItemRequest, prices map[int64]decimal.Decimal, names map[int64]string) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	values := make([]string, 0, len(items))
+	args := []interface{}{orderID}
+	for _, item := range items {
+		unitPrice := prices[item.ProductID]
+		subtotal := unitPrice.Mul(decimal.NewFromInt(int64(item.Quantity)))
+
+		n := len(args)
+		values = append(values, fmt.Sprintf("($1, $%d, $%d, $%d, $%d, NOW(), $%d)", n+1, n+2, n+3, n+4, n+5))
+		args = append(args, item.ProductID, item.Quantity, unitPrice, subtotal, names[item.ProductID])
+	}
+
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO order_items (order_id, product_id, quantity, unit_price, subtotal, created_at, product_name)
+		 VALUES `+strings.Join(values, ", "),
+		args...)
+	if err != nil {
+		return fmt.Errorf("create order items: %w", err)
+	}
+	return nil
+}
+
+// CreateOrdersBatch creates every order in reqs in one serializable
+// transaction, so either all of them are created or none are. The products of
+// the whole batch are locked up front in ID order, waiting on contended rows;
+// the single global order keeps concurrent batches and orders from
+// deadlocking. The requests' IsolationLevel is ignored. A failing request is
+// reported with its index in reqs.
+func CreateOrdersBatch(ctx context.Context, db *sql.DB, reqs []CreateOrderRequest) ([]*models.Order, error) {
+	var errs ValidationErrors
+	for i, req := range reqs {
+		if req.DryRun {
+			errs.add(fmt.Sprintf("orders[%d].dry_run", i), "is not supported in a batch", nil)
+		}
+		var reqErrs ValidationErrors
+		if errors.As(validateCreateOrder(req), &reqErrs) {
+			for _, fieldErr := range reqErrs {
+				fieldErr.Field = fmt.Sprintf("orders[%d].%s", i, fieldErr.Field)
+				errs = append(errs, fieldErr)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	productIDs := requestProductIDs(reqs...)
+	var orders []*models.Order
+
+	err := database.WithRetry(ctx, db, database.TxOptions{
+		IsolationLevel: sql.LevelSerializable,
+		MaxRetries:     3,
+	}, func(tx *sql.Tx) error {
+		orders = make([]*models.Order, 0, len(reqs))
+
+		condition, arg := anyOf("id", 1, productIDs)
+		_, err := tx.ExecContext(ctx,
+			`SELECT id FROM products WHERE `+condition+` ORDER BY id FOR UPDATE`,
+			arg)
+		if err != nil {
+			return fmt.Errorf("lock batch products: %w", err)
+		}
+
+		for i, req := range reqs {
+			order, err := createOrder(ctx, tx, req)
+			if err != nil {
+				return fmt.Errorf("order %d: %w", i, err)
+			}
+			orders = append(orders, order)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	invalidateProducts(productIDs...)
+
+	for _, order := range orders {
+		emitOrderEvent(OrderEvent{
+			OrderID:    order.ID,
+			NewStatus:  order.Status,
+			OccurredAt: order.CreatedAt,
+		})
+	}
+
+	return orders, nil
+}
+
+// BatchOptions changes how a batch treats failing items.
+type BatchOptions struct {
+	// ContinueOnError makes the batch best-effort: each item runs in its own
+	// transaction, and a failing item is reported in its result instead of
+	// failing the whole batch.
+	ContinueOnError bool
+}
+
+// OrderBatchResult is the outcome of reqs[Index] in a batch: Order on
+// success, Err otherwise.
+type OrderBatchResult struct {
+	Index int
+	Order *models.Order
+	Err   error
+}
+
+// CreateOrdersBatchWithOptions is CreateOrdersBatch with per-item results.
+// Without ContinueOnError it is all-or-nothing like CreateOrdersBatch and
+// returns the batch's error. With it, every request is placed with
+// CreateOrder on its own, in order, and the error is always nil; the results
+// say which requests failed and why. Orders created before a failure stay.
+func CreateOrdersBatchWithOptions(ctx context.Context, db *sql.DB, reqs []CreateOrderRequest, opts BatchOptions) ([]OrderBatchResult, error) {
+	results := make([]OrderBatchResult, len(reqs))
+
+	if !opts.ContinueOnError {
+		orders, err := CreateOrdersBatch(ctx, db, reqs)
+		if err != nil {
+			return nil, err
+		}
+		for i, order := range orders {
+			results[i] = OrderBatchResult{Index: i, Order: order}
+		}
+		return results, nil
+	}
+
+	for i, req := range reqs {
+		results[i].Index = i
+		if req.DryRun {
+			var errs ValidationErrors
+			errs.add("dry_run", "is not supported in a batch", nil)
+			results[i].Err = errs
+			continue
+		}
+		results[i].Order, results[i].Err = CreateOrder(ctx, db, req)
+	}
+
+	return results, nil
+}
+
+// expireOrdersBatchSize is how many orders ExpirePendingOrders cancels per
+// transaction.
+const expireOrdersBatchSize = 100
+
+// ExpirePendingOrders cancels pending orders created before olderThan and
+// gives their stock back: held units of reserve-only orders are released and
+// decremented stock is added back. It works through them
+// expireOrdersBatchSize at a time, each batch in its own transaction, so a
+// large backlog doesn't hold locks for long. Orders locked by someone else,
+// e.g. being confirmed, are skipped and left for the next run. It returns how
+// many orders were cancelled, including those of batches committed before an
+// error.
+func ExpirePendingOrders(ctx context.Context, db *sql.DB, olderThan time.Time) (int64, error) {
+	var expired int64
+
+	for {
+		var cancelled []*models.Order
+		var productIDs []int64
+
+		err := database.WithRetry(ctx, db, database.DefaultTxOptions(), func(tx *sql.Tx) error {
+			cancelled = nil
+			productIDs = nil
+
+			orders, err := lockExpiredOrders(ctx, tx, olderThan)
+			if err != nil || len(orders) == 0 {
+				return err
+			}
+
+			orderIDs := make([]int64, len(orders))
+			for i, order := range orders {
+				orderIDs[i] = order.ID
+			}
+			productIDs, err = lockOrdersProducts(ctx, tx, orderIDs)
 			if err != nil {
-				if err == sql.ErrNoRows {
-					return database.ErrProductNotFound
+				return err
+			}
+
+			for _, order := range orders {
+				updated, err := transitionOrder(ctx, tx, order, models.OrderStatusCancelled, nil)
+				if err != nil {
+					return fmt.Errorf("expire order %d: %w", order.ID, err)
 				}
-				return fmt.Errorf("lock product %d: %w", item.ProductID, err)
+				cancelled = append(cancelled, updated)
 			}
+			return nil
+		})
+		if err != nil {
+			return expired, err
+		}
+
+		invalidateProducts(productIDs...)
+		for _, order := range cancelled {
+			emitOrderEvent(OrderEvent{
+				OrderID:    order.ID,
+				OldStatus:  models.OrderStatusPending,
+				NewStatus:  order.Status,
+				OccurredAt: order.UpdatedAt,
+			})
+		}
 
-			if stockQuantity < item.Quantity {
-				return database.ErrInsufficientStock
+		expired += int64(len(cancelled))
+		if len(cancelled) < expireOrdersBatchSize {
+			return expired, nil
+		}
+	}
+}
+
+// lockExpiredOrders locks the next batch of pending orders created before
+// olderThan, skipping locked ones.
+func lockExpiredOrders(ctx context.Context, tx *sql.Tx, olderThan time.Time) ([]*models.Order, error) {
+	rows, err := tx.QueryContext(ctx,
+		`SELECT `+models.OrderColumns+`
+		 FROM orders
+		 WHERE status = $1 AND created_at < $2
+		 ORDER BY id
+		 LIMIT $3
+		 FOR UPDATE SKIP LOCKED`,
+		models.OrderStatusPending, olderThan, expireOrdersBatchSize)
+	if err != nil {
+		return nil, fmt.Errorf("lock expired orders: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			return
+		}
+	}()
+
+	var orders []*models.Order
+	for rows.Next() {
+		order, err := models.ScanOrder(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan order: %w", err)
+		}
+		orders = append(orders, order)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return orders, nil
+}
+
+// lockOrdersProducts locks the products of the given orders in ID order and
+// returns their IDs.
+func lockOrdersProducts(ctx context.Context, tx *sql.Tx, orderIDs []int64) ([]int64, error) {
+	condition, arg := anyOf("order_id", 1, orderIDs)
+	rows, err := tx.QueryContext(ctx,
+		`SELECT id
+		 FROM products
+		 WHERE id IN (SELECT product_id FROM order_items WHERE `+condition+`)
+		 ORDER BY id
+		 FOR UPDATE`,
+		arg)
+	if err != nil {
+		return nil, fmt.Errorf("lock order products: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			return
+		}
+	}()
+
+	var productIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("scan product id: %w", err)
+		}
+		productIDs = append(productIDs, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return productIDs, nil
+}
+
+func requestProductIDs(reqs ...CreateOrderRequest) []int64 {
+	var productIDs []int64
+	for _, req := range reqs {
+		for _, item := range req.Items {
+			productIDs = append(productIDs, item.ProductID)
+		}
+	}
+	return productIDs
+}
+
+// UpdateOrderStatus moves an order to newStatus if the transition is allowed.
+// Cancelling an order returns its items to stock. A status outside
+// models.OrderStatuses fails with ErrInvalidOrderStatus. Shipping needs a
+// tracking number, so it goes through ShipOrder and is refused here with
+// ErrInvalidStatusTransition.
+func UpdateOrderStatus(ctx context.Context, db *sql.DB, orderID int64, newStatus string) (*models.Order, error) {
+	if !models.IsValidOrderStatus(newStatus) {
+		return nil, database.ErrInvalidOrderStatus
+	}
+	if newStatus == models.OrderStatusShipped {
+		return nil, database.ErrInvalidStatusTransition
+	}
+	return changeOrderStatus(ctx, db, database.DefaultTxOptions(), orderID, newStatus, 0, nil)
+}
+
+// ConfirmOrder moves a pending order to confirmed. For a reserve-only order
+// the held stock is taken permanently in the same serializable transaction.
+// It fails with ErrInvalidStatusTransition if the order is not pending and
+// with ErrReservationExpired if its reservations were already released.
+func ConfirmOrder(ctx context.Context, db *sql.DB, orderID int64, version int) (*models.Order, error) {
+	opts := database.TxOptions{IsolationLevel: sql.LevelSerializable, MaxRetries: 3}
+	return changeOrderStatus(ctx, db, opts, orderID, models.OrderStatusConfirmed, version, nil)
+}
+
+// ShipOrder moves a confirmed order to shipped and records its tracking
+// number. version is required; it fails with ErrOptimisticLockFailed if it
+// is stale and with ErrInvalidStatusTransition if the order is not confirmed.
+func ShipOrder(ctx context.Context, db *sql.DB, orderID int64, trackingNumber string, version int) (*models.Order, error) {
+	if version < 1 {
+		var errs ValidationErrors
+		errs.add("version", "must be a positive version", nil)
+		return nil, errs
+	}
+
+	trackingNumber = strings.TrimSpace(trackingNumber)
+	if err := validateTrackingNumber(trackingNumber); err != nil {
+		return nil, err
+	}
+
+	return changeOrderStatus(ctx, db, database.DefaultTxOptions(), orderID, models.OrderStatusShipped, version, &trackingNumber)
+}
+
+// RepriceOrder sets every item of a pending order to its product's current
+// price and recomputes the subtotals and the order total, e.g. before
+// confirming an order whose cart sat while prices changed. It fails with
+// ErrOrderNotPending once the order has moved on, with
+// ErrOptimisticLockFailed if version is non-zero and stale, and, like
+// CreateOrder, with ErrMixedCurrency or ErrOrderTotalTooLarge if the current
+// prices don't fit the order. The products are share-locked until commit so
+// the prices can't change underneath it.
+func RepriceOrder(ctx context.Context, db *sql.DB, orderID int64, version int) (*models.Order, error) {
+	var order *models.Order
+
+	err := database.WithRetry(ctx, db, database.DefaultTxOptions(), func(tx *sql.Tx) error {
+		locked, err := models.ScanOrder(tx.QueryRowContext(ctx,
+			`SELECT `+models.OrderColumns+`
+			 FROM orders
+			 WHERE id = $1
+			 FOR UPDATE`,
+			orderID))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return database.ErrOrderNotFound
 			}
+			return fmt.Errorf("lock order: %w", err)
+		}
 
-			productPrices[item.ProductID] = price
-			totalAmount = totalAmount.Add(price.Mul(decimal.NewFromInt(int64(item.Quantity))))
+		if version != 0 && locked.Version != version {
+			return database.ErrOptimisticLockFailed
 		}
+		if locked.Status != models.OrderStatusPending {
+			return database.ErrOrderNotPending
+		}
+
+		total, err := currentOrderTotal(ctx, tx, locked)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx,
+			`UPDATE order_items oi
+			 SET unit_price = p.price,
+			     subtotal = p.price * oi.quantity
+			 FROM products p
+			 WHERE oi.order_id = $1 AND p.id = oi.product_id`,
+			orderID)
+		if err != nil {
+			return fmt.Errorf("reprice order items: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx,
+			`UPDATE orders
+			 SET total_amount = $1, version = version + 1, updated_at = NOW()
+			 WHERE id = $2`,
+			total, orderID)
+		if err != nil {
+			return fmt.Errorf("update order total: %w", err)
+		}
+
+		order, err = GetOrder(ctx, tx, orderID)
+		return err
+	})
+	if err != nil {
+		if database.IsNumericOutOfRange(err) {
+			return nil, database.ErrNumericOutOfRange
+		}
+		return nil, err
+	}
+
+	return order, nil
+}
+
+// currentOrderTotal share-locks the order's products in ID order and returns
+// what its items cost at their current prices.
+func currentOrderTotal(ctx context.Context, tx *sql.Tx, order *models.Order) (decimal.Decimal, error) {
+	rows, err := tx.QueryContext(ctx,
+		`SELECT oi.quantity, p.price, p.currency
+		 FROM order_items oi
+		 JOIN products p ON p.id = oi.product_id
+		 WHERE oi.order_id = $1
+		 ORDER BY p.id
+		 FOR SHARE OF p`,
+		order.ID)
+	if err != nil {
+		return decimal.Zero, fmt.Errorf("lock order products: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			return
+		}
+	}()
+
+	total := decimal.Zero
+	for rows.Next() {
+		var quantity int
+		var price decimal.Decimal
+		var currency string
+		if err := rows.Scan(&quantity, &price, &currency); err != nil {
+			return decimal.Zero, fmt.Errorf("scan order product: %w", err)
+		}
+		if currency != order.Currency {
+			return decimal.Zero, database.ErrMixedCurrency
+		}
+		total = total.Add(price.Mul(decimal.NewFromInt(int64(quantity))))
+	}
+
+	if err := rows.Err(); err != nil {
+		return decimal.Zero, fmt.Errorf("rows error: %w", err)
+	}
+
+	if total.GreaterThan(MaxOrderTotal) {
+		return decimal.Zero, database.ErrOrderTotalTooLarge
+	}
+	return total, nil
+}
+
+// OrderStatusFilter selects the orders BulkUpdateOrderStatus moves. The zero
+// value matches every order.
+type OrderStatusFilter struct {
+	// Status, when set, limits the update to orders currently in it.
+	Status string
+
+	// UserID, when non-zero, limits the update to that user's orders.
+	UserID int64
+
+	// CreatedAfter and CreatedBefore bound created_at to [CreatedAfter,
+	// CreatedBefore) when non-zero.
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+
+	// SkipInvalid leaves orders that can't make the transition unchanged
+	// instead of failing the whole update.
+	SkipInvalid bool
+}
+
+type bulkStatusCandidate struct {
+	id        int64
+	oldStatus string
+}
+
+// BulkUpdateOrderStatus moves every order matching filter to newStatus in one
+// transaction and returns how many it moved. Only transitions without stock
+// side effects can be made in bulk: cancelling, and shipping, which needs a
+// tracking number per order, are rejected with ErrInvalidStatusTransition,
+// and a pending reserve-only order counts as an
+// invalid transition because confirming it must capture its reservations. If
+// any matching order can't make the transition, nothing is updated and
+// ErrInvalidStatusTransition is returned, unless filter.SkipInvalid is set.
+func BulkUpdateOrderStatus(ctx context.Context, db *sql.DB, filter OrderStatusFilter, newStatus string) (int64, error) {
+	if !models.IsValidOrderStatus(newStatus) || (filter.Status != "" && !models.IsValidOrderStatus(filter.Status)) {
+		return 0, database.ErrInvalidOrderStatus
+	}
+	if newStatus == models.OrderStatusCancelled || newStatus == models.OrderStatusShipped {
+		return 0, database.ErrInvalidStatusTransition
+	}
+
+	var validFrom []string
+	for _, status := range models.OrderStatuses {
+		if models.CanTransitionOrderStatus(status, newStatus) {
+			validFrom = append(validFrom, status)
+		}
+	}
+
+	var conditions []string
+	validCondition, validArg := anyOf("o.status", 1, validFrom)
+	args := []interface{}{validArg}
+	if filter.Status != "" {
+		args = append(args, filter.Status)
+		conditions = append(conditions, fmt.Sprintf("o.status = $%d", len(args)))
+	}
+	if filter.UserID != 0 {
+		args = append(args, filter.UserID)
+		conditions = append(conditions, fmt.Sprintf("o.user_id = $%d", len(args)))
+	}
+	if !filter.CreatedAfter.IsZero() {
+		args = append(args, filter.CreatedAfter)
+		conditions = append(conditions, fmt.Sprintf("o.created_at >= $%d", len(args)))
+	}
+	if !filter.CreatedBefore.IsZero() {
+		args = append(args, filter.CreatedBefore)
+		conditions = append(conditions, fmt.Sprintf("o.created_at < $%d", len(args)))
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var moved []bulkStatusCandidate
+	var updatedAt time.Time
+
+	err := database.WithRetry(ctx, db, database.DefaultTxOptions(), func(tx *sql.Tx) error {
+		moved = nil
+
+		rows, err := tx.QueryContext(ctx,
+			`SELECT o.id, o.status,
+			        `+validCondition+`
+			        AND NOT (o.status = '`+models.OrderStatusPending+`'
+			                 AND EXISTS(SELECT 1 FROM stock_reservations r WHERE r.order_id = o.id))
+			 FROM orders o
+			 `+where+`
+			 ORDER BY o.id
+			 FOR UPDATE`,
+			args...)
+		if err != nil {
+			return fmt.Errorf("lock orders: %w", err)
+		}
+		defer func() {
+			if err := rows.Close(); err != nil {
+				return
+			}
+		}()
+
+		var ids []int64
+		for rows.Next() {
+			var candidate bulkStatusCandidate
+			var valid bool
+			if err := rows.Scan(&candidate.id, &candidate.oldStatus, &valid); err != nil {
+				return fmt.Errorf("scan order: %w", err)
+			}
+			if !valid {
+				if filter.SkipInvalid {
+					continue
+				}
+				return database.ErrInvalidStatusTransition
+			}
+			moved = append(moved, candidate)
+			ids = append(ids, candidate.id)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("rows error: %w", err)
+		}
+
+		if len(ids) == 0 {
+			return nil
+		}
+
+		condition, arg := anyOf("id", 2, ids)
+		err = tx.QueryRowContext(ctx,
+			`WITH updated AS (
+			     UPDATE orders
+			     SET status = $1, version = version + 1, updated_at = NOW()
+			     WHERE `+condition+`
+			     RETURNING updated_at
+			 )
+			 SELECT MAX(updated_at) FROM updated`,
+			newStatus, arg).Scan(&updatedAt)
+		if err != nil {
+			return fmt.Errorf("update order statuses: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, candidate := range moved {
+		emitOrderEvent(OrderEvent{
+			OrderID:    candidate.id,
+			OldStatus:  candidate.oldStatus,
+			NewStatus:  newStatus,
+			OccurredAt: updatedAt,
+		})
+	}
+
+	return int64(len(moved)), nil
+}
+
+// UpdateOrderMetadata merges metadata, a JSON object, into the order's
+// metadata: its keys replace the existing ones and keys set to null are
+// removed. Other keys are kept. It fails with ErrOptimisticLockFailed if
+// version is stale.
+func UpdateOrderMetadata(ctx context.Context, db Querier, orderID int64, metadata json.RawMessage, version int) (*models.Order, error) {
+	if err := validateOrderMetadata(metadata); err != nil {
+		return nil, err
+	}
+
+	var order *models.Order
+	err := writeAs(ctx, db, func(q Querier) error {
+		var err error
+		order, err = models.ScanOrder(q.QueryRowContext(ctx,
+			`UPDATE orders
+			 SET metadata = (metadata || $1::jsonb)
+			         - ARRAY(SELECT key FROM jsonb_each($1::jsonb) WHERE value = 'null'::jsonb),
+			     version = version + 1,
+			     updated_at = NOW()
+			 WHERE id = $2 AND version = $3
+			 RETURNING `+models.OrderColumns,
+			string(metadata), orderID, version))
+		return err
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, orderVersionMismatch(ctx, db, orderID)
+		}
+		return nil, fmt.Errorf("update order metadata: %w", err)
+	}
+
+	return order, nil
+}
+
+func orderVersionMismatch(ctx context.Context, db Querier, id int64) error {
+	var exists bool
+	err := db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM orders WHERE id = $1)`, id).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("check order exists: %w", err)
+	}
+	if !exists {
+		return database.ErrOrderNotFound
+	}
+	return database.ErrOptimisticLockFailed
+}
+
+// changeOrderStatus checks the order's version first when version is non-zero.
+// A non-nil trackingNumber is stored along with the new status.
+func changeOrderStatus(ctx context.Context, db *sql.DB, opts database.TxOptions, orderID int64, newStatus string, version int, trackingNumber *string) (*models.Order, error) {
+	var order *models.Order
+	var oldStatus string
 
-		orderNumber := generateOrderNumber()
-		var orderID int64
-		err = tx.QueryRowContext(ctx,
-			`INSERT INTO orders (user_id, order_number, status, total_amount, created_at, updated_at, version)
-			 VALUES ($1, $2, $3, $4, NOW(), NOW(), 1)
-			 RETURNING id`,
-			req.UserID, orderNumber, models.OrderStatusPending, totalAmount).Scan(&orderID)
+	err := database.WithRetry(ctx, db, opts, func(tx *sql.Tx) error {
+		var err error
+		order, err = models.ScanOrder(tx.QueryRowContext(ctx,
+			`SELECT `+models.OrderColumns+`
+			 FROM orders
+			 WHERE id = $1
+			 FOR UPDATE`,
+			orderID))
 		if err != nil {
-			return fmt.Errorf("create order: %w", err)
+			if err == sql.ErrNoRows {
+				return database.ErrOrderNotFound
+			}
+			return fmt.Errorf("lock order: %w", err)
 		}
 
-		for _, item := range req.Items {
-			unitPrice := productPrices[item.ProductID]
-			subtotal := unitPrice.Mul(decimal.NewFromInt(int64(item.Quantity)))
-
-			_, err = tx.ExecContext(ctx,
-				`INSERT INTO order_items (order_id, product_id, quantity, unit_price, subtotal, created_at)
-				 VALUES ($1, $2, $3, $4, $5, NOW())`,
-				orderID, item.ProductID, item.Quantity, unitPrice, subtotal)
-			if err != nil {
-				return fmt.Errorf("create order item: %w", err)
-			}
+		if version != 0 && order.Version != version {
+			return database.ErrOptimisticLockFailed
 		}
 
-		for _, item := range req.Items {
-			result, err := tx.ExecContext(ctx,
-				`UPDATE products
-				 SET stock_quantity = stock_quantity - $1,
-				     updated_at = NOW()
-				 WHERE id = $2
-				   AND stock_quantity >= $1`,
-				item.Quantity, item.ProductID)
-			if err != nil {
-				return fmt.Errorf("update stock: %w", err)
-			}
+		oldStatus = order.Status
+		order, err = transitionOrder(ctx, tx, order, newStatus, trackingNumber)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
 
-			rowsAffected, err := result.RowsAffected()
-			if err != nil {
-				return fmt.Errorf("get rows affected: %w", err)
-			}
+	if newStatus == models.OrderStatusConfirmed || newStatus == models.OrderStatusCancelled {
+		invalidateOrderProducts(ctx, db, order.ID)
+	}
 
-			if rowsAffected == 0 {
-				return database.ErrInsufficientStock
-			}
-		}
+	emitOrderEvent(OrderEvent{
+		OrderID:    order.ID,
+		OldStatus:  oldStatus,
+		NewStatus:  order.Status,
+		OccurredAt: order.UpdatedAt,
+	})
 
-		order = &models.Order{ID: orderID}
-		err = tx.QueryRowContext(ctx,
-			`SELECT order_number, user_id, status, total_amount, created_at, updated_at, version
-			 FROM orders WHERE id = $1`,
-			orderID).Scan(
-			&order.OrderNumber,
-			&order.UserID,
-			&order.Status,
-			&order.TotalAmount,
-			&order.CreatedAt,
-			&order.UpdatedAt,
-			&order.Version,
-		)
-		if err != nil {
-			return fmt.Errorf("fetch created order: %w", err)
-		}
+	return order, nil
+}
 
-		return nil
-	})
+// transitionOrder applies the stock side effects of moving a locked order to
+// newStatus and updates the row. Stock for a pending reserve-only order is
+// still only held, so confirming captures it and cancelling releases it. A nil
+// trackingNumber leaves the stored one unchanged.
+func transitionOrder(ctx context.Context, tx *sql.Tx, order *models.Order, newStatus string, trackingNumber *string) (*models.Order, error) {
+	if !models.CanTransitionOrderStatus(order.Status, newStatus) {
+		return nil, database.ErrInvalidStatusTransition
+	}
 
+	reserved, open, err := orderReservations(ctx, tx, order.ID)
 	if err != nil {
 		return nil, err
 	}
+	holding := reserved && order.Status == models.OrderStatusPending
 
-	return order, nil
+	switch {
+	case newStatus == models.OrderStatusConfirmed && holding:
+		if !open {
+			return nil, database.ErrReservationExpired
+		}
+		err = settleOrderReservations(ctx, tx, order.ID, true)
+	case newStatus == models.OrderStatusCancelled && holding:
+		err = settleOrderReservations(ctx, tx, order.ID, false)
+	case newStatus == models.OrderStatusCancelled:
+		err = restockOrderItems(ctx, tx, order.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	updated, err := models.ScanOrder(tx.QueryRowContext(ctx,
+		`UPDATE orders
+		 SET status = $1, tracking_number = COALESCE($3, tracking_number),
+		     shipped_at = CASE WHEN $1 = '`+models.OrderStatusShipped+`' THEN NOW() ELSE shipped_at END,
+		     version = version + 1, updated_at = NOW()
+		 WHERE id = $2
+		 RETURNING `+models.OrderColumns,
+		newStatus, order.ID, trackingNumber))
+	if err != nil {
+		return nil, fmt.Errorf("update order status: %w", err)
+	}
+
+	return updated, nil
 }
 
-func GetOrder(ctx context.Context, db *sql.DB, id int64) (*models.Order, error) {
-	order := &models.Order{}
+// restockOrderItems adds an order's item quantities back to product stock,
+// locking products in ID order like CreateOrder does.
+func restockOrderItems(ctx context.Context, tx *sql.Tx, orderID int64) error {
+	_, err := tx.ExecContext(ctx,
+		`SELECT id
+		 FROM products
+		 WHERE id IN (SELECT product_id FROM order_items WHERE order_id = $1)
+		 ORDER BY id
+		 FOR UPDATE`,
+		orderID)
+	if err != nil {
+		return fmt.Errorf("lock order products: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE products p
+		 SET stock_quantity = p.stock_quantity + oi.quantity,
+		     updated_at = NOW()
+		 FROM (
+		     SELECT product_id, SUM(quantity) AS quantity
+		     FROM order_items
+		     WHERE order_id = $1
+		     GROUP BY product_id
+		 ) oi
+		 WHERE p.id = oi.product_id`,
+		orderID)
+	if err != nil {
+		return fmt.Errorf("restock order items: %w", err)
+	}
+	return nil
+}
 
+func GetOrder(ctx context.Context, db Querier, id int64) (*models.Order, error) {
 	query := `
-		SELECT id, user_id, order_number, status, total_amount, created_at, updated_at, version
+		SELECT ` + models.OrderColumns + `
 		FROM orders
 		WHERE id = $1`
 
-	err := db.QueryRowContext(ctx, query, id).Scan(
-		&order.ID,
-		&order.UserID,
-		&order.OrderNumber,
-		&order.Status,
-		&order.TotalAmount,
-		&order.CreatedAt,
-		&order.UpdatedAt,
-		&order.Version,
-	)
+	order, err := models.ScanOrder(db.QueryRowContext(ctx, query, id))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, database.ErrOrderNotFound
@@ -171,7 +1080,7 @@ func GetOrder(ctx context.Context, db *sql.DB, id int64) (*models.Order, error)
 	}
 
 	itemsQuery := `
-		SELECT id, order_id, product_id, quantity, unit_price, subtotal, created_at
+		SELECT ` + models.OrderItemColumns + `
 		FROM order_items
 		WHERE order_id = $1`
 
@@ -187,20 +1096,11 @@ func GetOrder(ctx context.Context, db *sql.DB, id int64) (*models.Order, error)
 
 	var items []models.OrderItem
 	for rows.Next() {
-		var item models.OrderItem
-		err := rows.Scan(
-			&item.ID,
-			&item.OrderID,
-			&item.ProductID,
-			&item.Quantity,
-			&item.UnitPrice,
-			&item.Subtotal,
-			&item.CreatedAt,
-		)
+		item, err := models.ScanOrderItem(rows)
 		if err != nil {
 			return nil, fmt.Errorf("scan order item: %w", err)
 		}
-		items = append(items, item)
+		items = append(items, *item)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -212,21 +1112,328 @@ func GetOrder(ctx context.Context, db *sql.DB, id int64) (*models.Order, error)
 	return order, nil
 }
 
-func ListOrdersCursor(ctx context.Context, db *sql.DB, userID int64, cursor string, limit int) (*CursorPage, error) {
+func ListOrdersCursor(ctx context.Context, db Querier, userID int64, cursor string, limit int) (*CursorPage, error) {
 	cursorData, err := DecodeCursor(cursor)
 	if err != nil {
 		return nil, fmt.Errorf("decode cursor: %w", err)
 	}
 
 	query := `
-		SELECT id, order_number, status, total_amount, created_at, updated_at, version
+		SELECT ` + models.OrderColumns + `
 		FROM orders
 		WHERE user_id = $1
 		  AND (created_at, id) < ($2, $3)
 		ORDER BY created_at DESC, id DESC
 		LIMIT $4`
 
-	rows, err := db.QueryContext(ctx, query, userID, cursorData.CreatedAt, cursorData.ID, limit+1)
+	return queryOrderPage(ctx, db, limit, query, userID, cursorData.CreatedAt, cursorData.ID, limit+1)
+}
+
+// CountUserOrders returns how many orders userID has placed, in any status.
+// A user with no orders, or no such user, counts 0.
+func CountUserOrders(ctx context.Context, db Querier, userID int64) (int64, error) {
+	var count int64
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM orders WHERE user_id = $1`, userID).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("count user orders: %w", err)
+	}
+	return count, nil
+}
+
+// ListDistinctOrderStatuses returns the statuses that at least one order is
+// in, sorted.
+func ListDistinctOrderStatuses(ctx context.Context, db Querier) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT DISTINCT status FROM orders ORDER BY status`)
+	if err != nil {
+		return nil, fmt.Errorf("list order statuses: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			return
+		}
+	}()
+
+	statuses := []string{}
+	for rows.Next() {
+		var status string
+		if err := rows.Scan(&status); err != nil {
+			return nil, fmt.Errorf("scan order status: %w", err)
+		}
+		statuses = append(statuses, status)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return statuses, nil
+}
+
+// OrderStatusChange is one entry of an order's timeline. FromStatus is empty
+// for the order's creation.
+type OrderStatusChange struct {
+	FromStatus string    `json:"from_status,omitempty"`
+	ToStatus   string    `json:"to_status"`
+	ChangedAt  time.Time `json:"changed_at"`
+	ActorID    *int64    `json:"actor_id,omitempty"`
+}
+
+// GetOrderTimeline returns the order's creation and each status change after
+// it, oldest first. It is read from the audit log, so writes to the order
+// that leave its status alone are skipped, and ActorID is set only when the
+// write was made with WithActor.
+func GetOrderTimeline(ctx context.Context, db Querier, orderID int64) ([]OrderStatusChange, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT COALESCE(old_data->>'status', ''), new_data->>'status', created_at, actor_id
+		FROM audit_log
+		WHERE entity_type = $1 AND entity_id = $2
+		  AND (action = 'create'
+		       OR (action = 'update' AND old_data->>'status' IS DISTINCT FROM new_data->>'status'))
+		ORDER BY id`,
+		models.AuditEntityOrder, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("get order timeline: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			return
+		}
+	}()
+
+	timeline := []OrderStatusChange{}
+	for rows.Next() {
+		var change OrderStatusChange
+		if err := rows.Scan(&change.FromStatus, &change.ToStatus, &change.ChangedAt, &change.ActorID); err != nil {
+			return nil, fmt.Errorf("scan order status change: %w", err)
+		}
+		timeline = append(timeline, change)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	if len(timeline) == 0 {
+		var exists bool
+		err := db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM orders WHERE id = $1)`, orderID).Scan(&exists)
+		if err != nil {
+			return nil, fmt.Errorf("check order exists: %w", err)
+		}
+		if !exists {
+			return nil, database.ErrOrderNotFound
+		}
+	}
+
+	return timeline, nil
+}
+
+// OrderFilter narrows ListOrders. The zero value matches every order.
+type OrderFilter struct {
+	// Statuses, when non-empty, limits the orders to those in any of them.
+	Statuses []string
+
+	// MinTotal and MaxTotal bound total_amount inclusively when non-nil.
+	MinTotal *decimal.Decimal
+	MaxTotal *decimal.Decimal
+
+	// UserIDs, when non-empty, limits the orders to those placed by any of
+	// these users, at most MaxFilterUserIDs of them.
+	UserIDs []int64
+}
+
+// MaxFilterUserIDs caps OrderFilter.UserIDs.
+const MaxFilterUserIDs = 100
+
+// conditions returns the filter's SQL conditions, numbering placeholders from
+// $1, along with their arguments.
+func (f OrderFilter) conditions() ([]string, []interface{}, error) {
+	var conditions []string
+	var args []interface{}
+
+	if len(f.Statuses) > 0 {
+		for _, status := range f.Statuses {
+			if !models.IsValidOrderStatus(status) {
+				return nil, nil, database.ErrInvalidOrderStatus
+			}
+		}
+		condition, arg := anyOf("status", len(args)+1, f.Statuses)
+		args = append(args, arg)
+		conditions = append(conditions, condition)
+	}
+	if f.MinTotal != nil {
+		args = append(args, *f.MinTotal)
+		conditions = append(conditions, fmt.Sprintf("total_amount >= $%d", len(args)))
+	}
+	if f.MaxTotal != nil {
+		args = append(args, *f.MaxTotal)
+		conditions = append(conditions, fmt.Sprintf("total_amount <= $%d", len(args)))
+	}
+	if len(f.UserIDs) > 0 {
+		if len(f.UserIDs) > MaxFilterUserIDs {
+			var errs ValidationErrors
+			errs.add("user_ids", fmt.Sprintf("must have at most %d elements", MaxFilterUserIDs), nil)
+			return nil, nil, errs
+		}
+		condition, arg := anyOf("user_id", len(args)+1, f.UserIDs)
+		args = append(args, arg)
+		conditions = append(conditions, condition)
+	}
+
+	return conditions, args, nil
+}
+
+// ListOrders pages through orders matching filter, newest first, using the
+// same cursor format as ListOrdersCursor.
+func ListOrders(ctx context.Context, db Querier, filter OrderFilter, cursor string, limit int) (*CursorPage, error) {
+	conditions, args, err := filter.conditions()
+	if err != nil {
+		return nil, err
+	}
+
+	cursorData, err := DecodeCursor(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("decode cursor: %w", err)
+	}
+
+	args = append(args, cursorData.CreatedAt, cursorData.ID)
+	conditions = append(conditions, fmt.Sprintf("(created_at, id) < ($%d, $%d)", len(args)-1, len(args)))
+	args = append(args, limit+1)
+
+	query := `
+		SELECT ` + models.OrderColumns + `
+		FROM orders
+		WHERE ` + strings.Join(conditions, " AND ") + `
+		ORDER BY created_at DESC, id DESC
+		` + fmt.Sprintf("LIMIT $%d", len(args))
+
+	return queryOrderPage(ctx, db, limit, query, args...)
+}
+
+// ListOrdersByStatuses pages through orders in any of statuses, newest first,
+// using the same cursor format as ListOrdersCursor. No statuses match no
+// orders, so an empty statuses returns an empty page.
+func ListOrdersByStatuses(ctx context.Context, db Querier, statuses []string, cursor string, limit int) (*CursorPage, error) {
+	if len(statuses) == 0 {
+		return &CursorPage{Items: []models.Order{}}, nil
+	}
+	return ListOrders(ctx, db, OrderFilter{Statuses: statuses}, cursor, limit)
+}
+
+// ListOrdersForUsers pages through the orders of any of userIDs, newest
+// first across all of them, using the same cursor format as
+// ListOrdersCursor. At most MaxFilterUserIDs users can be passed.
+func ListOrdersForUsers(ctx context.Context, db Querier, userIDs []int64, cursor string, limit int) (*CursorPage, error) {
+	if len(userIDs) == 0 {
+		var errs ValidationErrors
+		errs.add("user_ids", "must contain at least one user ID", nil)
+		return nil, errs
+	}
+	return ListOrders(ctx, db, OrderFilter{UserIDs: userIDs}, cursor, limit)
+}
+
+// ListOrdersByShippedAt pages through all orders, most recently shipped
+// first, followed by the orders that haven't shipped, newest ID first. Its
+// cursors come from EncodeNullableTimeCursor, not EncodeCursor.
+func ListOrdersByShippedAt(ctx context.Context, db Querier, cursor string, limit int) (*CursorPage, error) {
+	cursorData, err := DecodeNullableTimeCursor(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("decode cursor: %w", err)
+	}
+
+	condition, args := afterNullsLast("shipped_at", "id", 1, cursorData)
+	args = append(args, limit+1)
+
+	query := `
+		SELECT ` + models.OrderColumns + `
+		FROM orders
+		WHERE ` + condition + `
+		ORDER BY shipped_at DESC NULLS LAST, id DESC
+		` + fmt.Sprintf("LIMIT $%d", len(args))
+
+	return queryOrderPageWith(ctx, db, limit, func(order models.Order) string {
+		return EncodeNullableTimeCursor(NullableTimeCursor{
+			Value: order.ShippedAt,
+			ID:    order.ID,
+		})
+	}, query, args...)
+}
+
+// ListOrderItemsByProduct pages through every order item for a product,
+// newest first, keyed on (created_at, id) with the same cursor format as
+// ListOrdersCursor.
+func ListOrderItemsByProduct(ctx context.Context, db Querier, productID int64, cursor string, limit int) (*CursorPage, error) {
+	cursorData, err := DecodeCursor(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("decode cursor: %w", err)
+	}
+
+	query := `
+		SELECT ` + models.OrderItemColumns + `
+		FROM order_items
+		WHERE product_id = $1
+		  AND (created_at, id) < ($2, $3)
+		ORDER BY created_at DESC, id DESC
+		LIMIT $4`
+
+	rows, err := db.QueryContext(ctx, query, productID, cursorData.CreatedAt, cursorData.ID, limit+1)
+	if err != nil {
+		return nil, fmt.Errorf("list order items: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			return
+		}
+	}()
+
+	items := []models.OrderItem{}
+	for rows.Next() {
+		item, err := models.ScanOrderItem(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan order item: %w", err)
+		}
+		items = append(items, *item)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	hasMore := len(items) > limit
+	if hasMore {
+		items = items[:limit]
+	}
+
+	var nextCursor string
+	if hasMore && len(items) > 0 {
+		lastItem := items[len(items)-1]
+		nextCursor = EncodeCursor(OrderCursor{
+			CreatedAt: lastItem.CreatedAt,
+			ID:        lastItem.ID,
+		})
+	}
+
+	return &CursorPage{
+		Items:      items,
+		NextCursor: nextCursor,
+		HasMore:    hasMore,
+	}, nil
+}
+
+// queryOrderPage runs a keyset query ordered by (created_at, id) that fetches
+// up to limit+1 orders and turns the result into a CursorPage.
+func queryOrderPage(ctx context.Context, db Querier, limit int, query string, args ...interface{}) (*CursorPage, error) {
+	return queryOrderPageWith(ctx, db, limit, func(order models.Order) string {
+		return EncodeCursor(OrderCursor{
+			CreatedAt: order.CreatedAt,
+			ID:        order.ID,
+		})
+	}, query, args...)
+}
+
+// queryOrderPageWith is queryOrderPage for any ordering; nextCursor encodes
+// the position of a page's last order.
+func queryOrderPageWith(ctx context.Context, db Querier, limit int, nextCursor func(models.Order) string, query string, args ...interface{}) (*CursorPage, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("list orders: %w", err)
 	}
@@ -236,22 +1443,13 @@ func ListOrdersCursor(ctx context.Context, db *sql.DB, userID int64, cursor stri
 		}
 	}()
 
-	var orders []models.Order
+	orders := []models.Order{}
 	for rows.Next() {
-		var order models.Order
-		err := rows.Scan(
-			&order.ID,
-			&order.OrderNumber,
-			&order.Status,
-			&order.TotalAmount,
-			&order.CreatedAt,
-			&order.UpdatedAt,
-			&order.Version,
-		)
+		order, err := models.ScanOrder(rows)
 		if err != nil {
 			return nil, fmt.Errorf("scan order: %w", err)
 		}
-		orders = append(orders, order)
+		orders = append(orders, *order)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -263,43 +1461,36 @@ func ListOrdersCursor(ctx context.Context, db *sql.DB, userID int64, cursor stri
 		orders = orders[:limit]
 	}
 
-	var nextCursor string
+	var cursor string
 	if hasMore && len(orders) > 0 {
-		lastOrder := orders[len(orders)-1]
-		nextCursor = EncodeCursor(OrderCursor{
-			CreatedAt: lastOrder.CreatedAt,
-			ID:        lastOrder.ID,
-		})
+		cursor = nextCursor(orders[len(orders)-1])
 	}
 
 	return &CursorPage{
 		Items:      orders,
-		NextCursor: nextCursor,
+		NextCursor: cursor,
 		HasMore:    hasMore,
 	}, nil
 }
 
 func GetNextPendingOrder(ctx context.Context, tx *sql.Tx) (*models.Order, error) {
-	order := &models.Order{}
+	return claimNextPendingOrder(ctx, tx, nil)
+}
 
+// claimNextPendingOrder is GetNextPendingOrder passing over the orders in
+// skip.
+func claimNextPendingOrder(ctx context.Context, tx *sql.Tx, skip []int64) (*models.Order, error) {
+	skipCondition, skipArg := anyOf("id", 2, skip)
 	query := `
-		SELECT id, user_id, order_number, status, total_amount, created_at, updated_at, version
+		SELECT ` + models.OrderColumns + `
 		FROM orders
 		WHERE status = $1
+		  AND NOT ` + skipCondition + `
 		ORDER BY created_at
 		FOR UPDATE SKIP LOCKED
 		LIMIT 1`
 
-	err := tx.QueryRowContext(ctx, query, models.OrderStatusPending).Scan(
-		&order.ID,
-		&order.UserID,
-		&order.OrderNumber,
-		&order.Status,
-		&order.TotalAmount,
-		&order.CreatedAt,
-		&order.UpdatedAt,
-		&order.Version,
-	)
+	order, err := models.ScanOrder(tx.QueryRowContext(ctx, query, models.OrderStatusPending, skipArg))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, database.ErrOrderNotFound
@@ -309,3 +1500,115 @@ func GetNextPendingOrder(ctx context.Context, tx *sql.Tx) (*models.Order, error)
 
 	return order, nil
 }
+
+// FetchPendingOrdersBatch claims up to limit pending orders. The rows stay
+// locked until tx ends, and rows locked by other workers are skipped.
+func FetchPendingOrdersBatch(ctx context.Context, tx *sql.Tx, limit int) ([]models.Order, error) {
+	query := `
+		SELECT ` + models.OrderColumns + `
+		FROM orders
+		WHERE status = $1
+		ORDER BY created_at, id
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED`
+
+	rows, err := tx.QueryContext(ctx, query, models.OrderStatusPending, limit)
+	if err != nil {
+		return nil, fmt.Errorf("fetch pending orders: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			return
+		}
+	}()
+
+	var orders []models.Order
+	for rows.Next() {
+		order, err := models.ScanOrder(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan order: %w", err)
+		}
+		orders = append(orders, *order)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return orders, nil
+}
+
+const purgeBatchSize = 500
+
+// PurgeCancelledOrders deletes cancelled orders created before olderThan.
+// Each batch runs in its own transaction so row locks are held briefly.
+func PurgeCancelledOrders(ctx context.Context, db *sql.DB, olderThan time.Time) (int64, error) {
+	var purged int64
+
+	for {
+		var batchCount int64
+
+		err := database.WithTransaction(ctx, db, database.DefaultTxOptions(), func(tx *sql.Tx) error {
+			rows, err := tx.QueryContext(ctx,
+				`SELECT id
+				 FROM orders
+				 WHERE status = $1
+				   AND created_at < $2
+				 ORDER BY id
+				 LIMIT $3
+				 FOR UPDATE SKIP LOCKED`,
+				models.OrderStatusCancelled, olderThan, purgeBatchSize)
+			if err != nil {
+				return fmt.Errorf("select cancelled orders: %w", err)
+			}
+			defer func() {
+				if err := rows.Close(); err != nil {
+					return
+				}
+			}()
+
+			var ids []int64
+			for rows.Next() {
+				var id int64
+				if err := rows.Scan(&id); err != nil {
+					return fmt.Errorf("scan order id: %w", err)
+				}
+				ids = append(ids, id)
+			}
+
+			if err := rows.Err(); err != nil {
+				return fmt.Errorf("rows error: %w", err)
+			}
+
+			if len(ids) == 0 {
+				return nil
+			}
+
+			itemsCondition, idsArg := anyOf("order_id", 1, ids)
+			if _, err := tx.ExecContext(ctx, `DELETE FROM order_items WHERE `+itemsCondition, idsArg); err != nil {
+				return fmt.Errorf("delete order items: %w", err)
+			}
+
+			ordersCondition, idsArg := anyOf("id", 1, ids)
+			result, err := tx.ExecContext(ctx, `DELETE FROM orders WHERE `+ordersCondition, idsArg)
+			if err != nil {
+				return fmt.Errorf("delete orders: %w", err)
+			}
+
+			batchCount, err = result.RowsAffected()
+			if err != nil {
+				return fmt.Errorf("get rows affected: %w", err)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return purged, err
+		}
+
+		purged += batchCount
+		if batchCount < purgeBatchSize {
+			return purged, nil
+		}
+	}
+}
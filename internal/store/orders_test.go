@@ -0,0 +1,52 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestSetOrderLimits(t *testing.T) {
+	defer func(total decimal.Decimal, quantity int) {
+		MaxOrderTotal, MaxItemQuantity = total, quantity
+	}(MaxOrderTotal, MaxItemQuantity)
+
+	tests := []struct {
+		name     string
+		total    string
+		quantity int
+		wantErr  bool
+	}{
+		{name: "column limit", total: "99999999.99", quantity: 10000},
+		{name: "smaller", total: "500", quantity: 1},
+		{name: "zero total", total: "0", quantity: 10, wantErr: true},
+		{name: "negative total", total: "-1", quantity: 10, wantErr: true},
+		{name: "over column limit", total: "100000000", quantity: 10, wantErr: true},
+		{name: "zero quantity", total: "500", quantity: 0, wantErr: true},
+		{name: "negative quantity", total: "500", quantity: -5, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MaxOrderTotal, MaxItemQuantity = orderTotalLimit, 10000
+
+			total := decimal.RequireFromString(tt.total)
+			err := SetOrderLimits(total, tt.quantity)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if !MaxOrderTotal.Equal(orderTotalLimit) || MaxItemQuantity != 10000 {
+					t.Errorf("limits changed on error: %s, %d", MaxOrderTotal, MaxItemQuantity)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !MaxOrderTotal.Equal(total) || MaxItemQuantity != tt.quantity {
+				t.Errorf("expected %s and %d, got %s and %d", total, tt.quantity, MaxOrderTotal, MaxItemQuantity)
+			}
+		})
+	}
+}
@@ -12,6 +12,8 @@ type CursorPage struct {
 	HasMore    bool        `json:"has_more"`
 }
 
+// OffsetPage is one page of a list. Total and TotalPages are -1 when the
+// page was fetched without PageOptions.IncludeTotal.
 type OffsetPage struct {
 	Items      interface{} `json:"items"`
 	Total      int64       `json:"total"`
@@ -20,6 +22,34 @@ type OffsetPage struct {
 	TotalPages int         `json:"total_pages"`
 }
 
+// PageOptions adjusts how an offset page is fetched.
+type PageOptions struct {
+	// IncludeTotal runs the COUNT query behind OffsetPage.Total. Consumers
+	// that only page forward, such as infinite scroll, can leave it off and
+	// save a query per page.
+	IncludeTotal bool
+}
+
+// newOffsetPage builds an OffsetPage, with a total of -1 meaning it wasn't
+// counted.
+func newOffsetPage(items interface{}, total int64, page, pageSize int) *OffsetPage {
+	totalPages := -1
+	if total >= 0 {
+		totalPages = int(total) / pageSize
+		if int(total)%pageSize > 0 {
+			totalPages++
+		}
+	}
+
+	return &OffsetPage{
+		Items:      items,
+		Total:      total,
+		Page:       page,
+		PageSize:   pageSize,
+		TotalPages: totalPages,
+	}
+}
+
 type OrderCursor struct {
 	CreatedAt time.Time `json:"created_at"`
 	ID        int64     `json:"id"`
@@ -50,3 +80,38 @@ func DecodeCursor(encoded string) (OrderCursor, error) {
 	err = json.Unmarshal(data, &cursor)
 	return cursor, err
 }
+
+// NullableTimeCursor marks the last row of a page ordered by a nullable
+// timestamp with NULLs last. A nil Value means the page ended among the rows
+// where the timestamp is NULL.
+type NullableTimeCursor struct {
+	Value *time.Time `json:"value"`
+	ID    int64      `json:"id"`
+}
+
+func EncodeNullableTimeCursor(cursor NullableTimeCursor) string {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return ""
+	}
+	return base64.URLEncoding.EncodeToString(data)
+}
+
+// DecodeNullableTimeCursor returns nil for an empty cursor, meaning the first
+// page.
+func DecodeNullableTimeCursor(encoded string) (*NullableTimeCursor, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+
+	data, err := base64.URLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	var cursor NullableTimeCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
@@ -0,0 +1,212 @@
+package store
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/safar/go-sql-store/internal/models"
+)
+
+// CachedProductReader is a read-through LRU cache in front of GetProduct.
+// Every store function that changes a product's stock, price or other
+// columns invalidates that product in all open readers, so a read never
+// sees data older than the last write that returned. Writes made inside a
+// caller's transaction are invalidated when the write runs, before the commit;
+// a read racing that commit can cache the old row for at most ttl.
+type CachedProductReader struct {
+	db   Querier
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[int64]*list.Element
+	lru     *list.List
+	// generation counts invalidations so that a read which started before
+	// one doesn't cache what it loaded.
+	generation uint64
+}
+
+type productCacheEntry struct {
+	product   models.Product
+	expiresAt time.Time
+}
+
+var (
+	productCachesMu sync.RWMutex
+	productCaches   = make(map[*CachedProductReader]struct{})
+)
+
+// NewCachedProductReader returns a cache holding up to size products for ttl
+// each. Call Close when done with it so writes stop invalidating it.
+func NewCachedProductReader(db Querier, size int, ttl time.Duration) *CachedProductReader {
+	if size < 1 {
+		size = 1
+	}
+
+	c := &CachedProductReader{
+		db:      db,
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[int64]*list.Element),
+		lru:     list.New(),
+	}
+
+	productCachesMu.Lock()
+	productCaches[c] = struct{}{}
+	productCachesMu.Unlock()
+
+	return c
+}
+
+// GetProduct behaves like the package-level GetProduct, serving the product
+// from the cache while its entry is fresh.
+func (c *CachedProductReader) GetProduct(ctx context.Context, id int64) (*models.Product, error) {
+	c.mu.Lock()
+	if elem, ok := c.entries[id]; ok {
+		entry := elem.Value.(*productCacheEntry)
+		if time.Now().Before(entry.expiresAt) {
+			c.lru.MoveToFront(elem)
+			product := entry.product
+			c.mu.Unlock()
+			return &product, nil
+		}
+		c.remove(elem)
+	}
+	generation := c.generation
+	c.mu.Unlock()
+
+	product, err := GetProduct(ctx, c.db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.generation == generation {
+		c.put(*product)
+	}
+	return product, nil
+}
+
+// Invalidate drops the cached entries for ids.
+func (c *CachedProductReader) Invalidate(ids ...int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	for _, id := range ids {
+		if elem, ok := c.entries[id]; ok {
+			c.remove(elem)
+		}
+	}
+}
+
+// Close empties the cache and stops it receiving invalidations.
+func (c *CachedProductReader) Close() {
+	productCachesMu.Lock()
+	delete(productCaches, c)
+	productCachesMu.Unlock()
+
+	c.clear()
+}
+
+func (c *CachedProductReader) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.entries = make(map[int64]*list.Element)
+	c.lru.Init()
+}
+
+func (c *CachedProductReader) put(product models.Product) {
+	entry := &productCacheEntry{product: product, expiresAt: time.Now().Add(c.ttl)}
+
+	if elem, ok := c.entries[product.ID]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[product.ID] = c.lru.PushFront(entry)
+	if c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *CachedProductReader) remove(elem *list.Element) {
+	delete(c.entries, elem.Value.(*productCacheEntry).product.ID)
+	c.lru.Remove(elem)
+}
+
+// invalidateProducts drops ids from every open CachedProductReader. Store
+// functions call it after writing to products.
+func invalidateProducts(ids ...int64) {
+	if len(ids) == 0 {
+		return
+	}
+
+	for _, c := range openProductCaches() {
+		c.Invalidate(ids...)
+	}
+}
+
+// invalidateOrderProducts invalidates the products of an order's items. It
+// runs after the order's transaction has committed, so if the products can't
+// be looked up it empties the caches rather than fail the caller.
+func invalidateOrderProducts(ctx context.Context, db Querier, orderID int64) {
+	caches := openProductCaches()
+	if len(caches) == 0 {
+		return
+	}
+
+	productIDs, err := orderProductIDs(ctx, db, orderID)
+	for _, c := range caches {
+		if err != nil {
+			c.clear()
+			continue
+		}
+		c.Invalidate(productIDs...)
+	}
+}
+
+func openProductCaches() []*CachedProductReader {
+	productCachesMu.RLock()
+	defer productCachesMu.RUnlock()
+
+	caches := make([]*CachedProductReader, 0, len(productCaches))
+	for c := range productCaches {
+		caches = append(caches, c)
+	}
+	return caches
+}
+
+func orderProductIDs(ctx context.Context, db Querier, orderID int64) ([]int64, error) {
+	rows, err := db.QueryContext(ctx, `SELECT DISTINCT product_id FROM order_items WHERE order_id = $1`, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("list order products: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			return
+		}
+	}()
+
+	var productIDs []int64
+	for rows.Next() {
+		var productID int64
+		if err := rows.Scan(&productID); err != nil {
+			return nil, fmt.Errorf("scan order product: %w", err)
+		}
+		productIDs = append(productIDs, productID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return productIDs, nil
+}
@@ -4,6 +4,9 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/lib/pq"
 	"github.com/safar/go-sql-store/internal/database"
@@ -11,25 +14,42 @@ import (
 	"github.com/shopspring/decimal"
 )
 
-func CreateProduct(ctx context.Context, db *sql.DB, sku, name, description string, price decimal.Decimal, stock int) (*models.Product, error) {
-	product := &models.Product{}
+// normalizeSKU returns the form SKUs are stored in. SKUs are compared
+// case-insensitively, so they are kept in upper case.
+func normalizeSKU(sku string) string {
+	return strings.ToUpper(strings.TrimSpace(sku))
+}
+
+// CreateProduct prices the product in currency, which must be a supported
+// ISO 4217 code. An empty currency means models.DefaultCurrency. The SKU is
+// stored in upper case, and one that differs from an existing SKU only in
+// case fails with ErrDuplicateSKU.
+func CreateProduct(ctx context.Context, db Querier, sku, name, description string, price decimal.Decimal, stock int, currency string) (*models.Product, error) {
+	if currency == "" {
+		currency = models.DefaultCurrency
+	}
+	if !models.IsSupportedCurrency(currency) {
+		return nil, database.ErrUnsupportedCurrency
+	}
 
 	query := `
-		INSERT INTO products (sku, name, description, price, stock_quantity, created_at, updated_at, version)
-		VALUES ($1, $2, $3, $4, $5, NOW(), NOW(), 1)
-		RETURNING id, sku, name, description, price, stock_quantity, created_at, updated_at, version`
-
-	err := db.QueryRowContext(ctx, query, sku, name, description, price, stock).Scan(
-		&product.ID,
-		&product.SKU,
-		&product.Name,
-		&product.Description,
-		&product.Price,
-		&product.StockQuantity,
-		&product.CreatedAt,
-		&product.UpdatedAt,
-		&product.Version,
-	)
+		INSERT INTO products (sku, name, description, price, stock_quantity, stocked_quantity, currency, created_at, updated_at, version)
+		VALUES ($1, $2, $3, $4, $5, $5, $6, NOW(), NOW(), 1)
+		ON CONFLICT (sku) DO NOTHING
+		RETURNING ` + models.ProductColumns
+
+	var product *models.Product
+	err := writeAs(ctx, db, func(q Querier) error {
+		var err error
+		product, err = models.ScanProduct(q.QueryRowContext(ctx, query, normalizeSKU(sku), name, description, price, stock, currency))
+		return err
+	})
+	if err == sql.ErrNoRows {
+		return nil, database.ErrDuplicateSKU
+	}
+	if database.IsNumericOutOfRange(err) {
+		return nil, database.ErrNumericOutOfRange
+	}
 	if err != nil {
 		return nil, fmt.Errorf("create product: %w", err)
 	}
@@ -37,25 +57,13 @@ func CreateProduct(ctx context.Context, db *sql.DB, sku, name, description strin
 	return product, nil
 }
 
-func GetProduct(ctx context.Context, db *sql.DB, id int64) (*models.Product, error) {
-	product := &models.Product{}
-
+func GetProduct(ctx context.Context, db Querier, id int64) (*models.Product, error) {
 	query := `
-		SELECT id, sku, name, description, price, stock_quantity, created_at, updated_at, version
+		SELECT ` + models.ProductColumns + `
 		FROM products
 		WHERE id = $1`
 
-	err := db.QueryRowContext(ctx, query, id).Scan(
-		&product.ID,
-		&product.SKU,
-		&product.Name,
-		&product.Description,
-		&product.Price,
-		&product.StockQuantity,
-		&product.CreatedAt,
-		&product.UpdatedAt,
-		&product.Version,
-	)
+	product, err := models.ScanProduct(db.QueryRowContext(ctx, query, id))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, database.ErrProductNotFound
@@ -66,26 +74,380 @@ func GetProduct(ctx context.Context, db *sql.DB, id int64) (*models.Product, err
 	return product, nil
 }
 
-func ReserveStock(ctx context.Context, tx *sql.Tx, productID int64, quantity int) (*models.Product, error) {
-	product := &models.Product{}
+// GetStockLevels returns stock_quantity for each of ids in one query, reading
+// only those two columns, e.g. to check a cart's products. IDs with no
+// matching product are absent from the returned map.
+func GetStockLevels(ctx context.Context, db Querier, ids []int64) (map[int64]int, error) {
+	levels := make(map[int64]int, len(ids))
+	if len(ids) == 0 {
+		return levels, nil
+	}
+
+	idsCondition, idsArg := anyOf("id", 1, ids)
+	rows, err := db.QueryContext(ctx, `SELECT id, stock_quantity FROM products WHERE `+idsCondition, idsArg)
+	if err != nil {
+		return nil, fmt.Errorf("get stock levels: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			return
+		}
+	}()
+
+	for rows.Next() {
+		var id int64
+		var stock int
+		if err := rows.Scan(&id, &stock); err != nil {
+			return nil, fmt.Errorf("scan stock level: %w", err)
+		}
+		levels[id] = stock
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return levels, nil
+}
+
+// GetProductsByIDs loads many products in one query. IDs with no matching
+// product are absent from the returned map.
+func GetProductsByIDs(ctx context.Context, db Querier, ids []int64) (map[int64]models.Product, error) {
+	products := make(map[int64]models.Product, len(ids))
+	if len(ids) == 0 {
+		return products, nil
+	}
+
+	idsCondition, idsArg := anyOf("id", 1, ids)
+	query := `
+		SELECT ` + models.ProductColumns + `
+		FROM products
+		WHERE ` + idsCondition
+
+	rows, err := db.QueryContext(ctx, query, idsArg)
+	if err != nil {
+		return nil, fmt.Errorf("get products by ids: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			return
+		}
+	}()
+
+	for rows.Next() {
+		product, err := models.ScanProduct(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan product: %w", err)
+		}
+		products[product.ID] = *product
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return products, nil
+}
+
+// GetProductPriceHistory returns a product's price changes, oldest first.
+// The rows are written by the products_price_history trigger whenever the
+// price column changes, so every write path is covered.
+func GetProductPriceHistory(ctx context.Context, db Querier, productID int64) ([]models.PriceChange, error) {
+	query := `
+		SELECT ` + models.PriceChangeColumns + `
+		FROM product_price_history
+		WHERE product_id = $1
+		ORDER BY id`
+
+	rows, err := db.QueryContext(ctx, query, productID)
+	if err != nil {
+		return nil, fmt.Errorf("get price history: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			return
+		}
+	}()
+
+	var changes []models.PriceChange
+	for rows.Next() {
+		change, err := models.ScanPriceChange(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan price change: %w", err)
+		}
+		changes = append(changes, *change)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return changes, nil
+}
+
+type ProductSales struct {
+	ProductID  int64           `json:"product_id"`
+	UnitsSold  int64           `json:"units_sold"`
+	Revenue    decimal.Decimal `json:"revenue"`
+	Currency   string          `json:"currency"`
+	OrderCount int64           `json:"order_count"`
+}
+
+// GetProductSales totals the units and revenue of a product's items in
+// non-cancelled orders. Like ReconcileStock, it leaves out pending orders that
+// only hold reservations, since their stock hasn't been taken yet. A product
+// that hasn't sold reports zeros.
+func GetProductSales(ctx context.Context, db Querier, productID int64) (*ProductSales, error) {
+	query := `
+		SELECT p.id, COALESCE(SUM(oi.quantity), 0), COALESCE(SUM(oi.subtotal), 0),
+		       p.currency, COUNT(DISTINCT oi.order_id)
+		FROM products p
+		LEFT JOIN order_items oi ON oi.product_id = p.id
+		     AND EXISTS (
+		         SELECT 1 FROM orders o
+		         WHERE o.id = oi.order_id
+		           AND o.status <> $2
+		           AND NOT (o.status = $3 AND EXISTS (
+		               SELECT 1 FROM stock_reservations r WHERE r.order_id = o.id
+		           ))
+		     )
+		WHERE p.id = $1
+		GROUP BY p.id, p.currency`
+
+	var sales ProductSales
+	err := db.QueryRowContext(ctx, query, productID, models.OrderStatusCancelled, models.OrderStatusPending).Scan(
+		&sales.ProductID, &sales.UnitsSold, &sales.Revenue, &sales.Currency, &sales.OrderCount)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, database.ErrProductNotFound
+		}
+		return nil, fmt.Errorf("get product sales: %w", err)
+	}
+
+	return &sales, nil
+}
+
+type ProductPatch struct {
+	Name          *string
+	Description   *string
+	Price         *decimal.Decimal
+	StockQuantity *int
+}
+
+func (p ProductPatch) IsEmpty() bool {
+	return p.Name == nil && p.Description == nil && p.Price == nil && p.StockQuantity == nil
+}
+
+// PatchProduct updates only the non-nil fields of patch, guarded by the
+// product's version. A stock quantity below the units currently reserved is
+// refused with a validation error.
+func PatchProduct(ctx context.Context, db Querier, id int64, patch ProductPatch, version int) (*models.Product, error) {
+	var sets []string
+	var args []interface{}
+
+	addSet := func(column string, value interface{}) {
+		args = append(args, value)
+		sets = append(sets, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
+
+	if patch.Name != nil {
+		addSet("name", *patch.Name)
+	}
+	if patch.Description != nil {
+		addSet("description", *patch.Description)
+	}
+	if patch.Price != nil {
+		addSet("price", *patch.Price)
+	}
+	if patch.StockQuantity != nil {
+		addSet("stock_quantity", *patch.StockQuantity)
+		// A direct stock change is a restock or write-off, not a sale.
+		sets = append(sets, fmt.Sprintf("stocked_quantity = stocked_quantity + $%d - stock_quantity", len(args)))
+	}
+
+	sets = append(sets, "version = version + 1", "updated_at = NOW()")
+	args = append(args, id, version)
+
+	query := fmt.Sprintf(`
+		UPDATE products
+		SET %s
+		WHERE id = $%d AND version = $%d
+		RETURNING `+models.ProductColumns,
+		strings.Join(sets, ", "), len(args)-1, len(args))
+
+	var product *models.Product
+	err := writeAs(ctx, db, func(q Querier) error {
+		var err error
+		product, err = models.ScanProduct(q.QueryRowContext(ctx, query, args...))
+		return err
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, productVersionMismatch(ctx, db, id)
+		}
+		if database.IsCheckViolation(err, "reserved_within_stock") {
+			var errs ValidationErrors
+			errs.add("stock_quantity", "must not be below the reserved quantity", database.ErrInsufficientStock)
+			return nil, errs
+		}
+		return nil, fmt.Errorf("patch product: %w", err)
+	}
+
+	invalidateProducts(id)
+	return product, nil
+}
+
+// UpdateProductSKU changes a product's SKU, guarded by its version. The new
+// SKU is normalized like CreateProduct's, and one already used by another
+// product, in any case, fails with ErrDuplicateSKU.
+func UpdateProductSKU(ctx context.Context, db Querier, id int64, newSKU string, version int) (*models.Product, error) {
+	sku := normalizeSKU(newSKU)
+	if sku == "" {
+		var errs ValidationErrors
+		errs.add("sku", "must not be empty", nil)
+		return nil, errs
+	}
+
+	var product *models.Product
+	err := writeAs(ctx, db, func(q Querier) error {
+		var err error
+		product, err = models.ScanProduct(q.QueryRowContext(ctx,
+			`UPDATE products
+			 SET sku = $2, version = version + 1, updated_at = NOW()
+			 WHERE id = $1 AND version = $3
+			 RETURNING `+models.ProductColumns,
+			id, sku, version))
+		return err
+	})
+	if err == sql.ErrNoRows {
+		return nil, productVersionMismatch(ctx, db, id)
+	}
+	if database.IsUniqueViolation(err) {
+		return nil, database.ErrDuplicateSKU
+	}
+	if err != nil {
+		return nil, fmt.Errorf("update product sku: %w", err)
+	}
+
+	invalidateProducts(id)
+	return product, nil
+}
+
+// ResyncProductVersion is an admin repair for a product whose version fell
+// behind, e.g. after writes that bypassed the store. It raises the version to
+// expectedVersion. Lowering it is refused with a validation error, since that
+// could let a client holding a stale version overwrite newer data; asking for
+// the current version changes nothing.
+func ResyncProductVersion(ctx context.Context, db Querier, productID int64, expectedVersion int) (*models.Product, error) {
+	var product *models.Product
+	err := writeAs(ctx, db, func(q Querier) error {
+		var err error
+		product, err = models.ScanProduct(q.QueryRowContext(ctx,
+			`UPDATE products
+			 SET version = $2, updated_at = NOW()
+			 WHERE id = $1 AND version < $2
+			 RETURNING `+models.ProductColumns,
+			productID, expectedVersion))
+		return err
+	})
+	if err == sql.ErrNoRows {
+		current, err := GetProduct(ctx, db, productID)
+		if err != nil {
+			return nil, err
+		}
+		if current.Version != expectedVersion {
+			var errs ValidationErrors
+			errs.add("version", fmt.Sprintf("must not be lower than the current version %d", current.Version), nil)
+			return nil, errs
+		}
+		return current, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("resync product version: %w", err)
+	}
+
+	invalidateProducts(productID)
+	return product, nil
+}
+
+// AdjustPricesByPercent changes the price of every product in productIDs by
+// percent, e.g. -20 for a 20% discount, rounding to cents half away from
+// zero. The products are locked in ID order and updated in one transaction,
+// and each price change is recorded by the products_price_history trigger.
+// A percent below -100 would make prices negative and is refused. Unknown IDs
+// are skipped; it returns the number of products updated.
+func AdjustPricesByPercent(ctx context.Context, db *sql.DB, productIDs []int64, percent decimal.Decimal) (int64, error) {
+	var errs ValidationErrors
+	if len(productIDs) == 0 {
+		errs.add("product_ids", "must contain at least one product ID", nil)
+	}
+	if percent.LessThan(decimal.NewFromInt(-100)) {
+		errs.add("percent", "must not be below -100", nil)
+	}
+	if len(errs) > 0 {
+		return 0, errs
+	}
+
+	factor := decimal.NewFromInt(1).Add(percent.Div(decimal.NewFromInt(100)))
+	var updated int64
+	idCondition, idArg := anyOf("id", 1, productIDs)
+
+	err := database.WithRetry(ctx, db, database.DefaultTxOptions(), func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx,
+			`SELECT id FROM products WHERE `+idCondition+` ORDER BY id FOR UPDATE`,
+			idArg)
+		if err != nil {
+			return fmt.Errorf("lock products: %w", err)
+		}
+
+		result, err := tx.ExecContext(ctx,
+			`UPDATE products
+			 SET price = ROUND(price * $2::numeric, 2),
+			     version = version + 1,
+			     updated_at = NOW()
+			 WHERE `+idCondition,
+			idArg, factor)
+		if err != nil {
+			return fmt.Errorf("adjust prices: %w", err)
+		}
 
+		updated, err = result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("get rows affected: %w", err)
+		}
+		return nil
+	})
+	if database.IsNumericOutOfRange(err) {
+		return 0, database.ErrNumericOutOfRange
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	invalidateProducts(productIDs...)
+	return updated, nil
+}
+
+func productVersionMismatch(ctx context.Context, db Querier, id int64) error {
+	var exists bool
+	err := db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM products WHERE id = $1)`, id).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("check product exists: %w", err)
+	}
+	if !exists {
+		return database.ErrProductNotFound
+	}
+	return database.ErrOptimisticLockFailed
+}
+
+func ReserveStock(ctx context.Context, tx *sql.Tx, productID int64, quantity int) (*models.Product, error) {
 	query := `
-		SELECT id, sku, name, description, price, stock_quantity, created_at, updated_at, version
+		SELECT ` + models.ProductColumns + `
 		FROM products
 		WHERE id = $1
 		FOR UPDATE`
 
-	err := tx.QueryRowContext(ctx, query, productID).Scan(
-		&product.ID,
-		&product.SKU,
-		&product.Name,
-		&product.Description,
-		&product.Price,
-		&product.StockQuantity,
-		&product.CreatedAt,
-		&product.UpdatedAt,
-		&product.Version,
-	)
+	product, err := models.ScanProduct(tx.QueryRowContext(ctx, query, productID))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, database.ErrProductNotFound
@@ -93,7 +455,7 @@ func ReserveStock(ctx context.Context, tx *sql.Tx, productID int64, quantity int
 		return nil, fmt.Errorf("lock product: %w", err)
 	}
 
-	if product.StockQuantity < quantity {
+	if product.AvailableQuantity() < quantity {
 		return nil, database.ErrInsufficientStock
 	}
 
@@ -101,25 +463,13 @@ func ReserveStock(ctx context.Context, tx *sql.Tx, productID int64, quantity int
 }
 
 func ReserveStockNoWait(ctx context.Context, tx *sql.Tx, productID int64, quantity int) (*models.Product, error) {
-	product := &models.Product{}
-
 	query := `
-		SELECT id, sku, name, description, price, stock_quantity, created_at, updated_at, version
+		SELECT ` + models.ProductColumns + `
 		FROM products
 		WHERE id = $1
 		FOR UPDATE NOWAIT`
 
-	err := tx.QueryRowContext(ctx, query, productID).Scan(
-		&product.ID,
-		&product.SKU,
-		&product.Name,
-		&product.Description,
-		&product.Price,
-		&product.StockQuantity,
-		&product.CreatedAt,
-		&product.UpdatedAt,
-		&product.Version,
-	)
+	product, err := models.ScanProduct(tx.QueryRowContext(ctx, query, productID))
 	if err != nil {
 		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "55P03" {
 			return nil, database.ErrLockTimeout
@@ -130,19 +480,27 @@ func ReserveStockNoWait(ctx context.Context, tx *sql.Tx, productID int64, quanti
 		return nil, fmt.Errorf("lock product (nowait): %w", err)
 	}
 
-	if product.StockQuantity < quantity {
+	if product.AvailableQuantity() < quantity {
 		return nil, database.ErrInsufficientStock
 	}
 
 	return product, nil
 }
 
-func UpdateStockOptimistic(ctx context.Context, db *sql.DB, productID int64, newStock int, version int) error {
-	result, err := db.ExecContext(ctx,
-		`UPDATE products
-		 SET stock_quantity = $1, version = version + 1, updated_at = NOW()
-		 WHERE id = $2 AND version = $3`,
-		newStock, productID, version)
+func UpdateStockOptimistic(ctx context.Context, db Querier, productID int64, newStock int, version int) error {
+	var result sql.Result
+	err := writeAs(ctx, db, func(q Querier) error {
+		var err error
+		result, err = q.ExecContext(ctx,
+			`UPDATE products
+			 SET stock_quantity = $1,
+			     stocked_quantity = stocked_quantity + $1 - stock_quantity,
+			     version = version + 1,
+			     updated_at = NOW()
+			 WHERE id = $2 AND version = $3`,
+			newStock, productID, version)
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("update stock: %w", err)
 	}
@@ -156,19 +514,73 @@ func UpdateStockOptimistic(ctx context.Context, db *sql.DB, productID int64, new
 		return database.ErrOptimisticLockFailed
 	}
 
+	invalidateProducts(productID)
 	return nil
 }
 
 func DecrementStock(ctx context.Context, tx *sql.Tx, productID int64, quantity int) error {
-	result, err := tx.ExecContext(ctx,
+	_, err := DecrementStockReturning(ctx, tx, productID, quantity)
+	return err
+}
+
+// DecrementStockReturning is DecrementStock that also returns the product's
+// stock_quantity after the decrement, saving callers a re-read.
+func DecrementStockReturning(ctx context.Context, tx *sql.Tx, productID int64, quantity int) (int, error) {
+	var newStock int
+	err := tx.QueryRowContext(ctx,
 		`UPDATE products
 		 SET stock_quantity = stock_quantity - $1,
 		     updated_at = NOW()
 		 WHERE id = $2
-		   AND stock_quantity >= $1`,
-		quantity, productID)
+		   AND stock_quantity - reserved_quantity >= $1
+		 RETURNING stock_quantity`,
+		quantity, productID).Scan(&newStock)
+	if err == sql.ErrNoRows {
+		return 0, database.ErrInsufficientStock
+	}
 	if err != nil {
-		return fmt.Errorf("decrement stock: %w", err)
+		return 0, fmt.Errorf("decrement stock: %w", err)
+	}
+
+	invalidateProducts(productID)
+	return newStock, nil
+}
+
+// DecrementStockBatch decrements stock for all items in a single UPDATE. It
+// fails with ErrInsufficientStock unless every product row was updated.
+func DecrementStockBatch(ctx context.Context, tx *sql.Tx, items []OrderItemRequest) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	quantities := make(map[int64]int)
+	var productIDs []int64
+	for _, item := range items {
+		if _, ok := quantities[item.ProductID]; !ok {
+			productIDs = append(productIDs, item.ProductID)
+		}
+		quantities[item.ProductID] += item.Quantity
+	}
+	sort.Slice(productIDs, func(i, j int) bool { return productIDs[i] < productIDs[j] })
+
+	values := make([]string, 0, len(productIDs))
+	args := make([]interface{}, 0, len(productIDs)*2)
+	for i, productID := range productIDs {
+		values = append(values, fmt.Sprintf("($%d::bigint, $%d::int)", i*2+1, i*2+2))
+		args = append(args, productID, quantities[productID])
+	}
+
+	query := `
+		UPDATE products
+		SET stock_quantity = stock_quantity - v.qty,
+		    updated_at = NOW()
+		FROM (VALUES ` + strings.Join(values, ", ") + `) AS v(id, qty)
+		WHERE products.id = v.id
+		  AND products.stock_quantity - products.reserved_quantity >= v.qty`
+
+	result, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("decrement stock batch: %w", err)
 	}
 
 	rowsAffected, err := result.RowsAffected()
@@ -176,28 +588,162 @@ func DecrementStock(ctx context.Context, tx *sql.Tx, productID int64, quantity i
 		return fmt.Errorf("get rows affected: %w", err)
 	}
 
-	if rowsAffected == 0 {
+	if rowsAffected != int64(len(productIDs)) {
 		return database.ErrInsufficientStock
 	}
 
+	invalidateProducts(productIDs...)
 	return nil
 }
 
-func ListProducts(ctx context.Context, db *sql.DB, page, pageSize int) (*OffsetPage, error) {
-	var total int64
-	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM products`).Scan(&total)
+// ListLowStockProducts returns products whose stock is below threshold, lowest
+// stock first.
+func ListLowStockProducts(ctx context.Context, db Querier, threshold int) ([]models.Product, error) {
+	query := `
+		SELECT ` + models.ProductColumns + `
+		FROM products
+		WHERE stock_quantity < $1
+		ORDER BY stock_quantity, id`
+
+	rows, err := db.QueryContext(ctx, query, threshold)
 	if err != nil {
-		return nil, fmt.Errorf("count products: %w", err)
+		return nil, fmt.Errorf("list low stock products: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			return
+		}
+	}()
+
+	products := []models.Product{}
+	for rows.Next() {
+		product, err := models.ScanProduct(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan product: %w", err)
+		}
+		products = append(products, *product)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return products, nil
+}
+
+// ListProductsConsistent runs ListProducts in a REPEATABLE READ transaction so
+// Total and Items come from the same snapshot. Plain ListProducts runs the
+// count and the page query separately, so a concurrent insert can make them
+// disagree.
+func ListProductsConsistent(ctx context.Context, db *sql.DB, page, pageSize int, filter ProductFilter, pageOpts PageOptions) (*OffsetPage, error) {
+	var result *OffsetPage
+
+	opts := database.TxOptions{IsolationLevel: sql.LevelRepeatableRead, ReadOnly: true}
+	err := database.WithTransaction(ctx, db, opts, func(tx *sql.Tx) error {
+		var err error
+		result, err = ListProducts(ctx, tx, page, pageSize, filter, pageOpts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// ProductFilter narrows ListProducts. The zero value matches every product.
+type ProductFilter struct {
+	// InStockOnly leaves out products with no stock.
+	InStockOnly bool
+
+	// CreatedFrom (inclusive) and CreatedTo (exclusive) bound created_at
+	// when non-zero.
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+}
+
+// where returns the WHERE clause for f, numbering its placeholders from $1,
+// along with their arguments.
+func (f ProductFilter) where() (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	if f.InStockOnly {
+		conditions = append(conditions, "stock_quantity > 0")
+	}
+	if !f.CreatedFrom.IsZero() {
+		args = append(args, f.CreatedFrom.UTC())
+		conditions = append(conditions, fmt.Sprintf("created_at >= $%d", len(args)))
+	}
+	if !f.CreatedTo.IsZero() {
+		args = append(args, f.CreatedTo.UTC())
+		conditions = append(conditions, fmt.Sprintf("created_at < $%d", len(args)))
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return "WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// StreamProducts calls fn with every product matching filter, in ID order, as
+// the rows are read, so callers can export the whole table without holding it
+// in memory. It stops at the first error fn returns and returns it.
+func StreamProducts(ctx context.Context, db Querier, filter ProductFilter, fn func(*models.Product) error) error {
+	where, args := filter.where()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+models.ProductColumns+`
+		FROM products
+		`+where+`
+		ORDER BY id`, args...)
+	if err != nil {
+		return fmt.Errorf("stream products: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			return
+		}
+	}()
+
+	for rows.Next() {
+		product, err := models.ScanProduct(rows)
+		if err != nil {
+			return fmt.Errorf("scan product: %w", err)
+		}
+		if err := fn(product); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("rows error: %w", err)
+	}
+	return nil
+}
+
+// ListProducts returns a page of the products matching filter, newest
+// first.
+func ListProducts(ctx context.Context, db Querier, page, pageSize int, filter ProductFilter, opts PageOptions) (*OffsetPage, error) {
+	where, args := filter.where()
+
+	total := int64(-1)
+	if opts.IncludeTotal {
+		err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM products `+where, args...).Scan(&total)
+		if err != nil {
+			return nil, fmt.Errorf("count products: %w", err)
+		}
 	}
 
 	offset := (page - 1) * pageSize
-	query := `
-		SELECT id, sku, name, description, price, stock_quantity, created_at, updated_at, version
+	query := fmt.Sprintf(`
+		SELECT `+models.ProductColumns+`
 		FROM products
+		%s
 		ORDER BY created_at DESC
-		LIMIT $1 OFFSET $2`
+		LIMIT $%d OFFSET $%d`, where, len(args)+1, len(args)+2)
 
-	rows, err := db.QueryContext(ctx, query, pageSize, offset)
+	rows, err := db.QueryContext(ctx, query, append(args, pageSize, offset)...)
 	if err != nil {
 		return nil, fmt.Errorf("list products: %w", err)
 	}
@@ -207,40 +753,18 @@ func ListProducts(ctx context.Context, db *sql.DB, page, pageSize int) (*OffsetP
 		}
 	}()
 
-	var products []models.Product
+	products := []models.Product{}
 	for rows.Next() {
-		var product models.Product
-		err := rows.Scan(
-			&product.ID,
-			&product.SKU,
-			&product.Name,
-			&product.Description,
-			&product.Price,
-			&product.StockQuantity,
-			&product.CreatedAt,
-			&product.UpdatedAt,
-			&product.Version,
-		)
+		product, err := models.ScanProduct(rows)
 		if err != nil {
 			return nil, fmt.Errorf("scan product: %w", err)
 		}
-		products = append(products, product)
+		products = append(products, *product)
 	}
 
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("rows error: %w", err)
 	}
 
-	totalPages := int(total) / pageSize
-	if int(total)%pageSize > 0 {
-		totalPages++
-	}
-
-	return &OffsetPage{
-		Items:      products,
-		Total:      total,
-		Page:       page,
-		PageSize:   pageSize,
-		TotalPages: totalPages,
-	}, nil
+	return newOffsetPage(products, total, page, pageSize), nil
 }
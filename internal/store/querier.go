@@ -0,0 +1,19 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Querier is satisfied by both *sql.DB and *sql.Tx, so functions that accept
+// it can run standalone or inside a caller's transaction.
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+var (
+	_ Querier = (*sql.DB)(nil)
+	_ Querier = (*sql.Tx)(nil)
+)
@@ -0,0 +1,274 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/safar/go-sql-store/internal/database"
+	"github.com/safar/go-sql-store/internal/models"
+)
+
+type StockDiscrepancy struct {
+	ProductID     int64  `json:"product_id"`
+	SKU           string `json:"sku"`
+	ExpectedStock int    `json:"expected_stock"`
+	ActualStock   int    `json:"actual_stock"`
+	Corrected     bool   `json:"corrected"`
+}
+
+// ReconcileStock reports products whose stock_quantity differs from
+// stocked_quantity minus the units sold in non-cancelled orders and taken by
+// consumed standalone reservations. Pending reserve-only orders have not
+// taken stock yet and are not counted. With correct set, it also resets
+// stock_quantity to the expected value, unless that would drop below the
+// reserved quantity.
+func ReconcileStock(ctx context.Context, db *sql.DB, correct bool) ([]StockDiscrepancy, error) {
+	var discrepancies []StockDiscrepancy
+
+	opts := database.TxOptions{IsolationLevel: sql.LevelRepeatableRead, ReadOnly: true}
+	if correct {
+		opts = database.DefaultTxOptions()
+	}
+
+	err := database.WithTransaction(ctx, db, opts, func(tx *sql.Tx) error {
+		if correct {
+			// Block orders for the duration so sales can't land between
+			// computing the expected stock and writing it.
+			if _, err := tx.ExecContext(ctx, `SELECT id FROM products ORDER BY id FOR UPDATE`); err != nil {
+				return fmt.Errorf("lock products: %w", err)
+			}
+		}
+
+		var err error
+		discrepancies, err = findStockDiscrepancies(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		if !correct {
+			return nil
+		}
+
+		for i := range discrepancies {
+			d := &discrepancies[i]
+			result, err := tx.ExecContext(ctx,
+				`UPDATE products
+				 SET stock_quantity = $1, version = version + 1, updated_at = NOW()
+				 WHERE id = $2 AND $1 >= reserved_quantity`,
+				d.ExpectedStock, d.ProductID)
+			if err != nil {
+				return fmt.Errorf("correct stock for product %d: %w", d.ProductID, err)
+			}
+
+			rowsAffected, err := result.RowsAffected()
+			if err != nil {
+				return fmt.Errorf("get rows affected: %w", err)
+			}
+			d.Corrected = rowsAffected == 1
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range discrepancies {
+		if d.Corrected {
+			invalidateProducts(d.ProductID)
+		}
+	}
+
+	return discrepancies, nil
+}
+
+// OrderReview is an open order that references products whose stock is
+// inconsistent.
+type OrderReview struct {
+	Order    models.Order       `json:"order"`
+	Products []StockDiscrepancy `json:"products"`
+}
+
+// ListOrdersNeedingReview returns the pending and confirmed orders that
+// contain a product ReconcileStock would report, oldest first, each with the
+// offending products. Those orders may have been accepted against stock that
+// isn't there.
+func ListOrdersNeedingReview(ctx context.Context, db *sql.DB) ([]OrderReview, error) {
+	var reviews []OrderReview
+
+	opts := database.TxOptions{IsolationLevel: sql.LevelRepeatableRead, ReadOnly: true}
+	err := database.WithTransaction(ctx, db, opts, func(tx *sql.Tx) error {
+		discrepancies, err := findStockDiscrepancies(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		byProduct := make(map[int64]StockDiscrepancy, len(discrepancies))
+		productIDs := make([]int64, 0, len(discrepancies))
+		for _, d := range discrepancies {
+			byProduct[d.ProductID] = d
+			productIDs = append(productIDs, d.ProductID)
+		}
+
+		productsCondition, productsArg := anyOf("oi.product_id", 1, productIDs)
+		statusesCondition, statusesArg := anyOf("o.status", 2, []string{models.OrderStatusPending, models.OrderStatusConfirmed})
+		rows, err := tx.QueryContext(ctx, `
+			SELECT oi.order_id, oi.product_id
+			FROM order_items oi
+			JOIN orders o ON o.id = oi.order_id
+			WHERE `+productsCondition+`
+			  AND `+statusesCondition+`
+			ORDER BY oi.order_id, oi.product_id`,
+			productsArg, statusesArg)
+		if err != nil {
+			return fmt.Errorf("find orders needing review: %w", err)
+		}
+		defer func() {
+			if err := rows.Close(); err != nil {
+				return
+			}
+		}()
+
+		reviews = []OrderReview{}
+		var orderIDs []int64
+		for rows.Next() {
+			var orderID, productID int64
+			if err := rows.Scan(&orderID, &productID); err != nil {
+				return fmt.Errorf("scan order needing review: %w", err)
+			}
+			if len(orderIDs) == 0 || orderIDs[len(orderIDs)-1] != orderID {
+				orderIDs = append(orderIDs, orderID)
+				reviews = append(reviews, OrderReview{Order: models.Order{ID: orderID}})
+			}
+			review := &reviews[len(reviews)-1]
+			review.Products = append(review.Products, byProduct[productID])
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("rows error: %w", err)
+		}
+
+		ordersCondition, ordersArg := anyOf("id", 1, orderIDs)
+		orderRows, err := tx.QueryContext(ctx,
+			`SELECT `+models.OrderColumns+` FROM orders WHERE `+ordersCondition, ordersArg)
+		if err != nil {
+			return fmt.Errorf("get orders needing review: %w", err)
+		}
+		defer func() {
+			if err := orderRows.Close(); err != nil {
+				return
+			}
+		}()
+
+		orders := make(map[int64]models.Order, len(orderIDs))
+		for orderRows.Next() {
+			order, err := models.ScanOrder(orderRows)
+			if err != nil {
+				return fmt.Errorf("scan order: %w", err)
+			}
+			orders[order.ID] = *order
+		}
+		if err := orderRows.Err(); err != nil {
+			return fmt.Errorf("rows error: %w", err)
+		}
+
+		for i := range reviews {
+			reviews[i].Order = orders[reviews[i].Order.ID]
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return reviews, nil
+}
+
+// FindOrphanedOrderItems returns the order items whose order no longer
+// exists, ordered by ID. The order_items_order_id_fkey foreign key rules them
+// out, so any found mean it was dropped or bypassed; migration 027 restores
+// it once they are removed.
+func FindOrphanedOrderItems(ctx context.Context, db Querier) ([]models.OrderItem, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT `+models.OrderItemColumns+`
+		 FROM order_items oi
+		 WHERE NOT EXISTS (SELECT 1 FROM orders o WHERE o.id = oi.order_id)
+		 ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("find orphaned order items: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			return
+		}
+	}()
+
+	items := []models.OrderItem{}
+	for rows.Next() {
+		item, err := models.ScanOrderItem(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan order item: %w", err)
+		}
+		items = append(items, *item)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return items, nil
+}
+
+// findStockDiscrepancies lists the products whose stock_quantity doesn't
+// match the stock their sales and consumed reservations leave, as described
+// on ReconcileStock.
+func findStockDiscrepancies(ctx context.Context, tx *sql.Tx) ([]StockDiscrepancy, error) {
+	var discrepancies []StockDiscrepancy
+
+	rows, err := tx.QueryContext(ctx,
+		`SELECT p.id, p.sku, p.stocked_quantity - COALESCE(s.sold, 0), p.stock_quantity
+		 FROM products p
+		 LEFT JOIN (
+		     SELECT product_id, SUM(quantity) AS sold
+		     FROM (
+		         SELECT oi.product_id, oi.quantity
+		         FROM order_items oi
+		         JOIN orders o ON o.id = oi.order_id
+		         WHERE o.status <> $1
+		           AND NOT (o.status = $2 AND EXISTS (
+		               SELECT 1 FROM stock_reservations r WHERE r.order_id = o.id
+		           ))
+		         UNION ALL
+		         SELECT product_id, quantity
+		         FROM stock_reservations
+		         WHERE order_id IS NULL AND consumed_at IS NOT NULL
+		     ) taken
+		     GROUP BY product_id
+		 ) s ON s.product_id = p.id
+		 WHERE p.stocked_quantity - COALESCE(s.sold, 0) <> p.stock_quantity
+		 ORDER BY p.id`,
+		models.OrderStatusCancelled, models.OrderStatusPending)
+	if err != nil {
+		return nil, fmt.Errorf("find stock discrepancies: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			return
+		}
+	}()
+
+	for rows.Next() {
+		var d StockDiscrepancy
+		if err := rows.Scan(&d.ProductID, &d.SKU, &d.ExpectedStock, &d.ActualStock); err != nil {
+			return nil, fmt.Errorf("scan stock discrepancy: %w", err)
+		}
+		discrepancies = append(discrepancies, d)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return discrepancies, nil
+}
@@ -0,0 +1,333 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/safar/go-sql-store/internal/database"
+	"github.com/safar/go-sql-store/internal/models"
+)
+
+// HoldStock moves quantity from available to reserved stock and records the
+// reservation. The stock stays on hand until the reservation is released or
+// converted into a permanent decrement.
+func HoldStock(ctx context.Context, tx *sql.Tx, productID int64, quantity int) (*models.StockReservation, error) {
+	return holdStock(ctx, tx, productID, quantity, 0, 0)
+}
+
+// holdStock is HoldStock with an optional ttl and cart; a positive ttl records
+// expires_at relative to the transaction's NOW(), a non-zero cartID links the
+// reservation to that cart.
+func holdStock(ctx context.Context, tx *sql.Tx, productID int64, quantity int, ttl time.Duration, cartID int64) (*models.StockReservation, error) {
+	product, err := ReserveStock(ctx, tx, productID, quantity)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE products
+		 SET reserved_quantity = reserved_quantity + $1,
+		     updated_at = NOW()
+		 WHERE id = $2`,
+		quantity, product.ID)
+	if err != nil {
+		return nil, fmt.Errorf("hold stock: %w", err)
+	}
+	invalidateProducts(product.ID)
+
+	var expiresAt interface{}
+	if ttl > 0 {
+		expiresAt = ttl.Seconds()
+	}
+
+	reservation, err := models.ScanStockReservation(tx.QueryRowContext(ctx,
+		`INSERT INTO stock_reservations (product_id, quantity, created_at, expires_at, cart_id)
+		 VALUES ($1, $2, NOW(), NOW() + make_interval(secs => $3), NULLIF($4, 0))
+		 RETURNING `+models.StockReservationColumns,
+		product.ID, quantity, expiresAt, cartID))
+	if err != nil {
+		return nil, fmt.Errorf("create reservation: %w", err)
+	}
+
+	return reservation, nil
+}
+
+// CreateReservation holds quantity units of a product for ttl without
+// creating an order. The hold ends when the reservation is consumed,
+// cancelled, or released by ReleaseExpiredReservations after it expires.
+func CreateReservation(ctx context.Context, db *sql.DB, productID int64, quantity int, ttl time.Duration) (*models.StockReservation, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("reservation ttl must be positive, got %s", ttl)
+	}
+
+	var reservation *models.StockReservation
+
+	err := database.WithRetry(ctx, db, database.DefaultTxOptions(), func(tx *sql.Tx) error {
+		var err error
+		reservation, err = holdStock(ctx, tx, productID, quantity, ttl, 0)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	invalidateProducts(productID)
+	return reservation, nil
+}
+
+// ConsumeReservation takes the held units out of stock and closes the
+// reservation. It returns ErrReservationExpired if the reservation has
+// expired or is no longer held.
+func ConsumeReservation(ctx context.Context, db *sql.DB, reservationID int64) (*models.StockReservation, error) {
+	return closeReservation(ctx, db, reservationID, true)
+}
+
+// CancelReservation returns the held units to available stock and closes
+// the reservation. It returns ErrReservationExpired if the reservation is no
+// longer held.
+func CancelReservation(ctx context.Context, db *sql.DB, reservationID int64) (*models.StockReservation, error) {
+	return closeReservation(ctx, db, reservationID, false)
+}
+
+func closeReservation(ctx context.Context, db *sql.DB, reservationID int64, consume bool) (*models.StockReservation, error) {
+	var reservation *models.StockReservation
+
+	err := database.WithRetry(ctx, db, database.DefaultTxOptions(), func(tx *sql.Tx) error {
+		var expired bool
+		err := tx.QueryRowContext(ctx,
+			`SELECT released_at IS NOT NULL OR COALESCE(expires_at <= NOW(), false)
+			 FROM stock_reservations
+			 WHERE id = $1 AND order_id IS NULL AND cart_id IS NULL
+			 FOR UPDATE`,
+			reservationID).Scan(&expired)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return database.ErrReservationNotFound
+			}
+			return fmt.Errorf("lock reservation: %w", err)
+		}
+
+		if expired && consume {
+			return database.ErrReservationExpired
+		}
+
+		consumedAt := "NULL"
+		stockChange := "stock_quantity"
+		if consume {
+			consumedAt = "NOW()"
+			stockChange = "stock_quantity - $1"
+		}
+
+		reservation, err = models.ScanStockReservation(tx.QueryRowContext(ctx,
+			`UPDATE stock_reservations
+			 SET released_at = NOW(),
+			     consumed_at = `+consumedAt+`
+			 WHERE id = $1 AND released_at IS NULL
+			 RETURNING `+models.StockReservationColumns,
+			reservationID))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return database.ErrReservationExpired
+			}
+			return fmt.Errorf("close reservation: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx,
+			`UPDATE products
+			 SET stock_quantity = `+stockChange+`,
+			     reserved_quantity = reserved_quantity - $1,
+			     updated_at = NOW()
+			 WHERE id = $2`,
+			reservation.Quantity, reservation.ProductID)
+		if err != nil {
+			return fmt.Errorf("settle reserved stock: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	invalidateProducts(reservation.ProductID)
+	return reservation, nil
+}
+
+// ReleaseExpiredReservations returns stock held by expired reservations to
+// available stock and reports how many were released. Reservations with an
+// expires_at expire at that time; the rest expire when created before
+// olderThan.
+func ReleaseExpiredReservations(ctx context.Context, db *sql.DB, olderThan time.Time) (int64, error) {
+	var released int64
+	var productIDs []int64
+
+	err := database.WithRetry(ctx, db, database.DefaultTxOptions(), func(tx *sql.Tx) error {
+		released = 0
+		productIDs = nil
+
+		rows, err := tx.QueryContext(ctx,
+			`UPDATE stock_reservations
+			 SET released_at = NOW()
+			 WHERE released_at IS NULL
+			   AND COALESCE(expires_at <= NOW(), created_at < $1)
+			 RETURNING product_id, quantity`,
+			olderThan)
+		if err != nil {
+			return fmt.Errorf("release reservations: %w", err)
+		}
+		defer func() {
+			if err := rows.Close(); err != nil {
+				return
+			}
+		}()
+
+		quantities := make(map[int64]int)
+		for rows.Next() {
+			var productID int64
+			var quantity int
+			if err := rows.Scan(&productID, &quantity); err != nil {
+				return fmt.Errorf("scan reservation: %w", err)
+			}
+			if _, ok := quantities[productID]; !ok {
+				productIDs = append(productIDs, productID)
+			}
+			quantities[productID] += quantity
+			released++
+		}
+
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("rows error: %w", err)
+		}
+
+		sort.Slice(productIDs, func(i, j int) bool { return productIDs[i] < productIDs[j] })
+
+		for _, productID := range productIDs {
+			_, err := tx.ExecContext(ctx,
+				`UPDATE products
+				 SET reserved_quantity = reserved_quantity - $1,
+				     updated_at = NOW()
+				 WHERE id = $2`,
+				quantities[productID], productID)
+			if err != nil {
+				return fmt.Errorf("restore reserved stock: %w", err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	invalidateProducts(productIDs...)
+	return released, nil
+}
+
+// holdOrderStock reserves stock for every item of a reserve-only order. The
+// products must already be locked by the caller.
+func holdOrderStock(ctx context.Context, tx *sql.Tx, orderID int64, items []OrderItemRequest) error {
+	for _, item := range lockOrder(items) {
+		result, err := tx.ExecContext(ctx,
+			`UPDATE products
+			 SET reserved_quantity = reserved_quantity + $1,
+			     updated_at = NOW()
+			 WHERE id = $2
+			   AND stock_quantity - reserved_quantity >= $1`,
+			item.Quantity, item.ProductID)
+		if err != nil {
+			return fmt.Errorf("hold stock: %w", err)
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("get rows affected: %w", err)
+		}
+		if rowsAffected == 0 {
+			return database.ErrInsufficientStock
+		}
+
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO stock_reservations (product_id, quantity, order_id, created_at)
+			 VALUES ($1, $2, $3, NOW())`,
+			item.ProductID, item.Quantity, orderID)
+		if err != nil {
+			return fmt.Errorf("create reservation: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// orderReservations reports whether the order was created reserve-only and,
+// if so, whether all of its reservations are still open.
+func orderReservations(ctx context.Context, tx *sql.Tx, orderID int64) (reserved bool, open bool, err error) {
+	var total, openCount int
+	err = tx.QueryRowContext(ctx,
+		`SELECT COUNT(*), COUNT(*) FILTER (WHERE released_at IS NULL)
+		 FROM stock_reservations
+		 WHERE order_id = $1`,
+		orderID).Scan(&total, &openCount)
+	if err != nil {
+		return false, false, fmt.Errorf("count order reservations: %w", err)
+	}
+
+	return total > 0, total > 0 && openCount == total, nil
+}
+
+// settleOrderReservations closes an order's open reservations. With capture
+// set the held units are also taken out of stock; otherwise they become
+// available again.
+func settleOrderReservations(ctx context.Context, tx *sql.Tx, orderID int64, capture bool) error {
+	return settleReservations(ctx, tx, "order_id", orderID, capture)
+}
+
+// settleReservations closes the open reservations whose owner column, order_id
+// or cart_id, is ownerID.
+func settleReservations(ctx context.Context, tx *sql.Tx, owner string, ownerID int64, capture bool) error {
+	_, err := tx.ExecContext(ctx,
+		`SELECT id
+		 FROM products
+		 WHERE id IN (SELECT product_id FROM stock_reservations WHERE `+owner+` = $1 AND released_at IS NULL)
+		 ORDER BY id
+		 FOR UPDATE`,
+		ownerID)
+	if err != nil {
+		return fmt.Errorf("lock reserved products: %w", err)
+	}
+
+	stockChange := "p.stock_quantity"
+	if capture {
+		stockChange = "p.stock_quantity - r.quantity"
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE products p
+		 SET stock_quantity = `+stockChange+`,
+		     reserved_quantity = p.reserved_quantity - r.quantity,
+		     updated_at = NOW()
+		 FROM (
+		     SELECT product_id, SUM(quantity) AS quantity
+		     FROM stock_reservations
+		     WHERE `+owner+` = $1 AND released_at IS NULL
+		     GROUP BY product_id
+		 ) r
+		 WHERE p.id = r.product_id`,
+		ownerID)
+	if err != nil {
+		return fmt.Errorf("settle reserved stock: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE stock_reservations
+		 SET released_at = NOW()
+		 WHERE `+owner+` = $1 AND released_at IS NULL`,
+		ownerID)
+	if err != nil {
+		return fmt.Errorf("close reservations: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package store
+
+import (
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// anyOf builds a `column = ANY($index)` condition and the array argument to
+// bind at that index. List filters use it instead of building
+// IN ($1, $2, ...) placeholder lists, so a query has the same text and the
+// same number of parameters however many values are passed. An empty list
+// matches no rows.
+func anyOf[T int64 | string](column string, index int, values []T) (string, interface{}) {
+	condition := fmt.Sprintf("%s = ANY($%d)", column, index)
+
+	switch v := any(values).(type) {
+	case []int64:
+		if v == nil {
+			v = []int64{}
+		}
+		return condition, pq.Int64Array(v)
+	case []string:
+		if v == nil {
+			v = []string{}
+		}
+		return condition, pq.StringArray(v)
+	}
+
+	panic("unreachable")
+}
+
+// afterNullsLast builds the keyset condition selecting the rows after cursor
+// in ORDER BY column DESC NULLS LAST, idColumn DESC, with its arguments
+// numbered from index. A row-value comparison such as (column, id) < ($1, $2)
+// can't be used: it is never true for a NULL column, so paging would stop at
+// the first NULL row. A nil cursor selects every row.
+func afterNullsLast(column, idColumn string, index int, cursor *NullableTimeCursor) (string, []interface{}) {
+	switch {
+	case cursor == nil:
+		return "TRUE", nil
+	case cursor.Value == nil:
+		return fmt.Sprintf("(%s IS NULL AND %s < $%d)", column, idColumn, index),
+			[]interface{}{cursor.ID}
+	default:
+		return fmt.Sprintf("(%[1]s < $%[3]d OR (%[1]s = $%[3]d AND %[2]s < $%[4]d) OR %[1]s IS NULL)",
+				column, idColumn, index, index+1),
+			[]interface{}{*cursor.Value, cursor.ID}
+	}
+}
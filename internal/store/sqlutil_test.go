@@ -0,0 +1,98 @@
+package store
+
+import (
+	"database/sql/driver"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAnyOf(t *testing.T) {
+	tests := []struct {
+		name          string
+		build         func() (string, interface{})
+		wantCondition string
+		wantValue     string
+	}{
+		{
+			name:          "ids",
+			build:         func() (string, interface{}) { return anyOf("id", 1, []int64{3, 1, 2}) },
+			wantCondition: "id = ANY($1)",
+			wantValue:     "{3,1,2}",
+		},
+		{
+			name:          "statuses at later index",
+			build:         func() (string, interface{}) { return anyOf("status", 4, []string{"pending", "confirmed"}) },
+			wantCondition: "status = ANY($4)",
+			wantValue:     `{"pending","confirmed"}`,
+		},
+		{
+			name:          "nil ids",
+			build:         func() (string, interface{}) { return anyOf("o.user_id", 2, []int64(nil)) },
+			wantCondition: "o.user_id = ANY($2)",
+			wantValue:     "{}",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			condition, arg := tt.build()
+			if condition != tt.wantCondition {
+				t.Errorf("condition = %q, want %q", condition, tt.wantCondition)
+			}
+
+			valuer, ok := arg.(driver.Valuer)
+			if !ok {
+				t.Fatalf("arg %T does not implement driver.Valuer", arg)
+			}
+			value, err := valuer.Value()
+			if err != nil {
+				t.Fatalf("Value: %v", err)
+			}
+			if value != tt.wantValue {
+				t.Errorf("value = %v, want %s", value, tt.wantValue)
+			}
+		})
+	}
+}
+
+func TestAfterNullsLast(t *testing.T) {
+	shippedAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		cursor        *NullableTimeCursor
+		wantCondition string
+		wantArgs      []interface{}
+	}{
+		{
+			name:          "first page",
+			cursor:        nil,
+			wantCondition: "TRUE",
+		},
+		{
+			name:          "after a non-null value",
+			cursor:        &NullableTimeCursor{Value: &shippedAt, ID: 7},
+			wantCondition: "(shipped_at < $2 OR (shipped_at = $2 AND id < $3) OR shipped_at IS NULL)",
+			wantArgs:      []interface{}{shippedAt, int64(7)},
+		},
+		{
+			name:          "among the nulls",
+			cursor:        &NullableTimeCursor{ID: 4},
+			wantCondition: "(shipped_at IS NULL AND id < $2)",
+			wantArgs:      []interface{}{int64(4)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			condition, args := afterNullsLast("shipped_at", "id", 2, tt.cursor)
+			if condition != tt.wantCondition {
+				t.Errorf("condition = %q, want %q", condition, tt.wantCondition)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("args = %v, want %v", args, tt.wantArgs)
+			}
+		})
+	}
+}
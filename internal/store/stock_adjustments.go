@@ -0,0 +1,131 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"github.com/safar/go-sql-store/internal/database"
+)
+
+// StockAdjustment changes a product's stock by Quantity, which is negative
+// for write-offs.
+type StockAdjustment struct {
+	ProductID int64
+	Quantity  int
+}
+
+// RestockProduct adds quantity units to a product's stock. See
+// AdjustStockBatch for adjustmentID.
+func RestockProduct(ctx context.Context, db *sql.DB, productID int64, quantity int, adjustmentID string) (bool, error) {
+	if quantity < 1 {
+		var errs ValidationErrors
+		errs.add("quantity", "must be positive", database.ErrInvalidQuantity)
+		return false, errs
+	}
+
+	return AdjustStockBatch(ctx, db, []StockAdjustment{{ProductID: productID, Quantity: quantity}}, adjustmentID)
+}
+
+// AdjustStockBatch applies every adjustment in one transaction, changing both
+// stock_quantity and stocked_quantity so ReconcileStock still balances.
+// Products are locked in ID order, and a decrease fails with
+// ErrInsufficientStock if it would take reserved units.
+//
+// A non-empty adjustmentID makes the call idempotent: the ID is recorded with
+// the adjustments, and a later call with the same ID, such as a retried
+// webhook, changes nothing. It reports whether the adjustments were applied.
+func AdjustStockBatch(ctx context.Context, db *sql.DB, adjustments []StockAdjustment, adjustmentID string) (bool, error) {
+	var errs ValidationErrors
+	if len(adjustments) == 0 {
+		errs.add("adjustments", "must contain at least one adjustment", nil)
+	}
+
+	deltas := make(map[int64]int)
+	var productIDs []int64
+	for i, adjustment := range adjustments {
+		if adjustment.ProductID <= 0 {
+			errs.add(fmt.Sprintf("adjustments[%d].product_id", i), "must be a positive ID", nil)
+		}
+		if adjustment.Quantity == 0 {
+			errs.add(fmt.Sprintf("adjustments[%d].quantity", i), "must not be zero", database.ErrInvalidQuantity)
+		}
+		if _, ok := deltas[adjustment.ProductID]; !ok {
+			productIDs = append(productIDs, adjustment.ProductID)
+		}
+		deltas[adjustment.ProductID] += adjustment.Quantity
+	}
+	if len(errs) > 0 {
+		return false, errs
+	}
+	sort.Slice(productIDs, func(i, j int) bool { return productIDs[i] < productIDs[j] })
+
+	var applied bool
+
+	err := database.WithRetry(ctx, db, database.DefaultTxOptions(), func(tx *sql.Tx) error {
+		applied = false
+
+		if adjustmentID != "" {
+			result, err := tx.ExecContext(ctx,
+				`INSERT INTO stock_adjustments (adjustment_id, created_at)
+				 VALUES ($1, NOW())
+				 ON CONFLICT DO NOTHING`,
+				adjustmentID)
+			if err != nil {
+				return fmt.Errorf("record stock adjustment: %w", err)
+			}
+
+			rowsAffected, err := result.RowsAffected()
+			if err != nil {
+				return fmt.Errorf("get rows affected: %w", err)
+			}
+			if rowsAffected == 0 {
+				return nil
+			}
+		}
+
+		for _, productID := range productIDs {
+			var available int
+			err := tx.QueryRowContext(ctx,
+				`SELECT stock_quantity - reserved_quantity
+				 FROM products
+				 WHERE id = $1
+				 FOR UPDATE`,
+				productID).Scan(&available)
+			if err != nil {
+				if err == sql.ErrNoRows {
+					return database.ErrProductNotFound
+				}
+				return fmt.Errorf("lock product %d: %w", productID, err)
+			}
+
+			if available+deltas[productID] < 0 {
+				return database.ErrInsufficientStock
+			}
+
+			_, err = tx.ExecContext(ctx,
+				`UPDATE products
+				 SET stock_quantity = stock_quantity + $1,
+				     stocked_quantity = stocked_quantity + $1,
+				     version = version + 1,
+				     updated_at = NOW()
+				 WHERE id = $2`,
+				deltas[productID], productID)
+			if err != nil {
+				return fmt.Errorf("adjust stock: %w", err)
+			}
+		}
+
+		applied = true
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if applied {
+		invalidateProducts(productIDs...)
+	}
+	return applied, nil
+}
@@ -4,27 +4,26 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"time"
 
+	"github.com/lib/pq"
 	"github.com/safar/go-sql-store/internal/database"
 	"github.com/safar/go-sql-store/internal/models"
+	"github.com/shopspring/decimal"
 )
 
-func CreateUser(ctx context.Context, db *sql.DB, email, name string) (*models.User, error) {
-	user := &models.User{}
-
+func CreateUser(ctx context.Context, db Querier, email, name string) (*models.User, error) {
 	query := `
 		INSERT INTO users (email, name, created_at, updated_at, version)
 		VALUES ($1, $2, NOW(), NOW(), 1)
-		RETURNING id, email, name, created_at, updated_at, version`
-
-	err := db.QueryRowContext(ctx, query, email, name).Scan(
-		&user.ID,
-		&user.Email,
-		&user.Name,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-		&user.Version,
-	)
+		RETURNING ` + models.UserColumns
+
+	var user *models.User
+	err := writeAs(ctx, db, func(q Querier) error {
+		var err error
+		user, err = models.ScanUser(q.QueryRowContext(ctx, query, email, name))
+		return err
+	})
 	if err != nil {
 		return nil, fmt.Errorf("create user: %w", err)
 	}
@@ -32,22 +31,13 @@ func CreateUser(ctx context.Context, db *sql.DB, email, name string) (*models.Us
 	return user, nil
 }
 
-func GetUser(ctx context.Context, db *sql.DB, id int64) (*models.User, error) {
-	user := &models.User{}
-
+func GetUser(ctx context.Context, db Querier, id int64) (*models.User, error) {
 	query := `
-		SELECT id, email, name, created_at, updated_at, version
+		SELECT ` + models.UserColumns + `
 		FROM users
 		WHERE id = $1`
 
-	err := db.QueryRowContext(ctx, query, id).Scan(
-		&user.ID,
-		&user.Email,
-		&user.Name,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-		&user.Version,
-	)
+	user, err := models.ScanUser(db.QueryRowContext(ctx, query, id))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, database.ErrUserNotFound
@@ -58,16 +48,58 @@ func GetUser(ctx context.Context, db *sql.DB, id int64) (*models.User, error) {
 	return user, nil
 }
 
-func ListUsers(ctx context.Context, db *sql.DB, page, pageSize int) (*OffsetPage, error) {
-	var total int64
-	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users`).Scan(&total)
+// GetUsersByIDs loads many users in one query. IDs with no matching user are
+// absent from the returned map.
+func GetUsersByIDs(ctx context.Context, db Querier, ids []int64) (map[int64]models.User, error) {
+	users := make(map[int64]models.User, len(ids))
+	if len(ids) == 0 {
+		return users, nil
+	}
+
+	idsCondition, idsArg := anyOf("id", 1, ids)
+	query := `
+		SELECT ` + models.UserColumns + `
+		FROM users
+		WHERE ` + idsCondition
+
+	rows, err := db.QueryContext(ctx, query, idsArg)
 	if err != nil {
-		return nil, fmt.Errorf("count users: %w", err)
+		return nil, fmt.Errorf("get users by ids: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			return
+		}
+	}()
+
+	for rows.Next() {
+		user, err := models.ScanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan user: %w", err)
+		}
+		users[user.ID] = *user
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return users, nil
+}
+
+// ListUsers returns a page of users, newest first.
+func ListUsers(ctx context.Context, db Querier, page, pageSize int, opts PageOptions) (*OffsetPage, error) {
+	total := int64(-1)
+	if opts.IncludeTotal {
+		err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users`).Scan(&total)
+		if err != nil {
+			return nil, fmt.Errorf("count users: %w", err)
+		}
 	}
 
 	offset := (page - 1) * pageSize
 	query := `
-		SELECT id, email, name, created_at, updated_at, version
+		SELECT ` + models.UserColumns + `
 		FROM users
 		ORDER BY created_at DESC
 		LIMIT $1 OFFSET $2`
@@ -78,37 +110,266 @@ func ListUsers(ctx context.Context, db *sql.DB, page, pageSize int) (*OffsetPage
 	}
 	defer rows.Close()
 
-	var users []models.User
+	users := []models.User{}
+	for rows.Next() {
+		user, err := models.ScanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan user: %w", err)
+		}
+		users = append(users, *user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return newOffsetPage(users, total, page, pageSize), nil
+}
+
+type UserSpend struct {
+	UserID     int64           `json:"user_id"`
+	Name       string          `json:"name"`
+	Email      string          `json:"email"`
+	OrderCount int64           `json:"order_count"`
+	TotalSpend decimal.Decimal `json:"total_spend"`
+	Currency   string          `json:"currency"`
+}
+
+// ListTopSpenders ranks users by the total of their non-cancelled orders in
+// currency, since amounts in different currencies can't be summed. An empty
+// currency means models.DefaultCurrency. Users without such orders are not
+// included.
+func ListTopSpenders(ctx context.Context, db Querier, currency string, limit int) ([]UserSpend, error) {
+	if currency == "" {
+		currency = models.DefaultCurrency
+	}
+	if !models.IsSupportedCurrency(currency) {
+		return nil, database.ErrUnsupportedCurrency
+	}
+
+	query := `
+		SELECT u.id, u.name, u.email, COUNT(o.id), SUM(o.total_amount), o.currency
+		FROM users u
+		JOIN orders o ON o.user_id = u.id
+		WHERE o.status <> $1
+		  AND o.currency = $2
+		GROUP BY u.id, u.name, u.email, o.currency
+		ORDER BY SUM(o.total_amount) DESC, u.id
+		LIMIT $3`
+
+	rows, err := db.QueryContext(ctx, query, models.OrderStatusCancelled, currency, limit)
+	if err != nil {
+		return nil, fmt.Errorf("list top spenders: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			return
+		}
+	}()
+
+	spenders := []UserSpend{}
+	for rows.Next() {
+		var spend UserSpend
+		if err := rows.Scan(&spend.UserID, &spend.Name, &spend.Email, &spend.OrderCount, &spend.TotalSpend, &spend.Currency); err != nil {
+			return nil, fmt.Errorf("scan user spend: %w", err)
+		}
+		spenders = append(spenders, spend)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return spenders, nil
+}
+
+// DuplicateGroup is a set of users whose emails differ only in case.
+type DuplicateGroup struct {
+	// Email is the lowercased email the users share.
+	Email   string  `json:"email"`
+	UserIDs []int64 `json:"user_ids"`
+}
+
+// FindDuplicateEmails returns the groups of users whose emails are equal
+// ignoring case, ordered by email, with user IDs ascending. The unique
+// constraint on users.email is case-sensitive, so these have to be merged or
+// renamed before a unique index on LOWER(email) can be created.
+func FindDuplicateEmails(ctx context.Context, db Querier) ([]DuplicateGroup, error) {
+	query := `
+		SELECT LOWER(email), array_agg(id ORDER BY id)
+		FROM users
+		GROUP BY LOWER(email)
+		HAVING COUNT(*) > 1
+		ORDER BY LOWER(email)`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("find duplicate emails: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			return
+		}
+	}()
+
+	groups := []DuplicateGroup{}
+	for rows.Next() {
+		var group DuplicateGroup
+		var userIDs pq.Int64Array
+		if err := rows.Scan(&group.Email, &userIDs); err != nil {
+			return nil, fmt.Errorf("scan duplicate group: %w", err)
+		}
+		group.UserIDs = userIDs
+		groups = append(groups, group)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return groups, nil
+}
+
+type UserWithOrders struct {
+	models.User
+	Orders []models.Order `json:"orders"`
+}
+
+// GetUserWithRecentOrders loads a user and their n most recent orders, without
+// items, in a single query. The lateral join yields one row per order, or a
+// single row of NULL order columns when the user has none.
+func GetUserWithRecentOrders(ctx context.Context, db Querier, userID int64, n int) (*UserWithOrders, error) {
+	query := `
+		SELECT u.id, u.email, u.name, u.created_at, u.updated_at, u.version, u.deleted_at,
+		       o.id, o.user_id, o.order_number, o.status, o.total_amount,
+		       o.created_at, o.updated_at, o.version, o.currency, o.tracking_number, o.shipped_at, o.metadata
+		FROM users u
+		LEFT JOIN LATERAL (
+		    SELECT ` + models.OrderColumns + `
+		    FROM orders
+		    WHERE user_id = u.id
+		    ORDER BY created_at DESC, id DESC
+		    LIMIT $2
+		) o ON true
+		WHERE u.id = $1
+		ORDER BY o.created_at DESC, o.id DESC`
+
+	rows, err := db.QueryContext(ctx, query, userID, n)
+	if err != nil {
+		return nil, fmt.Errorf("get user with recent orders: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			return
+		}
+	}()
+
+	var result *UserWithOrders
 	for rows.Next() {
 		var user models.User
+		var (
+			orderID, orderUserID sql.NullInt64
+			orderNumber, status  sql.NullString
+			totalAmount          decimal.NullDecimal
+			createdAt, updatedAt sql.NullTime
+			version              sql.NullInt32
+			currency             sql.NullString
+			trackingNumber       *string
+			shippedAt            *time.Time
+			metadata             []byte
+		)
 		err := rows.Scan(
-			&user.ID,
-			&user.Email,
-			&user.Name,
-			&user.CreatedAt,
-			&user.UpdatedAt,
-			&user.Version,
+			&user.ID, &user.Email, &user.Name, &user.CreatedAt, &user.UpdatedAt, &user.Version, &user.DeletedAt,
+			&orderID, &orderUserID, &orderNumber, &status, &totalAmount,
+			&createdAt, &updatedAt, &version, &currency, &trackingNumber, &shippedAt, &metadata,
 		)
 		if err != nil {
-			return nil, fmt.Errorf("scan user: %w", err)
+			return nil, fmt.Errorf("scan user with orders: %w", err)
+		}
+
+		if result == nil {
+			result = &UserWithOrders{User: user, Orders: []models.Order{}}
+		}
+		if !orderID.Valid {
+			continue
 		}
-		users = append(users, user)
+
+		result.Orders = append(result.Orders, models.Order{
+			ID:             orderID.Int64,
+			UserID:         orderUserID.Int64,
+			OrderNumber:    orderNumber.String,
+			Status:         status.String,
+			TotalAmount:    totalAmount.Decimal,
+			CreatedAt:      createdAt.Time,
+			UpdatedAt:      updatedAt.Time,
+			Version:        int(version.Int32),
+			Currency:       currency.String,
+			TrackingNumber: trackingNumber,
+			ShippedAt:      shippedAt,
+			Metadata:       metadata,
+		})
 	}
 
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("rows error: %w", err)
 	}
 
-	totalPages := int(total) / pageSize
-	if int(total)%pageSize > 0 {
-		totalPages++
+	if result == nil {
+		return nil, database.ErrUserNotFound
 	}
 
-	return &OffsetPage{
-		Items:      users,
-		Total:      total,
-		Page:       page,
-		PageSize:   pageSize,
-		TotalPages: totalPages,
-	}, nil
+	return result, nil
+}
+
+// AnonymizeUser scrubs a user's personal data: the email becomes
+// deleted-<id>@example.invalid, the name is blanked and deleted_at is set.
+// The row, and so the user's orders, stay in place. The same fields are
+// redacted from the user's audit_log history. Anonymizing an already
+// anonymized user is a no-op.
+func AnonymizeUser(ctx context.Context, db *sql.DB, userID int64) error {
+	return database.WithRetry(ctx, db, database.DefaultTxOptions(), func(tx *sql.Tx) error {
+		var email string
+		err := tx.QueryRowContext(ctx, `
+			UPDATE users
+			SET email = 'deleted-' || id || '@example.invalid',
+			    name = '',
+			    deleted_at = NOW(),
+			    updated_at = NOW(),
+			    version = version + 1
+			WHERE id = $1 AND deleted_at IS NULL
+			RETURNING email`,
+			userID).Scan(&email)
+		if err == sql.ErrNoRows {
+			var exists bool
+			if err := tx.QueryRowContext(ctx,
+				`SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`, userID).Scan(&exists); err != nil {
+				return fmt.Errorf("check user: %w", err)
+			}
+			if !exists {
+				return database.ErrUserNotFound
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("anonymize user: %w", err)
+		}
+
+		// audit_log is append-only unless app.audit_redaction is on; setting it
+		// with is_local = true scopes it to this transaction.
+		if _, err := tx.ExecContext(ctx, `SELECT set_config('app.audit_redaction', 'on', true)`); err != nil {
+			return fmt.Errorf("enable audit redaction: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			UPDATE audit_log
+			SET old_data = old_data || jsonb_build_object('email', $2::text, 'name', ''),
+			    new_data = new_data || jsonb_build_object('email', $2::text, 'name', '')
+			WHERE entity_type = 'user' AND entity_id = $1`,
+			userID, email)
+		if err != nil {
+			return fmt.Errorf("redact user audit log: %w", err)
+		}
+
+		return nil
+	})
 }
@@ -0,0 +1,123 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/safar/go-sql-store/internal/database"
+)
+
+// FieldError describes one invalid field of a request. Field is a path into
+// the request such as "items[2].quantity".
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+
+	err error
+}
+
+// ValidationErrors collects every invalid field of a request so callers can
+// report them together. It unwraps to the sentinel errors behind its fields,
+// so errors.Is(err, database.ErrInvalidQuantity) still matches.
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, fieldErr := range e {
+		messages[i] = fieldErr.Field + ": " + fieldErr.Message
+	}
+	return "validation failed: " + strings.Join(messages, "; ")
+}
+
+func (e ValidationErrors) Unwrap() []error {
+	var errs []error
+	for _, fieldErr := range e {
+		if fieldErr.err != nil {
+			errs = append(errs, fieldErr.err)
+		}
+	}
+	return errs
+}
+
+func (e *ValidationErrors) add(field, message string, err error) {
+	*e = append(*e, FieldError{Field: field, Message: message, err: err})
+}
+
+// validateCreateOrder checks the parts of a CreateOrderRequest that don't
+// need the database.
+func validateCreateOrder(req CreateOrderRequest) error {
+	var errs ValidationErrors
+
+	if req.UserID <= 0 {
+		errs.add("user_id", "must be a positive ID", nil)
+	}
+	validateOrderItems(req.Items, &errs)
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateOrderItems checks the items of an order or cart.
+func validateOrderItems(items []OrderItemRequest, errs *ValidationErrors) {
+	if len(items) == 0 {
+		errs.add("items", "must contain at least one item", nil)
+	}
+
+	seen := make(map[int64]int, len(items))
+	for i, item := range items {
+		if item.ProductID <= 0 {
+			errs.add(fmt.Sprintf("items[%d].product_id", i), "must be a positive ID", nil)
+		} else if first, ok := seen[item.ProductID]; ok {
+			errs.add(fmt.Sprintf("items[%d].product_id", i), fmt.Sprintf("duplicates items[%d]", first), nil)
+		} else {
+			seen[item.ProductID] = i
+		}
+
+		if item.Quantity < 1 || item.Quantity > MaxItemQuantity {
+			errs.add(fmt.Sprintf("items[%d].quantity", i),
+				fmt.Sprintf("must be between 1 and %d", MaxItemQuantity), database.ErrInvalidQuantity)
+		}
+	}
+}
+
+// maxTrackingNumberLength matches the orders.tracking_number column.
+const maxTrackingNumberLength = 100
+
+func validateTrackingNumber(trackingNumber string) error {
+	var errs ValidationErrors
+
+	switch {
+	case trackingNumber == "":
+		errs.add("tracking_number", "must not be empty", nil)
+	case len(trackingNumber) > maxTrackingNumberLength:
+		errs.add("tracking_number", fmt.Sprintf("must be at most %d characters", maxTrackingNumberLength), nil)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// maxOrderMetadataSize bounds the metadata patch sent for an order, in bytes.
+const maxOrderMetadataSize = 16 << 10
+
+func validateOrderMetadata(metadata json.RawMessage) error {
+	var errs ValidationErrors
+
+	var object map[string]json.RawMessage
+	switch {
+	case len(metadata) > maxOrderMetadataSize:
+		errs.add("metadata", fmt.Sprintf("must be at most %d bytes", maxOrderMetadataSize), nil)
+	case json.Unmarshal(metadata, &object) != nil || object == nil:
+		errs.add("metadata", "must be a JSON object", nil)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
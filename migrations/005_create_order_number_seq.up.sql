@@ -0,0 +1 @@
+CREATE SEQUENCE order_number_seq START WITH 1 INCREMENT BY 1;
@@ -0,0 +1,13 @@
+CREATE TABLE idempotency_keys (
+    method VARCHAR(10) NOT NULL,
+    path VARCHAR(255) NOT NULL,
+    idempotency_key VARCHAR(255) NOT NULL,
+    status_code INT,
+    content_type VARCHAR(255),
+    response_body BYTEA,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    completed_at TIMESTAMP,
+    PRIMARY KEY (method, path, idempotency_key)
+);
+
+CREATE INDEX idx_idempotency_keys_created_at ON idempotency_keys(created_at);
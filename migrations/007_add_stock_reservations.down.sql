@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS stock_reservations CASCADE;
+
+ALTER TABLE products
+    DROP CONSTRAINT IF EXISTS reserved_within_stock,
+    DROP COLUMN IF EXISTS reserved_quantity;
@@ -0,0 +1,14 @@
+ALTER TABLE products
+    ADD COLUMN reserved_quantity INT NOT NULL DEFAULT 0 CHECK (reserved_quantity >= 0),
+    ADD CONSTRAINT reserved_within_stock CHECK (reserved_quantity <= stock_quantity);
+
+CREATE TABLE stock_reservations (
+    id BIGSERIAL PRIMARY KEY,
+    product_id BIGINT NOT NULL REFERENCES products(id) ON DELETE RESTRICT,
+    quantity INT NOT NULL CHECK (quantity > 0),
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    released_at TIMESTAMP
+);
+
+CREATE INDEX idx_stock_reservations_product_id ON stock_reservations(product_id);
+CREATE INDEX idx_stock_reservations_active ON stock_reservations(created_at) WHERE released_at IS NULL;
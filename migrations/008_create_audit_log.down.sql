@@ -0,0 +1,7 @@
+DROP TRIGGER IF EXISTS order_items_audit ON order_items;
+DROP TRIGGER IF EXISTS orders_audit ON orders;
+DROP TRIGGER IF EXISTS products_audit ON products;
+DROP TRIGGER IF EXISTS users_audit ON users;
+DROP TABLE IF EXISTS audit_log CASCADE;
+DROP FUNCTION IF EXISTS audit_log_append_only();
+DROP FUNCTION IF EXISTS audit_row_change();
@@ -0,0 +1,12 @@
+ALTER TABLE products
+    ADD COLUMN stocked_quantity INT NOT NULL DEFAULT 0 CHECK (stocked_quantity >= 0);
+
+-- Existing rows are assumed consistent: everything sold plus what is left.
+UPDATE products p
+SET stocked_quantity = p.stock_quantity + COALESCE((
+    SELECT SUM(oi.quantity)
+    FROM order_items oi
+    JOIN orders o ON o.id = oi.order_id
+    WHERE oi.product_id = p.id
+      AND o.status <> 'cancelled'
+), 0);
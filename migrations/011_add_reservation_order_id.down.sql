@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_stock_reservations_order_id;
+
+ALTER TABLE stock_reservations DROP COLUMN IF EXISTS order_id;
@@ -0,0 +1,4 @@
+ALTER TABLE stock_reservations
+    ADD COLUMN order_id BIGINT REFERENCES orders(id) ON DELETE CASCADE;
+
+CREATE INDEX idx_stock_reservations_order_id ON stock_reservations(order_id) WHERE order_id IS NOT NULL;
@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS products_price_history ON products;
+DROP FUNCTION IF EXISTS record_price_change();
+DROP TABLE IF EXISTS product_price_history CASCADE;
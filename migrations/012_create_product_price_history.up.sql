@@ -0,0 +1,23 @@
+CREATE TABLE product_price_history (
+    id BIGSERIAL PRIMARY KEY,
+    product_id BIGINT NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    old_price DECIMAL(10, 2) NOT NULL,
+    new_price DECIMAL(10, 2) NOT NULL,
+    changed_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_product_price_history_product ON product_price_history(product_id, id);
+
+CREATE FUNCTION record_price_change() RETURNS TRIGGER AS $$
+BEGIN
+    INSERT INTO product_price_history (product_id, old_price, new_price)
+    VALUES (NEW.id, OLD.price, NEW.price);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER products_price_history
+    AFTER UPDATE OF price ON products
+    FOR EACH ROW
+    WHEN (OLD.price IS DISTINCT FROM NEW.price)
+    EXECUTE FUNCTION record_price_change();
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_stock_reservations_expires_at;
+
+ALTER TABLE stock_reservations
+    DROP CONSTRAINT IF EXISTS consumed_reservation_released,
+    DROP COLUMN IF EXISTS consumed_at,
+    DROP COLUMN IF EXISTS expires_at;
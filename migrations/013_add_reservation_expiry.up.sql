@@ -0,0 +1,6 @@
+ALTER TABLE stock_reservations
+    ADD COLUMN expires_at TIMESTAMP,
+    ADD COLUMN consumed_at TIMESTAMP,
+    ADD CONSTRAINT consumed_reservation_released CHECK (consumed_at IS NULL OR released_at IS NOT NULL);
+
+CREATE INDEX idx_stock_reservations_expires_at ON stock_reservations(expires_at) WHERE released_at IS NULL AND expires_at IS NOT NULL;
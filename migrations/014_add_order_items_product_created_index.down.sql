@@ -0,0 +1,3 @@
+CREATE INDEX IF NOT EXISTS idx_order_items_product_id ON order_items(product_id);
+
+DROP INDEX IF EXISTS idx_order_items_product_created;
@@ -0,0 +1,3 @@
+CREATE INDEX idx_order_items_product_created ON order_items(product_id, created_at DESC, id DESC);
+
+DROP INDEX IF EXISTS idx_order_items_product_id;
@@ -0,0 +1 @@
+ALTER TABLE orders ADD COLUMN tracking_number VARCHAR(100);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_orders_shipped_at;
+
+ALTER TABLE orders DROP COLUMN IF EXISTS shipped_at;
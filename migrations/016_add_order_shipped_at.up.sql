@@ -0,0 +1,5 @@
+ALTER TABLE orders ADD COLUMN shipped_at TIMESTAMP;
+
+UPDATE orders SET shipped_at = updated_at WHERE status IN ('shipped', 'delivered');
+
+CREATE INDEX idx_orders_shipped_at ON orders(shipped_at DESC NULLS LAST, id DESC);
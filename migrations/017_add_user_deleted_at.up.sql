@@ -0,0 +1,12 @@
+ALTER TABLE users ADD COLUMN deleted_at TIMESTAMP;
+
+-- audit_log stays append-only, except that AnonymizeUser may redact personal
+-- data in it after setting app.audit_redaction for its transaction.
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' AND current_setting('app.audit_redaction', true) = 'on' THEN
+        RETURN NEW;
+    END IF;
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
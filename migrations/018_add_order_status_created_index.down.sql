@@ -0,0 +1,3 @@
+CREATE INDEX IF NOT EXISTS idx_orders_status ON orders(status);
+
+DROP INDEX IF EXISTS idx_orders_status_created;
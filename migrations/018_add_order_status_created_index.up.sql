@@ -0,0 +1,5 @@
+-- Serves ListOrders and the status filters: equality on status, then the
+-- (created_at, id) keyset order. It also covers lookups by status alone.
+CREATE INDEX idx_orders_status_created ON orders(status, created_at DESC, id DESC);
+
+DROP INDEX IF EXISTS idx_orders_status;
@@ -0,0 +1,6 @@
+-- SKUs are compared case-insensitively. Storing them in upper case lets the
+-- existing unique constraint enforce that. This fails if two SKUs differ
+-- only in case; rename one of them first.
+UPDATE products SET sku = UPPER(sku) WHERE sku <> UPPER(sku);
+
+ALTER TABLE products ADD CONSTRAINT products_sku_upper CHECK (sku = UPPER(sku));
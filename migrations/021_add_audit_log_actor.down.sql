@@ -0,0 +1,22 @@
+CREATE OR REPLACE FUNCTION audit_row_change() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        INSERT INTO audit_log (entity_type, entity_id, action, new_data)
+        VALUES (TG_ARGV[0], NEW.id, 'create', to_jsonb(NEW));
+        RETURN NEW;
+    ELSIF TG_OP = 'UPDATE' THEN
+        IF OLD IS NOT DISTINCT FROM NEW THEN
+            RETURN NEW;
+        END IF;
+        INSERT INTO audit_log (entity_type, entity_id, action, old_data, new_data)
+        VALUES (TG_ARGV[0], NEW.id, 'update', to_jsonb(OLD), to_jsonb(NEW));
+        RETURN NEW;
+    ELSE
+        INSERT INTO audit_log (entity_type, entity_id, action, old_data)
+        VALUES (TG_ARGV[0], OLD.id, 'delete', to_jsonb(OLD));
+        RETURN OLD;
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+ALTER TABLE audit_log DROP COLUMN IF EXISTS actor_id;
@@ -0,0 +1,27 @@
+ALTER TABLE audit_log ADD COLUMN actor_id BIGINT;
+
+-- The actor is passed in the transaction-local app.actor_id setting, which
+-- database.WithTransaction sets from the request context. It is NULL when
+-- unset.
+CREATE OR REPLACE FUNCTION audit_row_change() RETURNS TRIGGER AS $$
+DECLARE
+    actor BIGINT := NULLIF(current_setting('app.actor_id', true), '')::BIGINT;
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        INSERT INTO audit_log (entity_type, entity_id, action, new_data, actor_id)
+        VALUES (TG_ARGV[0], NEW.id, 'create', to_jsonb(NEW), actor);
+        RETURN NEW;
+    ELSIF TG_OP = 'UPDATE' THEN
+        IF OLD IS NOT DISTINCT FROM NEW THEN
+            RETURN NEW;
+        END IF;
+        INSERT INTO audit_log (entity_type, entity_id, action, old_data, new_data, actor_id)
+        VALUES (TG_ARGV[0], NEW.id, 'update', to_jsonb(OLD), to_jsonb(NEW), actor);
+        RETURN NEW;
+    ELSE
+        INSERT INTO audit_log (entity_type, entity_id, action, old_data, actor_id)
+        VALUES (TG_ARGV[0], OLD.id, 'delete', to_jsonb(OLD), actor);
+        RETURN OLD;
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1 @@
+ALTER TABLE orders ADD COLUMN metadata JSONB NOT NULL DEFAULT '{}' CHECK (jsonb_typeof(metadata) = 'object');
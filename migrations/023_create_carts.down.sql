@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_stock_reservations_cart_id;
+
+ALTER TABLE stock_reservations DROP COLUMN IF EXISTS cart_id;
+
+DROP TABLE IF EXISTS carts;
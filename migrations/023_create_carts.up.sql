@@ -0,0 +1,12 @@
+CREATE TABLE carts (
+    id BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL,
+    released_at TIMESTAMP,
+    order_id BIGINT REFERENCES orders(id) ON DELETE SET NULL
+);
+
+ALTER TABLE stock_reservations
+    ADD COLUMN cart_id BIGINT REFERENCES carts(id) ON DELETE CASCADE;
+
+CREATE INDEX idx_stock_reservations_cart_id ON stock_reservations(cart_id) WHERE cart_id IS NOT NULL;
@@ -0,0 +1,4 @@
+CREATE TABLE stock_adjustments (
+    adjustment_id VARCHAR(255) PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
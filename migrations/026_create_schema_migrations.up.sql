@@ -0,0 +1,9 @@
+CREATE TABLE schema_migrations (
+    version INT PRIMARY KEY,
+    applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Migrations run in order, so every earlier one has been applied by the time
+-- this one runs. Later versions are recorded by the migration runner.
+INSERT INTO schema_migrations (version)
+SELECT generate_series(1, 26);
@@ -0,0 +1 @@
+-- The foreign key belongs to 004; rolling back 027 leaves it in place.
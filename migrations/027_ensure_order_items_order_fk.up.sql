@@ -0,0 +1,16 @@
+-- order_items.order_id has referenced orders since 004. This restores the
+-- foreign key on a database where it was dropped; it fails while orphaned
+-- items remain, which store.FindOrphanedOrderItems lists.
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM pg_constraint
+        WHERE conrelid = 'order_items'::regclass
+          AND confrelid = 'orders'::regclass
+          AND contype = 'f'
+    ) THEN
+        ALTER TABLE order_items
+            ADD CONSTRAINT order_items_order_id_fkey
+            FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE;
+    END IF;
+END $$;
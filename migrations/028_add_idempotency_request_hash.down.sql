@@ -0,0 +1,3 @@
+ALTER TABLE idempotency_keys
+    DROP COLUMN IF EXISTS locked_until,
+    DROP COLUMN IF EXISTS request_hash;
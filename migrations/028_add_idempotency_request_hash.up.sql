@@ -0,0 +1,6 @@
+-- request_hash ties a key to the request that claimed it; rows claimed
+-- before this migration have none and match any request. locked_until is the
+-- lease on an in-progress claim, after which the key can be claimed again.
+ALTER TABLE idempotency_keys
+    ADD COLUMN request_hash BYTEA,
+    ADD COLUMN locked_until TIMESTAMPTZ;
@@ -0,0 +1,8 @@
+// Package migrations embeds the SQL migrations, so the binary can compare
+// the schema it is running against with the set it was built with.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS
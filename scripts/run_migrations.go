@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
@@ -9,8 +10,9 @@ import (
 	"sort"
 	"strings"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/safar/go-sql-store/internal/config"
+	"github.com/safar/go-sql-store/internal/database"
 )
 
 func main() {
@@ -28,7 +30,18 @@ func main() {
 		log.Fatalf("Load config: %v", err)
 	}
 
-	db, err := sql.Open("postgres", cfg.Database.URL)
+	dsn, err := database.WithSchema(cfg.Database.URL, cfg.Database.Schema)
+	if err != nil {
+		log.Fatalf("Database schema: %v", err)
+	}
+
+	if schema := cfg.Database.Schema; schema != "" && direction == "up" {
+		if err := createSchema(cfg.Database.URL, schema); err != nil {
+			log.Fatalf("Create schema %s: %v", schema, err)
+		}
+	}
+
+	db, err := sql.Open("postgres", dsn)
 	if err != nil {
 		log.Fatalf("Connect to database: %v", err)
 	}
@@ -62,7 +75,28 @@ func main() {
 		}
 	}
 
+	ctx := context.Background()
+
+	// Without schema_migrations, which migration 026 creates, nothing is
+	// known to be applied and every migration runs, as on a new database.
+	applied, err := database.AppliedMigrations(ctx, db)
+	if err != nil {
+		log.Fatalf("Read applied migrations: %v", err)
+	}
+
+	ran := 0
 	for _, filename := range migrationFiles {
+		version, err := database.MigrationVersion(filename)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if direction == "up" && applied[version] {
+			continue
+		}
+		if direction == "down" && len(applied) > 0 && !applied[version] {
+			continue
+		}
+
 		filePath := filepath.Join(migrationDir, filename)
 		content, err := os.ReadFile(filePath)
 		if err != nil {
@@ -73,7 +107,28 @@ func main() {
 		if _, err := db.Exec(string(content)); err != nil {
 			log.Fatalf("Execute migration %s: %v", filename, err)
 		}
+
+		if err := database.RecordMigration(ctx, db, version, direction == "up"); err != nil {
+			log.Fatal(err)
+		}
+		ran++
 	}
 
-	log.Printf("Successfully ran %d migration(s) %s", len(migrationFiles), direction)
+	log.Printf("Successfully ran %d migration(s) %s", ran, direction)
+}
+
+// createSchema creates the schema the migrations run in.
+func createSchema(dsn, schema string) error {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			log.Printf("Failed to close database: %v", err)
+		}
+	}()
+
+	_, err = db.Exec(`CREATE SCHEMA IF NOT EXISTS ` + pq.QuoteIdentifier(schema))
+	return err
 }
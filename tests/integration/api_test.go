@@ -0,0 +1,1168 @@
+package integration
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/safar/go-sql-store/internal/api"
+	"github.com/safar/go-sql-store/internal/config"
+	"github.com/safar/go-sql-store/internal/database"
+	"github.com/safar/go-sql-store/internal/models"
+	"github.com/safar/go-sql-store/internal/store"
+	"github.com/safar/go-sql-store/migrations"
+	"github.com/shopspring/decimal"
+)
+
+func newTestServer(t *testing.T, db *sql.DB) *httptest.Server {
+	server := httptest.NewServer(api.NewRouter(db, &config.ServerConfig{
+		IdempotencyTTL: time.Hour,
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func doRequest(t *testing.T, method, url string, body interface{}, headers map[string]string) (*http.Response, []byte) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("Marshal request body: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		t.Fatalf("Build request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Read response body: %v", err)
+	}
+
+	return resp, respBody
+}
+
+func TestIdempotentCreateProduct(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	server := newTestServer(t, db)
+
+	body := map[string]interface{}{
+		"sku":   "TEST-IDEM-001",
+		"name":  "Idempotent Product",
+		"price": 10.5,
+		"stock": 5,
+	}
+	headers := map[string]string{"Idempotency-Key": "create-product-1"}
+
+	first, firstBody := doRequest(t, http.MethodPost, server.URL+"/products", body, headers)
+	if first.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", first.StatusCode, firstBody)
+	}
+
+	second, secondBody := doRequest(t, http.MethodPost, server.URL+"/products", body, headers)
+	if second.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected replayed 201, got %d: %s", second.StatusCode, secondBody)
+	}
+	if second.Header.Get("Idempotent-Replayed") != "true" {
+		t.Error("Expected Idempotent-Replayed header on replay")
+	}
+	if !bytes.Equal(firstBody, secondBody) {
+		t.Errorf("Expected replayed body %s, got %s", firstBody, secondBody)
+	}
+
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM products WHERE sku = 'TEST-IDEM-001'`).Scan(&count); err != nil {
+		t.Fatalf("Count products: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected exactly 1 product, got %d", count)
+	}
+}
+
+func TestIdempotencyKeyInProgress(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	server := newTestServer(t, db)
+
+	_, claim, err := store.ClaimIdempotencyKey(context.Background(), db, http.MethodPost, "/products", "in-flight", nil, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("Claim idempotency key: %v", err)
+	}
+	if claim == nil {
+		t.Fatal("Expected fresh key to be claimed")
+	}
+
+	resp, body := doRequest(t, http.MethodPost, server.URL+"/products", map[string]interface{}{
+		"sku":   "TEST-IDEM-002",
+		"name":  "In Flight",
+		"price": 1,
+		"stock": 1,
+	}, map[string]string{"Idempotency-Key": "in-flight"})
+
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected 409 for in-progress key, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestIdempotencyKeyReusedForDifferentRequest(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	server := newTestServer(t, db)
+	headers := map[string]string{"Idempotency-Key": "reused"}
+
+	body := map[string]interface{}{
+		"sku":   "TEST-IDEM-003",
+		"name":  "First Use",
+		"price": 1,
+		"stock": 1,
+	}
+	resp, respBody := doRequest(t, http.MethodPost, server.URL+"/products", body, headers)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", resp.StatusCode, respBody)
+	}
+
+	body["sku"] = "TEST-IDEM-004"
+	resp, respBody = doRequest(t, http.MethodPost, server.URL+"/products", body, headers)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for a different body, got %d: %s", resp.StatusCode, respBody)
+	}
+
+	body["sku"] = "TEST-IDEM-003"
+	resp, respBody = doRequest(t, http.MethodPost, server.URL+"/products?dry_run=true", body, headers)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for a different query, got %d: %s", resp.StatusCode, respBody)
+	}
+
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM products WHERE sku = 'TEST-IDEM-004'`).Scan(&count); err != nil {
+		t.Fatalf("Count products: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("Expected the reused key not to create a product, got %d", count)
+	}
+}
+
+func TestIdempotencyKeyLeaseExpires(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	server := newTestServer(t, db)
+
+	// A claim whose request died without completing or releasing the key.
+	ctx := context.Background()
+	_, claim, err := store.ClaimIdempotencyKey(ctx, db, http.MethodPost, "/products", "abandoned", nil, time.Hour, time.Millisecond)
+	if err != nil {
+		t.Fatalf("Claim idempotency key: %v", err)
+	}
+	if claim == nil {
+		t.Fatal("Expected fresh key to be claimed")
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	resp, body := doRequest(t, http.MethodPost, server.URL+"/products", map[string]interface{}{
+		"sku":   "TEST-IDEM-005",
+		"name":  "After Lease",
+		"price": 1,
+		"stock": 1,
+	}, map[string]string{"Idempotency-Key": "abandoned"})
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("Expected 201 once the lease expired, got %d: %s", resp.StatusCode, body)
+	}
+
+	// The stale claim must neither overwrite nor delete the retry's stored
+	// response, or a third request would run again.
+	if err := store.CompleteIdempotencyKey(ctx, db, claim, http.StatusCreated, "application/json", []byte("{}")); err != database.ErrIdempotencyClaimLost {
+		t.Errorf("Expected ErrIdempotencyClaimLost completing a stale claim, got: %v", err)
+	}
+	if err := store.ReleaseIdempotencyKey(ctx, db, claim); err != database.ErrIdempotencyClaimLost {
+		t.Errorf("Expected ErrIdempotencyClaimLost releasing a stale claim, got: %v", err)
+	}
+
+	resp, body = doRequest(t, http.MethodPost, server.URL+"/products", map[string]interface{}{
+		"sku":   "TEST-IDEM-005",
+		"name":  "After Lease",
+		"price": 1,
+		"stock": 1,
+	}, map[string]string{"Idempotency-Key": "abandoned"})
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Expected the retry's response replayed, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestIdempotencyBodyTooLarge(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	server := newTestServer(t, db)
+
+	resp, body := doRequest(t, http.MethodPost, server.URL+"/products", map[string]interface{}{
+		"sku":         "TEST-IDEM-006",
+		"name":        "Too Large",
+		"description": strings.Repeat("x", 2<<20),
+		"price":       1,
+	}, map[string]string{"Idempotency-Key": "too-large"})
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for an oversized body, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestPatchProductEndpoint(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	server := newTestServer(t, db)
+
+	product, err := store.CreateProduct(context.Background(), db, "TEST-PATCH-HTTP", "HTTP Product", "Keep me", decimal.NewFromInt(20), 3, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	url := fmt.Sprintf("%s/products/%d", server.URL, product.ID)
+
+	resp, body := doRequest(t, http.MethodPatch, url, map[string]interface{}{
+		"price":   "15.50",
+		"version": product.Version,
+	}, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	var patched models.Product
+	if err := json.Unmarshal(body, &patched); err != nil {
+		t.Fatalf("Unmarshal product: %v", err)
+	}
+	if !patched.Price.Equal(decimal.RequireFromString("15.50")) || patched.Description != "Keep me" {
+		t.Errorf("Unexpected patched product: %+v", patched)
+	}
+
+	resp, body = doRequest(t, http.MethodPatch, url, map[string]interface{}{
+		"name":    "Stale",
+		"version": product.Version,
+	}, nil)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected 409 for stale version, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestGzipResponses(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	server := newTestServer(t, db)
+
+	for i := 0; i < 20; i++ {
+		if _, err := store.CreateProduct(ctx, db, fmt.Sprintf("TEST-GZIP-%03d", i), "Compressible Product", "Padding for a large list response", decimal.NewFromInt(10), 5, ""); err != nil {
+			t.Fatalf("Create product: %v", err)
+		}
+	}
+
+	listURL := server.URL + "/products?page_size=20"
+
+	// Setting Accept-Encoding explicitly stops the transport from
+	// decompressing the body for us.
+	resp, body := doRequest(t, http.MethodGet, listURL, nil, map[string]string{"Accept-Encoding": "gzip"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected gzip encoding, got %q", resp.Header.Get("Content-Encoding"))
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Open gzip body: %v", err)
+	}
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Decompress body: %v", err)
+	}
+
+	var page struct {
+		Items []models.Product `json:"items"`
+	}
+	if err := json.Unmarshal(decompressed, &page); err != nil {
+		t.Fatalf("Unmarshal products: %v", err)
+	}
+	if len(page.Items) != 20 {
+		t.Errorf("Expected 20 products, got %d", len(page.Items))
+	}
+
+	resp, body = doRequest(t, http.MethodGet, listURL, nil, map[string]string{"Accept-Encoding": "identity"})
+	if resp.Header.Get("Content-Encoding") != "" {
+		t.Errorf("Expected uncompressed response, got %q", resp.Header.Get("Content-Encoding"))
+	}
+	if !json.Valid(body) {
+		t.Errorf("Expected plain JSON body, got %q", body)
+	}
+
+	resp, body = doRequest(t, http.MethodGet, server.URL+"/products/low-stock?threshold=1", nil, map[string]string{"Accept-Encoding": "gzip"})
+	if resp.Header.Get("Content-Encoding") != "" {
+		t.Errorf("Expected small body to stay uncompressed, got %q", resp.Header.Get("Content-Encoding"))
+	}
+	if !json.Valid(body) {
+		t.Errorf("Expected plain JSON body, got %q", body)
+	}
+}
+
+func TestProductSparseFieldsets(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	server := newTestServer(t, db)
+
+	product, err := store.CreateProduct(ctx, db, "TEST-FIELDS-001", "Sparse Product", "A long description", decimal.RequireFromString("12.50"), 5, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	resp, body := doRequest(t, http.MethodGet, server.URL+"/products?fields=id,name,price", nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	var page struct {
+		Items []map[string]json.RawMessage `json:"items"`
+		Total int64                        `json:"total"`
+	}
+	if err := json.Unmarshal(body, &page); err != nil {
+		t.Fatalf("Unmarshal products: %v", err)
+	}
+	if page.Total != 1 || len(page.Items) != 1 {
+		t.Fatalf("Expected 1 product, got %d of %d", len(page.Items), page.Total)
+	}
+
+	item := page.Items[0]
+	if len(item) != 3 {
+		t.Errorf("Expected only id, name and price, got %s", body)
+	}
+	for _, omitted := range []string{"description", "sku", "stock_quantity", "version"} {
+		if _, ok := item[omitted]; ok {
+			t.Errorf("Expected %s to be omitted, got %s", omitted, body)
+		}
+	}
+	if string(item["name"]) != `"Sparse Product"` {
+		t.Errorf("Expected name, got %s", item["name"])
+	}
+
+	resp, body = doRequest(t, http.MethodGet, fmt.Sprintf("%s/products/%d?fields=sku", server.URL, product.ID), nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	var single map[string]string
+	if err := json.Unmarshal(body, &single); err != nil {
+		t.Fatalf("Unmarshal product: %v", err)
+	}
+	if len(single) != 1 || single["sku"] != "TEST-FIELDS-001" {
+		t.Errorf("Expected only sku, got %s", body)
+	}
+
+	resp, body = doRequest(t, http.MethodGet, server.URL+"/products?fields=id,secret", nil, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for unknown field, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestAdmissionControlRejectsWhenSaturated(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	server := httptest.NewServer(api.NewRouter(db, &config.ServerConfig{
+		MaxConcurrentRequests: 1,
+	}))
+	defer server.Close()
+
+	product, err := store.CreateProduct(ctx, db, "TEST-ADMIT-001", "Admission Product", "Test", decimal.NewFromInt(10), 5, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	// A row lock held here parks the PATCH below inside the handler,
+	// occupying the only admission slot.
+	holder, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("Begin holder: %v", err)
+	}
+	defer func() { _ = holder.Rollback() }()
+	if _, err := holder.ExecContext(ctx, `SELECT id FROM products WHERE id = $1 FOR UPDATE`, product.ID); err != nil {
+		t.Fatalf("Lock product: %v", err)
+	}
+
+	productURL := fmt.Sprintf("%s/products/%d", server.URL, product.ID)
+
+	blocked := make(chan int, 1)
+	go func() {
+		body := fmt.Sprintf(`{"name": "Admitted", "version": %d}`, product.Version)
+		req, err := http.NewRequest(http.MethodPatch, productURL, bytes.NewBufferString(body))
+		if err != nil {
+			blocked <- 0
+			return
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			blocked <- 0
+			return
+		}
+		_ = resp.Body.Close()
+		blocked <- resp.StatusCode
+	}()
+
+	var rejected *http.Response
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		resp, _ := doRequest(t, http.MethodGet, productURL, nil, nil)
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			rejected = resp
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rejected == nil {
+		t.Fatal("Expected 503 while the only slot is in use")
+	}
+	if rejected.Header.Get("Retry-After") == "" {
+		t.Error("Expected Retry-After on 503")
+	}
+
+	if err := holder.Rollback(); err != nil {
+		t.Fatalf("Release lock: %v", err)
+	}
+
+	if status := <-blocked; status != http.StatusOK {
+		t.Errorf("Expected admitted request to succeed, got %d", status)
+	}
+
+	resp, body := doRequest(t, http.MethodGet, productURL, nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 once the slot is free, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestRequestValidationReportsAllViolations(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	server := newTestServer(t, db)
+
+	fieldsOf := func(t *testing.T, resp *http.Response, body []byte) map[string]string {
+		t.Helper()
+
+		if resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Fatalf("Expected 422, got %d: %s", resp.StatusCode, body)
+		}
+
+		var result struct {
+			Fields []store.FieldError `json:"fields"`
+		}
+		if err := json.Unmarshal(body, &result); err != nil {
+			t.Fatalf("Unmarshal validation errors: %v", err)
+		}
+
+		fields := make(map[string]string)
+		for _, fieldErr := range result.Fields {
+			fields[fieldErr.Field] = fieldErr.Message
+		}
+		return fields
+	}
+
+	resp, body := doRequest(t, http.MethodPost, server.URL+"/products", map[string]interface{}{
+		"description": "No SKU, name or price",
+		"stock":       -1,
+	}, nil)
+	fields := fieldsOf(t, resp, body)
+	for _, name := range []string{"sku", "name", "price", "stock"} {
+		if _, ok := fields[name]; !ok {
+			t.Errorf("Expected a violation for %s, got %v", name, fields)
+		}
+	}
+	if len(fields) != 4 {
+		t.Errorf("Expected 4 violations, got %v", fields)
+	}
+
+	resp, body = doRequest(t, http.MethodPost, server.URL+"/orders", map[string]interface{}{
+		"items": []map[string]interface{}{
+			{"product_id": 1, "quantity": 1},
+			{"quantity": "two"},
+		},
+	}, nil)
+	fields = fieldsOf(t, resp, body)
+	want := map[string]string{
+		"user_id":             "is required",
+		"items[1].product_id": "is required",
+		"items[1].quantity":   "must be an integer",
+	}
+	if len(fields) != len(want) {
+		t.Errorf("Expected %d violations, got %v", len(want), fields)
+	}
+	for name, message := range want {
+		if fields[name] != message {
+			t.Errorf("Expected %s %q, got %q", name, message, fields[name])
+		}
+	}
+
+	resp, body = doRequest(t, http.MethodPost, server.URL+"/users", nil, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a missing body, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestCreateOrderRejectsInvalidQuantities(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "quantity@example.com", "Quantity User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	product, err := store.CreateProduct(ctx, db, "TEST-QTY-001", "Quantity Product", "Test", decimal.NewFromInt(10), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	server := newTestServer(t, db)
+
+	tests := []struct {
+		quantity interface{}
+		message  string
+	}{
+		{0, "must be a positive integer"},
+		{-1, "must be a positive integer"},
+		{2.5, "must be a whole number"},
+	}
+
+	for _, tt := range tests {
+		resp, body := doRequest(t, http.MethodPost, server.URL+"/orders", map[string]interface{}{
+			"user_id": user.ID,
+			"items": []map[string]interface{}{
+				{"product_id": product.ID, "quantity": tt.quantity},
+			},
+		}, nil)
+		if resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("Quantity %v: expected 422, got %d: %s", tt.quantity, resp.StatusCode, body)
+			continue
+		}
+
+		var result struct {
+			Fields []store.FieldError `json:"fields"`
+		}
+		if err := json.Unmarshal(body, &result); err != nil {
+			t.Fatalf("Unmarshal validation errors: %v", err)
+		}
+		if len(result.Fields) != 1 || result.Fields[0].Field != "items[0].quantity" || result.Fields[0].Message != tt.message {
+			t.Errorf("Quantity %v: expected items[0].quantity %q, got %s", tt.quantity, tt.message, body)
+		}
+	}
+
+	assertStock(t, db, product.ID, 10, 0)
+}
+
+func TestExplainEndpoint(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	server := httptest.NewServer(api.NewRouter(db, &config.ServerConfig{DebugEndpoints: true}))
+	defer server.Close()
+
+	resp, body := doRequest(t, http.MethodGet, server.URL+"/debug/explain?q=products", nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if !strings.Contains(string(body), "Execution Time") || !strings.Contains(string(body), "Limit") {
+		t.Errorf("Expected an EXPLAIN ANALYZE plan, got:\n%s", body)
+	}
+
+	resp, body = doRequest(t, http.MethodGet, server.URL+"/debug/explain?q=SELECT+1", nil, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown query, got %d: %s", resp.StatusCode, body)
+	}
+
+	defaultServer := newTestServer(t, db)
+	resp, body = doRequest(t, http.MethodGet, defaultServer.URL+"/debug/explain?q=products", nil, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected debug endpoints to be off by default, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestConditionalGet(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	product, err := store.CreateProduct(ctx, db, "TEST-COND-001", "Conditional Product", "Test", decimal.NewFromInt(10), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	user, err := store.CreateUser(ctx, db, "conditional@example.com", "Conditional User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	server := newTestServer(t, db)
+	productURL := fmt.Sprintf("%s/products/%d", server.URL, product.ID)
+
+	resp, body := doRequest(t, http.MethodGet, productURL, nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	etag := resp.Header.Get("ETag")
+	lastModified := resp.Header.Get("Last-Modified")
+	if !strings.HasPrefix(etag, `W/"`) || lastModified == "" {
+		t.Fatalf("Expected a weak ETag and Last-Modified, got %q and %q", etag, lastModified)
+	}
+
+	resp, body = doRequest(t, http.MethodGet, productURL, nil, map[string]string{"If-Modified-Since": lastModified})
+	if resp.StatusCode != http.StatusNotModified || len(body) != 0 {
+		t.Errorf("Expected 304 with no body for If-Modified-Since, got %d: %s", resp.StatusCode, body)
+	}
+
+	resp, body = doRequest(t, http.MethodGet, productURL, nil, map[string]string{"If-None-Match": etag})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected 304 for a matching If-None-Match, got %d: %s", resp.StatusCode, body)
+	}
+
+	modified, err := http.ParseTime(lastModified)
+	if err != nil {
+		t.Fatalf("Parse Last-Modified: %v", err)
+	}
+	resp, body = doRequest(t, http.MethodGet, productURL, nil, map[string]string{
+		"If-Modified-Since": modified.Add(-time.Hour).Format(http.TimeFormat),
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 for a resource modified since, got %d: %s", resp.StatusCode, body)
+	}
+
+	price := decimal.NewFromInt(12)
+	if _, err := store.PatchProduct(ctx, db, product.ID, store.ProductPatch{Price: &price}, product.Version); err != nil {
+		t.Fatalf("Patch product: %v", err)
+	}
+
+	resp, body = doRequest(t, http.MethodGet, productURL, nil, map[string]string{"If-None-Match": etag})
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 after the product changed, got %d: %s", resp.StatusCode, body)
+	}
+	if resp.Header.Get("ETag") == etag {
+		t.Errorf("Expected a new ETag after the product changed, got %q", etag)
+	}
+
+	userURL := fmt.Sprintf("%s/users/%d", server.URL, user.ID)
+	resp, body = doRequest(t, http.MethodGet, userURL, nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	resp, body = doRequest(t, http.MethodGet, userURL, nil, map[string]string{
+		"If-Modified-Since": resp.Header.Get("Last-Modified"),
+	})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected 304 for an unchanged user, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestEmptyListsEncodeAsArrays(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	server := newTestServer(t, db)
+
+	product, err := store.CreateProduct(context.Background(), db, "TEST-EMPTY-001", "Unordered", "Test", decimal.NewFromInt(10), 100, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	pages := []string{
+		"/users",
+		"/products?created_from=2000-01-01T00:00:00Z&created_to=2000-01-02T00:00:00Z",
+		"/orders",
+		fmt.Sprintf("/products/%d/order-items", product.ID),
+	}
+	for _, path := range pages {
+		resp, body := doRequest(t, http.MethodGet, server.URL+path, nil, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s: expected 200, got %d: %s", path, resp.StatusCode, body)
+			continue
+		}
+		var page struct {
+			Items json.RawMessage `json:"items"`
+		}
+		if err := json.Unmarshal(body, &page); err != nil {
+			t.Fatalf("GET %s: decode response: %v", path, err)
+		}
+		if string(page.Items) != "[]" {
+			t.Errorf("GET %s: expected items [], got %s", path, page.Items)
+		}
+	}
+
+	lists := []string{
+		"/products/low-stock?threshold=1",
+		"/users/top-spenders",
+	}
+	for _, path := range lists {
+		resp, body := doRequest(t, http.MethodGet, server.URL+path, nil, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s: expected 200, got %d: %s", path, resp.StatusCode, body)
+			continue
+		}
+		if got := strings.TrimSpace(string(body)); got != "[]" {
+			t.Errorf("GET %s: expected [], got %s", path, got)
+		}
+	}
+}
+
+func TestGetProductsByIDsEndpoint(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	server := newTestServer(t, db)
+
+	var ids []int64
+	for i := 1; i <= 3; i++ {
+		product, err := store.CreateProduct(ctx, db, fmt.Sprintf("TEST-IDS-%03d", i), fmt.Sprintf("Product %d", i), "Test", decimal.NewFromInt(10), 5, "")
+		if err != nil {
+			t.Fatalf("Create product: %v", err)
+		}
+		ids = append(ids, product.ID)
+	}
+	missing := ids[2] + 1000
+
+	url := fmt.Sprintf("%s/products?ids=%d,%d,%d,%d", server.URL, ids[2], missing, ids[0], ids[2])
+	resp, body := doRequest(t, http.MethodGet, url, nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	var products []models.Product
+	if err := json.Unmarshal(body, &products); err != nil {
+		t.Fatalf("Decode products: %v", err)
+	}
+	if len(products) != 2 || products[0].ID != ids[2] || products[1].ID != ids[0] {
+		t.Errorf("Expected products %d and %d in request order, got %s", ids[2], ids[0], body)
+	}
+
+	resp, body = doRequest(t, http.MethodGet, fmt.Sprintf("%s/products?ids=%d&fields=id,name", server.URL, ids[1]), nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 with fields, got %d: %s", resp.StatusCode, body)
+	}
+	var projected []map[string]interface{}
+	if err := json.Unmarshal(body, &projected); err != nil {
+		t.Fatalf("Decode projected products: %v", err)
+	}
+	if len(projected) != 1 || len(projected[0]) != 2 {
+		t.Errorf("Expected one product with two fields, got %s", body)
+	}
+
+	resp, body = doRequest(t, http.MethodGet, fmt.Sprintf("%s/products?ids=%d", server.URL, missing), nil, nil)
+	if resp.StatusCode != http.StatusOK || strings.TrimSpace(string(body)) != "[]" {
+		t.Errorf("Expected 200 with [] for only missing IDs, got %d: %s", resp.StatusCode, body)
+	}
+
+	for _, query := range []string{"ids=", "ids=1,abc", "ids=0"} {
+		resp, body := doRequest(t, http.MethodGet, server.URL+"/products?"+query, nil, nil)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d: %s", query, resp.StatusCode, body)
+		}
+	}
+
+	tooMany := make([]string, 101)
+	for i := range tooMany {
+		tooMany[i] = strconv.Itoa(i + 1)
+	}
+	resp, body = doRequest(t, http.MethodGet, server.URL+"/products?ids="+strings.Join(tooMany, ","), nil, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for 101 IDs, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestProductStreamEndpoint(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	server := newTestServer(t, db)
+
+	resp, body := doRequest(t, http.MethodGet, server.URL+"/products/stream", nil, nil)
+	if resp.StatusCode != http.StatusOK || strings.TrimSpace(string(body)) != "[]" {
+		t.Errorf("Expected 200 with [] for no products, got %d: %s", resp.StatusCode, body)
+	}
+
+	for i := 1; i <= 250; i++ {
+		if _, err := store.CreateProduct(ctx, db, fmt.Sprintf("TEST-STREAM-%03d", i), fmt.Sprintf("Product %d", i), "Test", decimal.NewFromInt(10), i%3, ""); err != nil {
+			t.Fatalf("Create product: %v", err)
+		}
+	}
+
+	result, err := store.ListProducts(ctx, db, 1, 1000, store.ProductFilter{}, store.PageOptions{IncludeTotal: true})
+	if err != nil {
+		t.Fatalf("List products: %v", err)
+	}
+	expected := result.Items.([]models.Product)
+	sort.Slice(expected, func(i, j int) bool { return expected[i].ID < expected[j].ID })
+
+	resp, body = doRequest(t, http.MethodGet, server.URL+"/products/stream", nil, map[string]string{"Accept-Encoding": "gzip"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Open gzip body: %v", err)
+		}
+		if body, err = io.ReadAll(reader); err != nil {
+			t.Fatalf("Read gzip body: %v", err)
+		}
+	}
+
+	var streamed []models.Product
+	if err := json.Unmarshal(body, &streamed); err != nil {
+		t.Fatalf("Streamed body is not a JSON array of products: %v", err)
+	}
+	if len(streamed) != len(expected) {
+		t.Fatalf("Expected %d products, got %d", len(expected), len(streamed))
+	}
+	for i := range expected {
+		if streamed[i].ID != expected[i].ID || streamed[i].SKU != expected[i].SKU || streamed[i].StockQuantity != expected[i].StockQuantity {
+			t.Errorf("Product %d: expected %+v, got %+v", i, expected[i], streamed[i])
+		}
+	}
+
+	resp, body = doRequest(t, http.MethodGet, server.URL+"/products/stream?in_stock=true", nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 with in_stock, got %d: %s", resp.StatusCode, body)
+	}
+	var inStock []models.Product
+	if err := json.Unmarshal(body, &inStock); err != nil {
+		t.Fatalf("Decode in-stock products: %v", err)
+	}
+	for _, product := range inStock {
+		if product.StockQuantity == 0 {
+			t.Errorf("Expected only in-stock products, got %+v", product)
+		}
+	}
+	if len(inStock) != 167 {
+		t.Errorf("Expected 167 in-stock products, got %d", len(inStock))
+	}
+}
+
+func TestStockCheckEndpoint(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	server := newTestServer(t, db)
+
+	var ids []int64
+	for i, stock := range []int{7, 0, 42} {
+		product, err := store.CreateProduct(ctx, db, fmt.Sprintf("TEST-STOCK-CHECK-%03d", i), "Stock Check", "Test", decimal.NewFromInt(10), stock, "")
+		if err != nil {
+			t.Fatalf("Create product: %v", err)
+		}
+		ids = append(ids, product.ID)
+	}
+	missing := ids[2] + 1000
+
+	levels, err := store.GetStockLevels(ctx, db, []int64{ids[0], ids[1], missing})
+	if err != nil {
+		t.Fatalf("Get stock levels: %v", err)
+	}
+	if len(levels) != 2 || levels[ids[0]] != 7 || levels[ids[1]] != 0 {
+		t.Errorf("Expected stock 7 and 0 without the missing ID, got %v", levels)
+	}
+
+	resp, body := doRequest(t, http.MethodPost, server.URL+"/products/stock-check", map[string]interface{}{
+		"product_ids": []int64{ids[2], ids[0], missing},
+	}, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	var got map[int64]int
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("Decode stock levels: %v", err)
+	}
+	if len(got) != 2 || got[ids[2]] != 42 || got[ids[0]] != 7 {
+		t.Errorf("Expected stock 42 and 7, got %s", body)
+	}
+
+	for _, invalid := range []map[string]interface{}{
+		{},
+		{"product_ids": []int64{}},
+		{"product_ids": []int64{ids[0], 0}},
+	} {
+		resp, body := doRequest(t, http.MethodPost, server.URL+"/products/stock-check", invalid, nil)
+		if resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("Expected 422 for %v, got %d: %s", invalid, resp.StatusCode, body)
+		}
+	}
+
+	resp, body = doRequest(t, http.MethodGet, server.URL+"/products/stock-check", nil, nil)
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for GET, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestOrderRateLimitPerUser(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	server := httptest.NewServer(api.NewRouter(db, &config.ServerConfig{
+		OrderRatePerUser:  0.001,
+		OrderBurstPerUser: 3,
+	}))
+	defer server.Close()
+
+	flooder, err := store.CreateUser(ctx, db, "flooder@example.com", "Flooder")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	other, err := store.CreateUser(ctx, db, "patient@example.com", "Patient")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	// One product per request keeps the accepted orders from contending on
+	// row locks.
+	const requests = 10
+	var productIDs []int64
+	for i := 0; i <= requests; i++ {
+		product, err := store.CreateProduct(ctx, db, fmt.Sprintf("TEST-RATE-%03d", i), "Rate Product", "Test", decimal.NewFromInt(10), 5, "")
+		if err != nil {
+			t.Fatalf("Create product: %v", err)
+		}
+		productIDs = append(productIDs, product.ID)
+	}
+
+	orderBody := func(userID, productID int64) map[string]interface{} {
+		return map[string]interface{}{
+			"user_id": userID,
+			"items":   []map[string]interface{}{{"product_id": productID, "quantity": 1}},
+		}
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	statuses := make(map[int]int)
+	retryAfter := ""
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(productID int64) {
+			defer wg.Done()
+			resp, _ := doRequest(t, http.MethodPost, server.URL+"/orders", orderBody(flooder.ID, productID), nil)
+			mu.Lock()
+			defer mu.Unlock()
+			statuses[resp.StatusCode]++
+			if resp.StatusCode == http.StatusTooManyRequests {
+				retryAfter = resp.Header.Get("Retry-After")
+			}
+		}(productIDs[i])
+	}
+	wg.Wait()
+
+	if statuses[http.StatusCreated] != 3 || statuses[http.StatusTooManyRequests] != requests-3 {
+		t.Errorf("Expected 3 orders created and %d rejected, got %v", requests-3, statuses)
+	}
+	if retryAfter == "" {
+		t.Error("Expected Retry-After on 429")
+	}
+
+	resp, body := doRequest(t, http.MethodPost, server.URL+"/orders", orderBody(other.ID, productIDs[requests]), nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("Expected another user's order to be created, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestMigrationHealthEndpoint(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	server := newTestServer(t, db)
+	ctx := context.Background()
+
+	versions, err := database.MigrationVersions(migrations.FS)
+	if err != nil {
+		t.Fatalf("MigrationVersions: %v", err)
+	}
+	latest := versions[len(versions)-1]
+
+	var health struct {
+		Status         string `json:"status"`
+		CurrentVersion int    `json:"current_version"`
+		LatestVersion  int    `json:"latest_version"`
+		Pending        []int  `json:"pending"`
+	}
+
+	resp, body := doRequest(t, http.MethodGet, server.URL+"/healthz/migrations", nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if err := json.Unmarshal(body, &health); err != nil {
+		t.Fatalf("Decode health: %v", err)
+	}
+	if health.Status != "ok" || health.CurrentVersion != latest || health.LatestVersion != latest || len(health.Pending) != 0 {
+		t.Errorf("Expected up to date at version %d, got %+v", latest, health)
+	}
+
+	if _, err := db.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = $1`, latest); err != nil {
+		t.Fatalf("Unrecord migration: %v", err)
+	}
+	defer func() {
+		if _, err := db.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, latest); err != nil {
+			t.Fatalf("Restore migration record: %v", err)
+		}
+	}()
+
+	resp, body = doRequest(t, http.MethodGet, server.URL+"/healthz/migrations", nil, nil)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503, got %d: %s", resp.StatusCode, body)
+	}
+	health.Pending = nil
+	if err := json.Unmarshal(body, &health); err != nil {
+		t.Fatalf("Decode health: %v", err)
+	}
+	if health.Status != "pending" || len(health.Pending) != 1 || health.Pending[0] != latest {
+		t.Errorf("Expected migration %d pending, got %+v", latest, health)
+	}
+
+	status, err := database.GetMigrationStatus(ctx, db, fstest.MapFS{
+		"001_create_users.up.sql": {},
+		"999_future.up.sql":       {},
+	})
+	if err != nil {
+		t.Fatalf("GetMigrationStatus: %v", err)
+	}
+	if status.LatestVersion != 999 || len(status.Pending) != 1 || status.Pending[0] != 999 {
+		t.Errorf("Expected migration 999 pending, got %+v", status)
+	}
+}
+
+func TestPatchProductsBatchEndpoint(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	server := newTestServer(t, db)
+	ctx := context.Background()
+
+	first, err := store.CreateProduct(ctx, db, "TEST-BATCH-001", "First", "Test", decimal.NewFromInt(10), 5, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	second, err := store.CreateProduct(ctx, db, "TEST-BATCH-002", "Second", "Test", decimal.NewFromInt(20), 5, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	resp, body := doRequest(t, http.MethodPatch, server.URL+"/products/batch", map[string]interface{}{
+		"products": []map[string]interface{}{
+			{"id": first.ID, "name": "First Renamed", "version": first.Version},
+			{"id": second.ID, "price": "18.50", "version": second.Version},
+		},
+	}, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	var patched []models.Product
+	if err := json.Unmarshal(body, &patched); err != nil {
+		t.Fatalf("Decode products: %v", err)
+	}
+	if len(patched) != 2 || patched[0].Name != "First Renamed" || !patched[1].Price.Equal(decimal.RequireFromString("18.50")) {
+		t.Fatalf("Unexpected patched products: %+v", patched)
+	}
+
+	// The second patch carries a stale version, so the first must not stick.
+	resp, body = doRequest(t, http.MethodPatch, server.URL+"/products/batch", map[string]interface{}{
+		"products": []map[string]interface{}{
+			{"id": first.ID, "name": "Rolled Back", "version": patched[0].Version},
+			{"id": second.ID, "stock_quantity": 1, "version": second.Version},
+		},
+	}, nil)
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("Expected 409, got %d: %s", resp.StatusCode, body)
+	}
+
+	current, err := store.GetProduct(ctx, db, first.ID)
+	if err != nil {
+		t.Fatalf("Get product: %v", err)
+	}
+	if current.Name != "First Renamed" || current.Version != patched[0].Version {
+		t.Errorf("Expected the first patch rolled back, got name %q version %d", current.Name, current.Version)
+	}
+
+	resp, body = doRequest(t, http.MethodPatch, server.URL+"/products/batch", map[string]interface{}{
+		"products": []map[string]interface{}{
+			{"id": first.ID, "version": current.Version},
+		},
+	}, nil)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for an empty patch, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestPatchProductStockBelowReserved(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	server := newTestServer(t, db)
+	ctx := context.Background()
+
+	product, err := store.CreateProduct(ctx, db, "TEST-PATCH-RESERVED", "Reserved", "Test", decimal.NewFromInt(10), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	if _, err := store.CreateReservation(ctx, db, product.ID, 4, time.Hour); err != nil {
+		t.Fatalf("Create reservation: %v", err)
+	}
+	product, err = store.GetProduct(ctx, db, product.ID)
+	if err != nil {
+		t.Fatalf("Get product: %v", err)
+	}
+
+	resp, body := doRequest(t, http.MethodPatch, fmt.Sprintf("%s/products/%d", server.URL, product.ID), map[string]interface{}{
+		"stock_quantity": 2,
+		"version":        product.Version,
+	}, nil)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected 422, got %d: %s", resp.StatusCode, body)
+	}
+	if !strings.Contains(string(body), "stock_quantity") {
+		t.Errorf("Expected a stock_quantity field error, got %s", body)
+	}
+	assertStock(t, db, product.ID, 10, 4)
+}
@@ -0,0 +1,156 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/safar/go-sql-store/internal/models"
+	"github.com/safar/go-sql-store/internal/store"
+	"github.com/shopspring/decimal"
+)
+
+func TestAuditLogRecordsUpdate(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	product, err := store.CreateProduct(ctx, db, "TEST-AUDIT-001", "Audited Product", "Test", decimal.NewFromInt(10), 50, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	if err := store.UpdateStockOptimistic(ctx, db, product.ID, 40, product.Version); err != nil {
+		t.Fatalf("Update stock: %v", err)
+	}
+
+	entries, err := store.ListAuditLog(ctx, db, models.AuditEntityProduct, product.ID)
+	if err != nil {
+		t.Fatalf("List audit log: %v", err)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 audit entries, got %d", len(entries))
+	}
+
+	if entries[0].Action != models.AuditActionCreate {
+		t.Errorf("Expected first entry to be create, got %s", entries[0].Action)
+	}
+	if entries[0].OldData != nil {
+		t.Errorf("Expected no old data on create, got %s", entries[0].OldData)
+	}
+
+	update := entries[1]
+	if update.Action != models.AuditActionUpdate {
+		t.Fatalf("Expected second entry to be update, got %s", update.Action)
+	}
+
+	var before, after struct {
+		StockQuantity int `json:"stock_quantity"`
+		Version       int `json:"version"`
+	}
+	if err := json.Unmarshal(update.OldData, &before); err != nil {
+		t.Fatalf("Unmarshal old data: %v", err)
+	}
+	if err := json.Unmarshal(update.NewData, &after); err != nil {
+		t.Fatalf("Unmarshal new data: %v", err)
+	}
+
+	if before.StockQuantity != 50 || after.StockQuantity != 40 {
+		t.Errorf("Expected stock 50 -> 40, got %d -> %d", before.StockQuantity, after.StockQuantity)
+	}
+	if after.Version != before.Version+1 {
+		t.Errorf("Expected version bump, got %d -> %d", before.Version, after.Version)
+	}
+}
+
+func TestAuditLogIsAppendOnly(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "audit@example.com", "Audit User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	if _, err := db.ExecContext(ctx, `DELETE FROM audit_log WHERE entity_id = $1`, user.ID); err == nil {
+		t.Error("Expected deleting audit rows to fail")
+	}
+
+	entries, err := store.ListAuditLog(ctx, db, models.AuditEntityUser, user.ID)
+	if err != nil {
+		t.Fatalf("List audit log: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected 1 audit entry, got %d", len(entries))
+	}
+}
+
+func TestAuditLogRecordsActor(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	admin, err := store.CreateUser(ctx, db, "admin@example.com", "Admin")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	actorCtx := store.WithActor(ctx, admin.ID)
+	if actor, ok := store.ActorFromContext(actorCtx); !ok || actor != admin.ID {
+		t.Fatalf("Expected actor %d in context, got %d, %v", admin.ID, actor, ok)
+	}
+
+	product, err := store.CreateProduct(actorCtx, db, "TEST-ACTOR-001", "Acted On", "Test", decimal.NewFromInt(10), 50, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	if err := store.UpdateStockOptimistic(ctx, db, product.ID, 40, product.Version); err != nil {
+		t.Fatalf("Update stock: %v", err)
+	}
+	order, err := store.CreateOrder(actorCtx, db, store.CreateOrderRequest{
+		UserID: admin.ID,
+		Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 1}},
+	})
+	if err != nil {
+		t.Fatalf("Create order: %v", err)
+	}
+
+	entries, err := store.ListAuditLog(ctx, db, models.AuditEntityProduct, product.ID)
+	if err != nil {
+		t.Fatalf("List audit log: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 audit entries, got %d", len(entries))
+	}
+	wantActors := []*int64{&admin.ID, nil, &admin.ID}
+	for i, entry := range entries {
+		want := wantActors[i]
+		switch {
+		case want == nil && entry.ActorID != nil:
+			t.Errorf("Entry %d (%s): expected no actor, got %d", i, entry.Action, *entry.ActorID)
+		case want != nil && (entry.ActorID == nil || *entry.ActorID != *want):
+			t.Errorf("Entry %d (%s): expected actor %d, got %v", i, entry.Action, *want, entry.ActorID)
+		}
+	}
+
+	orderEntries, err := store.ListAuditLog(ctx, db, models.AuditEntityOrder, order.ID)
+	if err != nil {
+		t.Fatalf("List audit log: %v", err)
+	}
+	if len(orderEntries) == 0 || orderEntries[0].ActorID == nil || *orderEntries[0].ActorID != admin.ID {
+		t.Errorf("Expected the order's audit entry to record actor %d, got %+v", admin.ID, orderEntries)
+	}
+
+	userEntries, err := store.ListAuditLog(ctx, db, models.AuditEntityUser, admin.ID)
+	if err != nil {
+		t.Fatalf("List audit log: %v", err)
+	}
+	if len(userEntries) != 1 || userEntries[0].ActorID != nil {
+		t.Errorf("Expected the user created without an actor to have none, got %+v", userEntries)
+	}
+}
@@ -0,0 +1,147 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/safar/go-sql-store/internal/database"
+	"github.com/safar/go-sql-store/internal/store"
+	"github.com/shopspring/decimal"
+)
+
+func TestReserveCartAllOrNone(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	plenty, err := store.CreateProduct(ctx, db, "TEST-CART-001", "Plenty", "Test", decimal.NewFromInt(10), 5, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	scarce, err := store.CreateProduct(ctx, db, "TEST-CART-002", "Scarce", "Test", decimal.NewFromInt(20), 1, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	_, err = store.ReserveCart(ctx, db, []store.OrderItemRequest{
+		{ProductID: plenty.ID, Quantity: 2},
+		{ProductID: scarce.ID, Quantity: 3},
+	}, time.Hour)
+	if !errors.Is(err, database.ErrInsufficientStock) {
+		t.Fatalf("Expected ErrInsufficientStock, got %v", err)
+	}
+	assertStock(t, db, plenty.ID, 5, 0)
+	assertStock(t, db, scarce.ID, 1, 0)
+
+	cart, err := store.ReserveCart(ctx, db, []store.OrderItemRequest{
+		{ProductID: scarce.ID, Quantity: 1},
+		{ProductID: plenty.ID, Quantity: 2},
+	}, time.Hour)
+	if err != nil {
+		t.Fatalf("Reserve cart: %v", err)
+	}
+	if len(cart.Reservations) != 2 {
+		t.Fatalf("Expected 2 reservations, got %d", len(cart.Reservations))
+	}
+	if cart.Reservations[0].ProductID != plenty.ID {
+		t.Errorf("Expected reservations in product ID order, got product %d first", cart.Reservations[0].ProductID)
+	}
+	for _, reservation := range cart.Reservations {
+		if reservation.CartID == nil || *reservation.CartID != cart.ID {
+			t.Errorf("Expected reservation %d to belong to cart %d, got %v", reservation.ID, cart.ID, reservation.CartID)
+		}
+	}
+	if !cart.ExpiresAt.After(cart.CreatedAt) {
+		t.Errorf("Expected expiry after creation, got %v and %v", cart.ExpiresAt, cart.CreatedAt)
+	}
+	assertStock(t, db, plenty.ID, 5, 2)
+	assertStock(t, db, scarce.ID, 1, 1)
+
+	// Cart reservations are managed through the cart only.
+	if _, err := store.CancelReservation(ctx, db, cart.Reservations[0].ID); !errors.Is(err, database.ErrReservationNotFound) {
+		t.Errorf("Expected ErrReservationNotFound cancelling a cart reservation, got %v", err)
+	}
+
+	if err := store.ReleaseCart(ctx, db, cart.ID); err != nil {
+		t.Fatalf("Release cart: %v", err)
+	}
+	assertStock(t, db, plenty.ID, 5, 0)
+	assertStock(t, db, scarce.ID, 1, 0)
+
+	if err := store.ReleaseCart(ctx, db, cart.ID); !errors.Is(err, database.ErrReservationExpired) {
+		t.Errorf("Expected ErrReservationExpired releasing twice, got %v", err)
+	}
+	if err := store.ReleaseCart(ctx, db, cart.ID+100); !errors.Is(err, database.ErrCartNotFound) {
+		t.Errorf("Expected ErrCartNotFound, got %v", err)
+	}
+}
+
+func TestConvertCartToOrder(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	first, err := store.CreateProduct(ctx, db, "TEST-CART-003", "First", "Test", decimal.NewFromInt(10), 5, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	second, err := store.CreateProduct(ctx, db, "TEST-CART-004", "Second", "Test", decimal.NewFromInt(20), 3, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	user, err := store.CreateUser(ctx, db, "cart@example.com", "Cart User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	cart, err := store.ReserveCart(ctx, db, []store.OrderItemRequest{
+		{ProductID: first.ID, Quantity: 2},
+		{ProductID: second.ID, Quantity: 3},
+	}, time.Hour)
+	if err != nil {
+		t.Fatalf("Reserve cart: %v", err)
+	}
+
+	order, err := store.ConvertCartToOrder(ctx, db, cart.ID, user.ID)
+	if err != nil {
+		t.Fatalf("Convert cart: %v", err)
+	}
+	if order.UserID != user.ID {
+		t.Errorf("Expected order for user %d, got %d", user.ID, order.UserID)
+	}
+	if !order.TotalAmount.Equal(decimal.NewFromInt(80)) {
+		t.Errorf("Expected total 80, got %s", order.TotalAmount)
+	}
+	assertStock(t, db, first.ID, 3, 0)
+	assertStock(t, db, second.ID, 0, 0)
+
+	var cartOrderID int64
+	if err := db.QueryRowContext(ctx, `SELECT order_id FROM carts WHERE id = $1`, cart.ID).Scan(&cartOrderID); err != nil {
+		t.Fatalf("Get cart order: %v", err)
+	}
+	if cartOrderID != order.ID {
+		t.Errorf("Expected cart to record order %d, got %d", order.ID, cartOrderID)
+	}
+
+	if _, err := store.ConvertCartToOrder(ctx, db, cart.ID, user.ID); !errors.Is(err, database.ErrReservationExpired) {
+		t.Errorf("Expected ErrReservationExpired converting twice, got %v", err)
+	}
+
+	expired, err := store.ReserveCart(ctx, db, []store.OrderItemRequest{{ProductID: first.ID, Quantity: 1}}, time.Hour)
+	if err != nil {
+		t.Fatalf("Reserve cart: %v", err)
+	}
+	if _, err := db.ExecContext(ctx,
+		`UPDATE carts SET expires_at = NOW() - INTERVAL '1 second' WHERE id = $1`,
+		expired.ID); err != nil {
+		t.Fatalf("Expire cart: %v", err)
+	}
+	if _, err := store.ConvertCartToOrder(ctx, db, expired.ID, user.ID); !errors.Is(err, database.ErrReservationExpired) {
+		t.Errorf("Expected ErrReservationExpired for an expired cart, got %v", err)
+	}
+	assertStock(t, db, first.ID, 3, 1)
+}
@@ -0,0 +1,122 @@
+package integration
+
+import (
+	"context"
+	"testing"
+
+	"github.com/safar/go-sql-store/internal/database"
+	"github.com/safar/go-sql-store/internal/models"
+	"github.com/safar/go-sql-store/internal/store"
+	"github.com/shopspring/decimal"
+)
+
+func TestCreateProductCurrency(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	product, err := store.CreateProduct(ctx, db, "TEST-CUR-DEF", "Default Currency", "Test", decimal.NewFromInt(10), 5, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	if product.Currency != models.DefaultCurrency {
+		t.Errorf("Expected default currency %s, got %q", models.DefaultCurrency, product.Currency)
+	}
+
+	product, err = store.CreateProduct(ctx, db, "TEST-CUR-EUR", "Euro Product", "Test", decimal.NewFromInt(10), 5, "EUR")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	if product.Currency != "EUR" {
+		t.Errorf("Expected EUR, got %q", product.Currency)
+	}
+
+	for _, currency := range []string{"XYZ", "usd", "DOLLARS"} {
+		_, err := store.CreateProduct(ctx, db, "TEST-CUR-"+currency, "Bad Currency", "Test", decimal.NewFromInt(10), 5, currency)
+		if err != database.ErrUnsupportedCurrency {
+			t.Errorf("Currency %q: expected ErrUnsupportedCurrency, got: %v", currency, err)
+		}
+	}
+}
+
+func TestCreateOrderSingleCurrency(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "euro@example.com", "Euro Buyer")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	first, err := store.CreateProduct(ctx, db, "TEST-CUR-001", "Euro One", "Test", decimal.NewFromInt(10), 5, "EUR")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	second, err := store.CreateProduct(ctx, db, "TEST-CUR-002", "Euro Two", "Test", decimal.NewFromInt(15), 5, "EUR")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	order, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items: []store.OrderItemRequest{
+			{ProductID: first.ID, Quantity: 1},
+			{ProductID: second.ID, Quantity: 2},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Create order: %v", err)
+	}
+
+	if order.Currency != "EUR" {
+		t.Errorf("Expected order currency EUR, got %q", order.Currency)
+	}
+	if !order.TotalAmount.Equal(decimal.NewFromInt(40)) {
+		t.Errorf("Expected total 40, got %s", order.TotalAmount)
+	}
+}
+
+func TestCreateOrderMixedCurrencyRejected(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "mixed@example.com", "Mixed Buyer")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	dollars, err := store.CreateProduct(ctx, db, "TEST-CUR-USD", "Dollar Product", "Test", decimal.NewFromInt(10), 5, "USD")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	pounds, err := store.CreateProduct(ctx, db, "TEST-CUR-GBP", "Pound Product", "Test", decimal.NewFromInt(10), 5, "GBP")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	_, err = store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items: []store.OrderItemRequest{
+			{ProductID: dollars.ID, Quantity: 1},
+			{ProductID: pounds.ID, Quantity: 1},
+		},
+	})
+	if err != database.ErrMixedCurrency {
+		t.Fatalf("Expected ErrMixedCurrency, got: %v", err)
+	}
+
+	for _, id := range []int64{dollars.ID, pounds.ID} {
+		product, err := store.GetProduct(ctx, db, id)
+		if err != nil {
+			t.Fatalf("Get product: %v", err)
+		}
+		if product.StockQuantity != 5 {
+			t.Errorf("Product %d: expected stock unchanged at 5, got %d", id, product.StockQuantity)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package integration
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/safar/go-sql-store/internal/store"
+)
+
+func TestCursorIterate(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	const total = 5000
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO users (email, name)
+		SELECT 'cursor-' || n || '@example.com', CASE WHEN n % 2 = 0 THEN 'Even' ELSE 'Odd' END
+		FROM generate_series(1, $1) AS n`, total); err != nil {
+		t.Fatalf("Seed users: %v", err)
+	}
+
+	var count int
+	var lastID int64
+	err := store.CursorIterate(ctx, db, `SELECT id FROM users WHERE name = $1 ORDER BY id`, []interface{}{"Even"}, 300, func(rows *sql.Rows) error {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		if id <= lastID {
+			t.Errorf("Expected ascending IDs, got %d after %d", id, lastID)
+		}
+		lastID = id
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Cursor iterate: %v", err)
+	}
+	if count != total/2 {
+		t.Errorf("Expected %d rows, got %d", total/2, count)
+	}
+
+	// A result that is an exact multiple of the batch size ends cleanly too.
+	count = 0
+	err = store.CursorIterate(ctx, db, `SELECT id FROM users`, nil, 1000, func(rows *sql.Rows) error {
+		count++
+		return nil
+	})
+	if err != nil || count != total {
+		t.Errorf("Expected %d rows, got %d: %v", total, count, err)
+	}
+
+	stop := errors.New("stop")
+	count = 0
+	err = store.CursorIterate(ctx, db, `SELECT id FROM users ORDER BY id`, nil, 100, func(rows *sql.Rows) error {
+		count++
+		if count == 150 {
+			return stop
+		}
+		return nil
+	})
+	if !errors.Is(err, stop) {
+		t.Errorf("Expected fn's error to be returned, got: %v", err)
+	}
+	if count != 150 {
+		t.Errorf("Expected iteration to stop at row 150, got %d", count)
+	}
+
+	if err := store.CursorIterate(ctx, db, `SELECT id FROM users`, nil, 0, func(rows *sql.Rows) error { return nil }); err == nil {
+		t.Error("Expected an error for a zero batch size")
+	}
+}
@@ -0,0 +1,763 @@
+package integration
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/safar/go-sql-store/internal/config"
+	"github.com/safar/go-sql-store/internal/database"
+	"github.com/safar/go-sql-store/internal/store"
+	"github.com/shopspring/decimal"
+)
+
+func TestWarmup(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	db.SetMaxIdleConns(3)
+
+	if err := database.Warmup(ctx, db, 5); err != nil {
+		t.Fatalf("Warmup: %v", err)
+	}
+
+	if idle := db.Stats().Idle; idle < 3 {
+		t.Errorf("Expected at least 3 idle connections (bounded by MaxIdleConns), got %d", idle)
+	}
+
+	db.SetMaxIdleConns(10)
+
+	if err := database.Warmup(ctx, db, 8); err != nil {
+		t.Fatalf("Warmup: %v", err)
+	}
+
+	if idle := db.Stats().Idle; idle < 8 {
+		t.Errorf("Expected at least 8 idle connections, got %d", idle)
+	}
+
+	// Asking for more than the pool allows warms the whole pool instead of
+	// waiting for a connection that never frees up.
+	db.SetMaxOpenConns(4)
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := database.Warmup(timeoutCtx, db, 10); err != nil {
+		t.Fatalf("Warmup beyond MaxOpenConns: %v", err)
+	}
+}
+
+// TestWithRetryRecoversFromDeadlock makes two transactions lock rows A,B and
+// B,A. Both hold their first lock before asking for the second, so Postgres
+// must abort one with 40P01, and WithRetry has to run it again.
+func TestWithRetryRecoversFromDeadlock(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	productA, err := store.CreateProduct(ctx, db, "TEST-DL-A", "Deadlock A", "Test", decimal.NewFromInt(10), 100, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	productB, err := store.CreateProduct(ctx, db, "TEST-DL-B", "Deadlock B", "Test", decimal.NewFromInt(10), 100, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	var firstLocks sync.WaitGroup
+	firstLocks.Add(2)
+
+	var attempts int32
+	var deadlocks int32
+
+	lockBoth := func(first, second int64) func(*sql.Tx) error {
+		var attempted bool
+		return func(tx *sql.Tx) error {
+			atomic.AddInt32(&attempts, 1)
+
+			lock := func(id int64) error {
+				_, err := tx.ExecContext(ctx, `UPDATE products SET stock_quantity = stock_quantity - 1 WHERE id = $1`, id)
+				if err != nil && database.ClassifyError(err) == database.ErrorClassDeadlock {
+					atomic.AddInt32(&deadlocks, 1)
+				}
+				return err
+			}
+
+			if err := lock(first); err != nil {
+				return err
+			}
+
+			// Only the first attempt waits at the barrier; a retry must not
+			// block on a partner that has already finished.
+			if !attempted {
+				attempted = true
+				firstLocks.Done()
+				firstLocks.Wait()
+			}
+
+			return lock(second)
+		}
+	}
+
+	opts := database.TxOptions{
+		IsolationLevel: sql.LevelReadCommitted,
+		MaxRetries:     3,
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+
+	for _, pair := range [][2]int64{{productA.ID, productB.ID}, {productB.ID, productA.ID}} {
+		wg.Add(1)
+		go func(first, second int64) {
+			defer wg.Done()
+			errs <- database.WithRetry(ctx, db, opts, lockBoth(first, second))
+		}(pair[0], pair[1])
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Expected both transactions to succeed, got: %v", err)
+		}
+	}
+
+	if got := atomic.LoadInt32(&deadlocks); got != 1 {
+		t.Errorf("Expected exactly 1 deadlock, got %d", got)
+	}
+	if got := atomic.LoadInt32(&attempts); got != 3 {
+		t.Errorf("Expected 3 attempts (one retry), got %d", got)
+	}
+
+	for _, id := range []int64{productA.ID, productB.ID} {
+		product, err := store.GetProduct(ctx, db, id)
+		if err != nil {
+			t.Fatalf("Get product: %v", err)
+		}
+		if product.StockQuantity != 98 {
+			t.Errorf("Product %d: expected stock 98, got %d", id, product.StockQuantity)
+		}
+	}
+}
+
+func TestWithTransactionTimeout(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	product, err := store.CreateProduct(ctx, db, "TEST-TXTO-001", "Timeout Product", "Test", decimal.NewFromInt(10), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	opts := database.DefaultTxOptions()
+	opts.Timeout = 200 * time.Millisecond
+
+	err = database.WithTransaction(ctx, db, opts, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `UPDATE products SET stock_quantity = 0 WHERE id = $1`, product.ID); err != nil {
+			return err
+		}
+		time.Sleep(500 * time.Millisecond)
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got: %v", err)
+	}
+
+	productAfter, err := store.GetProduct(ctx, db, product.ID)
+	if err != nil {
+		t.Fatalf("Get product: %v", err)
+	}
+	if productAfter.StockQuantity != 10 {
+		t.Errorf("Expected update to be rolled back, stock is %d", productAfter.StockQuantity)
+	}
+
+	// A statement that is already running is interrupted as well.
+	start := time.Now()
+	err = database.WithTransaction(ctx, db, opts, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `SELECT pg_sleep(5)`)
+		return err
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the sleeping statement to be cut short, took %v", elapsed)
+	}
+}
+
+func TestRetryBudgetSharedAcrossCalls(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := database.WithRetryBudget(context.Background(), 3)
+
+	serializationFailure := &pq.Error{Code: "40001"}
+	opts := database.TxOptions{
+		IsolationLevel: sql.LevelReadCommitted,
+		MaxRetries:     5,
+	}
+
+	// The first call fails twice before succeeding, spending two retries.
+	firstAttempts := 0
+	err := database.WithRetry(ctx, db, opts, func(tx *sql.Tx) error {
+		firstAttempts++
+		if firstAttempts <= 2 {
+			return serializationFailure
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("First call: %v", err)
+	}
+
+	if remaining, ok := database.RetryBudgetRemaining(ctx); !ok || remaining != 1 {
+		t.Errorf("Expected 1 retry left, got %d (budget present: %v)", remaining, ok)
+	}
+
+	// The second call always fails; MaxRetries would allow five retries but
+	// only one is left in the budget.
+	secondAttempts := 0
+	err = database.WithRetry(ctx, db, opts, func(tx *sql.Tx) error {
+		secondAttempts++
+		return serializationFailure
+	})
+	if !errors.Is(err, database.ErrRetryBudgetExhausted) {
+		t.Fatalf("Expected ErrRetryBudgetExhausted, got: %v", err)
+	}
+	if !errors.Is(err, serializationFailure) {
+		t.Errorf("Expected the last error to be wrapped, got: %v", err)
+	}
+	if secondAttempts != 2 {
+		t.Errorf("Expected 2 attempts on the second call, got %d", secondAttempts)
+	}
+}
+
+func TestPoolMonitor(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const threshold = 3
+	alerts := make(chan sql.DBStats, 10)
+	if err := database.StartPoolMonitor(ctx, db, 0, threshold, func(sql.DBStats) {}); err == nil {
+		t.Error("Expected an error for a zero interval")
+	}
+
+	err := database.StartPoolMonitor(ctx, db, 10*time.Millisecond, threshold, func(stats sql.DBStats) {
+		alerts <- stats
+	})
+	if err != nil {
+		t.Fatalf("Start pool monitor: %v", err)
+	}
+
+	hold := func() []*sql.Conn {
+		conns := make([]*sql.Conn, threshold)
+		for i := range conns {
+			conn, err := db.Conn(context.Background())
+			if err != nil {
+				t.Fatalf("Open connection: %v", err)
+			}
+			conns[i] = conn
+		}
+		return conns
+	}
+	release := func(conns []*sql.Conn) {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}
+	expectAlert := func() {
+		select {
+		case stats := <-alerts:
+			if stats.InUse < threshold {
+				t.Errorf("Expected at least %d connections in use, got %d", threshold, stats.InUse)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Expected the monitor to fire")
+		}
+	}
+
+	conns := hold()
+	expectAlert()
+
+	// Staying above the threshold doesn't repeat the alert.
+	time.Sleep(100 * time.Millisecond)
+	if len(alerts) != 0 {
+		t.Errorf("Expected one alert while the pool stays saturated, got %d more", len(alerts))
+	}
+
+	// Dropping below re-arms it.
+	release(conns)
+	time.Sleep(100 * time.Millisecond)
+	conns = hold()
+	expectAlert()
+	release(conns)
+
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	conns = hold()
+	defer release(conns)
+	time.Sleep(100 * time.Millisecond)
+	if len(alerts) != 0 {
+		t.Errorf("Expected no alerts after ctx was cancelled, got %d", len(alerts))
+	}
+}
+
+func TestRetriesExhaustedError(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	serializationFailure := &pq.Error{Code: "40001"}
+	attempts := 0
+	err := database.WithRetry(ctx, db, database.TxOptions{
+		IsolationLevel: sql.LevelReadCommitted,
+		MaxRetries:     2,
+	}, func(tx *sql.Tx) error {
+		attempts++
+		return fmt.Errorf("update stock: %w", serializationFailure)
+	})
+
+	var exhausted *database.RetriesExhaustedError
+	if !errors.As(err, &exhausted) {
+		t.Fatalf("Expected RetriesExhaustedError, got: %v", err)
+	}
+	if exhausted.Attempts != 3 || attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d (fn ran %d times)", exhausted.Attempts, attempts)
+	}
+	if exhausted.Class != database.ErrorClassSerialization {
+		t.Errorf("Expected serialization class, got %s", exhausted.Class)
+	}
+	if exhausted.Phase != database.RetryPhaseFn {
+		t.Errorf("Expected fn phase, got %s", exhausted.Phase)
+	}
+	if !errors.Is(err, serializationFailure) {
+		t.Errorf("Expected errors.Is to match the underlying error, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "max retries (2) exceeded") {
+		t.Errorf("Expected the retry count in the message, got: %v", err)
+	}
+}
+
+func TestRetryableClasses(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	opts := database.TxOptions{
+		IsolationLevel:   sql.LevelReadCommitted,
+		MaxRetries:       3,
+		RetryableClasses: []database.ErrorClass{database.ErrorClassSerialization},
+	}
+
+	deadlock := &pq.Error{Code: "40P01"}
+	attempts := 0
+	err := database.WithRetry(ctx, db, opts, func(tx *sql.Tx) error {
+		attempts++
+		return deadlock
+	})
+	if !errors.Is(err, deadlock) {
+		t.Fatalf("Expected the deadlock error, got: %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("Expected a deadlock not to be retried, got %d attempts", attempts)
+	}
+
+	attempts = 0
+	err = database.WithRetry(ctx, db, opts, func(tx *sql.Tx) error {
+		attempts++
+		if attempts == 1 {
+			return &pq.Error{Code: "40001"}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected a serialization failure to be retried, got: %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("Expected 2 attempts, got %d", attempts)
+	}
+
+	attempts = 0
+	opts.RetryableClasses = nil
+	err = database.WithRetry(ctx, db, opts, func(tx *sql.Tx) error {
+		attempts++
+		if attempts == 1 {
+			return deadlock
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Errorf("Expected a deadlock to be retried by default, got %d attempts: %v", attempts, err)
+	}
+}
+
+func TestDefaultIsolationFromConfig(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	levels := map[string]sql.IsolationLevel{
+		"read committed":  sql.LevelReadCommitted,
+		"REPEATABLE_READ": sql.LevelRepeatableRead,
+		"serializable":    sql.LevelSerializable,
+	}
+	for name, want := range levels {
+		got, err := database.ParseIsolationLevel(name)
+		if err != nil || got != want {
+			t.Errorf("ParseIsolationLevel(%q) = %v, %v; want %v", name, got, err, want)
+		}
+	}
+	if _, err := database.ParseIsolationLevel("snapshot"); err == nil {
+		t.Error("Expected an error for an unknown isolation level")
+	}
+
+	t.Cleanup(func() { database.SetDefaultIsolationLevel(sql.LevelReadCommitted) })
+
+	t.Setenv("DATABASE_DEFAULT_ISOLATION", "serializable")
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("Load config: %v", err)
+	}
+	cfg.Database.URL = testDSN
+
+	// Opening a connection must not change the process-wide default; main
+	// sets it once at startup.
+	configured, err := database.NewConnection(&cfg.Database)
+	if err != nil {
+		t.Fatalf("New connection: %v", err)
+	}
+	defer func() { _ = configured.Close() }()
+
+	if level := database.DefaultTxOptions().IsolationLevel; level != sql.LevelReadCommitted {
+		t.Fatalf("Expected NewConnection to leave the default isolation alone, got %v", level)
+	}
+
+	level, err := database.ParseIsolationLevel(cfg.Database.DefaultIsolation)
+	if err != nil {
+		t.Fatalf("Parse default isolation: %v", err)
+	}
+	database.SetDefaultIsolationLevel(level)
+
+	if level := database.DefaultTxOptions().IsolationLevel; level != sql.LevelSerializable {
+		t.Fatalf("Expected DefaultTxOptions to use serializable, got %v", level)
+	}
+
+	var isolation string
+	err = database.WithTransaction(ctx, db, database.DefaultTxOptions(), func(tx *sql.Tx) error {
+		return tx.QueryRowContext(ctx, `SHOW transaction_isolation`).Scan(&isolation)
+	})
+	if err != nil {
+		t.Fatalf("Read isolation: %v", err)
+	}
+	if isolation != "serializable" {
+		t.Errorf("Expected serializable transaction, got %q", isolation)
+	}
+}
+
+func TestErrorClassObserver(t *testing.T) {
+	var observed []database.ErrorClass
+	database.ErrorClassObserver = func(class database.ErrorClass) {
+		observed = append(observed, class)
+	}
+	t.Cleanup(func() { database.ErrorClassObserver = nil })
+
+	cases := []struct {
+		err  error
+		want database.ErrorClass
+	}{
+		{&pq.Error{Code: "40001"}, database.ErrorClassSerialization},
+		{fmt.Errorf("lock product 1: %w", &pq.Error{Code: "40P01"}), database.ErrorClassDeadlock},
+		{&pq.Error{Code: "55P03"}, database.ErrorClassTransient},
+		{&pq.Error{Code: "23505"}, database.ErrorClassPermanent},
+		{sql.ErrNoRows, database.ErrorClassPermanent},
+	}
+
+	for _, c := range cases {
+		if got := database.ClassifyError(c.err); got != c.want {
+			t.Errorf("ClassifyError(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+
+	database.ClassifyError(nil)
+
+	if len(observed) != len(cases) {
+		t.Fatalf("Expected %d observations with nil ignored, got %v", len(cases), observed)
+	}
+	for i, c := range cases {
+		if observed[i] != c.want {
+			t.Errorf("Observation %d: expected %v, got %v", i, c.want, observed[i])
+		}
+	}
+
+	database.ErrorClassObserver = nil
+	if database.ClassifyError(&pq.Error{Code: "40001"}) != database.ErrorClassSerialization {
+		t.Error("Expected classification to work with no observer")
+	}
+}
+
+func TestDatabaseSchema(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	const schema = "app_schema_test"
+
+	if _, err := database.WithSchema(testDSN, "Other-App"); err == nil {
+		t.Error("Expected WithSchema to reject an invalid schema name")
+	}
+
+	if _, err := db.ExecContext(ctx, `DROP SCHEMA IF EXISTS `+schema+` CASCADE; CREATE SCHEMA `+schema); err != nil {
+		t.Fatalf("Create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := db.ExecContext(ctx, `DROP SCHEMA IF EXISTS `+schema+` CASCADE`); err != nil {
+			t.Logf("Drop schema: %v", err)
+		}
+	})
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("Load config: %v", err)
+	}
+	cfg.Database.URL = testDSN
+	cfg.Database.Schema = schema
+
+	schemaDB, err := database.NewConnection(&cfg.Database)
+	if err != nil {
+		t.Fatalf("New connection: %v", err)
+	}
+	defer func() { _ = schemaDB.Close() }()
+
+	if err := runMigrations(schemaDB); err != nil {
+		t.Fatalf("Run migrations in schema: %v", err)
+	}
+
+	user, err := store.CreateUser(ctx, schemaDB, "schema@example.com", "Schema User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	product, err := store.CreateProduct(ctx, schemaDB, "TEST-SCHEMA-001", "Schema Product", "Test", decimal.NewFromInt(10), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	if _, err := store.CreateOrder(ctx, schemaDB, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 1}},
+	}); err != nil {
+		t.Fatalf("Create order: %v", err)
+	}
+	price := decimal.NewFromInt(12)
+	if _, err := store.PatchProduct(ctx, schemaDB, product.ID, store.ProductPatch{Price: &price}, product.Version); err != nil {
+		t.Fatalf("Patch product: %v", err)
+	}
+
+	// Rows written through the schema connection, including those written by
+	// triggers, land in the schema and not in the default public tables.
+	for _, table := range []string{"users", "products", "orders", "order_items", "product_price_history", "audit_log"} {
+		var inSchema, inPublic int
+		if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM `+schema+`.`+table).Scan(&inSchema); err != nil {
+			t.Fatalf("Count %s.%s: %v", schema, table, err)
+		}
+		if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM public.`+table).Scan(&inPublic); err != nil {
+			t.Fatalf("Count public.%s: %v", table, err)
+		}
+		if inSchema == 0 || inPublic != 0 {
+			t.Errorf("Expected %s rows only in %s, got %d there and %d in public", table, schema, inSchema, inPublic)
+		}
+	}
+}
+
+func TestWithRetryReportsCommitPhase(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	productA, err := store.CreateProduct(ctx, db, "TEST-PHASE-A", "Phase Product A", "Test", decimal.NewFromInt(10), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	productB, err := store.CreateProduct(ctx, db, "TEST-PHASE-B", "Phase Product B", "Test", decimal.NewFromInt(10), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	// Write skew: each transaction reads both rows and writes a different
+	// one. Neither write conflicts directly, so Postgres only finds the
+	// dangerous cycle when the second transaction commits.
+	other, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		t.Fatalf("Begin transaction: %v", err)
+	}
+	defer func() { _ = other.Rollback() }()
+
+	var total int
+	if err := other.QueryRowContext(ctx, `SELECT SUM(stock_quantity) FROM products`).Scan(&total); err != nil {
+		t.Fatalf("Read stock: %v", err)
+	}
+
+	var events []database.RetryEvent
+	opts := database.TxOptions{
+		IsolationLevel: sql.LevelSerializable,
+		MaxRetries:     2,
+		OnRetry:        func(event database.RetryEvent) { events = append(events, event) },
+	}
+
+	written := make(chan struct{})
+	committed := make(chan struct{})
+	done := make(chan error, 1)
+	var attempts int32
+
+	go func() {
+		done <- database.WithRetry(ctx, db, opts, func(tx *sql.Tx) error {
+			var total int
+			if err := tx.QueryRowContext(ctx, `SELECT SUM(stock_quantity) FROM products`).Scan(&total); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE products SET stock_quantity = stock_quantity + 1 WHERE id = $1`, productB.ID); err != nil {
+				return err
+			}
+			if atomic.AddInt32(&attempts, 1) == 1 {
+				close(written)
+				<-committed
+			}
+			return nil
+		})
+	}()
+
+	<-written
+	if _, err := other.ExecContext(ctx, `UPDATE products SET stock_quantity = stock_quantity + 1 WHERE id = $1`, productA.ID); err != nil {
+		t.Fatalf("Update product A: %v", err)
+	}
+	if err := other.Commit(); err != nil {
+		t.Fatalf("Commit first transaction: %v", err)
+	}
+	close(committed)
+
+	if err := <-done; err != nil {
+		t.Fatalf("WithRetry: %v", err)
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 retry, got %d: %+v", len(events), events)
+	}
+	if events[0].Phase != database.RetryPhaseCommit || events[0].Class != database.ErrorClassSerialization {
+		t.Errorf("Expected a serialization failure at commit, got phase %s, class %v: %v", events[0].Phase, events[0].Class, events[0].Err)
+	}
+	if attempts := atomic.LoadInt32(&attempts); attempts != 2 {
+		t.Errorf("Expected fn to run twice, got %d", attempts)
+	}
+
+	assertStock(t, db, productB.ID, 11, 0)
+}
+
+func TestTimestampsUTC(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	// Connect with a session in another zone; NewConnection must still
+	// return timestamps in UTC.
+	u, err := url.Parse(testDSN)
+	if err != nil {
+		t.Fatalf("Parse DSN: %v", err)
+	}
+	query := u.Query()
+	query.Set("timezone", "America/New_York")
+	u.RawQuery = query.Encode()
+	newYorkDSN := u.String()
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("Load config: %v", err)
+	}
+	cfg.Database.URL = newYorkDSN
+
+	utcDB, err := database.NewConnection(&cfg.Database)
+	if err != nil {
+		t.Fatalf("New connection: %v", err)
+	}
+	defer func() { _ = utcDB.Close() }()
+
+	user, err := store.CreateUser(ctx, utcDB, "utc@example.com", "UTC User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	if user.CreatedAt.Location() != time.UTC {
+		t.Errorf("Expected created_at in UTC, got %s", user.CreatedAt.Location())
+	}
+	if d := time.Since(user.CreatedAt); d < -time.Minute || d > time.Minute {
+		t.Errorf("Expected created_at close to now, got %v (off by %v)", user.CreatedAt, d)
+	}
+
+	encoded, err := json.Marshal(user)
+	if err != nil {
+		t.Fatalf("Encode user: %v", err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		t.Fatalf("Decode user: %v", err)
+	}
+	for _, name := range []string{"created_at", "updated_at"} {
+		value, _ := fields[name].(string)
+		if !strings.HasSuffix(value, "Z") {
+			t.Errorf("Expected %s with a Z suffix, got %q", name, value)
+		}
+		parsed, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			t.Errorf("Parse %s: %v", name, err)
+		} else if name == "created_at" && !parsed.Equal(user.CreatedAt) {
+			t.Errorf("Expected created_at to round-trip as %v, got %v", user.CreatedAt, parsed)
+		}
+	}
+
+	// The stored instant doesn't depend on the reading session's zone.
+	newYorkDB, err := sql.Open("postgres", newYorkDSN)
+	if err != nil {
+		t.Fatalf("Open database: %v", err)
+	}
+	defer func() { _ = newYorkDB.Close() }()
+
+	fetched, err := store.GetUser(ctx, newYorkDB, user.ID)
+	if err != nil {
+		t.Fatalf("Get user: %v", err)
+	}
+	if !fetched.CreatedAt.Equal(user.CreatedAt) {
+		t.Errorf("Expected the same instant from a New York session, got %v and %v", fetched.CreatedAt, user.CreatedAt)
+	}
+	if _, offset := fetched.CreatedAt.Zone(); offset == 0 {
+		t.Errorf("Expected the New York session to return a non-UTC offset, got %v", fetched.CreatedAt)
+	}
+
+	var dataType string
+	err = db.QueryRowContext(ctx,
+		`SELECT data_type FROM information_schema.columns
+		 WHERE table_schema = current_schema() AND table_name = 'users' AND column_name = 'created_at'`).Scan(&dataType)
+	if err != nil {
+		t.Fatalf("Get column type: %v", err)
+	}
+	if dataType != "timestamp with time zone" {
+		t.Errorf("Expected users.created_at to be timestamp with time zone, got %s", dataType)
+	}
+}
@@ -0,0 +1,176 @@
+package integration
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/safar/go-sql-store/internal/api"
+	"github.com/safar/go-sql-store/internal/config"
+	storev1 "github.com/safar/go-sql-store/proto/store/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestGRPCClient serves StoreService in-process over an in-memory
+// listener and returns a client connected to it.
+func newTestGRPCClient(t *testing.T, db *sql.DB, cfg *config.ServerConfig) storev1.StoreServiceClient {
+	t.Helper()
+
+	listener := bufconn.Listen(1 << 20)
+	server := api.NewGRPCServer(db, cfg)
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Dial gRPC server: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return storev1.NewStoreServiceClient(conn)
+}
+
+func TestGRPCStoreService(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	client := newTestGRPCClient(t, db, &config.ServerConfig{})
+
+	user, err := client.CreateUser(ctx, &storev1.CreateUserRequest{Email: "grpc@example.com", Name: "gRPC User"})
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	if user.GetId() == 0 || user.GetCreatedAt() == nil {
+		t.Errorf("Expected a stored user, got %+v", user)
+	}
+
+	product, err := client.CreateProduct(ctx, &storev1.CreateProductRequest{Sku: "test-grpc-001", Name: "gRPC Product", Price: "12.50", Stock: 10})
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	if product.GetSku() != "TEST-GRPC-001" || product.GetStockQuantity() != 10 || product.GetCurrency() != "USD" {
+		t.Errorf("Expected product TEST-GRPC-001 in USD with stock 10, got %+v", product)
+	}
+
+	order, err := client.CreateOrder(ctx, &storev1.CreateOrderRequest{
+		UserId: user.GetId(),
+		Items:  []*storev1.OrderItemRequest{{ProductId: product.GetId(), Quantity: 2}},
+	})
+	if err != nil {
+		t.Fatalf("Create order: %v", err)
+	}
+	if order.GetUserId() != user.GetId() || order.GetTotalAmount() != "25" {
+		t.Errorf("Expected a 25 order for user %d, got %s for user %d", user.GetId(), order.GetTotalAmount(), order.GetUserId())
+	}
+
+	fetched, err := client.GetOrder(ctx, &storev1.GetOrderRequest{Id: order.GetId()})
+	if err != nil {
+		t.Fatalf("Get order: %v", err)
+	}
+	if len(fetched.GetItems()) != 1 || fetched.GetItems()[0].GetQuantity() != 2 || fetched.GetItems()[0].GetUnitPrice() != "12.5" {
+		t.Errorf("Expected the order's item with quantity 2 at 12.5, got %+v", fetched.GetItems())
+	}
+
+	stocked, err := client.GetProduct(ctx, &storev1.GetProductRequest{Id: product.GetId()})
+	if err != nil {
+		t.Fatalf("Get product: %v", err)
+	}
+	if stocked.GetStockQuantity() != 8 {
+		t.Errorf("Expected stock 8 after the order, got %d", stocked.GetStockQuantity())
+	}
+
+	if got, err := client.GetUser(ctx, &storev1.GetUserRequest{Id: user.GetId()}); err != nil || got.GetEmail() != "grpc@example.com" {
+		t.Errorf("Expected to get the user back, got %+v: %v", got, err)
+	}
+
+	errorCases := []struct {
+		name string
+		call func() error
+		code codes.Code
+		want string
+	}{
+		{"missing id", func() error {
+			_, err := client.GetUser(ctx, &storev1.GetUserRequest{})
+			return err
+		}, codes.InvalidArgument, "id: is required"},
+		{"negative id", func() error {
+			_, err := client.GetProduct(ctx, &storev1.GetProductRequest{Id: -1})
+			return err
+		}, codes.InvalidArgument, "id: must be a positive integer"},
+		{"unknown user", func() error {
+			_, err := client.GetUser(ctx, &storev1.GetUserRequest{Id: user.GetId() + 1000})
+			return err
+		}, codes.NotFound, ""},
+		{"missing fields", func() error {
+			_, err := client.CreateProduct(ctx, &storev1.CreateProductRequest{Sku: "TEST-GRPC-002"})
+			return err
+		}, codes.InvalidArgument, "price: is required"},
+		{"bad price", func() error {
+			_, err := client.CreateProduct(ctx, &storev1.CreateProductRequest{Sku: "TEST-GRPC-002", Name: "Bad", Price: "lots"})
+			return err
+		}, codes.InvalidArgument, "price: must be a number"},
+		{"duplicate sku", func() error {
+			_, err := client.CreateProduct(ctx, &storev1.CreateProductRequest{Sku: "TEST-GRPC-001", Name: "Duplicate", Price: "1"})
+			return err
+		}, codes.AlreadyExists, ""},
+		{"invalid item", func() error {
+			_, err := client.CreateOrder(ctx, &storev1.CreateOrderRequest{
+				UserId: user.GetId(),
+				Items:  []*storev1.OrderItemRequest{{ProductId: product.GetId()}},
+			})
+			return err
+		}, codes.InvalidArgument, "items[0].quantity: is required"},
+		{"insufficient stock", func() error {
+			_, err := client.CreateOrder(ctx, &storev1.CreateOrderRequest{
+				UserId: user.GetId(),
+				Items:  []*storev1.OrderItemRequest{{ProductId: product.GetId(), Quantity: 100}},
+			})
+			return err
+		}, codes.FailedPrecondition, ""},
+	}
+	for _, tc := range errorCases {
+		err := tc.call()
+		if status.Code(err) != tc.code || !strings.Contains(status.Convert(err).Message(), tc.want) {
+			t.Errorf("%s: expected %s containing %q, got %v", tc.name, tc.code, tc.want, err)
+		}
+	}
+}
+
+func TestGRPCCreateOrderRateLimit(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	client := newTestGRPCClient(t, db, &config.ServerConfig{OrderRatePerUser: 0.001, OrderBurstPerUser: 1})
+
+	user, err := client.CreateUser(ctx, &storev1.CreateUserRequest{Email: "grpc-limit@example.com", Name: "Limited"})
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	product, err := client.CreateProduct(ctx, &storev1.CreateProductRequest{Sku: "TEST-GRPC-LIMIT", Name: "Limited Product", Price: "5", Stock: 10})
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	req := &storev1.CreateOrderRequest{
+		UserId: user.GetId(),
+		Items:  []*storev1.OrderItemRequest{{ProductId: product.GetId(), Quantity: 1}},
+	}
+	if _, err := client.CreateOrder(ctx, req); err != nil {
+		t.Fatalf("Create first order: %v", err)
+	}
+	if _, err := client.CreateOrder(ctx, req); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected ResourceExhausted for the second order, got %v", err)
+	}
+}
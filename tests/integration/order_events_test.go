@@ -0,0 +1,130 @@
+package integration
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/safar/go-sql-store/internal/database"
+	"github.com/safar/go-sql-store/internal/models"
+	"github.com/safar/go-sql-store/internal/store"
+	"github.com/shopspring/decimal"
+)
+
+func TestOrderEventHook(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	var events []store.OrderEvent
+	unregister := store.RegisterOrderEventHook(func(event store.OrderEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	})
+	defer unregister()
+
+	user, err := store.CreateUser(ctx, db, "events@example.com", "Events User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	product, err := store.CreateProduct(ctx, db, "TEST-EVT-001", "Event Product", "Test", decimal.NewFromInt(10), 5, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	order, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 2}},
+	})
+	if err != nil {
+		t.Fatalf("Create order: %v", err)
+	}
+
+	confirmed, err := store.UpdateOrderStatus(ctx, db, order.ID, models.OrderStatusConfirmed)
+	if err != nil {
+		t.Fatalf("Update order status: %v", err)
+	}
+
+	// Rejected transitions change nothing and emit nothing.
+	if _, err := store.UpdateOrderStatus(ctx, db, order.ID, models.OrderStatusDelivered); err != database.ErrInvalidStatusTransition {
+		t.Errorf("Expected ErrInvalidStatusTransition, got: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d: %+v", len(events), events)
+	}
+
+	created := events[0]
+	if created.OrderID != order.ID || created.OldStatus != "" || created.NewStatus != models.OrderStatusPending || !created.OccurredAt.Equal(order.CreatedAt) {
+		t.Errorf("Unexpected create event: %+v", created)
+	}
+
+	changed := events[1]
+	if changed.OrderID != order.ID || changed.OldStatus != models.OrderStatusPending || changed.NewStatus != models.OrderStatusConfirmed || !changed.OccurredAt.Equal(confirmed.UpdatedAt) {
+		t.Errorf("Unexpected status change event: %+v", changed)
+	}
+}
+
+func TestUpdateOrderStatusCancelRestocks(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "cancel@example.com", "Cancel User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	product, err := store.CreateProduct(ctx, db, "TEST-EVT-002", "Cancel Product", "Test", decimal.NewFromInt(10), 5, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	order, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 3}},
+	})
+	if err != nil {
+		t.Fatalf("Create order: %v", err)
+	}
+
+	cancelled, err := store.UpdateOrderStatus(ctx, db, order.ID, models.OrderStatusCancelled)
+	if err != nil {
+		t.Fatalf("Cancel order: %v", err)
+	}
+	if cancelled.Status != models.OrderStatusCancelled || cancelled.Version != order.Version+1 {
+		t.Errorf("Unexpected cancelled order: %+v", cancelled)
+	}
+
+	productAfter, err := store.GetProduct(ctx, db, product.ID)
+	if err != nil {
+		t.Fatalf("Get product: %v", err)
+	}
+	if productAfter.StockQuantity != 5 {
+		t.Errorf("Expected stock restored to 5, got %d", productAfter.StockQuantity)
+	}
+
+	if _, err := store.UpdateOrderStatus(ctx, db, order.ID, models.OrderStatusConfirmed); err != database.ErrInvalidStatusTransition {
+		t.Errorf("Expected cancelled order to be final, got: %v", err)
+	}
+
+	if _, err := store.UpdateOrderStatus(ctx, db, order.ID+1000, models.OrderStatusConfirmed); err != database.ErrOrderNotFound {
+		t.Errorf("Expected ErrOrderNotFound, got: %v", err)
+	}
+
+	report, err := store.ReconcileStock(ctx, db, false)
+	if err != nil {
+		t.Fatalf("Reconcile stock: %v", err)
+	}
+	if len(report) != 0 {
+		t.Errorf("Expected cancellation to keep stock reconciled, got %+v", report)
+	}
+}
@@ -0,0 +1,208 @@
+package integration
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/safar/go-sql-store/internal/database"
+	"github.com/safar/go-sql-store/internal/store"
+	"github.com/shopspring/decimal"
+)
+
+func TestOrderNumberGeneratorsUnique(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	strategies := []string{
+		store.OrderNumberStrategySequence,
+		store.OrderNumberStrategyULID,
+	}
+
+	for _, strategy := range strategies {
+		t.Run(strategy, func(t *testing.T) {
+			gen, err := store.NewOrderNumberGenerator(strategy, "TST-")
+			if err != nil {
+				t.Fatalf("New generator: %v", err)
+			}
+
+			concurrency := 20
+			perWorker := 25
+			var wg sync.WaitGroup
+			numbers := make(chan string, concurrency*perWorker)
+			errs := make(chan error, concurrency)
+
+			for i := 0; i < concurrency; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					err := database.WithTransaction(ctx, db, database.DefaultTxOptions(), func(tx *sql.Tx) error {
+						for j := 0; j < perWorker; j++ {
+							number, err := gen.NextOrderNumber(ctx, tx)
+							if err != nil {
+								return err
+							}
+							numbers <- number
+						}
+						return nil
+					})
+					if err != nil {
+						errs <- err
+					}
+				}()
+			}
+
+			wg.Wait()
+			close(numbers)
+			close(errs)
+
+			for err := range errs {
+				t.Fatalf("Generate order number: %v", err)
+			}
+
+			seen := make(map[string]bool)
+			for number := range numbers {
+				if !strings.HasPrefix(number, "TST-") {
+					t.Errorf("Expected prefix TST-, got %s", number)
+				}
+				if seen[number] {
+					t.Errorf("Duplicate order number %s", number)
+				}
+				seen[number] = true
+			}
+
+			if len(seen) != concurrency*perWorker {
+				t.Errorf("Expected %d unique numbers, got %d", concurrency*perWorker, len(seen))
+			}
+		})
+	}
+}
+
+func TestCreateOrderWithSequenceNumbers(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	previous := store.DefaultOrderNumberGenerator
+	store.DefaultOrderNumberGenerator = store.SequenceOrderNumberGenerator{Prefix: "SEQ-"}
+	defer func() { store.DefaultOrderNumberGenerator = previous }()
+
+	user, err := store.CreateUser(ctx, db, "seq@example.com", "Seq User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	product, err := store.CreateProduct(ctx, db, "TEST-SEQ-001", "Seq Product", "Test", decimal.NewFromInt(10), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	order, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 1}},
+	})
+	if err != nil {
+		t.Fatalf("Create order: %v", err)
+	}
+
+	if !strings.HasPrefix(order.OrderNumber, "SEQ-") || len(order.OrderNumber) != len("SEQ-0000000001") {
+		t.Errorf("Expected sequence order number like SEQ-0000000001, got %s", order.OrderNumber)
+	}
+}
+
+func TestUnknownOrderNumberStrategy(t *testing.T) {
+	if _, err := store.NewOrderNumberGenerator("uuid", "ORD-"); err == nil {
+		t.Error("Expected error for unknown strategy")
+	}
+}
+
+type collidingOrderNumbers struct {
+	mu       sync.Mutex
+	fixed    string
+	returned bool
+	next     store.OrderNumberGenerator
+}
+
+func (g *collidingOrderNumbers) NextOrderNumber(ctx context.Context, tx *sql.Tx) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.returned {
+		g.returned = true
+		return g.fixed, nil
+	}
+	return g.next.NextOrderNumber(ctx, tx)
+}
+
+type fixedOrderNumbers string
+
+func (g fixedOrderNumbers) NextOrderNumber(ctx context.Context, tx *sql.Tx) (string, error) {
+	return string(g), nil
+}
+
+func TestCreateOrderRecoversFromOrderNumberCollision(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "collide@example.com", "Collide User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	product, err := store.CreateProduct(ctx, db, "TEST-COL-001", "Collide Product", "Test", decimal.NewFromInt(10), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	items := []store.OrderItemRequest{{ProductID: product.ID, Quantity: 1}}
+
+	first, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID:       user.ID,
+		Items:        items,
+		OrderNumbers: fixedOrderNumbers("ORD-FIXED"),
+	})
+	if err != nil {
+		t.Fatalf("Create first order: %v", err)
+	}
+
+	second, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items:  items,
+		OrderNumbers: &collidingOrderNumbers{
+			fixed: first.OrderNumber,
+			next:  store.TimestampOrderNumberGenerator{Prefix: "ORD-"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Create colliding order: %v", err)
+	}
+
+	if second.OrderNumber == first.OrderNumber {
+		t.Errorf("Expected regenerated order number, got duplicate %s", second.OrderNumber)
+	}
+
+	_, err = store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID:       user.ID,
+		Items:        items,
+		OrderNumbers: fixedOrderNumbers("ORD-FIXED"),
+	})
+	if err != database.ErrOrderNumberConflict {
+		t.Errorf("Expected order number conflict after exhausting attempts, got: %v", err)
+	}
+
+	productAfter, err := store.GetProduct(ctx, db, product.ID)
+	if err != nil {
+		t.Fatalf("Get product: %v", err)
+	}
+	if productAfter.StockQuantity != 8 {
+		t.Errorf("Expected stock 8 after two orders, got %d", productAfter.StockQuantity)
+	}
+}
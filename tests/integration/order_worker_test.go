@@ -0,0 +1,138 @@
+package integration
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/safar/go-sql-store/internal/models"
+	"github.com/safar/go-sql-store/internal/store"
+	"github.com/shopspring/decimal"
+)
+
+func TestRunOrderWorker(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "worker@example.com", "Worker User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	product, err := store.CreateProduct(ctx, db, "TEST-WORKER-001", "Worker Product", "Test", decimal.NewFromInt(10), 100, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	pending := make(map[int64]bool)
+	var badOrderID int64
+	for i := 0; i < 4; i++ {
+		order, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+			UserID: user.ID,
+			Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 1}},
+		})
+		if err != nil {
+			t.Fatalf("Create order: %v", err)
+		}
+		if i == 0 {
+			badOrderID = order.ID
+			continue
+		}
+		pending[order.ID] = true
+	}
+
+	workerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	processed := make(chan int64, 10)
+	failedOnce := false
+	errBadOrder := errors.New("bad order")
+
+	handler := func(ctx context.Context, tx *sql.Tx, order *models.Order) error {
+		// The oldest order always fails. The worker must report it and go on
+		// to the orders behind it.
+		if order.ID == badOrderID {
+			return errBadOrder
+		}
+
+		// The first attempt fails with a serialization error, which must be
+		// retried rather than stopping the worker.
+		if !failedOnce {
+			failedOnce = true
+			return &pq.Error{Code: "40001"}
+		}
+
+		_, err := tx.ExecContext(ctx,
+			`UPDATE orders SET status = $1, version = version + 1, updated_at = NOW() WHERE id = $2`,
+			models.OrderStatusConfirmed, order.ID)
+		if err != nil {
+			return err
+		}
+		processed <- order.ID
+		return nil
+	}
+
+	reported := make(chan int64, 10)
+	onError := func(order *models.Order, err error) {
+		if !errors.Is(err, errBadOrder) {
+			t.Errorf("Expected errBadOrder for order %d, got: %v", order.ID, err)
+		}
+		reported <- order.ID
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- store.RunOrderWorker(workerCtx, db, handler, 20*time.Millisecond, onError)
+	}()
+
+	timeout := time.After(10 * time.Second)
+	var reports []int64
+	for len(pending) > 0 {
+		select {
+		case id := <-reported:
+			reports = append(reports, id)
+		case id := <-processed:
+			if !pending[id] {
+				t.Errorf("Order %d processed twice or unexpectedly", id)
+			}
+			delete(pending, id)
+		case err := <-done:
+			t.Fatalf("Worker exited early: %v", err)
+		case <-timeout:
+			t.Fatalf("Timed out with %d orders unprocessed", len(pending))
+		}
+	}
+
+	// Let the worker poll the empty queue at least once before stopping it.
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	for len(reported) > 0 {
+		reports = append(reports, <-reported)
+	}
+	if len(reports) != 1 || reports[0] != badOrderID {
+		t.Errorf("Expected order %d reported once, got %v", badOrderID, reports)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected clean exit on cancel, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Worker did not exit after cancel")
+	}
+
+	var stillPending int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM orders WHERE status = $1`, models.OrderStatusPending).Scan(&stillPending); err != nil {
+		t.Fatalf("Count pending orders: %v", err)
+	}
+	if stillPending != 1 {
+		t.Errorf("Expected only the failed order to stay pending, got %d", stillPending)
+	}
+}
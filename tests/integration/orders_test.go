@@ -2,10 +2,19 @@ package integration
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/lib/pq"
 	"github.com/safar/go-sql-store/internal/database"
+	"github.com/safar/go-sql-store/internal/models"
 	"github.com/safar/go-sql-store/internal/store"
 	"github.com/shopspring/decimal"
 )
@@ -21,12 +30,12 @@ func TestCreateOrder(t *testing.T) {
 		t.Fatalf("Create user: %v", err)
 	}
 
-	product1, err := store.CreateProduct(ctx, db, "TEST-ORD-001", "Product 1", "Test", decimal.NewFromInt(100), 50)
+	product1, err := store.CreateProduct(ctx, db, "TEST-ORD-001", "Product 1", "Test", decimal.NewFromInt(100), 50, "")
 	if err != nil {
 		t.Fatalf("Create product 1: %v", err)
 	}
 
-	product2, err := store.CreateProduct(ctx, db, "TEST-ORD-002", "Product 2", "Test", decimal.NewFromInt(200), 30)
+	product2, err := store.CreateProduct(ctx, db, "TEST-ORD-002", "Product 2", "Test", decimal.NewFromInt(200), 30, "")
 	if err != nil {
 		t.Fatalf("Create product 2: %v", err)
 	}
@@ -81,7 +90,7 @@ func TestCreateOrderInsufficientStock(t *testing.T) {
 		t.Fatalf("Create user: %v", err)
 	}
 
-	product, err := store.CreateProduct(ctx, db, "TEST-ORD-003", "Product 3", "Test", decimal.NewFromInt(100), 5)
+	product, err := store.CreateProduct(ctx, db, "TEST-ORD-003", "Product 3", "Test", decimal.NewFromInt(100), 5, "")
 	if err != nil {
 		t.Fatalf("Create product: %v", err)
 	}
@@ -117,7 +126,7 @@ func TestConcurrentOrderCreation(t *testing.T) {
 		t.Fatalf("Create user: %v", err)
 	}
 
-	product, err := store.CreateProduct(ctx, db, "TEST-ORD-004", "Product 4", "Test", decimal.NewFromInt(100), 20)
+	product, err := store.CreateProduct(ctx, db, "TEST-ORD-004", "Product 4", "Test", decimal.NewFromInt(100), 20, "")
 	if err != nil {
 		t.Fatalf("Create product: %v", err)
 	}
@@ -186,7 +195,7 @@ func TestListOrdersCursor(t *testing.T) {
 		t.Fatalf("Create user: %v", err)
 	}
 
-	product, err := store.CreateProduct(ctx, db, "TEST-ORD-005", "Product 5", "Test", decimal.NewFromInt(100), 100)
+	product, err := store.CreateProduct(ctx, db, "TEST-ORD-005", "Product 5", "Test", decimal.NewFromInt(100), 100, "")
 	if err != nil {
 		t.Fatalf("Create product: %v", err)
 	}
@@ -225,3 +234,2101 @@ func TestListOrdersCursor(t *testing.T) {
 		t.Error("Page 2 should not have more results")
 	}
 }
+
+func TestCreateOrderManyItems(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "bulk@example.com", "Bulk User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	var items []store.OrderItemRequest
+	for i := 0; i < 20; i++ {
+		product, err := store.CreateProduct(ctx, db, fmt.Sprintf("TEST-BULK-%03d", i), "Bulk Product", "Test", decimal.NewFromInt(10), 50, "")
+		if err != nil {
+			t.Fatalf("Create product %d: %v", i, err)
+		}
+		items = append(items, store.OrderItemRequest{ProductID: product.ID, Quantity: i + 1})
+	}
+
+	// The items must be written and their stock taken in one statement
+	// each, however many there are.
+	var mu sync.Mutex
+	var itemInserts, stockUpdates int
+	connector, err := database.NewConnector(testDSN, func(ctx context.Context, event database.QueryEvent) {
+		query := strings.TrimSpace(event.Query)
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.HasPrefix(query, "INSERT INTO order_items"):
+			itemInserts++
+		case strings.HasPrefix(query, "UPDATE products") && strings.Contains(query, "stock_quantity = stock_quantity -"):
+			stockUpdates++
+		}
+	})
+	if err != nil {
+		t.Fatalf("New connector: %v", err)
+	}
+	hooked := sql.OpenDB(connector)
+	defer hooked.Close()
+
+	order, err := store.CreateOrder(ctx, hooked, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items:  items,
+	})
+	if err != nil {
+		t.Fatalf("Create order: %v", err)
+	}
+
+	mu.Lock()
+	if itemInserts != 1 {
+		t.Errorf("Expected 1 order_items INSERT, got %d", itemInserts)
+	}
+	if stockUpdates != 1 {
+		t.Errorf("Expected 1 stock UPDATE, got %d", stockUpdates)
+	}
+	mu.Unlock()
+
+	var itemCount int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM order_items WHERE order_id = $1`, order.ID).Scan(&itemCount); err != nil {
+		t.Fatalf("Count order items: %v", err)
+	}
+	if itemCount != len(items) {
+		t.Errorf("Expected %d order items, got %d", len(items), itemCount)
+	}
+
+	expectedTotal := decimal.NewFromInt(10 * 210)
+	if !order.TotalAmount.Equal(expectedTotal) {
+		t.Errorf("Expected total %s, got %s", expectedTotal, order.TotalAmount)
+	}
+
+	for _, item := range items {
+		product, err := store.GetProduct(ctx, db, item.ProductID)
+		if err != nil {
+			t.Fatalf("Get product %d: %v", item.ProductID, err)
+		}
+		if product.StockQuantity != 50-item.Quantity {
+			t.Errorf("Product %d: expected stock %d, got %d", item.ProductID, 50-item.Quantity, product.StockQuantity)
+		}
+	}
+}
+
+func TestDecrementStockBatchAllOrNothing(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	plenty, err := store.CreateProduct(ctx, db, "TEST-BATCH-001", "Plenty", "Test", decimal.NewFromInt(10), 100, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	scarce, err := store.CreateProduct(ctx, db, "TEST-BATCH-002", "Scarce", "Test", decimal.NewFromInt(10), 1, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	err = database.WithTransaction(ctx, db, database.DefaultTxOptions(), func(tx *sql.Tx) error {
+		return store.DecrementStockBatch(ctx, tx, []store.OrderItemRequest{
+			{ProductID: plenty.ID, Quantity: 5},
+			{ProductID: scarce.ID, Quantity: 2},
+		})
+	})
+	if err != database.ErrInsufficientStock {
+		t.Fatalf("Expected insufficient stock error, got: %v", err)
+	}
+
+	plentyAfter, err := store.GetProduct(ctx, db, plenty.ID)
+	if err != nil {
+		t.Fatalf("Get product: %v", err)
+	}
+	if plentyAfter.StockQuantity != 100 {
+		t.Errorf("Expected stock to remain 100, got %d", plentyAfter.StockQuantity)
+	}
+}
+
+func TestPurgeCancelledOrders(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "purge@example.com", "Purge User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	product, err := store.CreateProduct(ctx, db, "TEST-PURGE-001", "Purge Product", "Test", decimal.NewFromInt(10), 100, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	var orderIDs []int64
+	for i := 0; i < 4; i++ {
+		order, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+			UserID: user.ID,
+			Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 1}},
+		})
+		if err != nil {
+			t.Fatalf("Create order %d: %v", i, err)
+		}
+		orderIDs = append(orderIDs, order.ID)
+	}
+
+	oldCancelled := orderIDs[:2]
+	recentCancelled := orderIDs[2]
+	oldPending := orderIDs[3]
+
+	_, err = db.ExecContext(ctx,
+		`UPDATE orders SET status = 'cancelled', created_at = NOW() - INTERVAL '90 days' WHERE id = ANY($1)`,
+		pq.Array(oldCancelled))
+	if err != nil {
+		t.Fatalf("Age cancelled orders: %v", err)
+	}
+	if _, err := db.ExecContext(ctx, `UPDATE orders SET status = 'cancelled' WHERE id = $1`, recentCancelled); err != nil {
+		t.Fatalf("Cancel recent order: %v", err)
+	}
+	if _, err := db.ExecContext(ctx, `UPDATE orders SET created_at = NOW() - INTERVAL '90 days' WHERE id = $1`, oldPending); err != nil {
+		t.Fatalf("Age pending order: %v", err)
+	}
+
+	purged, err := store.PurgeCancelledOrders(ctx, db, time.Now().AddDate(0, 0, -30))
+	if err != nil {
+		t.Fatalf("Purge cancelled orders: %v", err)
+	}
+	if purged != 2 {
+		t.Errorf("Expected 2 purged orders, got %d", purged)
+	}
+
+	for _, id := range oldCancelled {
+		if _, err := store.GetOrder(ctx, db, id); err != database.ErrOrderNotFound {
+			t.Errorf("Expected order %d to be purged, got: %v", id, err)
+		}
+	}
+
+	var itemCount int
+	err = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM order_items WHERE order_id = ANY($1)`, pq.Array(oldCancelled)).Scan(&itemCount)
+	if err != nil {
+		t.Fatalf("Count order items: %v", err)
+	}
+	if itemCount != 0 {
+		t.Errorf("Expected purged order items to be removed, found %d", itemCount)
+	}
+
+	for _, id := range []int64{recentCancelled, oldPending} {
+		if _, err := store.GetOrder(ctx, db, id); err != nil {
+			t.Errorf("Expected order %d to remain, got: %v", id, err)
+		}
+	}
+}
+
+func TestFetchPendingOrdersBatchDisjoint(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "worker@example.com", "Worker User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	product, err := store.CreateProduct(ctx, db, "TEST-WORK-001", "Worker Product", "Test", decimal.NewFromInt(10), 100, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	for i := 0; i < 8; i++ {
+		_, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+			UserID: user.ID,
+			Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 1}},
+		})
+		if err != nil {
+			t.Fatalf("Create order %d: %v", i, err)
+		}
+	}
+
+	tx1, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("Begin tx1: %v", err)
+	}
+	defer func() { _ = tx1.Rollback() }()
+
+	tx2, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("Begin tx2: %v", err)
+	}
+	defer func() { _ = tx2.Rollback() }()
+
+	batch1, err := store.FetchPendingOrdersBatch(ctx, tx1, 5)
+	if err != nil {
+		t.Fatalf("Worker 1 fetch: %v", err)
+	}
+
+	batch2, err := store.FetchPendingOrdersBatch(ctx, tx2, 5)
+	if err != nil {
+		t.Fatalf("Worker 2 fetch: %v", err)
+	}
+
+	if len(batch1) != 5 {
+		t.Errorf("Expected worker 1 to claim 5 orders, got %d", len(batch1))
+	}
+	if len(batch2) != 3 {
+		t.Errorf("Expected worker 2 to claim remaining 3 orders, got %d", len(batch2))
+	}
+
+	claimed := make(map[int64]bool)
+	for _, order := range batch1 {
+		claimed[order.ID] = true
+	}
+	for _, order := range batch2 {
+		if claimed[order.ID] {
+			t.Errorf("Order %d claimed by both workers", order.ID)
+		}
+	}
+}
+
+func TestConcurrentOrderCreationReadCommitted(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "rc@example.com", "Read Committed User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	product, err := store.CreateProduct(ctx, db, "TEST-RC-001", "RC Product", "Test", decimal.NewFromInt(100), 15, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	concurrency := 10
+	var wg sync.WaitGroup
+	results := make(chan error, concurrency)
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+				UserID:         user.ID,
+				Items:          []store.OrderItemRequest{{ProductID: product.ID, Quantity: 2}},
+				IsolationLevel: sql.LevelReadCommitted,
+			})
+			results <- err
+		}()
+	}
+
+	wg.Wait()
+	close(results)
+
+	successCount := 0
+	for err := range results {
+		switch err {
+		case nil:
+			successCount++
+		case database.ErrInsufficientStock:
+		default:
+			t.Logf("Unexpected error: %v", err)
+		}
+	}
+
+	if successCount > 7 {
+		t.Errorf("Oversold: %d orders of 2 succeeded with stock 15", successCount)
+	}
+
+	productAfter, err := store.GetProduct(ctx, db, product.ID)
+	if err != nil {
+		t.Fatalf("Get product: %v", err)
+	}
+
+	expectedStock := 15 - successCount*2
+	if productAfter.StockQuantity != expectedStock {
+		t.Errorf("Expected final stock %d, got %d", expectedStock, productAfter.StockQuantity)
+	}
+
+	var orderCount int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM orders WHERE user_id = $1`, user.ID).Scan(&orderCount); err != nil {
+		t.Fatalf("Count orders: %v", err)
+	}
+	if orderCount != successCount {
+		t.Errorf("Expected %d orders, got %d", successCount, orderCount)
+	}
+}
+
+func TestConcurrentOrdersOppositeItemOrder(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "lockorder@example.com", "Lock Order User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	productA, err := store.CreateProduct(ctx, db, "TEST-LO-A", "Lock Order A", "Test", decimal.NewFromInt(10), 100, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	productB, err := store.CreateProduct(ctx, db, "TEST-LO-B", "Lock Order B", "Test", decimal.NewFromInt(20), 100, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	forward := []store.OrderItemRequest{{ProductID: productA.ID, Quantity: 1}, {ProductID: productB.ID, Quantity: 1}}
+	reverse := []store.OrderItemRequest{{ProductID: productB.ID, Quantity: 1}, {ProductID: productA.ID, Quantity: 1}}
+
+	concurrency := 10
+	var wg sync.WaitGroup
+	results := make(chan error, concurrency)
+
+	for i := 0; i < concurrency; i++ {
+		items := forward
+		if i%2 == 1 {
+			items = reverse
+		}
+
+		wg.Add(1)
+		go func(items []store.OrderItemRequest) {
+			defer wg.Done()
+
+			_, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+				UserID:         user.ID,
+				Items:          items,
+				IsolationLevel: sql.LevelReadCommitted,
+			})
+			results <- err
+		}(items)
+	}
+
+	wg.Wait()
+	close(results)
+
+	successCount := 0
+	for err := range results {
+		if err != nil {
+			if database.ClassifyError(err) == database.ErrorClassDeadlock {
+				t.Errorf("Deadlock despite sorted lock order: %v", err)
+			}
+			continue
+		}
+		successCount++
+	}
+
+	if successCount == 0 {
+		t.Fatal("Expected at least one order to succeed")
+	}
+
+	for _, id := range []int64{productA.ID, productB.ID} {
+		product, err := store.GetProduct(ctx, db, id)
+		if err != nil {
+			t.Fatalf("Get product: %v", err)
+		}
+		if product.StockQuantity != 100-successCount {
+			t.Errorf("Product %d: expected stock %d, got %d", id, 100-successCount, product.StockQuantity)
+		}
+	}
+}
+
+func TestListOrdersByStatuses(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "statuses@example.com", "Statuses User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	product, err := store.CreateProduct(ctx, db, "TEST-STATUS-001", "Status Product", "Test", decimal.NewFromInt(10), 100, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	statusPath := map[string][]string{
+		models.OrderStatusPending:   nil,
+		models.OrderStatusConfirmed: {models.OrderStatusConfirmed},
+		models.OrderStatusShipped:   {models.OrderStatusConfirmed},
+		models.OrderStatusCancelled: {models.OrderStatusCancelled},
+	}
+
+	wanted := map[int64]bool{}
+	for _, final := range []string{
+		models.OrderStatusPending,
+		models.OrderStatusConfirmed,
+		models.OrderStatusShipped,
+		models.OrderStatusPending,
+		models.OrderStatusCancelled,
+	} {
+		order, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+			UserID: user.ID,
+			Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 1}},
+		})
+		if err != nil {
+			t.Fatalf("Create order: %v", err)
+		}
+		for _, status := range statusPath[final] {
+			if order, err = store.UpdateOrderStatus(ctx, db, order.ID, status); err != nil {
+				t.Fatalf("Update order status: %v", err)
+			}
+		}
+		if final == models.OrderStatusShipped {
+			if _, err := store.ShipOrder(ctx, db, order.ID, "TRACK-STATUSES", order.Version); err != nil {
+				t.Fatalf("Ship order: %v", err)
+			}
+		}
+		if final == models.OrderStatusPending || final == models.OrderStatusConfirmed {
+			wanted[order.ID] = true
+		}
+	}
+
+	statuses := []string{models.OrderStatusPending, models.OrderStatusConfirmed}
+
+	var seen []models.Order
+	cursor := ""
+	for {
+		page, err := store.ListOrdersByStatuses(ctx, db, statuses, cursor, 2)
+		if err != nil {
+			t.Fatalf("List orders by statuses: %v", err)
+		}
+		seen = append(seen, page.Items.([]models.Order)...)
+		if !page.HasMore {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	if len(seen) != len(wanted) {
+		t.Fatalf("Expected %d orders, got %d", len(wanted), len(seen))
+	}
+	for _, order := range seen {
+		if !wanted[order.ID] {
+			t.Errorf("Order %d with status %s should not be listed", order.ID, order.Status)
+		}
+		delete(wanted, order.ID)
+	}
+
+	page, err := store.ListOrdersByStatuses(ctx, db, nil, "", 10)
+	if err != nil {
+		t.Fatalf("List orders by no statuses: %v", err)
+	}
+	if items := page.Items.([]models.Order); len(items) != 0 || page.HasMore {
+		t.Errorf("Expected an empty page for no statuses, got %d orders", len(items))
+	}
+
+	if _, err := store.ListOrdersByStatuses(ctx, db, []string{models.OrderStatusPending, "lost"}, "", 10); err != database.ErrInvalidOrderStatus {
+		t.Errorf("Expected ErrInvalidOrderStatus, got: %v", err)
+	}
+}
+
+func TestCreateOrderLockModes(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "lockmode@example.com", "Lock Mode User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	product, err := store.CreateProduct(ctx, db, "TEST-LOCK-001", "Locked Product", "Test", decimal.NewFromInt(10), 50, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	holdLock := func(t *testing.T) *sql.Tx {
+		t.Helper()
+
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatalf("Begin holder: %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, `SELECT id FROM products WHERE id = $1 FOR UPDATE`, product.ID); err != nil {
+			_ = tx.Rollback()
+			t.Fatalf("Lock product: %v", err)
+		}
+		return tx
+	}
+
+	order := func(mode store.LockMode, timeout time.Duration) error {
+		_, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+			UserID:      user.ID,
+			Items:       []store.OrderItemRequest{{ProductID: product.ID, Quantity: 1}},
+			LockMode:    mode,
+			LockTimeout: timeout,
+		})
+		return err
+	}
+
+	t.Run("nowait", func(t *testing.T) {
+		holder := holdLock(t)
+		defer func() { _ = holder.Rollback() }()
+
+		err := order(store.LockNoWait, 0)
+		if err == nil || database.ClassifyError(err) != database.ErrorClassTransient {
+			t.Errorf("Expected retried lock_not_available error, got: %v", err)
+		}
+	})
+
+	t.Run("wait", func(t *testing.T) {
+		holder := holdLock(t)
+
+		const holdFor = 200 * time.Millisecond
+		go func() {
+			time.Sleep(holdFor)
+			_ = holder.Rollback()
+		}()
+
+		start := time.Now()
+		if err := order(store.LockWait, 0); err != nil {
+			t.Fatalf("Expected order to succeed once the lock is released, got: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < holdFor {
+			t.Errorf("Expected order to wait for the lock, returned after %v", elapsed)
+		}
+	})
+
+	t.Run("wait with timeout", func(t *testing.T) {
+		holder := holdLock(t)
+		defer func() { _ = holder.Rollback() }()
+
+		const timeout = 100 * time.Millisecond
+		start := time.Now()
+		err := order(store.LockWait, timeout)
+		if err == nil || database.ClassifyError(err) != database.ErrorClassTransient {
+			t.Errorf("Expected retried lock timeout error, got: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < timeout {
+			t.Errorf("Expected order to wait at least %v, returned after %v", timeout, elapsed)
+		}
+	})
+
+	var orders int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM orders`).Scan(&orders); err != nil {
+		t.Fatalf("Count orders: %v", err)
+	}
+	if orders != 1 {
+		t.Errorf("Expected only the waiting order to be created, got %d", orders)
+	}
+}
+
+func TestCreateOrderRejectsOversizedOrders(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "oversized@example.com", "Oversized User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	product, err := store.CreateProduct(ctx, db, "TEST-HUGE-001", "Expensive Product", "Test", decimal.RequireFromString("99999.99"), store.MaxItemQuantity, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	_, err = store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 1_000_000_000}},
+	})
+	if !errors.Is(err, database.ErrInvalidQuantity) {
+		t.Errorf("Expected ErrInvalidQuantity for absurd quantity, got: %v", err)
+	}
+
+	_, err = store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: store.MaxItemQuantity}},
+	})
+	if err != database.ErrOrderTotalTooLarge {
+		t.Errorf("Expected ErrOrderTotalTooLarge, got: %v", err)
+	}
+
+	assertStock(t, db, product.ID, store.MaxItemQuantity, 0)
+
+	server := newTestServer(t, db)
+	resp, body := doRequest(t, http.MethodPost, server.URL+"/orders", map[string]interface{}{
+		"user_id": user.ID,
+		"items":   []map[string]interface{}{{"product_id": product.ID, "quantity": store.MaxItemQuantity}},
+	}, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for oversized order, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestCreateOrderErrorStatuses(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "statuses@example.com", "Status User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	product, err := store.CreateProduct(ctx, db, "TEST-STATUS-001", "Status Product", "Test", decimal.NewFromInt(10), 5, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	server := newTestServer(t, db)
+
+	cases := []struct {
+		name      string
+		userID    int64
+		productID int64
+		quantity  int
+		want      int
+	}{
+		{"insufficient stock", user.ID, product.ID, 10, http.StatusConflict},
+		{"unknown user", user.ID + 1000, product.ID, 1, http.StatusNotFound},
+		{"unknown product", user.ID, product.ID + 1000, 1, http.StatusNotFound},
+	}
+	for _, tc := range cases {
+		resp, body := doRequest(t, http.MethodPost, server.URL+"/orders", map[string]interface{}{
+			"user_id": tc.userID,
+			"items":   []map[string]interface{}{{"product_id": tc.productID, "quantity": tc.quantity}},
+		}, nil)
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s: expected %d, got %d: %s", tc.name, tc.want, resp.StatusCode, body)
+		}
+	}
+
+	assertStock(t, db, product.ID, 5, 0)
+}
+
+func TestListOrderItemsByProduct(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "demand@example.com", "Demand User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	product, err := store.CreateProduct(ctx, db, "TEST-DEMAND-001", "Demand Product", "Test", decimal.NewFromInt(10), 100, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	other, err := store.CreateProduct(ctx, db, "TEST-DEMAND-002", "Other Product", "Test", decimal.NewFromInt(10), 100, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	var orderIDs []int64
+	for i := 1; i <= 5; i++ {
+		order, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+			UserID: user.ID,
+			Items: []store.OrderItemRequest{
+				{ProductID: product.ID, Quantity: i},
+				{ProductID: other.ID, Quantity: 1},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Create order: %v", err)
+		}
+		orderIDs = append(orderIDs, order.ID)
+	}
+
+	var seen []models.OrderItem
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("Pagination did not terminate")
+		}
+
+		page, err := store.ListOrderItemsByProduct(ctx, db, product.ID, cursor, 2)
+		if err != nil {
+			t.Fatalf("List order items: %v", err)
+		}
+
+		items := page.Items.([]models.OrderItem)
+		if len(items) > 2 {
+			t.Fatalf("Expected at most 2 items per page, got %d", len(items))
+		}
+		seen = append(seen, items...)
+
+		if !page.HasMore {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	if len(seen) != 5 {
+		t.Fatalf("Expected 5 items, got %d", len(seen))
+	}
+	for i, item := range seen {
+		wantOrder := orderIDs[len(orderIDs)-1-i]
+		if item.ProductID != product.ID || item.OrderID != wantOrder || item.Quantity != len(orderIDs)-i {
+			t.Errorf("Position %d: expected item of order %d, got %+v", i, wantOrder, item)
+		}
+	}
+
+	server := newTestServer(t, db)
+
+	resp, body := doRequest(t, http.MethodGet, fmt.Sprintf("%s/products/%d/order-items?limit=3", server.URL, product.ID), nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	var page struct {
+		Items      []models.OrderItem `json:"items"`
+		NextCursor string             `json:"next_cursor"`
+		HasMore    bool               `json:"has_more"`
+	}
+	if err := json.Unmarshal(body, &page); err != nil {
+		t.Fatalf("Unmarshal page: %v", err)
+	}
+	if len(page.Items) != 3 || !page.HasMore || page.NextCursor == "" {
+		t.Errorf("Unexpected first page from endpoint: %+v", page)
+	}
+
+	resp, body = doRequest(t, http.MethodGet, fmt.Sprintf("%s/products/%d/order-items?cursor=%%21%%21%%21", server.URL, product.ID), nil, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for malformed cursor, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestCreateOrderValidationErrors(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "invalid@example.com", "Invalid User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	var productIDs []int64
+	for i := 0; i < 3; i++ {
+		product, err := store.CreateProduct(ctx, db, fmt.Sprintf("TEST-VALID-%03d", i), "Validated Product", "Test", decimal.NewFromInt(10), 10, "")
+		if err != nil {
+			t.Fatalf("Create product: %v", err)
+		}
+		productIDs = append(productIDs, product.ID)
+	}
+
+	_, err = store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items: []store.OrderItemRequest{
+			{ProductID: productIDs[0], Quantity: 1},
+			{ProductID: productIDs[1], Quantity: 2},
+			{ProductID: productIDs[2], Quantity: 0},
+		},
+	})
+
+	var validationErrs store.ValidationErrors
+	if !errors.As(err, &validationErrs) {
+		t.Fatalf("Expected ValidationErrors, got: %v", err)
+	}
+	if len(validationErrs) != 1 || validationErrs[0].Field != "items[2].quantity" {
+		t.Errorf("Expected a single error at items[2].quantity, got %+v", validationErrs)
+	}
+
+	server := newTestServer(t, db)
+
+	resp, body := doRequest(t, http.MethodPost, server.URL+"/orders", map[string]interface{}{
+		"user_id": user.ID,
+		"items": []map[string]interface{}{
+			{"product_id": productIDs[0], "quantity": 1},
+			{"product_id": productIDs[1], "quantity": 2},
+			{"product_id": productIDs[0], "quantity": store.MaxItemQuantity + 1},
+		},
+	}, nil)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected 422, got %d: %s", resp.StatusCode, body)
+	}
+
+	var result struct {
+		Fields []store.FieldError `json:"fields"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		t.Fatalf("Unmarshal validation errors: %v", err)
+	}
+
+	fields := make(map[string]bool)
+	for _, fieldErr := range result.Fields {
+		fields[fieldErr.Field] = true
+	}
+	if len(result.Fields) != 2 || !fields["items[2].product_id"] || !fields["items[2].quantity"] {
+		t.Errorf("Expected duplicate product and quantity errors on items[2], got %s", body)
+	}
+
+	var orders int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM orders`).Scan(&orders); err != nil {
+		t.Fatalf("Count orders: %v", err)
+	}
+	if orders != 0 {
+		t.Errorf("Expected no orders created, got %d", orders)
+	}
+}
+
+func TestShipOrder(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "ship@example.com", "Ship User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	product, err := store.CreateProduct(ctx, db, "TEST-SHIP-001", "Shipped Product", "Test", decimal.NewFromInt(10), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	order, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 1}},
+	})
+	if err != nil {
+		t.Fatalf("Create order: %v", err)
+	}
+
+	if _, err := store.ShipOrder(ctx, db, order.ID, "1Z999AA10123456784", order.Version); err != database.ErrInvalidStatusTransition {
+		t.Fatalf("Expected ErrInvalidStatusTransition shipping a pending order, got: %v", err)
+	}
+
+	confirmed, err := store.ConfirmOrder(ctx, db, order.ID, order.Version)
+	if err != nil {
+		t.Fatalf("Confirm order: %v", err)
+	}
+
+	if _, err := store.ShipOrder(ctx, db, order.ID, "1Z999AA10123456784", order.Version); err != database.ErrOptimisticLockFailed {
+		t.Fatalf("Expected ErrOptimisticLockFailed with stale version, got: %v", err)
+	}
+
+	var versionErrs store.ValidationErrors
+	if _, err := store.ShipOrder(ctx, db, order.ID, "1Z999AA10123456784", 0); !errors.As(err, &versionErrs) {
+		t.Fatalf("Expected ValidationErrors without a version, got: %v", err)
+	}
+	if _, err := store.UpdateOrderStatus(ctx, db, order.ID, models.OrderStatusShipped); err != database.ErrInvalidStatusTransition {
+		t.Fatalf("Expected UpdateOrderStatus to refuse shipping, got: %v", err)
+	}
+
+	var validationErrs store.ValidationErrors
+	if _, err := store.ShipOrder(ctx, db, order.ID, "  ", confirmed.Version); !errors.As(err, &validationErrs) {
+		t.Fatalf("Expected ValidationErrors for blank tracking number, got: %v", err)
+	}
+
+	shipped, err := store.ShipOrder(ctx, db, order.ID, "1Z999AA10123456784", confirmed.Version)
+	if err != nil {
+		t.Fatalf("Ship order: %v", err)
+	}
+	if shipped.Status != models.OrderStatusShipped {
+		t.Errorf("Expected status %s, got %s", models.OrderStatusShipped, shipped.Status)
+	}
+	if shipped.TrackingNumber == nil || *shipped.TrackingNumber != "1Z999AA10123456784" {
+		t.Errorf("Expected tracking number to be stored, got %v", shipped.TrackingNumber)
+	}
+	if shipped.ShippedAt == nil {
+		t.Error("Expected shipped_at to be set")
+	}
+	if shipped.Version != confirmed.Version+1 {
+		t.Errorf("Expected version %d, got %d", confirmed.Version+1, shipped.Version)
+	}
+
+	server := newTestServer(t, db)
+
+	resp, body := doRequest(t, http.MethodPost, fmt.Sprintf("%s/orders/%d/ship", server.URL, order.ID), map[string]interface{}{
+		"tracking_number": "1Z999AA10123456785",
+		"version":         shipped.Version,
+	}, nil)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected 409 shipping a shipped order, got %d: %s", resp.StatusCode, body)
+	}
+
+	other, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 1}},
+	})
+	if err != nil {
+		t.Fatalf("Create order: %v", err)
+	}
+	other, err = store.ConfirmOrder(ctx, db, other.ID, other.Version)
+	if err != nil {
+		t.Fatalf("Confirm order: %v", err)
+	}
+
+	resp, body = doRequest(t, http.MethodPost, fmt.Sprintf("%s/orders/%d/ship", server.URL, other.ID), map[string]interface{}{
+		"tracking_number": "1Z999AA10123456786",
+		"version":         other.Version,
+	}, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	var result models.Order
+	if err := json.Unmarshal(body, &result); err != nil {
+		t.Fatalf("Unmarshal order: %v", err)
+	}
+	if result.Status != models.OrderStatusShipped || result.TrackingNumber == nil {
+		t.Errorf("Expected shipped order with tracking number, got %s", body)
+	}
+}
+
+func TestListOrdersByTotalRange(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "totals@example.com", "Totals User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	product, err := store.CreateProduct(ctx, db, "TEST-TOTAL-001", "Totals Product", "Test", decimal.RequireFromString("25.50"), 100, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	// Totals: 25.50, 51.00, 76.50, 102.00
+	for quantity := 1; quantity <= 4; quantity++ {
+		_, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+			UserID: user.ID,
+			Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: quantity}},
+		})
+		if err != nil {
+			t.Fatalf("Create order: %v", err)
+		}
+	}
+
+	minTotal := decimal.RequireFromString("51.00")
+	maxTotal := decimal.RequireFromString("76.50")
+	page, err := store.ListOrders(ctx, db, store.OrderFilter{MinTotal: &minTotal, MaxTotal: &maxTotal}, "", 10)
+	if err != nil {
+		t.Fatalf("List orders: %v", err)
+	}
+
+	orders := page.Items.([]models.Order)
+	if len(orders) != 2 {
+		t.Fatalf("Expected 2 orders between 51.00 and 76.50, got %d", len(orders))
+	}
+	for _, order := range orders {
+		if order.TotalAmount.LessThan(minTotal) || order.TotalAmount.GreaterThan(maxTotal) {
+			t.Errorf("Order %d total %s is outside the range", order.ID, order.TotalAmount)
+		}
+	}
+
+	server := newTestServer(t, db)
+
+	resp, body := doRequest(t, http.MethodGet, server.URL+"/orders?min_total=76.50", nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	var result struct {
+		Items []models.Order `json:"items"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		t.Fatalf("Unmarshal orders: %v", err)
+	}
+	if len(result.Items) != 2 {
+		t.Errorf("Expected 2 orders of at least 76.50, got %d", len(result.Items))
+	}
+
+	resp, body = doRequest(t, http.MethodGet, server.URL+"/orders?max_total=lots", nil, nil)
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), `Invalid max_total: expected a decimal number, got \"lots\"`) {
+		t.Errorf("Expected 400 naming max_total, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestCreateOrdersBatch(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "batch@example.com", "Batch User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	product1, err := store.CreateProduct(ctx, db, "TEST-BATCH-001", "Batch Product 1", "Test", decimal.NewFromInt(10), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	product2, err := store.CreateProduct(ctx, db, "TEST-BATCH-002", "Batch Product 2", "Test", decimal.NewFromInt(5), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	orders, err := store.CreateOrdersBatch(ctx, db, []store.CreateOrderRequest{
+		{UserID: user.ID, Items: []store.OrderItemRequest{{ProductID: product2.ID, Quantity: 2}, {ProductID: product1.ID, Quantity: 1}}},
+		{UserID: user.ID, Items: []store.OrderItemRequest{{ProductID: product1.ID, Quantity: 3}}},
+	})
+	if err != nil {
+		t.Fatalf("Create orders batch: %v", err)
+	}
+	if len(orders) != 2 {
+		t.Fatalf("Expected 2 orders, got %d", len(orders))
+	}
+	if !orders[0].TotalAmount.Equal(decimal.NewFromInt(20)) || !orders[1].TotalAmount.Equal(decimal.NewFromInt(30)) {
+		t.Errorf("Expected totals 20 and 30, got %s and %s", orders[0].TotalAmount, orders[1].TotalAmount)
+	}
+
+	assertStock(t, db, product1.ID, 6, 0)
+	assertStock(t, db, product2.ID, 8, 0)
+
+	_, err = store.CreateOrdersBatch(ctx, db, []store.CreateOrderRequest{
+		{UserID: user.ID, Items: []store.OrderItemRequest{{ProductID: product1.ID, Quantity: 1}}},
+		{UserID: user.ID, Items: []store.OrderItemRequest{{ProductID: product2.ID, Quantity: 1}}},
+		{UserID: user.ID, Items: []store.OrderItemRequest{{ProductID: product2.ID, Quantity: 8}}},
+	})
+	if !errors.Is(err, database.ErrInsufficientStock) {
+		t.Fatalf("Expected ErrInsufficientStock, got: %v", err)
+	}
+
+	assertStock(t, db, product1.ID, 6, 0)
+	assertStock(t, db, product2.ID, 8, 0)
+
+	var count int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM orders`).Scan(&count); err != nil {
+		t.Fatalf("Count orders: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("Expected the failed batch to create no orders, got %d in total", count)
+	}
+
+	_, err = store.CreateOrdersBatch(ctx, db, []store.CreateOrderRequest{
+		{UserID: user.ID, Items: []store.OrderItemRequest{{ProductID: product1.ID, Quantity: 1}}},
+		{UserID: user.ID},
+	})
+	var validationErrs store.ValidationErrors
+	if !errors.As(err, &validationErrs) || len(validationErrs) != 1 || validationErrs[0].Field != "orders[1].items" {
+		t.Errorf("Expected a validation error at orders[1].items, got: %v", err)
+	}
+}
+
+func TestCreateOrdersBatchContinueOnError(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "batch-partial@example.com", "Batch User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	product, err := store.CreateProduct(ctx, db, "TEST-BATCH-PARTIAL-001", "Batch Product", "Test", decimal.NewFromInt(10), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	reqs := []store.CreateOrderRequest{
+		{UserID: user.ID, Items: []store.OrderItemRequest{{ProductID: product.ID, Quantity: 2}}},
+		{UserID: user.ID, Items: []store.OrderItemRequest{{ProductID: product.ID, Quantity: 50}}},
+		{UserID: user.ID},
+		{UserID: user.ID, Items: []store.OrderItemRequest{{ProductID: product.ID, Quantity: 3}}},
+	}
+
+	// By default the batch is still all-or-nothing.
+	if _, err := store.CreateOrdersBatchWithOptions(ctx, db, reqs, store.BatchOptions{}); err == nil {
+		t.Fatal("Expected the all-or-nothing batch to fail")
+	}
+	assertStock(t, db, product.ID, 10, 0)
+
+	results, err := store.CreateOrdersBatchWithOptions(ctx, db, reqs, store.BatchOptions{ContinueOnError: true})
+	if err != nil {
+		t.Fatalf("Create orders batch: %v", err)
+	}
+	if len(results) != len(reqs) {
+		t.Fatalf("Expected %d results, got %d", len(reqs), len(results))
+	}
+
+	for _, i := range []int{0, 3} {
+		if results[i].Err != nil || results[i].Order == nil {
+			t.Errorf("Expected order %d to be created, got: %v", i, results[i].Err)
+		}
+	}
+	if !errors.Is(results[1].Err, database.ErrInsufficientStock) || results[1].Order != nil {
+		t.Errorf("Expected order 1 to fail with ErrInsufficientStock, got: %v", results[1].Err)
+	}
+	var validationErrs store.ValidationErrors
+	if !errors.As(results[2].Err, &validationErrs) || results[2].Order != nil {
+		t.Errorf("Expected order 2 to fail validation, got: %v", results[2].Err)
+	}
+	for i, result := range results {
+		if result.Index != i {
+			t.Errorf("Expected result %d to have index %d, got %d", i, i, result.Index)
+		}
+	}
+
+	assertStock(t, db, product.ID, 5, 0)
+}
+
+func TestListOrdersByShippedAtNullsLast(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "shipped@example.com", "Shipped User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	product, err := store.CreateProduct(ctx, db, "TEST-SHIPPED-001", "Shipped Product", "Test", decimal.NewFromInt(10), 100, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	var orderIDs []int64
+	for i := 0; i < 7; i++ {
+		order, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+			UserID: user.ID,
+			Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 1}},
+		})
+		if err != nil {
+			t.Fatalf("Create order: %v", err)
+		}
+		orderIDs = append(orderIDs, order.ID)
+	}
+
+	// Ship every other order. Two share a shipped_at so the id tiebreak is
+	// exercised too.
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	shippedAt := map[int64]time.Time{
+		orderIDs[0]: base.Add(2 * time.Hour),
+		orderIDs[2]: base.Add(time.Hour),
+		orderIDs[4]: base.Add(time.Hour),
+		orderIDs[6]: base,
+	}
+	for id, at := range shippedAt {
+		_, err := db.ExecContext(ctx, `UPDATE orders SET status = $1, shipped_at = $2 WHERE id = $3`,
+			models.OrderStatusShipped, at, id)
+		if err != nil {
+			t.Fatalf("Ship order: %v", err)
+		}
+	}
+
+	want := []int64{orderIDs[0], orderIDs[4], orderIDs[2], orderIDs[6], orderIDs[5], orderIDs[3], orderIDs[1]}
+
+	var got []int64
+	cursor := ""
+	for pages := 0; pages < len(want); pages++ {
+		page, err := store.ListOrdersByShippedAt(ctx, db, cursor, 2)
+		if err != nil {
+			t.Fatalf("List orders by shipped_at: %v", err)
+		}
+		for _, order := range page.Items.([]models.Order) {
+			got = append(got, order.ID)
+		}
+		if !page.HasMore {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Expected order %v, got %v", want, got)
+	}
+}
+
+func TestOrderIndexes(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	wantIndexes := map[string]string{
+		"idx_orders_user_created":         "orders",
+		"idx_orders_status_created":       "orders",
+		"products_sku_key":                "products",
+		"idx_order_items_order_id":        "order_items",
+		"idx_order_items_product_created": "order_items",
+	}
+	for name, table := range wantIndexes {
+		var found string
+		err := db.QueryRowContext(ctx,
+			`SELECT tablename FROM pg_indexes WHERE schemaname = current_schema() AND indexname = $1`,
+			name).Scan(&found)
+		if err != nil || found != table {
+			t.Errorf("Expected index %s on %s, got table %q, err %v", name, table, found, err)
+		}
+	}
+
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO users (email, name)
+		SELECT 'index-' || n || '@example.com', 'Index ' || n
+		FROM generate_series(1, 20) AS n`); err != nil {
+		t.Fatalf("Seed users: %v", err)
+	}
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO orders (user_id, order_number, total_amount, created_at)
+		SELECT u.id, 'IDX-' || u.id || '-' || n, 10, NOW() - n * INTERVAL '1 minute'
+		FROM users u, generate_series(1, 100) AS n`); err != nil {
+		t.Fatalf("Seed orders: %v", err)
+	}
+	if _, err := db.ExecContext(ctx, `ANALYZE orders`); err != nil {
+		t.Fatalf("Analyze orders: %v", err)
+	}
+
+	var userID int64
+	if err := db.QueryRowContext(ctx, `SELECT MIN(id) FROM users`).Scan(&userID); err != nil {
+		t.Fatalf("Get user: %v", err)
+	}
+
+	// The same query as ListOrdersCursor.
+	plan := explainPlan(t, db, `
+		SELECT `+models.OrderColumns+`
+		FROM orders
+		WHERE user_id = $1
+		  AND (created_at, id) < ($2, $3)
+		ORDER BY created_at DESC, id DESC
+		LIMIT $4`,
+		userID, time.Now(), int64(1<<63-1), 21)
+	if !strings.Contains(plan, "idx_orders_user_created") || strings.Contains(plan, "Sort") {
+		t.Errorf("Expected the cursor query to read idx_orders_user_created in order, got:\n%s", plan)
+	}
+}
+
+// explainPlan returns the EXPLAIN output for query with sequential scans
+// disabled, so that the plan shows whether a usable index exists regardless of
+// the table's size.
+func explainPlan(t *testing.T, db *sql.DB, query string, args ...interface{}) string {
+	t.Helper()
+
+	var lines []string
+	err := database.WithTransaction(context.Background(), db, database.DefaultTxOptions(), func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`SET LOCAL enable_seqscan = off`); err != nil {
+			return err
+		}
+		rows, err := tx.Query(`EXPLAIN `+query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var line string
+			if err := rows.Scan(&line); err != nil {
+				return err
+			}
+			lines = append(lines, line)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		t.Fatalf("Explain: %v", err)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestOrderItemProductNameSnapshot(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	product, err := store.CreateProduct(ctx, db, "TEST-SNAP-001", "Original Name", "Test", decimal.NewFromInt(10), 100, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	user, err := store.CreateUser(ctx, db, "snapshot@example.com", "Snapshot")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	order, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 2}},
+	})
+	if err != nil {
+		t.Fatalf("Create order: %v", err)
+	}
+
+	current, err := store.GetProduct(ctx, db, product.ID)
+	if err != nil {
+		t.Fatalf("Get product: %v", err)
+	}
+	newName := "Renamed"
+	newPrice := decimal.NewFromInt(25)
+	if _, err := store.PatchProduct(ctx, db, product.ID, store.ProductPatch{Name: &newName, Price: &newPrice}, current.Version); err != nil {
+		t.Fatalf("Patch product: %v", err)
+	}
+
+	fetched, err := store.GetOrder(ctx, db, order.ID)
+	if err != nil {
+		t.Fatalf("Get order: %v", err)
+	}
+	if len(fetched.Items) != 1 {
+		t.Fatalf("Expected 1 item, got %d", len(fetched.Items))
+	}
+	item := fetched.Items[0]
+	if item.ProductName != "Original Name" {
+		t.Errorf("Expected item name %q from order time, got %q", "Original Name", item.ProductName)
+	}
+	if !item.UnitPrice.Equal(decimal.NewFromInt(10)) {
+		t.Errorf("Expected unit price 10 from order time, got %s", item.UnitPrice)
+	}
+}
+
+func TestUpdateOrderMetadata(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	product, err := store.CreateProduct(ctx, db, "TEST-META-001", "Meta Product", "Test", decimal.NewFromInt(10), 100, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	user, err := store.CreateUser(ctx, db, "metadata@example.com", "Metadata")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	order, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 1}},
+	})
+	if err != nil {
+		t.Fatalf("Create order: %v", err)
+	}
+
+	metadataOf := func(order *models.Order) map[string]interface{} {
+		t.Helper()
+		var metadata map[string]interface{}
+		if err := json.Unmarshal(order.Metadata, &metadata); err != nil {
+			t.Fatalf("Decode metadata %s: %v", order.Metadata, err)
+		}
+		return metadata
+	}
+
+	if got := metadataOf(order); len(got) != 0 {
+		t.Errorf("Expected new order to have empty metadata, got %v", got)
+	}
+
+	updated, err := store.UpdateOrderMetadata(ctx, db, order.ID,
+		json.RawMessage(`{"gift_message": "Happy birthday", "channel": "web"}`), order.Version)
+	if err != nil {
+		t.Fatalf("Update metadata: %v", err)
+	}
+	if updated.Version != order.Version+1 {
+		t.Errorf("Expected version %d, got %d", order.Version+1, updated.Version)
+	}
+
+	updated, err = store.UpdateOrderMetadata(ctx, db, order.ID,
+		json.RawMessage(`{"channel": "mobile", "gift_message": null, "tags": ["vip"]}`), updated.Version)
+	if err != nil {
+		t.Fatalf("Update metadata: %v", err)
+	}
+
+	fetched, err := store.GetOrder(ctx, db, order.ID)
+	if err != nil {
+		t.Fatalf("Get order: %v", err)
+	}
+	got := metadataOf(fetched)
+	if got["channel"] != "mobile" || len(got) != 2 {
+		t.Errorf("Expected merged metadata with channel and tags only, got %v", got)
+	}
+	if _, ok := got["gift_message"]; ok {
+		t.Errorf("Expected null to remove gift_message, got %v", got)
+	}
+
+	if _, err := store.UpdateOrderMetadata(ctx, db, order.ID, json.RawMessage(`{"channel": "web"}`), order.Version); err != database.ErrOptimisticLockFailed {
+		t.Errorf("Expected ErrOptimisticLockFailed for a stale version, got: %v", err)
+	}
+	if _, err := store.UpdateOrderMetadata(ctx, db, order.ID+1000, json.RawMessage(`{}`), 1); err != database.ErrOrderNotFound {
+		t.Errorf("Expected ErrOrderNotFound, got: %v", err)
+	}
+	var validationErrs store.ValidationErrors
+	if _, err := store.UpdateOrderMetadata(ctx, db, order.ID, json.RawMessage(`["not", "an", "object"]`), updated.Version); !errors.As(err, &validationErrs) {
+		t.Errorf("Expected ValidationErrors for a non-object, got: %v", err)
+	}
+
+	server := newTestServer(t, db)
+
+	resp, body := doRequest(t, http.MethodPatch, fmt.Sprintf("%s/orders/%d/metadata", server.URL, order.ID), map[string]interface{}{
+		"metadata": map[string]interface{}{"channel": "store"},
+		"version":  updated.Version,
+	}, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	var patched models.Order
+	if err := json.Unmarshal(body, &patched); err != nil {
+		t.Fatalf("Decode response: %v", err)
+	}
+	if got := metadataOf(&patched); got["channel"] != "store" || got["tags"] == nil {
+		t.Errorf("Expected channel store with tags kept, got %v", got)
+	}
+
+	resp, body = doRequest(t, http.MethodPatch, fmt.Sprintf("%s/orders/%d/metadata", server.URL, order.ID), map[string]interface{}{
+		"metadata": "gift",
+		"version":  patched.Version,
+	}, nil)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for non-object metadata, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestCreateOrderDryRun(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	widget, err := store.CreateProduct(ctx, db, "TEST-DRY-001", "Widget", "Test", decimal.RequireFromString("12.50"), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	gadget, err := store.CreateProduct(ctx, db, "TEST-DRY-002", "Gadget", "Test", decimal.NewFromInt(3), 1, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	user, err := store.CreateUser(ctx, db, "dryrun@example.com", "Dry Run")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	order, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items: []store.OrderItemRequest{
+			{ProductID: widget.ID, Quantity: 2},
+			{ProductID: gadget.ID, Quantity: 1},
+		},
+		DryRun: true,
+	})
+	if err != nil {
+		t.Fatalf("Dry-run order: %v", err)
+	}
+	if order.ID != 0 || order.OrderNumber != "" {
+		t.Errorf("Expected no ID or order number, got %d %q", order.ID, order.OrderNumber)
+	}
+	if !order.TotalAmount.Equal(decimal.NewFromInt(28)) {
+		t.Errorf("Expected total 28, got %s", order.TotalAmount)
+	}
+	if len(order.Items) != 2 {
+		t.Fatalf("Expected 2 items, got %d", len(order.Items))
+	}
+	for _, item := range order.Items {
+		if item.ID != 0 || item.OrderID != 0 {
+			t.Errorf("Expected item without IDs, got %+v", item)
+		}
+		if item.ProductID == widget.ID && !item.Subtotal.Equal(decimal.NewFromInt(25)) {
+			t.Errorf("Expected widget subtotal 25, got %s", item.Subtotal)
+		}
+	}
+
+	assertStock(t, db, widget.ID, 10, 0)
+	assertStock(t, db, gadget.ID, 1, 0)
+	if count, err := store.CountUserOrders(ctx, db, user.ID); err != nil || count != 0 {
+		t.Errorf("Expected no orders after a dry run, got %d, %v", count, err)
+	}
+
+	_, err = store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items:  []store.OrderItemRequest{{ProductID: gadget.ID, Quantity: 2}},
+		DryRun: true,
+	})
+	if err != database.ErrInsufficientStock {
+		t.Errorf("Expected ErrInsufficientStock from a dry run, got: %v", err)
+	}
+
+	var validationErrs store.ValidationErrors
+	_, err = store.CreateOrdersBatch(ctx, db, []store.CreateOrderRequest{{
+		UserID: user.ID,
+		Items:  []store.OrderItemRequest{{ProductID: widget.ID, Quantity: 1}},
+		DryRun: true,
+	}})
+	if !errors.As(err, &validationErrs) {
+		t.Errorf("Expected a batch to reject dry runs, got: %v", err)
+	}
+
+	server := newTestServer(t, db)
+
+	resp, body := doRequest(t, http.MethodPost, server.URL+"/orders?dry_run=true", map[string]interface{}{
+		"user_id": user.ID,
+		"items":   []map[string]interface{}{{"product_id": widget.ID, "quantity": 4}},
+	}, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	var preview models.Order
+	if err := json.Unmarshal(body, &preview); err != nil {
+		t.Fatalf("Decode response: %v", err)
+	}
+	if !preview.TotalAmount.Equal(decimal.NewFromInt(50)) {
+		t.Errorf("Expected total 50, got %s", preview.TotalAmount)
+	}
+	assertStock(t, db, widget.ID, 10, 0)
+}
+
+func TestListDistinctOrderStatuses(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	statuses, err := store.ListDistinctOrderStatuses(ctx, db)
+	if err != nil {
+		t.Fatalf("List statuses: %v", err)
+	}
+	if len(statuses) != 0 {
+		t.Errorf("Expected no statuses without orders, got %v", statuses)
+	}
+
+	product, err := store.CreateProduct(ctx, db, "TEST-STATUSES-001", "Status Product", "Test", decimal.NewFromInt(10), 100, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	user, err := store.CreateUser(ctx, db, "statuses@example.com", "Statuses")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	var orderIDs []int64
+	for i := 0; i < 3; i++ {
+		order, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+			UserID: user.ID,
+			Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 1}},
+		})
+		if err != nil {
+			t.Fatalf("Create order: %v", err)
+		}
+		orderIDs = append(orderIDs, order.ID)
+	}
+	if _, err := store.UpdateOrderStatus(ctx, db, orderIDs[0], models.OrderStatusConfirmed); err != nil {
+		t.Fatalf("Confirm order: %v", err)
+	}
+	if _, err := store.UpdateOrderStatus(ctx, db, orderIDs[1], models.OrderStatusCancelled); err != nil {
+		t.Fatalf("Cancel order: %v", err)
+	}
+
+	statuses, err = store.ListDistinctOrderStatuses(ctx, db)
+	if err != nil {
+		t.Fatalf("List statuses: %v", err)
+	}
+	want := []string{models.OrderStatusCancelled, models.OrderStatusConfirmed, models.OrderStatusPending}
+	if fmt.Sprint(statuses) != fmt.Sprint(want) {
+		t.Errorf("Expected %v, got %v", want, statuses)
+	}
+
+	server := newTestServer(t, db)
+
+	resp, body := doRequest(t, http.MethodGet, server.URL+"/orders/statuses", nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	var got []string
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("Decode response: %v", err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Expected %v from the API, got %v", want, got)
+	}
+}
+
+func TestBulkUpdateOrderStatus(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	product, err := store.CreateProduct(ctx, db, "TEST-BULK-001", "Bulk Product", "Test", decimal.NewFromInt(10), 100, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	user, err := store.CreateUser(ctx, db, "bulk@example.com", "Bulk User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	other, err := store.CreateUser(ctx, db, "bulk-other@example.com", "Other User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	createOrder := func(userID int64, reserveOnly bool) *models.Order {
+		t.Helper()
+		order, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+			UserID:      userID,
+			Items:       []store.OrderItemRequest{{ProductID: product.ID, Quantity: 1}},
+			ReserveOnly: reserveOnly,
+		})
+		if err != nil {
+			t.Fatalf("Create order: %v", err)
+		}
+		return order
+	}
+
+	pending1 := createOrder(user.ID, false)
+	pending2 := createOrder(user.ID, false)
+	reserved := createOrder(user.ID, true)
+	shipped := createOrder(user.ID, false)
+	otherPending := createOrder(other.ID, false)
+
+	confirmedShipped, err := store.UpdateOrderStatus(ctx, db, shipped.ID, models.OrderStatusConfirmed)
+	if err != nil {
+		t.Fatalf("Confirm order: %v", err)
+	}
+	if _, err := store.ShipOrder(ctx, db, shipped.ID, "TRACK-BULK", confirmedShipped.Version); err != nil {
+		t.Fatalf("Ship order: %v", err)
+	}
+
+	if _, err := store.BulkUpdateOrderStatus(ctx, db, store.OrderStatusFilter{UserID: user.ID}, models.OrderStatusShipped); !errors.Is(err, database.ErrInvalidStatusTransition) {
+		t.Errorf("Expected bulk shipping to be refused, got: %v", err)
+	}
+
+	assertStatus := func(orderID int64, want string) {
+		t.Helper()
+		order, err := store.GetOrder(ctx, db, orderID)
+		if err != nil {
+			t.Fatalf("Get order: %v", err)
+		}
+		if order.Status != want {
+			t.Errorf("Expected order %d to be %s, got %s", orderID, want, order.Status)
+		}
+	}
+
+	_, err = store.BulkUpdateOrderStatus(ctx, db, store.OrderStatusFilter{UserID: user.ID}, models.OrderStatusConfirmed)
+	if !errors.Is(err, database.ErrInvalidStatusTransition) {
+		t.Fatalf("Expected ErrInvalidStatusTransition with a shipped order matched, got: %v", err)
+	}
+	assertStatus(pending1.ID, models.OrderStatusPending)
+
+	_, err = store.BulkUpdateOrderStatus(ctx, db, store.OrderStatusFilter{UserID: user.ID}, models.OrderStatusCancelled)
+	if !errors.Is(err, database.ErrInvalidStatusTransition) {
+		t.Errorf("Expected ErrInvalidStatusTransition for bulk cancel, got: %v", err)
+	}
+
+	count, err := store.BulkUpdateOrderStatus(ctx, db, store.OrderStatusFilter{
+		UserID:      user.ID,
+		SkipInvalid: true,
+	}, models.OrderStatusConfirmed)
+	if err != nil {
+		t.Fatalf("Bulk confirm: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 orders confirmed, got %d", count)
+	}
+
+	assertStatus(pending1.ID, models.OrderStatusConfirmed)
+	assertStatus(pending2.ID, models.OrderStatusConfirmed)
+	assertStatus(reserved.ID, models.OrderStatusPending)
+	assertStatus(shipped.ID, models.OrderStatusShipped)
+	assertStatus(otherPending.ID, models.OrderStatusPending)
+	assertStock(t, db, product.ID, 96, 1)
+
+	count, err = store.BulkUpdateOrderStatus(ctx, db, store.OrderStatusFilter{
+		Status:        models.OrderStatusPending,
+		CreatedBefore: time.Now().Add(-time.Hour),
+	}, models.OrderStatusConfirmed)
+	if err != nil {
+		t.Fatalf("Bulk confirm old orders: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("Expected no orders older than an hour, got %d", count)
+	}
+}
+
+func TestOrderTimeline(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	product, err := store.CreateProduct(ctx, db, "TEST-TIMELINE-001", "Timeline Product", "Test", decimal.NewFromInt(10), 100, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	user, err := store.CreateUser(ctx, db, "timeline@example.com", "Timeline User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	agent, err := store.CreateUser(ctx, db, "timeline-agent@example.com", "Support Agent")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	order, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 1}},
+	})
+	if err != nil {
+		t.Fatalf("Create order: %v", err)
+	}
+
+	agentCtx := store.WithActor(ctx, agent.ID)
+	confirmed, err := store.UpdateOrderStatus(agentCtx, db, order.ID, models.OrderStatusConfirmed)
+	if err != nil {
+		t.Fatalf("Confirm order: %v", err)
+	}
+	// A write that leaves the status alone must not appear in the timeline.
+	confirmed, err = store.UpdateOrderMetadata(ctx, db, order.ID, json.RawMessage(`{"gift":true}`), confirmed.Version)
+	if err != nil {
+		t.Fatalf("Update metadata: %v", err)
+	}
+	if _, err := store.ShipOrder(agentCtx, db, order.ID, "TRACK-TIMELINE", confirmed.Version); err != nil {
+		t.Fatalf("Ship order: %v", err)
+	}
+
+	timeline, err := store.GetOrderTimeline(ctx, db, order.ID)
+	if err != nil {
+		t.Fatalf("Get timeline: %v", err)
+	}
+
+	want := []struct{ from, to string }{
+		{"", models.OrderStatusPending},
+		{models.OrderStatusPending, models.OrderStatusConfirmed},
+		{models.OrderStatusConfirmed, models.OrderStatusShipped},
+	}
+	if len(timeline) != len(want) {
+		t.Fatalf("Expected %d timeline entries, got %+v", len(want), timeline)
+	}
+	for i, change := range timeline {
+		if change.FromStatus != want[i].from || change.ToStatus != want[i].to {
+			t.Errorf("Entry %d: expected %q -> %q, got %q -> %q", i, want[i].from, want[i].to, change.FromStatus, change.ToStatus)
+		}
+		if i > 0 && change.ChangedAt.Before(timeline[i-1].ChangedAt) {
+			t.Errorf("Entry %d is older than the one before it", i)
+		}
+	}
+	if timeline[0].ActorID != nil {
+		t.Errorf("Expected no actor on creation, got %d", *timeline[0].ActorID)
+	}
+	for _, change := range timeline[1:] {
+		if change.ActorID == nil || *change.ActorID != agent.ID {
+			t.Errorf("Expected actor %d on %s, got %v", agent.ID, change.ToStatus, change.ActorID)
+		}
+	}
+
+	server := newTestServer(t, db)
+
+	resp, body := doRequest(t, http.MethodGet, fmt.Sprintf("%s/orders/%d/timeline", server.URL, order.ID), nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	var got []store.OrderStatusChange
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("Decode response: %v", err)
+	}
+	if len(got) != len(want) || got[2].ToStatus != models.OrderStatusShipped {
+		t.Errorf("Expected the same timeline from the API, got %s", body)
+	}
+
+	resp, body = doRequest(t, http.MethodGet, fmt.Sprintf("%s/orders/%d/timeline", server.URL, order.ID+1000), nil, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing order, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestExpirePendingOrders(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	product, err := store.CreateProduct(ctx, db, "TEST-EXPIRE-001", "Expire Product", "Test", decimal.NewFromInt(10), 100, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	user, err := store.CreateUser(ctx, db, "expire@example.com", "Expire User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	createOrder := func(quantity int, reserveOnly bool, age time.Duration) *models.Order {
+		order, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+			UserID:      user.ID,
+			Items:       []store.OrderItemRequest{{ProductID: product.ID, Quantity: quantity}},
+			ReserveOnly: reserveOnly,
+		})
+		if err != nil {
+			t.Fatalf("Create order: %v", err)
+		}
+		if _, err := db.ExecContext(ctx, `UPDATE orders SET created_at = NOW() - $1 * INTERVAL '1 second' WHERE id = $2`, age.Seconds(), order.ID); err != nil {
+			t.Fatalf("Backdate order: %v", err)
+		}
+		return order
+	}
+
+	oldOrder := createOrder(5, false, 2*time.Hour)
+	newOrder := createOrder(3, false, 0)
+	oldReserved := createOrder(4, true, 2*time.Hour)
+	oldConfirmed := createOrder(2, false, 2*time.Hour)
+	if _, err := store.UpdateOrderStatus(ctx, db, oldConfirmed.ID, models.OrderStatusConfirmed); err != nil {
+		t.Fatalf("Confirm order: %v", err)
+	}
+
+	assertStock(t, db, product.ID, 90, 4)
+
+	expired, err := store.ExpirePendingOrders(ctx, db, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("Expire pending orders: %v", err)
+	}
+	if expired != 2 {
+		t.Errorf("Expected 2 orders expired, got %d", expired)
+	}
+
+	wantStatus := map[int64]string{
+		oldOrder.ID:     models.OrderStatusCancelled,
+		oldReserved.ID:  models.OrderStatusCancelled,
+		newOrder.ID:     models.OrderStatusPending,
+		oldConfirmed.ID: models.OrderStatusConfirmed,
+	}
+	for id, want := range wantStatus {
+		order, err := store.GetOrder(ctx, db, id)
+		if err != nil {
+			t.Fatalf("Get order: %v", err)
+		}
+		if order.Status != want {
+			t.Errorf("Expected order %d to be %s, got %s", id, want, order.Status)
+		}
+	}
+
+	assertStock(t, db, product.ID, 95, 0)
+
+	expired, err = store.ExpirePendingOrders(ctx, db, time.Now().Add(-time.Hour))
+	if err != nil || expired != 0 {
+		t.Errorf("Expected a second run to expire nothing, got %d: %v", expired, err)
+	}
+}
+
+func TestRepriceOrder(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "reprice@example.com", "Reprice User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	product1, err := store.CreateProduct(ctx, db, "TEST-REPRICE-001", "Reprice Product 1", "Test", decimal.NewFromInt(10), 100, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	product2, err := store.CreateProduct(ctx, db, "TEST-REPRICE-002", "Reprice Product 2", "Test", decimal.RequireFromString("2.50"), 100, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	order, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items: []store.OrderItemRequest{
+			{ProductID: product1.ID, Quantity: 2},
+			{ProductID: product2.ID, Quantity: 4},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Create order: %v", err)
+	}
+	if !order.TotalAmount.Equal(decimal.NewFromInt(30)) {
+		t.Fatalf("Expected total 30, got %s", order.TotalAmount)
+	}
+
+	newPrice := decimal.RequireFromString("12.25")
+	if _, err := store.PatchProduct(ctx, db, product1.ID, store.ProductPatch{Price: &newPrice}, product1.Version); err != nil {
+		t.Fatalf("Patch product: %v", err)
+	}
+
+	if _, err := store.RepriceOrder(ctx, db, order.ID, order.Version+1); err != database.ErrOptimisticLockFailed {
+		t.Errorf("Expected ErrOptimisticLockFailed for a stale version, got: %v", err)
+	}
+
+	repriced, err := store.RepriceOrder(ctx, db, order.ID, order.Version)
+	if err != nil {
+		t.Fatalf("Reprice order: %v", err)
+	}
+	if !repriced.TotalAmount.Equal(decimal.RequireFromString("34.50")) {
+		t.Errorf("Expected total 34.50, got %s", repriced.TotalAmount)
+	}
+	if repriced.Version != order.Version+1 {
+		t.Errorf("Expected version %d, got %d", order.Version+1, repriced.Version)
+	}
+	for _, item := range repriced.Items {
+		if item.ProductID == product1.ID && (!item.UnitPrice.Equal(newPrice) || !item.Subtotal.Equal(decimal.RequireFromString("24.50"))) {
+			t.Errorf("Expected product 1 at 12.25 with subtotal 24.50, got %s and %s", item.UnitPrice, item.Subtotal)
+		}
+		if item.ProductID == product2.ID && !item.Subtotal.Equal(decimal.NewFromInt(10)) {
+			t.Errorf("Expected product 2 subtotal unchanged at 10, got %s", item.Subtotal)
+		}
+	}
+
+	server := newTestServer(t, db)
+
+	newPrice = decimal.NewFromInt(5)
+	product1, err = store.GetProduct(ctx, db, product1.ID)
+	if err != nil {
+		t.Fatalf("Get product: %v", err)
+	}
+	if _, err := store.PatchProduct(ctx, db, product1.ID, store.ProductPatch{Price: &newPrice}, product1.Version); err != nil {
+		t.Fatalf("Patch product: %v", err)
+	}
+
+	url := fmt.Sprintf("%s/orders/%d/reprice", server.URL, order.ID)
+	resp, body := doRequest(t, http.MethodPost, url, map[string]int{"version": repriced.Version}, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	var fromAPI models.Order
+	if err := json.Unmarshal(body, &fromAPI); err != nil {
+		t.Fatalf("Decode order: %v", err)
+	}
+	if !fromAPI.TotalAmount.Equal(decimal.NewFromInt(20)) {
+		t.Errorf("Expected total 20 from the API, got %s", fromAPI.TotalAmount)
+	}
+
+	if _, err := store.UpdateOrderStatus(ctx, db, order.ID, models.OrderStatusConfirmed); err != nil {
+		t.Fatalf("Confirm order: %v", err)
+	}
+	resp, body = doRequest(t, http.MethodPost, url, map[string]int{"version": fromAPI.Version + 1}, nil)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected 409 for a confirmed order, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestListOrdersForUsers(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	product, err := store.CreateProduct(ctx, db, "TEST-MULTI-USER-001", "Multi User Product", "Test", decimal.NewFromInt(10), 100, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	var users []*models.User
+	for i := 0; i < 3; i++ {
+		user, err := store.CreateUser(ctx, db, fmt.Sprintf("multi-%d@example.com", i), "Multi User")
+		if err != nil {
+			t.Fatalf("Create user: %v", err)
+		}
+		users = append(users, user)
+	}
+
+	// Seven orders alternating between the users, each a minute older than
+	// the one before it, so the expected order interleaves them.
+	owners := []int{0, 1, 2, 0, 1, 0, 1}
+	var want []int64
+	for i, owner := range owners {
+		order, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+			UserID: users[owner].ID,
+			Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 1}},
+		})
+		if err != nil {
+			t.Fatalf("Create order: %v", err)
+		}
+		if _, err := db.ExecContext(ctx, `UPDATE orders SET created_at = NOW() - $1 * INTERVAL '1 minute' WHERE id = $2`, i, order.ID); err != nil {
+			t.Fatalf("Backdate order: %v", err)
+		}
+		if owner != 2 {
+			want = append(want, order.ID)
+		}
+	}
+
+	var got []int64
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("Too many pages")
+		}
+		page, err := store.ListOrdersForUsers(ctx, db, []int64{users[1].ID, users[0].ID}, cursor, 2)
+		if err != nil {
+			t.Fatalf("List orders for users: %v", err)
+		}
+		for _, order := range page.Items.([]models.Order) {
+			got = append(got, order.ID)
+		}
+		if !page.HasMore {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Expected orders %v newest first across both users, got %v", want, got)
+	}
+
+	if _, err := store.ListOrdersForUsers(ctx, db, nil, "", 10); err == nil {
+		t.Error("Expected an error for no user IDs")
+	}
+	tooMany := make([]int64, store.MaxFilterUserIDs+1)
+	for i := range tooMany {
+		tooMany[i] = int64(i + 1)
+	}
+	var validationErrs store.ValidationErrors
+	if _, err := store.ListOrdersForUsers(ctx, db, tooMany, "", 10); !errors.As(err, &validationErrs) {
+		t.Errorf("Expected a validation error for %d user IDs, got: %v", len(tooMany), err)
+	}
+
+	server := newTestServer(t, db)
+
+	resp, body := doRequest(t, http.MethodGet, fmt.Sprintf("%s/orders?user_ids=%d,%d&limit=100", server.URL, users[0].ID, users[1].ID), nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	var apiPage struct {
+		Items []models.Order `json:"items"`
+	}
+	if err := json.Unmarshal(body, &apiPage); err != nil {
+		t.Fatalf("Decode page: %v", err)
+	}
+	if len(apiPage.Items) != len(want) {
+		t.Errorf("Expected %d orders from the API, got %d", len(want), len(apiPage.Items))
+	}
+
+	resp, body = doRequest(t, http.MethodGet, server.URL+"/orders?user_ids=1,abc", nil, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid user ID, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestOrderStatusValidation(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "status-check@example.com", "Status User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	product, err := store.CreateProduct(ctx, db, "TEST-STATUS-CHECK", "Product", "Test", decimal.NewFromInt(10), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	order, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 1}},
+	})
+	if err != nil {
+		t.Fatalf("Create order: %v", err)
+	}
+
+	if _, err := store.UpdateOrderStatus(ctx, db, order.ID, "refunded"); err != database.ErrInvalidOrderStatus {
+		t.Errorf("Expected ErrInvalidOrderStatus, got: %v", err)
+	}
+
+	// The valid_status CHECK rejects writes that bypass the store.
+	_, err = db.ExecContext(ctx, `UPDATE orders SET status = 'refunded' WHERE id = $1`, order.ID)
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "23514" || pqErr.Constraint != "valid_status" {
+		t.Errorf("Expected a valid_status check violation, got: %v", err)
+	}
+
+	current, err := store.GetOrder(ctx, db, order.ID)
+	if err != nil {
+		t.Fatalf("Get order: %v", err)
+	}
+	if current.Status != models.OrderStatusPending {
+		t.Errorf("Expected status %q, got %q", models.OrderStatusPending, current.Status)
+	}
+}
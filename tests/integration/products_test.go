@@ -3,10 +3,17 @@ package integration
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/safar/go-sql-store/internal/database"
+	"github.com/safar/go-sql-store/internal/models"
 	"github.com/safar/go-sql-store/internal/store"
 	"github.com/shopspring/decimal"
 )
@@ -17,7 +24,7 @@ func TestConcurrentStockReservation(t *testing.T) {
 
 	ctx := context.Background()
 
-	product, err := store.CreateProduct(ctx, db, "TEST-001", "Test Product", "Test", decimal.NewFromInt(100), 10)
+	product, err := store.CreateProduct(ctx, db, "TEST-001", "Test Product", "Test", decimal.NewFromInt(100), 10, "")
 	if err != nil {
 		t.Fatalf("Create product: %v", err)
 	}
@@ -73,7 +80,7 @@ func TestOptimisticLocking(t *testing.T) {
 
 	ctx := context.Background()
 
-	product, err := store.CreateProduct(ctx, db, "TEST-002", "Test Product 2", "Test", decimal.NewFromInt(100), 50)
+	product, err := store.CreateProduct(ctx, db, "TEST-002", "Test Product 2", "Test", decimal.NewFromInt(100), 50, "")
 	if err != nil {
 		t.Fatalf("Create product: %v", err)
 	}
@@ -89,13 +96,89 @@ func TestOptimisticLocking(t *testing.T) {
 	}
 }
 
+func TestDecrementStockReturning(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	product, err := store.CreateProduct(ctx, db, "TEST-DEC-RET-001", "Decrement Product", "Test", decimal.NewFromInt(10), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	var newStock int
+	err = database.WithTransaction(ctx, db, database.DefaultTxOptions(), func(tx *sql.Tx) error {
+		var err error
+		newStock, err = store.DecrementStockReturning(ctx, tx, product.ID, 3)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Decrement stock: %v", err)
+	}
+
+	updated, err := store.GetProduct(ctx, db, product.ID)
+	if err != nil {
+		t.Fatalf("Get product: %v", err)
+	}
+	if newStock != 7 || newStock != updated.StockQuantity {
+		t.Errorf("Expected returned stock 7 matching product stock %d, got %d", updated.StockQuantity, newStock)
+	}
+
+	err = database.WithTransaction(ctx, db, database.DefaultTxOptions(), func(tx *sql.Tx) error {
+		_, err := store.DecrementStockReturning(ctx, tx, product.ID, 8)
+		return err
+	})
+	if err != database.ErrInsufficientStock {
+		t.Errorf("Expected ErrInsufficientStock, got: %v", err)
+	}
+	assertStock(t, db, product.ID, 7, 0)
+}
+
+func TestCreateProductCaseInsensitiveSKU(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	product, err := store.CreateProduct(ctx, db, " abc-1 ", "Lower", "Test", decimal.NewFromInt(10), 1, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	if product.SKU != "ABC-1" {
+		t.Errorf("Expected SKU stored as ABC-1, got %q", product.SKU)
+	}
+
+	if _, err := store.CreateProduct(ctx, db, "ABC-1", "Upper", "Test", decimal.NewFromInt(10), 1, ""); err != database.ErrDuplicateSKU {
+		t.Errorf("Expected ErrDuplicateSKU, got: %v", err)
+	}
+	if _, err := store.CreateProduct(ctx, db, "Abc-1", "Mixed", "Test", decimal.NewFromInt(10), 1, ""); err != database.ErrDuplicateSKU {
+		t.Errorf("Expected ErrDuplicateSKU, got: %v", err)
+	}
+
+	if _, err := db.ExecContext(ctx, `UPDATE products SET sku = 'abc-1' WHERE id = $1`, product.ID); err == nil {
+		t.Error("Expected the check constraint to reject a lower-case SKU")
+	}
+
+	server := newTestServer(t, db)
+
+	resp, body := doRequest(t, http.MethodPost, server.URL+"/products", map[string]interface{}{
+		"sku":   "abc-1",
+		"name":  "Duplicate",
+		"price": 10,
+	}, nil)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected 409 for a duplicate SKU, got %d: %s", resp.StatusCode, body)
+	}
+}
+
 func TestReserveStockNoWait(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
 
 	ctx := context.Background()
 
-	product, err := store.CreateProduct(ctx, db, "TEST-003", "Test Product 3", "Test", decimal.NewFromInt(100), 20)
+	product, err := store.CreateProduct(ctx, db, "TEST-003", "Test Product 3", "Test", decimal.NewFromInt(100), 20, "")
 	if err != nil {
 		t.Fatalf("Create product: %v", err)
 	}
@@ -122,3 +205,923 @@ func TestReserveStockNoWait(t *testing.T) {
 		t.Errorf("Expected lock timeout, got: %v", err)
 	}
 }
+
+func TestProductNullDescription(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	var id int64
+	err := db.QueryRowContext(ctx,
+		`INSERT INTO products (sku, name, description, price, stock_quantity)
+		 VALUES ('TEST-NULL-001', 'No Description', NULL, 5, 1)
+		 RETURNING id`).Scan(&id)
+	if err != nil {
+		t.Fatalf("Insert product: %v", err)
+	}
+
+	product, err := store.GetProduct(ctx, db, id)
+	if err != nil {
+		t.Fatalf("Get product with NULL description: %v", err)
+	}
+	if product.Description != "" {
+		t.Errorf("Expected empty description, got %q", product.Description)
+	}
+
+	data, err := json.Marshal(product)
+	if err != nil {
+		t.Fatalf("Marshal product: %v", err)
+	}
+	if strings.Contains(string(data), `"description"`) {
+		t.Errorf("Expected description to be omitted from JSON, got %s", data)
+	}
+
+	if _, err := store.ListProducts(ctx, db, 1, 10, store.ProductFilter{}, store.PageOptions{IncludeTotal: true}); err != nil {
+		t.Errorf("List products with NULL description: %v", err)
+	}
+}
+
+func TestPatchProduct(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	product, err := store.CreateProduct(ctx, db, "TEST-PATCH-001", "Original Name", "Original description", decimal.NewFromInt(100), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	newPrice := decimal.RequireFromString("79.99")
+	patched, err := store.PatchProduct(ctx, db, product.ID, store.ProductPatch{Price: &newPrice}, product.Version)
+	if err != nil {
+		t.Fatalf("Patch price: %v", err)
+	}
+
+	if !patched.Price.Equal(newPrice) {
+		t.Errorf("Expected price %s, got %s", newPrice, patched.Price)
+	}
+	if patched.Name != product.Name || patched.Description != product.Description || patched.StockQuantity != product.StockQuantity {
+		t.Errorf("Price patch changed other fields: %+v", patched)
+	}
+	if patched.Version != product.Version+1 {
+		t.Errorf("Expected version %d, got %d", product.Version+1, patched.Version)
+	}
+
+	newName := "Renamed"
+	renamed, err := store.PatchProduct(ctx, db, product.ID, store.ProductPatch{Name: &newName}, patched.Version)
+	if err != nil {
+		t.Fatalf("Patch name: %v", err)
+	}
+
+	if renamed.Name != newName {
+		t.Errorf("Expected name %q, got %q", newName, renamed.Name)
+	}
+	if !renamed.Price.Equal(newPrice) || renamed.Description != product.Description {
+		t.Errorf("Name patch changed other fields: %+v", renamed)
+	}
+
+	_, err = store.PatchProduct(ctx, db, product.ID, store.ProductPatch{Name: &newName}, product.Version)
+	if err != database.ErrOptimisticLockFailed {
+		t.Errorf("Expected optimistic lock failure for stale version, got: %v", err)
+	}
+
+	_, err = store.PatchProduct(ctx, db, product.ID+1000, store.ProductPatch{Name: &newName}, 1)
+	if err != database.ErrProductNotFound {
+		t.Errorf("Expected product not found, got: %v", err)
+	}
+}
+
+func TestProductPriceHistory(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	product, err := store.CreateProduct(ctx, db, "TEST-PRICE-001", "Priced Product", "Test", decimal.NewFromInt(100), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	first := decimal.RequireFromString("89.99")
+	patched, err := store.PatchProduct(ctx, db, product.ID, store.ProductPatch{Price: &first}, product.Version)
+	if err != nil {
+		t.Fatalf("Patch price: %v", err)
+	}
+
+	newName := "Renamed"
+	patched, err = store.PatchProduct(ctx, db, product.ID, store.ProductPatch{Name: &newName}, patched.Version)
+	if err != nil {
+		t.Fatalf("Patch name: %v", err)
+	}
+
+	second := decimal.RequireFromString("74.50")
+	if _, err := store.PatchProduct(ctx, db, product.ID, store.ProductPatch{Price: &second}, patched.Version); err != nil {
+		t.Fatalf("Patch price again: %v", err)
+	}
+
+	history, err := store.GetProductPriceHistory(ctx, db, product.ID)
+	if err != nil {
+		t.Fatalf("Get price history: %v", err)
+	}
+
+	if len(history) != 2 {
+		t.Fatalf("Expected 2 price changes, got %d", len(history))
+	}
+	if !history[0].OldPrice.Equal(product.Price) || !history[0].NewPrice.Equal(first) {
+		t.Errorf("Unexpected first change: %s -> %s", history[0].OldPrice, history[0].NewPrice)
+	}
+	if !history[1].OldPrice.Equal(first) || !history[1].NewPrice.Equal(second) {
+		t.Errorf("Unexpected second change: %s -> %s", history[1].OldPrice, history[1].NewPrice)
+	}
+	if history[1].ChangedAt.Before(history[0].ChangedAt) {
+		t.Errorf("Expected changes in order, got %v before %v", history[1].ChangedAt, history[0].ChangedAt)
+	}
+}
+
+func TestListLowStockProducts(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	stocks := map[string]int{
+		"TEST-LOW-000": 0,
+		"TEST-LOW-004": 4,
+		"TEST-LOW-002": 2,
+		"TEST-LOW-005": 5,
+		"TEST-LOW-050": 50,
+	}
+	ids := make(map[string]int64)
+	for sku, stock := range stocks {
+		product, err := store.CreateProduct(ctx, db, sku, sku, "Test", decimal.NewFromInt(1), stock, "")
+		if err != nil {
+			t.Fatalf("Create product %s: %v", sku, err)
+		}
+		ids[sku] = product.ID
+	}
+
+	products, err := store.ListLowStockProducts(ctx, db, 5)
+	if err != nil {
+		t.Fatalf("List low stock products: %v", err)
+	}
+
+	expected := []string{"TEST-LOW-000", "TEST-LOW-002", "TEST-LOW-004"}
+	if len(products) != len(expected) {
+		t.Fatalf("Expected %d products, got %d", len(expected), len(products))
+	}
+	for i, sku := range expected {
+		if products[i].ID != ids[sku] {
+			t.Errorf("Position %d: expected %s, got %s", i, sku, products[i].SKU)
+		}
+	}
+
+	server := newTestServer(t, db)
+
+	resp, body := doRequest(t, http.MethodGet, server.URL+"/products/low-stock?threshold=1", nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	var low []models.Product
+	if err := json.Unmarshal(body, &low); err != nil {
+		t.Fatalf("Unmarshal products: %v", err)
+	}
+	if len(low) != 1 || low[0].SKU != "TEST-LOW-000" {
+		t.Errorf("Expected only the out-of-stock product, got %+v", low)
+	}
+}
+
+func TestListProductsConsistentUnderConcurrentInserts(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for i := 0; i < 20; i++ {
+		if _, err := store.CreateProduct(ctx, db, fmt.Sprintf("TEST-SNAP-%03d", i), "Seed", "Test", decimal.NewFromInt(1), 1, ""); err != nil {
+			t.Fatalf("Create product: %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ctx.Err() == nil; i++ {
+			_, _ = store.CreateProduct(ctx, db, fmt.Sprintf("TEST-SNAP-W%05d", i), "Writer", "Test", decimal.NewFromInt(1), 1, "")
+		}
+	}()
+
+	// With a page large enough to hold every row, a consistent snapshot must
+	// return exactly Total items.
+	for i := 0; i < 50; i++ {
+		result, err := store.ListProductsConsistent(ctx, db, 1, 100000, store.ProductFilter{}, store.PageOptions{IncludeTotal: true})
+		if err != nil {
+			t.Fatalf("List products: %v", err)
+		}
+
+		items, ok := result.Items.([]models.Product)
+		if !ok {
+			t.Fatalf("Unexpected items type %T", result.Items)
+		}
+		if int64(len(items)) != result.Total {
+			t.Fatalf("Iteration %d: Total %d but %d items returned", i, result.Total, len(items))
+		}
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestListProductsInStockOnly(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	inStock := map[int64]bool{}
+	for i, stock := range []int{0, 3, 0, 1, 7, 0} {
+		product, err := store.CreateProduct(ctx, db, fmt.Sprintf("TEST-INSTOCK-%d", i), "Product", "Test", decimal.NewFromInt(1), stock, "")
+		if err != nil {
+			t.Fatalf("Create product: %v", err)
+		}
+		if stock > 0 {
+			inStock[product.ID] = true
+		}
+	}
+
+	result, err := store.ListProducts(ctx, db, 1, 2, store.ProductFilter{InStockOnly: true}, store.PageOptions{IncludeTotal: true})
+	if err != nil {
+		t.Fatalf("List products: %v", err)
+	}
+
+	if result.Total != 3 {
+		t.Errorf("Expected total 3, got %d", result.Total)
+	}
+	if result.TotalPages != 2 {
+		t.Errorf("Expected 2 pages, got %d", result.TotalPages)
+	}
+
+	var seen []models.Product
+	for page := 1; page <= result.TotalPages; page++ {
+		pageResult, err := store.ListProducts(ctx, db, page, 2, store.ProductFilter{InStockOnly: true}, store.PageOptions{IncludeTotal: true})
+		if err != nil {
+			t.Fatalf("List products page %d: %v", page, err)
+		}
+		seen = append(seen, pageResult.Items.([]models.Product)...)
+	}
+
+	if len(seen) != 3 {
+		t.Fatalf("Expected 3 in-stock products, got %d", len(seen))
+	}
+	for _, product := range seen {
+		if !inStock[product.ID] {
+			t.Errorf("Out-of-stock product %s listed", product.SKU)
+		}
+	}
+
+	all, err := store.ListProducts(ctx, db, 1, 10, store.ProductFilter{}, store.PageOptions{IncludeTotal: true})
+	if err != nil {
+		t.Fatalf("List products: %v", err)
+	}
+	if all.Total != 6 {
+		t.Errorf("Expected total 6 without filter, got %d", all.Total)
+	}
+
+	server := newTestServer(t, db)
+
+	resp, body := doRequest(t, http.MethodGet, server.URL+"/products?in_stock=true", nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	var page struct {
+		Items []models.Product `json:"items"`
+		Total int64            `json:"total"`
+	}
+	if err := json.Unmarshal(body, &page); err != nil {
+		t.Fatalf("Unmarshal page: %v", err)
+	}
+	if page.Total != 3 || len(page.Items) != 3 {
+		t.Errorf("Expected 3 in-stock products from endpoint, got total %d with %d items", page.Total, len(page.Items))
+	}
+}
+
+func TestListProductsCreatedRange(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	base := time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)
+	ids := make(map[int]int64)
+	for day := 0; day < 5; day++ {
+		product, err := store.CreateProduct(ctx, db, fmt.Sprintf("TEST-RANGE-%d", day), "Product", "Test", decimal.NewFromInt(1), 1, "")
+		if err != nil {
+			t.Fatalf("Create product: %v", err)
+		}
+		if _, err := db.ExecContext(ctx, `UPDATE products SET created_at = $1 WHERE id = $2`,
+			base.AddDate(0, 0, day), product.ID); err != nil {
+			t.Fatalf("Backdate product: %v", err)
+		}
+		ids[day] = product.ID
+	}
+
+	result, err := store.ListProducts(ctx, db, 1, 10, store.ProductFilter{
+		CreatedFrom: base.AddDate(0, 0, 1),
+		CreatedTo:   base.AddDate(0, 0, 4),
+	}, store.PageOptions{IncludeTotal: true})
+	if err != nil {
+		t.Fatalf("List products: %v", err)
+	}
+
+	products := result.Items.([]models.Product)
+	if result.Total != 3 || len(products) != 3 {
+		t.Fatalf("Expected 3 products in range, got %d of %d", len(products), result.Total)
+	}
+	for i, product := range products {
+		if want := ids[3-i]; product.ID != want {
+			t.Errorf("Position %d: expected product %d, got %d", i, want, product.ID)
+		}
+	}
+
+	server := newTestServer(t, db)
+
+	resp, body := doRequest(t, http.MethodGet, server.URL+"/products?created_from=2024-03-04T00:00:00Z", nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	var page struct {
+		Total int64 `json:"total"`
+	}
+	if err := json.Unmarshal(body, &page); err != nil {
+		t.Fatalf("Unmarshal page: %v", err)
+	}
+	if page.Total != 1 {
+		t.Errorf("Expected 1 product from 2024-03-04, got %d", page.Total)
+	}
+
+	resp, body = doRequest(t, http.MethodGet, server.URL+"/products?created_to=yesterday", nil, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for unparseable date, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestGetProductsByIDs(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	first, err := store.CreateProduct(ctx, db, "TEST-BYID-001", "First", "Test", decimal.NewFromInt(1), 1, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	second, err := store.CreateProduct(ctx, db, "TEST-BYID-002", "Second", "Test", decimal.NewFromInt(2), 2, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	missingID := second.ID + 1000
+
+	products, err := store.GetProductsByIDs(ctx, db, []int64{second.ID, first.ID, missingID})
+	if err != nil {
+		t.Fatalf("Get products by IDs: %v", err)
+	}
+
+	if len(products) != 2 {
+		t.Fatalf("Expected 2 products, got %d", len(products))
+	}
+	if products[first.ID].SKU != "TEST-BYID-001" || products[second.ID].SKU != "TEST-BYID-002" {
+		t.Errorf("Unexpected products: %+v", products)
+	}
+	if _, ok := products[missingID]; ok {
+		t.Errorf("Nonexistent ID %d should be absent", missingID)
+	}
+}
+
+func TestCachedProductReader(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "cache@example.com", "Cache User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	product, err := store.CreateProduct(ctx, db, "TEST-CACHE-001", "Cached Product", "Test", decimal.NewFromInt(10), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	cache := store.NewCachedProductReader(db, 10, time.Hour)
+	defer cache.Close()
+
+	if _, err := cache.GetProduct(ctx, product.ID); err != nil {
+		t.Fatalf("Get product: %v", err)
+	}
+
+	// A write behind the store's back isn't seen until the entry goes away.
+	if _, err := db.ExecContext(ctx, `UPDATE products SET name = 'Renamed' WHERE id = $1`, product.ID); err != nil {
+		t.Fatalf("Rename product: %v", err)
+	}
+	cached, err := cache.GetProduct(ctx, product.ID)
+	if err != nil {
+		t.Fatalf("Get product: %v", err)
+	}
+	if cached.Name != "Cached Product" {
+		t.Errorf("Expected cache hit with the original name, got %q", cached.Name)
+	}
+
+	_, err = store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 3}},
+	})
+	if err != nil {
+		t.Fatalf("Create order: %v", err)
+	}
+	cached, err = cache.GetProduct(ctx, product.ID)
+	if err != nil {
+		t.Fatalf("Get product: %v", err)
+	}
+	if cached.StockQuantity != 7 || cached.Name != "Renamed" {
+		t.Errorf("Expected the order to invalidate the entry, got stock %d and name %q", cached.StockQuantity, cached.Name)
+	}
+
+	price := decimal.NewFromInt(12)
+	if _, err := store.PatchProduct(ctx, db, product.ID, store.ProductPatch{Price: &price}, cached.Version); err != nil {
+		t.Fatalf("Patch product: %v", err)
+	}
+	cached, err = cache.GetProduct(ctx, product.ID)
+	if err != nil {
+		t.Fatalf("Get product: %v", err)
+	}
+	if !cached.Price.Equal(price) {
+		t.Errorf("Expected the update to invalidate the entry, got price %s", cached.Price)
+	}
+
+	shortLived := store.NewCachedProductReader(db, 10, 50*time.Millisecond)
+	defer shortLived.Close()
+
+	if _, err := shortLived.GetProduct(ctx, product.ID); err != nil {
+		t.Fatalf("Get product: %v", err)
+	}
+	if _, err := db.ExecContext(ctx, `UPDATE products SET name = 'Expired' WHERE id = $1`, product.ID); err != nil {
+		t.Fatalf("Rename product: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	cached, err = shortLived.GetProduct(ctx, product.ID)
+	if err != nil {
+		t.Fatalf("Get product: %v", err)
+	}
+	if cached.Name != "Expired" {
+		t.Errorf("Expected the entry to expire after its ttl, got name %q", cached.Name)
+	}
+
+	if _, err := cache.GetProduct(ctx, 999999); err != database.ErrProductNotFound {
+		t.Errorf("Expected ErrProductNotFound, got: %v", err)
+	}
+}
+
+func TestGetProductSales(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "sales@example.com", "Sales User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	product, err := store.CreateProduct(ctx, db, "TEST-SALES-001", "Sold Product", "Test", decimal.RequireFromString("12.50"), 100, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	unsold, err := store.CreateProduct(ctx, db, "TEST-SALES-002", "Unsold Product", "Test", decimal.NewFromInt(5), 100, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	var cancelled *models.Order
+	for _, quantity := range []int{2, 3, 4} {
+		order, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+			UserID: user.ID,
+			Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: quantity}},
+		})
+		if err != nil {
+			t.Fatalf("Create order: %v", err)
+		}
+		cancelled = order
+	}
+	if _, err := store.UpdateOrderStatus(ctx, db, cancelled.ID, models.OrderStatusCancelled); err != nil {
+		t.Fatalf("Cancel order: %v", err)
+	}
+
+	// A pending order that only reserves stock hasn't sold anything yet.
+	if _, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID:      user.ID,
+		Items:       []store.OrderItemRequest{{ProductID: product.ID, Quantity: 7}},
+		ReserveOnly: true,
+	}); err != nil {
+		t.Fatalf("Create reserve-only order: %v", err)
+	}
+
+	sales, err := store.GetProductSales(ctx, db, product.ID)
+	if err != nil {
+		t.Fatalf("Get product sales: %v", err)
+	}
+	if sales.UnitsSold != 5 || !sales.Revenue.Equal(decimal.RequireFromString("62.50")) || sales.OrderCount != 2 {
+		t.Errorf("Expected 5 units, 62.50 revenue over 2 orders, got %+v", sales)
+	}
+
+	sales, err = store.GetProductSales(ctx, db, unsold.ID)
+	if err != nil {
+		t.Fatalf("Get product sales: %v", err)
+	}
+	if sales.UnitsSold != 0 || !sales.Revenue.IsZero() || sales.OrderCount != 0 {
+		t.Errorf("Expected zero sales, got %+v", sales)
+	}
+
+	if _, err := store.GetProductSales(ctx, db, 999999); err != database.ErrProductNotFound {
+		t.Errorf("Expected ErrProductNotFound, got: %v", err)
+	}
+
+	server := newTestServer(t, db)
+
+	resp, body := doRequest(t, http.MethodGet, fmt.Sprintf("%s/products/%d/sales", server.URL, product.ID), nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	var result store.ProductSales
+	if err := json.Unmarshal(body, &result); err != nil {
+		t.Fatalf("Unmarshal sales: %v", err)
+	}
+	if result.UnitsSold != 5 || !result.Revenue.Equal(decimal.RequireFromString("62.50")) {
+		t.Errorf("Expected 5 units and 62.50 revenue, got %s", body)
+	}
+
+	resp, body = doRequest(t, http.MethodGet, server.URL+"/products/999999/sales", nil, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown product, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestNumericOutOfRange(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	// products.price is DECIMAL(10, 2).
+	_, err := store.CreateProduct(ctx, db, "TEST-RANGE-001", "Priceless", "Test", decimal.RequireFromString("100000000"), 1, "")
+	if !errors.Is(err, database.ErrNumericOutOfRange) {
+		t.Errorf("Expected ErrNumericOutOfRange, got: %v", err)
+	}
+
+	server := newTestServer(t, db)
+	resp, body := doRequest(t, http.MethodPost, server.URL+"/products", map[string]interface{}{
+		"sku":   "TEST-RANGE-002",
+		"name":  "Priceless",
+		"price": 100000000,
+	}, nil)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for out-of-range price, got %d: %s", resp.StatusCode, body)
+	}
+
+	user, err := store.CreateUser(ctx, db, "range@example.com", "Range User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	product, err := store.CreateProduct(ctx, db, "TEST-RANGE-003", "Expensive", "Test", decimal.RequireFromString("99999999.99"), 2, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	// Raise the cap so the total reaches the orders.total_amount column.
+	defer func(max decimal.Decimal) { store.MaxOrderTotal = max }(store.MaxOrderTotal)
+	store.MaxOrderTotal = decimal.RequireFromString("1000000000")
+
+	_, err = store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 2}},
+	})
+	if !errors.Is(err, database.ErrNumericOutOfRange) {
+		t.Errorf("Expected ErrNumericOutOfRange for an oversized total, got: %v", err)
+	}
+	assertStock(t, db, product.ID, 2, 0)
+}
+
+func TestAdjustStockIdempotent(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	first, err := store.CreateProduct(ctx, db, "TEST-ADJ-001", "Adjusted", "Test", decimal.NewFromInt(10), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	second, err := store.CreateProduct(ctx, db, "TEST-ADJ-002", "Written Off", "Test", decimal.NewFromInt(10), 4, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	for i, want := range []bool{true, false} {
+		applied, err := store.RestockProduct(ctx, db, first.ID, 5, "webhook-123")
+		if err != nil {
+			t.Fatalf("Restock attempt %d: %v", i+1, err)
+		}
+		if applied != want {
+			t.Errorf("Expected applied=%v on attempt %d, got %v", want, i+1, applied)
+		}
+	}
+	assertStock(t, db, first.ID, 15, 0)
+
+	applied, err := store.RestockProduct(ctx, db, first.ID, 5, "")
+	if err != nil || !applied {
+		t.Fatalf("Restock without adjustment ID: applied=%v, err=%v", applied, err)
+	}
+	assertStock(t, db, first.ID, 20, 0)
+
+	_, err = store.AdjustStockBatch(ctx, db, []store.StockAdjustment{
+		{ProductID: first.ID, Quantity: 3},
+		{ProductID: second.ID, Quantity: -5},
+	}, "count-7")
+	if !errors.Is(err, database.ErrInsufficientStock) {
+		t.Fatalf("Expected ErrInsufficientStock, got: %v", err)
+	}
+	assertStock(t, db, first.ID, 20, 0)
+
+	// The failed batch didn't record its ID, so a corrected retry applies.
+	applied, err = store.AdjustStockBatch(ctx, db, []store.StockAdjustment{
+		{ProductID: first.ID, Quantity: 3},
+		{ProductID: second.ID, Quantity: -4},
+	}, "count-7")
+	if err != nil || !applied {
+		t.Fatalf("Adjust stock batch: applied=%v, err=%v", applied, err)
+	}
+	assertStock(t, db, first.ID, 23, 0)
+	assertStock(t, db, second.ID, 0, 0)
+
+	discrepancies, err := store.ReconcileStock(ctx, db, false)
+	if err != nil {
+		t.Fatalf("Reconcile stock: %v", err)
+	}
+	if len(discrepancies) != 0 {
+		t.Errorf("Expected adjustments to keep stock reconciled, got %+v", discrepancies)
+	}
+}
+
+func TestResyncProductVersion(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	product, err := store.CreateProduct(ctx, db, "TEST-RESYNC-001", "Resynced", "Test", decimal.NewFromInt(10), 5, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	resynced, err := store.ResyncProductVersion(ctx, db, product.ID, 5)
+	if err != nil {
+		t.Fatalf("Resync version: %v", err)
+	}
+	if resynced.Version != 5 {
+		t.Errorf("Expected version 5, got %d", resynced.Version)
+	}
+
+	name := "Stale Write"
+	if _, err := store.PatchProduct(ctx, db, product.ID, store.ProductPatch{Name: &name}, product.Version); err != database.ErrOptimisticLockFailed {
+		t.Errorf("Expected a write with the old version to fail, got: %v", err)
+	}
+
+	var validationErrs store.ValidationErrors
+	if _, err := store.ResyncProductVersion(ctx, db, product.ID, 3); !errors.As(err, &validationErrs) {
+		t.Errorf("Expected a validation error lowering the version, got: %v", err)
+	}
+
+	unchanged, err := store.ResyncProductVersion(ctx, db, product.ID, 5)
+	if err != nil {
+		t.Fatalf("Resync to the current version: %v", err)
+	}
+	if unchanged.Version != 5 || !unchanged.UpdatedAt.Equal(resynced.UpdatedAt) {
+		t.Errorf("Expected resyncing to the current version to change nothing, got version %d", unchanged.Version)
+	}
+
+	if _, err := store.ResyncProductVersion(ctx, db, product.ID+1000, 2); err != database.ErrProductNotFound {
+		t.Errorf("Expected ErrProductNotFound, got: %v", err)
+	}
+}
+
+func TestAdjustPricesByPercent(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	prices := []string{"19.99", "0.05", "10.00"}
+	expected := []string{"15.99", "0.04", "8.00"}
+
+	var products []*models.Product
+	var ids []int64
+	for i, price := range prices {
+		product, err := store.CreateProduct(ctx, db, fmt.Sprintf("TEST-DISCOUNT-%03d", i), "Discounted", "Test", decimal.RequireFromString(price), 5, "")
+		if err != nil {
+			t.Fatalf("Create product: %v", err)
+		}
+		products = append(products, product)
+		ids = append(ids, product.ID)
+	}
+
+	updated, err := store.AdjustPricesByPercent(ctx, db, append(ids, ids[0]+1000), decimal.NewFromInt(-20))
+	if err != nil {
+		t.Fatalf("Adjust prices: %v", err)
+	}
+	if updated != int64(len(ids)) {
+		t.Errorf("Expected %d products updated, got %d", len(ids), updated)
+	}
+
+	for i, product := range products {
+		adjusted, err := store.GetProduct(ctx, db, product.ID)
+		if err != nil {
+			t.Fatalf("Get product: %v", err)
+		}
+		if !adjusted.Price.Equal(decimal.RequireFromString(expected[i])) {
+			t.Errorf("Expected %s discounted to %s, got %s", prices[i], expected[i], adjusted.Price)
+		}
+		if adjusted.Version != product.Version+1 {
+			t.Errorf("Expected version %d, got %d", product.Version+1, adjusted.Version)
+		}
+
+		history, err := store.GetProductPriceHistory(ctx, db, product.ID)
+		if err != nil {
+			t.Fatalf("Get price history: %v", err)
+		}
+		if len(history) != 1 || !history[0].OldPrice.Equal(product.Price) || !history[0].NewPrice.Equal(adjusted.Price) {
+			t.Errorf("Expected one price change %s -> %s, got %+v", product.Price, adjusted.Price, history)
+		}
+	}
+
+	var validationErrs store.ValidationErrors
+	if _, err := store.AdjustPricesByPercent(ctx, db, ids, decimal.NewFromInt(-150)); !errors.As(err, &validationErrs) {
+		t.Errorf("Expected a validation error for a negative resulting price, got: %v", err)
+	}
+}
+
+func TestListWithoutTotal(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, err := store.CreateProduct(ctx, db, fmt.Sprintf("TEST-NOTOTAL-%03d", i), "Product", "Test", decimal.NewFromInt(10), 5, ""); err != nil {
+			t.Fatalf("Create product: %v", err)
+		}
+	}
+	if _, err := store.CreateUser(ctx, db, "nototal@example.com", "No Total"); err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	var mu sync.Mutex
+	var counts int
+	connector, err := database.NewConnector(testDSN, func(ctx context.Context, event database.QueryEvent) {
+		if strings.Contains(event.Query, "COUNT(*)") {
+			mu.Lock()
+			counts++
+			mu.Unlock()
+		}
+	})
+	if err != nil {
+		t.Fatalf("New connector: %v", err)
+	}
+	hooked := sql.OpenDB(connector)
+	defer hooked.Close()
+
+	countQueries := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		n := counts
+		counts = 0
+		return n
+	}
+
+	products, err := store.ListProducts(ctx, hooked, 1, 2, store.ProductFilter{}, store.PageOptions{})
+	if err != nil {
+		t.Fatalf("List products: %v", err)
+	}
+	if items, _ := products.Items.([]models.Product); len(items) != 2 {
+		t.Errorf("Expected 2 products, got %d", len(items))
+	}
+	if products.Total != -1 || products.TotalPages != -1 {
+		t.Errorf("Expected no total, got total %d of %d pages", products.Total, products.TotalPages)
+	}
+	if n := countQueries(); n != 0 {
+		t.Errorf("Expected no COUNT query, got %d", n)
+	}
+
+	users, err := store.ListUsers(ctx, hooked, 1, 10, store.PageOptions{})
+	if err != nil {
+		t.Fatalf("List users: %v", err)
+	}
+	if users.Total != -1 || users.TotalPages != -1 {
+		t.Errorf("Expected no user total, got total %d of %d pages", users.Total, users.TotalPages)
+	}
+	if n := countQueries(); n != 0 {
+		t.Errorf("Expected no COUNT query for users, got %d", n)
+	}
+
+	server := newTestServer(t, hooked)
+
+	resp, body := doRequest(t, http.MethodGet, server.URL+"/products?page_size=2&include_total=false", nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	var page struct {
+		Total      int64 `json:"total"`
+		TotalPages int   `json:"total_pages"`
+	}
+	if err := json.Unmarshal(body, &page); err != nil {
+		t.Fatalf("Decode page: %v", err)
+	}
+	if page.Total != -1 || page.TotalPages != -1 {
+		t.Errorf("Expected no total from endpoint, got total %d of %d pages", page.Total, page.TotalPages)
+	}
+	if n := countQueries(); n != 0 {
+		t.Errorf("Expected no COUNT query from endpoint, got %d", n)
+	}
+
+	resp, body = doRequest(t, http.MethodGet, server.URL+"/products?page_size=2", nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if err := json.Unmarshal(body, &page); err != nil {
+		t.Fatalf("Decode page: %v", err)
+	}
+	if page.Total != 3 || page.TotalPages != 2 {
+		t.Errorf("Expected total 3 of 2 pages by default, got total %d of %d pages", page.Total, page.TotalPages)
+	}
+	if n := countQueries(); n != 1 {
+		t.Errorf("Expected 1 COUNT query by default, got %d", n)
+	}
+}
+
+func TestUpdateProductSKU(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	product, err := store.CreateProduct(ctx, db, "TEST-SKU-OLD", "Renamed SKU", "Test", decimal.NewFromInt(10), 5, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	other, err := store.CreateProduct(ctx, db, "TEST-SKU-TAKEN", "Other", "Test", decimal.NewFromInt(10), 5, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	updated, err := store.UpdateProductSKU(ctx, db, product.ID, " test-sku-new ", product.Version)
+	if err != nil {
+		t.Fatalf("Update SKU: %v", err)
+	}
+	if updated.SKU != "TEST-SKU-NEW" || updated.Version != product.Version+1 {
+		t.Errorf("Expected SKU TEST-SKU-NEW at version %d, got %s at version %d", product.Version+1, updated.SKU, updated.Version)
+	}
+
+	if _, err := store.UpdateProductSKU(ctx, db, product.ID, "test-sku-taken", updated.Version); err != database.ErrDuplicateSKU {
+		t.Errorf("Expected ErrDuplicateSKU, got: %v", err)
+	}
+	if _, err := store.UpdateProductSKU(ctx, db, product.ID, "TEST-SKU-NEWER", product.Version); err != database.ErrOptimisticLockFailed {
+		t.Errorf("Expected ErrOptimisticLockFailed for a stale version, got: %v", err)
+	}
+	if _, err := store.UpdateProductSKU(ctx, db, product.ID+1000, "TEST-SKU-NEWER", 1); err != database.ErrProductNotFound {
+		t.Errorf("Expected ErrProductNotFound, got: %v", err)
+	}
+
+	unchanged, err := store.GetProduct(ctx, db, other.ID)
+	if err != nil {
+		t.Fatalf("Get product: %v", err)
+	}
+	if unchanged.SKU != "TEST-SKU-TAKEN" {
+		t.Errorf("Expected the other product's SKU unchanged, got %s", unchanged.SKU)
+	}
+
+	current, err := store.GetProduct(ctx, db, product.ID)
+	if err != nil {
+		t.Fatalf("Get product: %v", err)
+	}
+	if current.SKU != "TEST-SKU-NEW" || current.Version != updated.Version {
+		t.Errorf("Expected SKU TEST-SKU-NEW at version %d, got %s at version %d", updated.Version, current.SKU, current.Version)
+	}
+}
@@ -0,0 +1,79 @@
+package integration
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/safar/go-sql-store/internal/database"
+	"github.com/safar/go-sql-store/internal/models"
+	"github.com/safar/go-sql-store/internal/store"
+	"github.com/shopspring/decimal"
+)
+
+func TestStoreFunctionsComposeInTransaction(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	var user *models.User
+	var product *models.Product
+
+	err := database.WithTransaction(ctx, db, database.DefaultTxOptions(), func(tx *sql.Tx) error {
+		var err error
+		user, err = store.CreateUser(ctx, tx, "composed@example.com", "Composed User")
+		if err != nil {
+			return err
+		}
+
+		product, err = store.CreateProduct(ctx, tx, "TEST-TX-001", "Composed Product", "Test", decimal.NewFromInt(5), 3, "")
+		if err != nil {
+			return err
+		}
+
+		// Reads through the same transaction see the uncommitted rows.
+		if _, err := store.GetUser(ctx, tx, user.ID); err != nil {
+			return err
+		}
+		_, err = store.GetProduct(ctx, tx, product.ID)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Transaction: %v", err)
+	}
+
+	if _, err := store.GetUser(ctx, db, user.ID); err != nil {
+		t.Errorf("Expected committed user, got: %v", err)
+	}
+	if _, err := store.GetProduct(ctx, db, product.ID); err != nil {
+		t.Errorf("Expected committed product, got: %v", err)
+	}
+
+	errAbort := errors.New("abort")
+	err = database.WithTransaction(ctx, db, database.DefaultTxOptions(), func(tx *sql.Tx) error {
+		var err error
+		user, err = store.CreateUser(ctx, tx, "rolledback@example.com", "Rolled Back User")
+		if err != nil {
+			return err
+		}
+
+		product, err = store.CreateProduct(ctx, tx, "TEST-TX-002", "Rolled Back Product", "Test", decimal.NewFromInt(5), 3, "")
+		if err != nil {
+			return err
+		}
+
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("Expected abort error, got: %v", err)
+	}
+
+	if _, err := store.GetUser(ctx, db, user.ID); err != database.ErrUserNotFound {
+		t.Errorf("Expected rolled back user to be missing, got: %v", err)
+	}
+	if _, err := store.GetProduct(ctx, db, product.ID); err != database.ErrProductNotFound {
+		t.Errorf("Expected rolled back product to be missing, got: %v", err)
+	}
+}
@@ -0,0 +1,252 @@
+package integration
+
+import (
+	"context"
+	"testing"
+
+	"github.com/safar/go-sql-store/internal/store"
+	"github.com/shopspring/decimal"
+)
+
+func TestReconcileStock(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "reconcile@example.com", "Reconcile User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	drifted, err := store.CreateProduct(ctx, db, "TEST-REC-001", "Drifted", "Test", decimal.NewFromInt(10), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	restocked, err := store.CreateProduct(ctx, db, "TEST-REC-002", "Restocked", "Test", decimal.NewFromInt(10), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	_, err = store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items: []store.OrderItemRequest{
+			{ProductID: drifted.ID, Quantity: 3},
+			{ProductID: restocked.ID, Quantity: 4},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Create order: %v", err)
+	}
+
+	// A restock through the store is not a discrepancy.
+	restocked, err = store.GetProduct(ctx, db, restocked.ID)
+	if err != nil {
+		t.Fatalf("Get product: %v", err)
+	}
+	newStock := 20
+	if _, err := store.PatchProduct(ctx, db, restocked.ID, store.ProductPatch{StockQuantity: &newStock}, restocked.Version); err != nil {
+		t.Fatalf("Patch product: %v", err)
+	}
+
+	report, err := store.ReconcileStock(ctx, db, false)
+	if err != nil {
+		t.Fatalf("Reconcile stock: %v", err)
+	}
+	if len(report) != 0 {
+		t.Fatalf("Expected no discrepancies, got %+v", report)
+	}
+
+	// Simulate a bug that deducted stock without recording a sale.
+	if _, err := db.ExecContext(ctx, `UPDATE products SET stock_quantity = 5 WHERE id = $1`, drifted.ID); err != nil {
+		t.Fatalf("Inject discrepancy: %v", err)
+	}
+
+	report, err = store.ReconcileStock(ctx, db, false)
+	if err != nil {
+		t.Fatalf("Reconcile stock: %v", err)
+	}
+	if len(report) != 1 {
+		t.Fatalf("Expected 1 discrepancy, got %+v", report)
+	}
+	if d := report[0]; d.ProductID != drifted.ID || d.ExpectedStock != 7 || d.ActualStock != 5 || d.Corrected {
+		t.Errorf("Unexpected discrepancy: %+v", d)
+	}
+
+	product, err := store.GetProduct(ctx, db, drifted.ID)
+	if err != nil {
+		t.Fatalf("Get product: %v", err)
+	}
+	if product.StockQuantity != 5 {
+		t.Errorf("Report-only run changed stock to %d", product.StockQuantity)
+	}
+
+	report, err = store.ReconcileStock(ctx, db, true)
+	if err != nil {
+		t.Fatalf("Reconcile stock: %v", err)
+	}
+	if len(report) != 1 || !report[0].Corrected {
+		t.Fatalf("Expected 1 corrected discrepancy, got %+v", report)
+	}
+
+	product, err = store.GetProduct(ctx, db, drifted.ID)
+	if err != nil {
+		t.Fatalf("Get product: %v", err)
+	}
+	if product.StockQuantity != 7 {
+		t.Errorf("Expected corrected stock 7, got %d", product.StockQuantity)
+	}
+
+	report, err = store.ReconcileStock(ctx, db, false)
+	if err != nil {
+		t.Fatalf("Reconcile stock: %v", err)
+	}
+	if len(report) != 0 {
+		t.Errorf("Expected no discrepancies after correction, got %+v", report)
+	}
+}
+
+func TestListOrdersNeedingReview(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "review@example.com", "Review User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	drifted, err := store.CreateProduct(ctx, db, "TEST-REV-001", "Drifted", "Test", decimal.NewFromInt(10), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	healthy, err := store.CreateProduct(ctx, db, "TEST-REV-002", "Healthy", "Test", decimal.NewFromInt(10), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	affected, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items: []store.OrderItemRequest{
+			{ProductID: drifted.ID, Quantity: 2},
+			{ProductID: healthy.ID, Quantity: 1},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Create order: %v", err)
+	}
+	unaffected, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items:  []store.OrderItemRequest{{ProductID: healthy.ID, Quantity: 1}},
+	})
+	if err != nil {
+		t.Fatalf("Create order: %v", err)
+	}
+	cancelled, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items:  []store.OrderItemRequest{{ProductID: drifted.ID, Quantity: 1}},
+	})
+	if err != nil {
+		t.Fatalf("Create order: %v", err)
+	}
+	if _, err := store.UpdateOrderStatus(ctx, db, cancelled.ID, "cancelled"); err != nil {
+		t.Fatalf("Cancel order: %v", err)
+	}
+
+	reviews, err := store.ListOrdersNeedingReview(ctx, db)
+	if err != nil {
+		t.Fatalf("List orders needing review: %v", err)
+	}
+	if len(reviews) != 0 {
+		t.Fatalf("Expected no orders while stock is consistent, got %+v", reviews)
+	}
+
+	// Simulate a bug that deducted stock without recording a sale.
+	if _, err := db.ExecContext(ctx, `UPDATE products SET stock_quantity = 3 WHERE id = $1`, drifted.ID); err != nil {
+		t.Fatalf("Corrupt stock: %v", err)
+	}
+
+	reviews, err = store.ListOrdersNeedingReview(ctx, db)
+	if err != nil {
+		t.Fatalf("List orders needing review: %v", err)
+	}
+	if len(reviews) != 1 || reviews[0].Order.ID != affected.ID {
+		t.Fatalf("Expected only order %d (not %d or cancelled %d), got %+v", affected.ID, unaffected.ID, cancelled.ID, reviews)
+	}
+	review := reviews[0]
+	if review.Order.OrderNumber != affected.OrderNumber {
+		t.Errorf("Expected the full order, got %+v", review.Order)
+	}
+	if len(review.Products) != 1 {
+		t.Fatalf("Expected 1 problematic product, got %+v", review.Products)
+	}
+	if p := review.Products[0]; p.ProductID != drifted.ID || p.ExpectedStock != 8 || p.ActualStock != 3 {
+		t.Errorf("Expected product %d expected 8 actual 3, got %+v", drifted.ID, p)
+	}
+}
+
+func TestFindOrphanedOrderItems(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "orphans@example.com", "Orphan User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	product, err := store.CreateProduct(ctx, db, "TEST-ORPHAN-001", "Orphaned", "Test", decimal.NewFromInt(10), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	kept, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 1}},
+	})
+	if err != nil {
+		t.Fatalf("Create order: %v", err)
+	}
+	deleted, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 2}},
+	})
+	if err != nil {
+		t.Fatalf("Create order: %v", err)
+	}
+
+	orphans, err := store.FindOrphanedOrderItems(ctx, db)
+	if err != nil {
+		t.Fatalf("Find orphaned order items: %v", err)
+	}
+	if len(orphans) != 0 {
+		t.Fatalf("Expected no orphans, got %+v", orphans)
+	}
+
+	// Dropping the foreign key is transactional, so rolling back restores it.
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("Begin transaction: %v", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil {
+			t.Errorf("Rollback: %v", err)
+		}
+	}()
+
+	if _, err := tx.ExecContext(ctx, `ALTER TABLE order_items DROP CONSTRAINT order_items_order_id_fkey`); err != nil {
+		t.Fatalf("Drop foreign key: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM orders WHERE id = $1`, deleted.ID); err != nil {
+		t.Fatalf("Delete order: %v", err)
+	}
+
+	orphans, err = store.FindOrphanedOrderItems(ctx, tx)
+	if err != nil {
+		t.Fatalf("Find orphaned order items: %v", err)
+	}
+	if len(orphans) != 1 || orphans[0].OrderID != deleted.ID || orphans[0].Quantity != 2 {
+		t.Errorf("Expected the item of order %d (not %d), got %+v", deleted.ID, kept.ID, orphans)
+	}
+}
@@ -0,0 +1,372 @@
+package integration
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/safar/go-sql-store/internal/database"
+	"github.com/safar/go-sql-store/internal/models"
+	"github.com/safar/go-sql-store/internal/store"
+	"github.com/shopspring/decimal"
+)
+
+func holdStock(t *testing.T, db *sql.DB, productID int64, quantity int) *models.StockReservation {
+	t.Helper()
+
+	var reservation *models.StockReservation
+	err := database.WithTransaction(context.Background(), db, database.DefaultTxOptions(), func(tx *sql.Tx) error {
+		var err error
+		reservation, err = store.HoldStock(context.Background(), tx, productID, quantity)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Hold stock: %v", err)
+	}
+	return reservation
+}
+
+func TestReleaseExpiredReservations(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	product, err := store.CreateProduct(ctx, db, "TEST-RES-001", "Reserved Product", "Test", decimal.NewFromInt(10), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	expired := holdStock(t, db, product.ID, 3)
+	holdStock(t, db, product.ID, 2)
+
+	if _, err := db.ExecContext(ctx,
+		`UPDATE stock_reservations SET created_at = NOW() - INTERVAL '2 hours' WHERE id = $1`,
+		expired.ID); err != nil {
+		t.Fatalf("Age reservation: %v", err)
+	}
+
+	held, err := store.GetProduct(ctx, db, product.ID)
+	if err != nil {
+		t.Fatalf("Get product: %v", err)
+	}
+	if held.ReservedQuantity != 5 || held.StockQuantity != 10 {
+		t.Errorf("Expected stock 10 with 5 reserved, got %d with %d reserved", held.StockQuantity, held.ReservedQuantity)
+	}
+
+	released, err := store.ReleaseExpiredReservations(ctx, db, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("Release expired reservations: %v", err)
+	}
+	if released != 1 {
+		t.Errorf("Expected 1 released reservation, got %d", released)
+	}
+
+	after, err := store.GetProduct(ctx, db, product.ID)
+	if err != nil {
+		t.Fatalf("Get product: %v", err)
+	}
+	if after.ReservedQuantity != 2 {
+		t.Errorf("Expected 2 reserved after release, got %d", after.ReservedQuantity)
+	}
+
+	released, err = store.ReleaseExpiredReservations(ctx, db, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("Release expired reservations again: %v", err)
+	}
+	if released != 0 {
+		t.Errorf("Expected no reservations released twice, got %d", released)
+	}
+}
+
+func TestReservedStockIsUnavailableForOrders(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "reserved@example.com", "Reserved User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	product, err := store.CreateProduct(ctx, db, "TEST-RES-002", "Reserved Product", "Test", decimal.NewFromInt(10), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	holdStock(t, db, product.ID, 4)
+
+	_, err = store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 7}},
+	})
+	if err != database.ErrInsufficientStock {
+		t.Errorf("Expected insufficient stock with reserved units, got: %v", err)
+	}
+
+	_, err = store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 6}},
+	})
+	if err != nil {
+		t.Errorf("Expected order within available stock to succeed, got: %v", err)
+	}
+}
+
+func assertStock(t *testing.T, db *sql.DB, productID int64, stock, reserved int) {
+	t.Helper()
+
+	product, err := store.GetProduct(context.Background(), db, productID)
+	if err != nil {
+		t.Fatalf("Get product: %v", err)
+	}
+	if product.StockQuantity != stock || product.ReservedQuantity != reserved {
+		t.Errorf("Expected stock %d with %d reserved, got %d with %d reserved",
+			stock, reserved, product.StockQuantity, product.ReservedQuantity)
+	}
+}
+
+func TestConfirmOrderCapturesReservation(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "confirm@example.com", "Confirm User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	product, err := store.CreateProduct(ctx, db, "TEST-CONF-001", "Confirm Product", "Test", decimal.NewFromInt(10), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	order, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID:      user.ID,
+		Items:       []store.OrderItemRequest{{ProductID: product.ID, Quantity: 3}},
+		ReserveOnly: true,
+	})
+	if err != nil {
+		t.Fatalf("Create order: %v", err)
+	}
+
+	assertStock(t, db, product.ID, 10, 3)
+
+	report, err := store.ReconcileStock(ctx, db, false)
+	if err != nil {
+		t.Fatalf("Reconcile stock: %v", err)
+	}
+	if len(report) != 0 {
+		t.Errorf("Expected a reserve-only order to reconcile, got %+v", report)
+	}
+
+	if _, err := store.ConfirmOrder(ctx, db, order.ID, order.Version+1); err != database.ErrOptimisticLockFailed {
+		t.Errorf("Expected ErrOptimisticLockFailed for stale version, got: %v", err)
+	}
+
+	confirmed, err := store.ConfirmOrder(ctx, db, order.ID, order.Version)
+	if err != nil {
+		t.Fatalf("Confirm order: %v", err)
+	}
+	if confirmed.Status != models.OrderStatusConfirmed || confirmed.Version != order.Version+1 {
+		t.Errorf("Unexpected confirmed order: %+v", confirmed)
+	}
+
+	assertStock(t, db, product.ID, 7, 0)
+
+	if _, err := store.ConfirmOrder(ctx, db, order.ID, confirmed.Version); err != database.ErrInvalidStatusTransition {
+		t.Errorf("Expected ErrInvalidStatusTransition for confirmed order, got: %v", err)
+	}
+
+	assertStock(t, db, product.ID, 7, 0)
+
+	report, err = store.ReconcileStock(ctx, db, false)
+	if err != nil {
+		t.Fatalf("Reconcile stock: %v", err)
+	}
+	if len(report) != 0 {
+		t.Errorf("Expected confirmed order to reconcile, got %+v", report)
+	}
+
+	// Cancelling after confirmation returns the captured stock.
+	if _, err := store.UpdateOrderStatus(ctx, db, order.ID, models.OrderStatusCancelled); err != nil {
+		t.Fatalf("Cancel order: %v", err)
+	}
+	assertStock(t, db, product.ID, 10, 0)
+}
+
+func TestCancelReserveOnlyOrderReleasesHold(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "release@example.com", "Release User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	product, err := store.CreateProduct(ctx, db, "TEST-CONF-002", "Release Product", "Test", decimal.NewFromInt(10), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	order, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID:      user.ID,
+		Items:       []store.OrderItemRequest{{ProductID: product.ID, Quantity: 4}},
+		ReserveOnly: true,
+	})
+	if err != nil {
+		t.Fatalf("Create order: %v", err)
+	}
+
+	if _, err := store.UpdateOrderStatus(ctx, db, order.ID, models.OrderStatusCancelled); err != nil {
+		t.Fatalf("Cancel order: %v", err)
+	}
+
+	assertStock(t, db, product.ID, 10, 0)
+}
+
+func TestConfirmOrderAfterReservationExpired(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, db, "expired@example.com", "Expired User")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	product, err := store.CreateProduct(ctx, db, "TEST-CONF-003", "Expired Product", "Test", decimal.NewFromInt(10), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	order, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID:      user.ID,
+		Items:       []store.OrderItemRequest{{ProductID: product.ID, Quantity: 2}},
+		ReserveOnly: true,
+	})
+	if err != nil {
+		t.Fatalf("Create order: %v", err)
+	}
+
+	if _, err := store.ReleaseExpiredReservations(ctx, db, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Release reservations: %v", err)
+	}
+
+	if _, err := store.ConfirmOrder(ctx, db, order.ID, order.Version); err != database.ErrReservationExpired {
+		t.Errorf("Expected ErrReservationExpired, got: %v", err)
+	}
+
+	assertStock(t, db, product.ID, 10, 0)
+}
+
+func TestCreateAndConsumeReservation(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	product, err := store.CreateProduct(ctx, db, "TEST-RSV-001", "Reservable Product", "Test", decimal.NewFromInt(10), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	reservation, err := store.CreateReservation(ctx, db, product.ID, 4, time.Hour)
+	if err != nil {
+		t.Fatalf("Create reservation: %v", err)
+	}
+	if reservation.ExpiresAt == nil || !reservation.ExpiresAt.After(reservation.CreatedAt) {
+		t.Errorf("Expected expiry after creation, got %v", reservation.ExpiresAt)
+	}
+
+	assertStock(t, db, product.ID, 10, 4)
+
+	if _, err := store.CreateReservation(ctx, db, product.ID, 7, time.Hour); err != database.ErrInsufficientStock {
+		t.Errorf("Expected insufficient stock beyond available units, got: %v", err)
+	}
+
+	consumed, err := store.ConsumeReservation(ctx, db, reservation.ID)
+	if err != nil {
+		t.Fatalf("Consume reservation: %v", err)
+	}
+	if consumed.ConsumedAt == nil || consumed.ReleasedAt == nil {
+		t.Errorf("Expected consumed reservation to be closed, got %+v", consumed)
+	}
+
+	assertStock(t, db, product.ID, 6, 0)
+
+	if _, err := store.ConsumeReservation(ctx, db, reservation.ID); err != database.ErrReservationExpired {
+		t.Errorf("Expected ErrReservationExpired consuming twice, got: %v", err)
+	}
+	if _, err := store.CancelReservation(ctx, db, reservation.ID); err != database.ErrReservationExpired {
+		t.Errorf("Expected ErrReservationExpired cancelling a consumed reservation, got: %v", err)
+	}
+	if _, err := store.ConsumeReservation(ctx, db, reservation.ID+1000); err != database.ErrReservationNotFound {
+		t.Errorf("Expected ErrReservationNotFound, got: %v", err)
+	}
+
+	report, err := store.ReconcileStock(ctx, db, false)
+	if err != nil {
+		t.Fatalf("Reconcile stock: %v", err)
+	}
+	if len(report) != 0 {
+		t.Errorf("Expected consumed reservation to reconcile, got %+v", report)
+	}
+
+	cancelled, err := store.CreateReservation(ctx, db, product.ID, 2, time.Hour)
+	if err != nil {
+		t.Fatalf("Create reservation: %v", err)
+	}
+	if _, err := store.CancelReservation(ctx, db, cancelled.ID); err != nil {
+		t.Fatalf("Cancel reservation: %v", err)
+	}
+
+	assertStock(t, db, product.ID, 6, 0)
+}
+
+func TestReservationExpiresAndIsReleased(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	product, err := store.CreateProduct(ctx, db, "TEST-RSV-002", "Expiring Product", "Test", decimal.NewFromInt(10), 10, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	reservation, err := store.CreateReservation(ctx, db, product.ID, 3, time.Minute)
+	if err != nil {
+		t.Fatalf("Create reservation: %v", err)
+	}
+	if _, err := store.CreateReservation(ctx, db, product.ID, 2, time.Hour); err != nil {
+		t.Fatalf("Create reservation: %v", err)
+	}
+
+	if _, err := db.ExecContext(ctx,
+		`UPDATE stock_reservations SET expires_at = NOW() - INTERVAL '1 second' WHERE id = $1`,
+		reservation.ID); err != nil {
+		t.Fatalf("Expire reservation: %v", err)
+	}
+
+	if _, err := store.ConsumeReservation(ctx, db, reservation.ID); err != database.ErrReservationExpired {
+		t.Errorf("Expected ErrReservationExpired consuming an expired reservation, got: %v", err)
+	}
+
+	// The cutoff is an hour ago, so only expires_at makes this one eligible.
+	released, err := store.ReleaseExpiredReservations(ctx, db, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("Release expired reservations: %v", err)
+	}
+	if released != 1 {
+		t.Errorf("Expected 1 released reservation, got %d", released)
+	}
+
+	assertStock(t, db, product.ID, 10, 2)
+}
@@ -0,0 +1,56 @@
+package integration
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/safar/go-sql-store/internal/models"
+)
+
+func TestScanColumnsMatchSchema(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	tables := map[string]string{
+		"users":                 models.UserColumns,
+		"products":              models.ProductColumns,
+		"orders":                models.OrderColumns,
+		"order_items":           models.OrderItemColumns,
+		"stock_reservations":    models.StockReservationColumns,
+		"audit_log":             models.AuditEntryColumns,
+		"product_price_history": models.PriceChangeColumns,
+	}
+
+	for table, columns := range tables {
+		rows, err := db.QueryContext(ctx,
+			`SELECT column_name
+			 FROM information_schema.columns
+			 WHERE table_schema = current_schema() AND table_name = $1
+			 ORDER BY ordinal_position`,
+			table)
+		if err != nil {
+			t.Fatalf("Query columns of %s: %v", table, err)
+		}
+
+		var schemaColumns []string
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				t.Fatalf("Scan column name: %v", err)
+			}
+			schemaColumns = append(schemaColumns, name)
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatalf("Rows error: %v", err)
+		}
+		_ = rows.Close()
+
+		helperColumns := strings.Split(columns, ", ")
+		if strings.Join(helperColumns, ",") != strings.Join(schemaColumns, ",") {
+			t.Errorf("%s: helper columns %v do not match schema order %v", table, helperColumns, schemaColumns)
+		}
+	}
+}
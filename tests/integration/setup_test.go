@@ -12,13 +12,55 @@ import (
 	"time"
 
 	_ "github.com/lib/pq"
+	"github.com/safar/go-sql-store/internal/database"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/wait"
 )
 
-func setupTestDB(t *testing.T) (*sql.DB, func()) {
+// testDSN points at the database shared by every test in the package. It is
+// set once by TestMain.
+var testDSN string
+
+// TestMain starts a single Postgres container and migrates it once. Setting
+// TEST_DATABASE_URL runs the suite against an existing, empty database instead.
+func TestMain(m *testing.M) {
+	os.Exit(runTests(m))
+}
+
+func runTests(m *testing.M) int {
 	ctx := context.Background()
 
+	testDSN = os.Getenv("TEST_DATABASE_URL")
+	if testDSN == "" {
+		dsn, terminate, err := startPostgres(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to start postgres container: %v\n", err)
+			return 1
+		}
+		defer terminate()
+		testDSN = dsn
+	}
+
+	db, err := sql.Open("postgres", testDSN)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to connect to database: %v\n", err)
+		return 1
+	}
+
+	if err := runMigrations(db); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to run migrations: %v\n", err)
+		return 1
+	}
+
+	if err := db.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to close database: %v\n", err)
+		return 1
+	}
+
+	return m.Run()
+}
+
+func startPostgres(ctx context.Context) (string, func(), error) {
 	req := testcontainers.ContainerRequest{
 		Image:        "postgres:14-alpine",
 		ExposedPorts: []string{"5432/tcp"},
@@ -37,22 +79,35 @@ func setupTestDB(t *testing.T) (*sql.DB, func()) {
 		Started:          true,
 	})
 	if err != nil {
-		t.Fatalf("Failed to start postgres container: %v", err)
+		return "", nil, err
+	}
+
+	terminate := func() {
+		if err := postgres.Terminate(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to terminate container: %v\n", err)
+		}
 	}
 
 	host, err := postgres.Host(ctx)
 	if err != nil {
-		t.Fatalf("Failed to get container host: %v", err)
+		terminate()
+		return "", nil, fmt.Errorf("get container host: %w", err)
 	}
 
 	port, err := postgres.MappedPort(ctx, "5432")
 	if err != nil {
-		t.Fatalf("Failed to get container port: %v", err)
+		terminate()
+		return "", nil, fmt.Errorf("get container port: %w", err)
 	}
 
 	dsn := fmt.Sprintf("postgres://testuser:testpass@%s:%s/testdb?sslmode=disable", host, port.Port())
+	return dsn, terminate, nil
+}
 
-	db, err := sql.Open("postgres", dsn)
+// setupTestDB returns a fresh connection pool on the shared database with all
+// tables emptied. Each test gets its own pool so pool settings don't leak.
+func setupTestDB(t *testing.T) (*sql.DB, func()) {
+	db, err := sql.Open("postgres", testDSN)
 	if err != nil {
 		t.Fatalf("Failed to connect to database: %v", err)
 	}
@@ -61,22 +116,75 @@ func setupTestDB(t *testing.T) (*sql.DB, func()) {
 		t.Fatalf("Failed to ping database: %v", err)
 	}
 
-	if err := runMigrations(db); err != nil {
-		t.Fatalf("Failed to run migrations: %v", err)
-	}
+	resetTables(t, db)
 
 	cleanup := func() {
 		if err := db.Close(); err != nil {
 			t.Logf("Failed to close database: %v", err)
 		}
-		if err := postgres.Terminate(ctx); err != nil {
-			t.Logf("Failed to terminate container: %v", err)
-		}
 	}
 
 	return db, cleanup
 }
 
+// resetTables truncates every table in the public schema but
+// schema_migrations and restarts all sequences, so ids and sequence-based
+// order numbers start from 1 again.
+func resetTables(t *testing.T, db *sql.DB) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	tables, err := queryNames(ctx, db,
+		`SELECT quote_ident(tablename) FROM pg_tables
+		 WHERE schemaname = 'public' AND tablename <> 'schema_migrations'
+		 ORDER BY tablename`)
+	if err != nil {
+		t.Fatalf("List tables: %v", err)
+	}
+
+	if len(tables) > 0 {
+		if _, err := db.ExecContext(ctx, `TRUNCATE `+strings.Join(tables, ", ")+` RESTART IDENTITY CASCADE`); err != nil {
+			t.Fatalf("Truncate tables: %v", err)
+		}
+	}
+
+	sequences, err := queryNames(ctx, db,
+		`SELECT quote_ident(sequence_name) FROM information_schema.sequences WHERE sequence_schema = 'public'`)
+	if err != nil {
+		t.Fatalf("List sequences: %v", err)
+	}
+
+	for _, sequence := range sequences {
+		if _, err := db.ExecContext(ctx, `ALTER SEQUENCE `+sequence+` RESTART`); err != nil {
+			t.Fatalf("Restart sequence %s: %v", sequence, err)
+		}
+	}
+}
+
+func queryNames(ctx context.Context, db *sql.DB, query string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			return
+		}
+	}()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
+}
+
 func runMigrations(db *sql.DB) error {
 	migrationDir := "../../migrations"
 	files, err := os.ReadDir(migrationDir)
@@ -103,6 +211,14 @@ func runMigrations(db *sql.DB) error {
 		if _, err := db.Exec(string(content)); err != nil {
 			return fmt.Errorf("execute migration %s: %w", filename, err)
 		}
+
+		version, err := database.MigrationVersion(filename)
+		if err != nil {
+			return err
+		}
+		if err := database.RecordMigration(context.Background(), db, version, true); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -0,0 +1,85 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/safar/go-sql-store/internal/database"
+)
+
+// syncBuffer guards a bytes.Buffer written from the querying goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.Split(strings.TrimSpace(b.buf.String()), "\n")
+}
+
+func TestSlowQueryLogger(t *testing.T) {
+	var out syncBuffer
+	logger := slog.New(slog.NewJSONHandler(&out, nil))
+
+	connector, err := database.NewConnector(testDSN, database.SlowQueryLogger(200*time.Millisecond, logger))
+	if err != nil {
+		t.Fatalf("New connector: %v", err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	ctx := context.Background()
+
+	if _, err := db.ExecContext(ctx, `SELECT 1`); err != nil {
+		t.Fatalf("Fast query: %v", err)
+	}
+
+	// Statements inside a transaction go through the same hook.
+	err = database.WithTransaction(ctx, db, database.DefaultTxOptions(), func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `SELECT pg_sleep(0.3)`)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Slow query: %v", err)
+	}
+
+	lines := out.Lines()
+	if len(lines) != 1 {
+		t.Fatalf("Expected exactly 1 slow query log line, got %d: %q", len(lines), lines)
+	}
+
+	var record struct {
+		Level      string  `json:"level"`
+		Msg        string  `json:"msg"`
+		DurationMS float64 `json:"duration_ms"`
+		Query      string  `json:"query"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("Unmarshal log line %q: %v", lines[0], err)
+	}
+
+	if record.Level != "WARN" || record.Msg != "slow query" {
+		t.Errorf("Expected WARN \"slow query\", got %s %q", record.Level, record.Msg)
+	}
+	if !strings.Contains(record.Query, "pg_sleep") {
+		t.Errorf("Expected the slow statement to be logged, got %q", record.Query)
+	}
+	if record.DurationMS < 300 {
+		t.Errorf("Expected duration of at least 300ms, got %.1fms", record.DurationMS)
+	}
+}
@@ -0,0 +1,463 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/safar/go-sql-store/internal/database"
+	"github.com/safar/go-sql-store/internal/models"
+	"github.com/safar/go-sql-store/internal/store"
+	"github.com/shopspring/decimal"
+)
+
+func TestListTopSpenders(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	product, err := store.CreateProduct(ctx, db, "TEST-SPEND-001", "Spend Product", "Test", decimal.NewFromInt(100), 100, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	placeOrder := func(userID int64, quantity int) *models.Order {
+		t.Helper()
+		order, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+			UserID: userID,
+			Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: quantity}},
+		})
+		if err != nil {
+			t.Fatalf("Create order: %v", err)
+		}
+		return order
+	}
+
+	steady, err := store.CreateUser(ctx, db, "steady@example.com", "Steady")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	big, err := store.CreateUser(ctx, db, "big@example.com", "Big")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	canceller, err := store.CreateUser(ctx, db, "canceller@example.com", "Canceller")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	if _, err := store.CreateUser(ctx, db, "browser@example.com", "Browser"); err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	placeOrder(steady.ID, 1)
+	placeOrder(steady.ID, 2)
+	placeOrder(big.ID, 5)
+	placeOrder(canceller.ID, 1)
+	cancelled := placeOrder(canceller.ID, 10)
+
+	if _, err := db.ExecContext(ctx, `UPDATE orders SET status = $1 WHERE id = $2`, models.OrderStatusCancelled, cancelled.ID); err != nil {
+		t.Fatalf("Cancel order: %v", err)
+	}
+
+	// A large order in another currency must not be added to USD totals.
+	euroProduct, err := store.CreateProduct(ctx, db, "TEST-SPEND-EUR", "Euro Product", "Test", decimal.NewFromInt(1000), 100, "EUR")
+	if err != nil {
+		t.Fatalf("Create EUR product: %v", err)
+	}
+	if _, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: canceller.ID,
+		Items:  []store.OrderItemRequest{{ProductID: euroProduct.ID, Quantity: 1}},
+	}); err != nil {
+		t.Fatalf("Create EUR order: %v", err)
+	}
+
+	spenders, err := store.ListTopSpenders(ctx, db, "", 10)
+	if err != nil {
+		t.Fatalf("List top spenders: %v", err)
+	}
+
+	expected := []struct {
+		userID     int64
+		orderCount int64
+		total      int64
+	}{
+		{big.ID, 1, 500},
+		{steady.ID, 2, 300},
+		{canceller.ID, 1, 100},
+	}
+
+	if len(spenders) != len(expected) {
+		t.Fatalf("Expected %d spenders, got %d: %+v", len(expected), len(spenders), spenders)
+	}
+
+	for i, want := range expected {
+		got := spenders[i]
+		if got.UserID != want.userID || got.OrderCount != want.orderCount || !got.TotalSpend.Equal(decimal.NewFromInt(want.total)) || got.Currency != models.DefaultCurrency {
+			t.Errorf("Rank %d: expected user %d with %d orders totalling %d, got %+v", i+1, want.userID, want.orderCount, want.total, got)
+		}
+	}
+
+	if spenders[0].Email != "big@example.com" || spenders[0].Name != "Big" {
+		t.Errorf("Expected user details for top spender, got %+v", spenders[0])
+	}
+
+	euroSpenders, err := store.ListTopSpenders(ctx, db, "EUR", 10)
+	if err != nil {
+		t.Fatalf("List EUR top spenders: %v", err)
+	}
+	if len(euroSpenders) != 1 || euroSpenders[0].UserID != canceller.ID || !euroSpenders[0].TotalSpend.Equal(decimal.NewFromInt(1000)) || euroSpenders[0].Currency != "EUR" {
+		t.Errorf("Expected only the EUR order in EUR totals, got %+v", euroSpenders)
+	}
+
+	if _, err := store.ListTopSpenders(ctx, db, "XXX", 10); err != database.ErrUnsupportedCurrency {
+		t.Errorf("Expected ErrUnsupportedCurrency, got: %v", err)
+	}
+
+	limited, err := store.ListTopSpenders(ctx, db, "", 1)
+	if err != nil {
+		t.Fatalf("List top spenders: %v", err)
+	}
+	if len(limited) != 1 || limited[0].UserID != big.ID {
+		t.Errorf("Expected only the top spender with limit 1, got %+v", limited)
+	}
+
+	server := newTestServer(t, db)
+
+	resp, body := doRequest(t, http.MethodGet, server.URL+"/users/top-spenders?limit=2", nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	var ranked []store.UserSpend
+	if err := json.Unmarshal(body, &ranked); err != nil {
+		t.Fatalf("Unmarshal spenders: %v", err)
+	}
+	if len(ranked) != 2 || ranked[0].UserID != big.ID || ranked[1].UserID != steady.ID {
+		t.Errorf("Unexpected ranking from endpoint: %+v", ranked)
+	}
+}
+
+func TestGetUsersByIDs(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	alice, err := store.CreateUser(ctx, db, "alice@example.com", "Alice")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	bob, err := store.CreateUser(ctx, db, "bob@example.com", "Bob")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	if _, err := store.CreateUser(ctx, db, "carol@example.com", "Carol"); err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	missingID := bob.ID + 1000
+
+	users, err := store.GetUsersByIDs(ctx, db, []int64{alice.ID, bob.ID, missingID, alice.ID})
+	if err != nil {
+		t.Fatalf("Get users by IDs: %v", err)
+	}
+
+	if len(users) != 2 {
+		t.Fatalf("Expected 2 users, got %d: %+v", len(users), users)
+	}
+	if users[alice.ID].Email != "alice@example.com" || users[bob.ID].Name != "Bob" {
+		t.Errorf("Unexpected users: %+v", users)
+	}
+	if _, ok := users[missingID]; ok {
+		t.Errorf("Nonexistent ID %d should be absent", missingID)
+	}
+
+	empty, err := store.GetUsersByIDs(ctx, db, nil)
+	if err != nil {
+		t.Fatalf("Get users by IDs: %v", err)
+	}
+	if len(empty) != 0 {
+		t.Errorf("Expected no users for empty ID list, got %+v", empty)
+	}
+}
+
+func TestGetUserWithRecentOrders(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	product, err := store.CreateProduct(ctx, db, "TEST-RECENT-001", "Recent Product", "Test", decimal.NewFromInt(10), 100, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+
+	user, err := store.CreateUser(ctx, db, "recent@example.com", "Recent")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	other, err := store.CreateUser(ctx, db, "other@example.com", "Other")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	var orderIDs []int64
+	for i := 0; i < 5; i++ {
+		order, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+			UserID: user.ID,
+			Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 1}},
+		})
+		if err != nil {
+			t.Fatalf("Create order: %v", err)
+		}
+		orderIDs = append(orderIDs, order.ID)
+
+		if _, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+			UserID: other.ID,
+			Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 1}},
+		}); err != nil {
+			t.Fatalf("Create order: %v", err)
+		}
+	}
+
+	result, err := store.GetUserWithRecentOrders(ctx, db, user.ID, 3)
+	if err != nil {
+		t.Fatalf("Get user with recent orders: %v", err)
+	}
+
+	if result.ID != user.ID || result.Email != user.Email {
+		t.Errorf("Expected user %d, got %+v", user.ID, result.User)
+	}
+	if len(result.Orders) != 3 {
+		t.Fatalf("Expected 3 orders, got %d", len(result.Orders))
+	}
+	for i, order := range result.Orders {
+		want := orderIDs[len(orderIDs)-1-i]
+		if order.ID != want || order.UserID != user.ID {
+			t.Errorf("Position %d: expected order %d, got %+v", i, want, order)
+		}
+	}
+
+	loner, err := store.CreateUser(ctx, db, "loner@example.com", "Loner")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	empty, err := store.GetUserWithRecentOrders(ctx, db, loner.ID, 3)
+	if err != nil {
+		t.Fatalf("Get user with recent orders: %v", err)
+	}
+	if empty.ID != loner.ID || len(empty.Orders) != 0 {
+		t.Errorf("Expected user with no orders, got %+v", empty)
+	}
+
+	if _, err := store.GetUserWithRecentOrders(ctx, db, loner.ID+1000, 3); err != database.ErrUserNotFound {
+		t.Errorf("Expected ErrUserNotFound, got: %v", err)
+	}
+
+	server := newTestServer(t, db)
+
+	resp, body := doRequest(t, http.MethodGet, fmt.Sprintf("%s/users/%d?include=orders&limit=2", server.URL, user.ID), nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	var fetched store.UserWithOrders
+	if err := json.Unmarshal(body, &fetched); err != nil {
+		t.Fatalf("Unmarshal user: %v", err)
+	}
+	if fetched.ID != user.ID || len(fetched.Orders) != 2 || fetched.Orders[0].ID != orderIDs[4] {
+		t.Errorf("Unexpected user from endpoint: %+v", fetched)
+	}
+
+	resp, body = doRequest(t, http.MethodGet, fmt.Sprintf("%s/users/%d?include=orders", server.URL, loner.ID+1000), nil, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for missing user, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestCountUserOrders(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	product, err := store.CreateProduct(ctx, db, "TEST-COUNT-001", "Count Product", "Test", decimal.NewFromInt(10), 100, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	user, err := store.CreateUser(ctx, db, "count@example.com", "Count")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	other, err := store.CreateUser(ctx, db, "count-other@example.com", "Other")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+
+	count, err := store.CountUserOrders(ctx, db, user.ID)
+	if err != nil {
+		t.Fatalf("Count user orders: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("Expected 0 orders before any were placed, got %d", count)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+			UserID: user.ID,
+			Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 1}},
+		}); err != nil {
+			t.Fatalf("Create order: %v", err)
+		}
+	}
+	if _, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: other.ID,
+		Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 1}},
+	}); err != nil {
+		t.Fatalf("Create order: %v", err)
+	}
+
+	count, err = store.CountUserOrders(ctx, db, user.ID)
+	if err != nil {
+		t.Fatalf("Count user orders: %v", err)
+	}
+	if count != 3 {
+		t.Errorf("Expected 3 orders, got %d", count)
+	}
+
+	server := newTestServer(t, db)
+
+	resp, body := doRequest(t, http.MethodGet, fmt.Sprintf("%s/users/%d/order-count", server.URL, user.ID), nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	var got struct {
+		UserID     int64 `json:"user_id"`
+		OrderCount int64 `json:"order_count"`
+	}
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("Decode response: %v", err)
+	}
+	if got.UserID != user.ID || got.OrderCount != 3 {
+		t.Errorf("Expected user %d with 3 orders, got %+v", user.ID, got)
+	}
+
+	resp, body = doRequest(t, http.MethodGet, server.URL+"/users/abc/order-count", nil, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad ID, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestAnonymizeUser(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	product, err := store.CreateProduct(ctx, db, "TEST-ANON-001", "Anon Product", "Test", decimal.NewFromInt(10), 100, "")
+	if err != nil {
+		t.Fatalf("Create product: %v", err)
+	}
+	user, err := store.CreateUser(ctx, db, "private@example.com", "Private Person")
+	if err != nil {
+		t.Fatalf("Create user: %v", err)
+	}
+	order, err := store.CreateOrder(ctx, db, store.CreateOrderRequest{
+		UserID: user.ID,
+		Items:  []store.OrderItemRequest{{ProductID: product.ID, Quantity: 1}},
+	})
+	if err != nil {
+		t.Fatalf("Create order: %v", err)
+	}
+
+	if err := store.AnonymizeUser(ctx, db, user.ID); err != nil {
+		t.Fatalf("Anonymize user: %v", err)
+	}
+
+	anonymized, err := store.GetUser(ctx, db, user.ID)
+	if err != nil {
+		t.Fatalf("Get user: %v", err)
+	}
+	wantEmail := fmt.Sprintf("deleted-%d@example.invalid", user.ID)
+	if anonymized.Email != wantEmail || anonymized.Name != "" {
+		t.Errorf("Expected scrubbed user, got email %q name %q", anonymized.Email, anonymized.Name)
+	}
+	if anonymized.DeletedAt == nil {
+		t.Error("Expected deleted_at to be set")
+	}
+	if anonymized.Version != user.Version+1 {
+		t.Errorf("Expected version %d, got %d", user.Version+1, anonymized.Version)
+	}
+
+	stillLinked, err := store.GetOrder(ctx, db, order.ID)
+	if err != nil {
+		t.Fatalf("Get order: %v", err)
+	}
+	if stillLinked.UserID != user.ID {
+		t.Errorf("Expected order to stay linked to user %d, got %d", user.ID, stillLinked.UserID)
+	}
+
+	var leaked int
+	if err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM audit_log
+		WHERE entity_type = 'user' AND entity_id = $1
+		  AND (old_data::text LIKE '%private@example.com%' OR new_data::text LIKE '%private@example.com%'
+		       OR old_data::text LIKE '%Private Person%' OR new_data::text LIKE '%Private Person%')`,
+		user.ID).Scan(&leaked); err != nil {
+		t.Fatalf("Query audit log: %v", err)
+	}
+	if leaked != 0 {
+		t.Errorf("Expected no audit rows with the old email or name, got %d", leaked)
+	}
+
+	if _, err := db.ExecContext(ctx, `UPDATE audit_log SET old_data = NULL WHERE entity_id = $1`, user.ID); err == nil {
+		t.Error("Expected audit_log to stay append-only outside AnonymizeUser")
+	}
+
+	if err := store.AnonymizeUser(ctx, db, user.ID); err != nil {
+		t.Errorf("Expected anonymizing twice to succeed, got: %v", err)
+	}
+	again, err := store.GetUser(ctx, db, user.ID)
+	if err != nil {
+		t.Fatalf("Get user: %v", err)
+	}
+	if again.Version != anonymized.Version {
+		t.Errorf("Expected second anonymize to be a no-op, version went %d -> %d", anonymized.Version, again.Version)
+	}
+
+	if err := store.AnonymizeUser(ctx, db, user.ID+1000); err != database.ErrUserNotFound {
+		t.Errorf("Expected ErrUserNotFound, got: %v", err)
+	}
+}
+
+func TestFindDuplicateEmails(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	var ids []int64
+	for _, email := range []string{"dup@example.com", "Dup@Example.com", "other@example.com", "DUP@EXAMPLE.COM", "Other@example.com", "unique@example.com"} {
+		user, err := store.CreateUser(ctx, db, email, "Legacy User")
+		if err != nil {
+			t.Fatalf("Create user %s: %v", email, err)
+		}
+		ids = append(ids, user.ID)
+	}
+
+	groups, err := store.FindDuplicateEmails(ctx, db)
+	if err != nil {
+		t.Fatalf("Find duplicate emails: %v", err)
+	}
+
+	want := []store.DuplicateGroup{
+		{Email: "dup@example.com", UserIDs: []int64{ids[0], ids[1], ids[3]}},
+		{Email: "other@example.com", UserIDs: []int64{ids[2], ids[4]}},
+	}
+	if fmt.Sprint(groups) != fmt.Sprint(want) {
+		t.Errorf("Expected %v, got %v", want, groups)
+	}
+}